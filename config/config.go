@@ -9,6 +9,22 @@ import (
 	"github.com/spf13/viper"
 )
 
+var loaded bool
+
+// Why the config file couldn't be read, if there is one
+var readErr error
+
+// Loaded returns true once SetupConfig has finished
+func Loaded() bool {
+	return loaded
+}
+
+// ReadError returns why the config file couldn't be read, nil if it was or
+// there isn't one and the defaults are used
+func ReadError() error {
+	return readErr
+}
+
 func SetupConfig(configFilePath string) {
 	viper.SetConfigName("gladius-guardian")
 	viper.AddConfigPath(configFilePath)
@@ -22,6 +38,9 @@ func SetupConfig(configFilePath string) {
 	err := viper.ReadInConfig()
 	if err != nil {
 		log.Warn(fmt.Errorf("error reading config file: %s, using defaults", err))
+		if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound {
+			readErr = err
+		}
 	}
 
 	ConfigOption("NetworkdExecutable", "gladius-networkd")
@@ -37,10 +56,226 @@ func SetupConfig(configFilePath string) {
 	// Add a default environment so that we can set the gladius base of our sub
 	// processes
 	ConfigOption("DefaultEnvironment", []string{"GLADIUSBASE=" + base})
+	ConfigOption("Phases", []string{})
+
+	// Bytes of log lines kept in ram for all services together and for each
+	// one, the oldest lines are deleted first
+	ConfigOption("LogBufferBytes", 32<<20)
+	ConfigOption("MaxServiceLogBytes", 1<<20)
+
+	// How long starts wait for services to come up until a timeout is set
+	// through the API
+	ConfigOption("DefaultSpawnTimeout", "5s")
+
+	// Range ports are allocated to services from, 0 lets the OS pick
+	ConfigOption("PortRangeStart", 0)
+	ConfigOption("PortRangeEnd", 0)
+
+	// Named groups of environment variables, like ones for mainnet and
+	// testnet, and the one services that use them get
+	ConfigOption("EnvSets", map[string][]string{})
+	ConfigOption("ActiveEnvSet", "")
+
+	// Templates services can be instantiated from through the API
+	ConfigOption("Templates", map[string]interface{}{})
+
+	// Docker daemon used for services that run from an image
+	ConfigOption("DockerHost", "unix:///var/run/docker.sock")
+
+	// How services with the ssh backend are reached: the key to log in with
+	// (as well as the SSH agent's), known hosts to check host keys against
+	// (both default to the ones in ~/.ssh) and how many keepalives in a row
+	// can go unanswered before the service is treated as exited
+	ConfigOption("SSHKeyFile", "")
+	ConfigOption("SSHKnownHostsFile", "")
+	ConfigOption("SSHConnectTimeout", "10s")
+	ConfigOption("SSHKeepAliveInterval", "15s")
+	ConfigOption("SSHKeepAliveMax", 3)
+
+	// How often to look for orphaned and zombie service processes, 0 disables
+	// it. Orphans are only killed if KillOrphans is set, zombies that were
+	// adopted and nothing waits on only reaped if ReapZombies is.
+	ConfigOption("StrayScanInterval", "30s")
+	ConfigOption("ReapZombies", false)
+	ConfigOption("KillOrphans", false)
+
+	// How often to measure the data directories of services, 0 disables it
+	ConfigOption("DiskUsageInterval", "5m")
+	ConfigOption("LogHeartbeatInterval", "15s")
+
+	// How many lifecycle events are kept for GET /events
+	ConfigOption("EventLogSize", 1000)
+
+	// How often to prune old files matching PruneRules and exits in the
+	// history older than PruneRunHistoryAge, 0 disables them
+	ConfigOption("HousekeepingInterval", "1h")
+	ConfigOption("PruneRules", []map[string]interface{}{})
+	ConfigOption("PruneRunHistoryAge", "0s")
+
+	// Executables run on lifecycle events and before starts and automatic
+	// restarts, to extend what the guardian does
+	ConfigOption("Plugins", []map[string]interface{}{})
+
+	// Rules that start, stop or restart services or post to a webhook when
+	// events happen to services, more can be added through the API
+	ConfigOption("AutomationRules", []map[string]interface{}{})
+
+	// Adopt the orphaned descendants of services so ones that daemonize are
+	// still supervised, Linux only
+	ConfigOption("Subreaper", false)
+
+	// Directory to keep PID files of the guardian and its services in, empty
+	// disables them
+	ConfigOption("PIDFileDir", "")
+
+	// How long a watched file has to be left alone before services using it
+	// are restarted
+	ConfigOption("FileChangeDebounce", "2s")
+
+	// Free space the diagnostics want left in the Gladius base, in megabytes
+	ConfigOption("DiagnosticsMinFreeMB", 512)
+
+	// Start with the whole guardian in maintenance mode
+	ConfigOption("Maintenance", false)
+
+	// CORS settings for browser based clients served from another origin, no
+	// origins means CORS is disabled
+	ConfigOption("CORSAllowedOrigins", []string{})
+	ConfigOption("CORSAllowedMethods", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
+	ConfigOption("CORSAllowedHeaders", []string{"Content-Type", "Authorization"})
+
+	// Rate limit for the endpoints that start and stop services, per client per
+	// minute. 0 disables the limit.
+	ConfigOption("ControlRateLimit", 30)
+	ConfigOption("ControlRateBurst", 10)
+
+	// How many services can be starting at once and how many can be spawned
+	// per minute, 0 disables either limit
+	ConfigOption("MaxConcurrentStarts", 4)
+	ConfigOption("SpawnRateLimit", 60)
+	ConfigOption("SpawnRateBurst", 20)
+
+	// Secret used to verify HS256 JWT bearer tokens, empty disables auth
+	ConfigOption("JWTSecret", "")
+
+	// Serve the API over TLS when a certificate is set, and only accept clients
+	// with a certificate signed by the client CA when that's set too
+	ConfigOption("TLSCertFile", "")
+	ConfigOption("TLSKeyFile", "")
+	ConfigOption("TLSClientCAFile", "")
+
+	// In read-only mode status and logs can be viewed but nothing can be changed
+	ConfigOption("ReadOnly", false)
+
+	// Default for whether starting a running service or stopping a stopped one
+	// is a successful no-op, can be overridden per request
+	ConfigOption("IdempotentStateChanges", false)
 
-	ConfigOption("MaxLogLines", 1000) // Max number of log lines to keep in ram for each service
+	// Serve pprof and expvar under /debug, needs an admin token if auth is on
+	ConfigOption("EnableDebugEndpoints", false)
 
-	// Setup logging level
+	// OTLP/HTTP collector to export traces to, like http://localhost:4318.
+	// Tracing is off when it's empty.
+	ConfigOption("TracingEndpoint", "")
+	ConfigOption("TracingServiceName", "gladius-guardian")
+
+	// StatsD server to push per-service metrics to, empty disables it
+	ConfigOption("StatsDAddress", "")
+	ConfigOption("StatsDPrefix", "gladius.guardian")
+	ConfigOption("StatsDInterval", "10s")
+	// Add the labels of each service to its metrics as DogStatsD tags
+	ConfigOption("StatsDLabelTags", false)
+
+	// Graylog server to ship service log lines to as GELF over "udp" or "tcp",
+	// empty disables it. GELFFields are sent with every message.
+	ConfigOption("GELFAddress", "")
+	ConfigOption("GELFProtocol", "udp")
+	ConfigOption("GELFFields", map[string]string{})
+
+	// Publish service lifecycle events to "nats" or "mqtt", empty disables it
+	ConfigOption("EventPublisher", "")
+	ConfigOption("EventPublisherAddress", "")
+	ConfigOption("EventPublisherPrefix", "gladius.guardian")
+	ConfigOption("EventPublisherClientID", "gladius-guardian")
+	ConfigOption("EventPublisherUsername", "")
+	ConfigOption("EventPublisherPassword", "")
+
+	// Announce the API on the LAN over mDNS, the instance name defaults to the
+	// hostname
+	ConfigOption("MDNSEnabled", false)
+	ConfigOption("MDNSInstanceName", "")
+	ConfigOption("MDNSAnnounceServices", false)
+
+	// Where to get guardian releases and the base64 ed25519 key they must be
+	// signed with, updates are refused without a key
+	ConfigOption("UpdateURL", "")
+	ConfigOption("UpdatePublicKey", "")
+
+	// Register running services with "consul" or "etcd", empty disables it
+	ConfigOption("Discovery", "")
+	ConfigOption("DiscoveryAddress", "")
+	ConfigOption("DiscoveryToken", "")
+	ConfigOption("DiscoveryPrefix", "/gladius/services")
+	ConfigOption("DiscoveryAdvertiseAddress", "")
+	ConfigOption("DiscoveryTags", []string{})
+	ConfigOption("DiscoveryTTL", "30s")
+
+	// Other guardians to aggregate under /fleet by name, the token they're
+	// sent and the name this one is listed as, the hostname by default
+	ConfigOption("FleetPeers", map[string]string{})
+	ConfigOption("FleetToken", "")
+	ConfigOption("FleetNodeName", "")
+	ConfigOption("FleetTimeout", "10s")
+
+	// Where service data directories are backed up, <base>/backups by
+	// default, and how many backups of each service are kept
+	ConfigOption("BackupDir", "")
+	ConfigOption("BackupKeep", 5)
+
+	// Redundant guardians elect a leader with a "file" or "consul" lock, only
+	// the leader runs services
+	ConfigOption("LeaderLock", "")
+	ConfigOption("LeaderLockPath", "")
+	ConfigOption("LeaderLockAddress", "http://localhost:8500")
+	ConfigOption("LeaderLockToken", "")
+	ConfigOption("LeaderLockKey", "gladius/guardian/leader")
+	ConfigOption("LeaderLockTTL", "15s")
+
+	// Alert rules and where to send alerts when they fire and resolve
+	ConfigOption("AlertRules", []map[string]interface{}{})
+	ConfigOption("AlertWebhooks", []string{})
+	ConfigOption("AlertSMTPServer", "")
+	ConfigOption("AlertEmailFrom", "")
+	ConfigOption("AlertEmailTo", []string{})
+	ConfigOption("AlertSMTPUsername", "")
+	ConfigOption("AlertSMTPPassword", "")
+
+	// Settings and services can also come from a key in Consul or etcd,
+	// merged over the config file
+	ConfigOption("RemoteConfigProvider", "")
+	ConfigOption("RemoteConfigAddress", "")
+	ConfigOption("RemoteConfigKey", "gladius/guardian/config")
+	ConfigOption("RemoteConfigType", "toml")
+	ConfigOption("RemoteConfigToken", "")
+	if err := loadRemoteConfig(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't load remote config")
+	}
+
+	setLogLevel()
+
+	loaded = true
+}
+
+func ConfigOption(key string, defaultValue interface{}) string {
+	viper.SetDefault(key, defaultValue)
+
+	return key
+}
+
+// setLogLevel sets up the logging level
+func setLogLevel() {
 	switch loglevel := viper.GetString("LogLevel"); loglevel {
 	case "debug":
 		log.SetLevel(log.DebugLevel)
@@ -54,9 +289,3 @@ func SetupConfig(configFilePath string) {
 		log.SetLevel(log.InfoLevel)
 	}
 }
-
-func ConfigOption(key string, defaultValue interface{}) string {
-	viper.SetDefault(key, defaultValue)
-
-	return key
-}
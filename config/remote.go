@@ -0,0 +1,272 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// How long to wait before trying again after the remote config couldn't be
+// read or watched
+const remoteRetryInterval = 10 * time.Second
+
+// remoteSource is a key in Consul or etcd that holds config
+type remoteSource interface {
+	// get returns the config and a revision that changes whenever it does
+	get(ctx context.Context) ([]byte, uint64, error)
+	// wait blocks until the config changed since the revision, or for a
+	// while if it doesn't
+	wait(ctx context.Context, revision uint64) error
+}
+
+func newRemoteSource() (remoteSource, error) {
+	address := strings.TrimSuffix(viper.GetString("RemoteConfigAddress"), "/")
+	key := strings.TrimPrefix(viper.GetString("RemoteConfigKey"), "/")
+	switch provider := viper.GetString("RemoteConfigProvider"); provider {
+	case "":
+		return nil, nil
+	case "consul":
+		return &consulSource{url: address, key: key, token: viper.GetString("RemoteConfigToken")}, nil
+	case "etcd":
+		return &etcdSource{url: address, key: "/" + key}, nil
+	default:
+		return nil, fmt.Errorf("unknown remote config provider %q, must be consul or etcd", provider)
+	}
+}
+
+// loadRemoteConfig merges the remote config over the config file, if there's
+// a remote provider
+func loadRemoteConfig() error {
+	source, err := newRemoteSource()
+	if source == nil || err != nil {
+		return err
+	}
+	_, err = mergeRemote(context.Background(), source)
+	return err
+}
+
+func mergeRemote(ctx context.Context, source remoteSource) (uint64, error) {
+	b, revision, err := source.get(ctx)
+	if err != nil {
+		return 0, err
+	}
+	viper.SetConfigType(viper.GetString("RemoteConfigType"))
+	err = viper.MergeConfig(bytes.NewReader(b))
+
+	// The type is used for the config file too, put back the one it has
+	if ext := filepath.Ext(viper.ConfigFileUsed()); ext != "" {
+		viper.SetConfigType(ext[1:])
+	}
+	return revision, err
+}
+
+// WatchRemoteConfig reloads the config whenever the remote config changes and
+// calls onChange after, the config file is read again first so settings
+// removed from the remote config go back to what they were. It does nothing
+// without a remote provider.
+func WatchRemoteConfig(ctx context.Context, onChange func()) error {
+	source, err := newRemoteSource()
+	if source == nil || err != nil {
+		return err
+	}
+
+	go func() {
+		var revision uint64
+		if _, rev, err := source.get(ctx); err == nil {
+			revision = rev
+		}
+		for ctx.Err() == nil {
+			if err := source.wait(ctx, revision); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Warn("Couldn't watch remote config")
+				sleep(ctx, remoteRetryInterval)
+				continue
+			}
+
+			_, rev, err := source.get(ctx)
+			if err != nil || rev == revision {
+				continue
+			}
+			if err := viper.ReadInConfig(); err != nil {
+				log.Warn(fmt.Errorf("error reading config file: %s", err))
+			}
+			if revision, err = mergeRemote(ctx, source); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Warn("Couldn't load remote config")
+				continue
+			}
+			setLogLevel()
+			log.WithFields(log.Fields{
+				"revision": revision,
+			}).Info("Remote config changed, reloaded it")
+			onChange()
+		}
+	}()
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
+
+// consulSource is a key in Consul's KV store, watched with blocking queries
+type consulSource struct {
+	url   string
+	key   string
+	token string
+}
+
+func (cs *consulSource) request(ctx context.Context, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", cs.url+"/v1/kv/"+cs.key+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if cs.token != "" {
+		req.Header.Set("X-Consul-Token", cs.token)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error talking to consul: %s", err)
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("consul returned %s for key %s", resp.Status, cs.key)
+	}
+	return resp, nil
+}
+
+func (cs *consulSource) get(ctx context.Context) ([]byte, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := cs.request(ctx, url.Values{"raw": {"true"}})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return b, index, nil
+}
+
+func (cs *consulSource) wait(ctx context.Context, revision uint64) error {
+	resp, err := cs.request(ctx, url.Values{"index": {strconv.FormatUint(revision, 10)}, "wait": {"5m"}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// etcdSource is a key in etcd, read and watched through its v3 JSON gateway
+type etcdSource struct {
+	url string
+	key string
+}
+
+func (es *etcdSource) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", es.url+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error talking to etcd: %s", err)
+	}
+	if resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd returned %s for %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+func (es *etcdSource) get(ctx context.Context) ([]byte, uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	resp, err := es.post(ctx, "/v3/kv/range", map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(es.key)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Kvs []struct {
+			Value       string `json:"value"`
+			ModRevision string `json:"mod_revision"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, 0, err
+	}
+	if len(out.Kvs) == 0 {
+		return nil, 0, fmt.Errorf("key %s isn't in etcd", es.key)
+	}
+	value, err := base64.StdEncoding.DecodeString(out.Kvs[0].Value)
+	if err != nil {
+		return nil, 0, err
+	}
+	revision, _ := strconv.ParseUint(out.Kvs[0].ModRevision, 10, 64)
+	return value, revision, nil
+}
+
+// wait opens a watch starting after the revision and returns once it has an
+// event. The gateway streams one JSON object per message.
+func (es *etcdSource) wait(ctx context.Context, revision uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+	resp, err := es.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(es.key)),
+			"start_revision": strconv.FormatUint(revision+1, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+		if len(msg.Result.Events) > 0 {
+			return nil
+		}
+	}
+}
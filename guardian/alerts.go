@@ -0,0 +1,335 @@
+package guardian
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of alert rules
+const (
+	AlertServiceDown = "service_down"  // Service hasn't been running for For
+	AlertRestarts    = "restarts"      // Service started Count times within Window
+	AlertLogMatch    = "log_match"     // A log line matched Pattern within Window
+	AlertDataDirSize = "data_dir_size" // Service's data directory is over MaxMB
+	AlertDiskFree    = "disk_free"     // Under MinFreeMB left where the service's data directory is
+)
+
+// How often alert rules are evaluated
+const alertInterval = 5 * time.Second
+
+// AlertRule is a condition that fires an alert while it holds
+type AlertRule struct {
+	Name    string
+	Type    string
+	Service string // Empty or "all" applies the rule to every service
+	For     time.Duration
+	Count   int
+	Window  time.Duration
+	Pattern string
+
+	// Thresholds of the data_dir_size and disk_free rules
+	MaxMB     int64
+	MinFreeMB int64
+
+	re *regexp.Regexp
+}
+
+// Alert states
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// Alert is a rule firing (or resolving) for a service
+type Alert struct {
+	Rule    string     `json:"rule"`
+	Service string     `json:"service"`
+	State   string     `json:"state"`
+	Message string     `json:"message"`
+	Since   time.Time  `json:"since"`
+	Ended   *time.Time `json:"ended,omitempty"`
+}
+
+// AlertNotifier is told whenever an alert fires or resolves
+type AlertNotifier interface {
+	Notify(a Alert) error
+}
+
+type alertEngine struct {
+	mux       sync.Mutex
+	rules     []*AlertRule
+	notifiers []AlertNotifier
+	active    map[string]*Alert
+	downSince map[string]time.Time   // When each stopped service went down
+	starts    map[string][]time.Time // Recent starts of each service
+	matches   map[string][]time.Time // Recent log matches by rule and service
+	now       func() time.Time
+
+	// Services that shouldn't fire new alerts, like ones in maintenance
+	suppressed func(service string) bool
+
+	// Size of each service's data directory as of the last scan
+	diskUsage func() map[string]DiskUsage
+	usage     map[string]DiskUsage
+}
+
+// SetupAlerts validates the rules and starts evaluating them, notifying each
+// notifier when an alert fires or resolves
+func (gg *GladiusGuardian) SetupAlerts(rules []*AlertRule, notifiers []AlertNotifier) error {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("invalid alert rule %q: %s", rule.Name, err)
+		}
+	}
+
+	ae := &alertEngine{
+		rules:     rules,
+		notifiers: notifiers,
+		active:    make(map[string]*Alert),
+		downSince: make(map[string]time.Time),
+		starts:    make(map[string][]time.Time),
+		matches:   make(map[string][]time.Time),
+		now:       time.Now,
+
+		suppressed: gg.InMaintenance,
+		diskUsage:  gg.diskUsage.snapshot,
+	}
+
+	gg.mux.Lock()
+	gg.alerts = ae
+	gg.mux.Unlock()
+
+	gg.AddEventPublisher(ae)
+	go func() {
+		for range time.Tick(alertInterval) {
+			ae.evaluate()
+		}
+	}()
+	return nil
+}
+
+// ActiveAlerts returns the alerts that are currently firing
+func (gg *GladiusGuardian) ActiveAlerts() []Alert {
+	gg.mux.Lock()
+	ae := gg.alerts
+	gg.mux.Unlock()
+
+	alerts := make([]Alert, 0)
+	if ae == nil {
+		return alerts
+	}
+
+	ae.mux.Lock()
+	defer ae.mux.Unlock()
+	for _, a := range ae.active {
+		alerts = append(alerts, *a)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Since.Before(alerts[j].Since) })
+	return alerts
+}
+
+func (rule *AlertRule) validate() error {
+	switch rule.Type {
+	case AlertServiceDown:
+		if rule.For <= 0 {
+			return errors.New("service_down rules need For")
+		}
+	case AlertRestarts:
+		if rule.Count <= 0 || rule.Window <= 0 {
+			return errors.New("restarts rules need Count and Window")
+		}
+	case AlertDataDirSize:
+		if rule.MaxMB <= 0 {
+			return errors.New("data_dir_size rules need MaxMB")
+		}
+	case AlertDiskFree:
+		if rule.MinFreeMB <= 0 {
+			return errors.New("disk_free rules need MinFreeMB")
+		}
+	case AlertLogMatch:
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("bad pattern: %s", err)
+		}
+		rule.re = re
+		if rule.Window <= 0 {
+			rule.Window = 5 * time.Minute // How long after the last match it resolves
+		}
+	default:
+		return fmt.Errorf("unknown type %q", rule.Type)
+	}
+	return nil
+}
+
+func (rule *AlertRule) appliesTo(service string) bool {
+	return rule.Service == "" || rule.Service == "all" || rule.Service == service
+}
+
+// Publish receives service lifecycle events
+func (ae *alertEngine) Publish(ev Event) error {
+	ae.mux.Lock()
+	defer ae.mux.Unlock()
+
+	switch ev.Type {
+	case EventStarted:
+		delete(ae.downSince, ev.Service)
+		ae.starts[ev.Service] = append(ae.starts[ev.Service], ev.Time)
+	case EventStopped, EventExited, EventCrashed:
+		ae.downSince[ev.Service] = ev.Time
+	}
+	return nil
+}
+
+// logLine checks a service's log line against the log_match rules
+func (ae *alertEngine) logLine(service, line string) {
+	ae.mux.Lock()
+	defer ae.mux.Unlock()
+
+	for _, rule := range ae.rules {
+		if rule.Type == AlertLogMatch && rule.appliesTo(service) && rule.re.MatchString(line) {
+			key := alertKey(rule, service)
+			ae.matches[key] = append(ae.matches[key], ae.now())
+		}
+	}
+}
+
+// evaluate fires alerts for rules that now hold and resolves those that don't
+func (ae *alertEngine) evaluate() {
+	usage := ae.diskUsage()
+	ae.mux.Lock()
+	now := ae.now()
+	changed := make([]Alert, 0)
+	ae.usage = usage
+
+	services := make(map[string]bool)
+	for s := range ae.downSince {
+		services[s] = true
+	}
+	for s := range ae.starts {
+		services[s] = true
+	}
+	for s := range ae.usage {
+		services[s] = true
+	}
+
+	for _, rule := range ae.rules {
+		for service := range services {
+			if !rule.appliesTo(service) {
+				continue
+			}
+			if a, ok := ae.check(rule, service, now); ok {
+				changed = append(changed, a)
+			}
+		}
+		if rule.Type == AlertLogMatch {
+			for key, times := range ae.matches {
+				if a, ok := ae.checkLogMatch(rule, key, times, now); ok {
+					changed = append(changed, a)
+				}
+			}
+		}
+	}
+	ae.mux.Unlock()
+
+	for _, a := range changed {
+		ae.notify(a)
+	}
+}
+
+// check evaluates a service_down, restarts or disk rule, returning the alert
+// if its state changed
+func (ae *alertEngine) check(rule *AlertRule, service string, now time.Time) (Alert, bool) {
+	var holds bool
+	var message string
+
+	switch rule.Type {
+	case AlertServiceDown:
+		since, down := ae.downSince[service]
+		holds = down && now.Sub(since) >= rule.For
+		message = fmt.Sprintf("%s has been down for over %s", service, rule.For)
+	case AlertRestarts:
+		recent := pruneTimes(ae.starts[service], now.Add(-rule.Window))
+		ae.starts[service] = recent
+		holds = len(recent) >= rule.Count
+		message = fmt.Sprintf("%s started %d times in the last %s", service, len(recent), rule.Window)
+	case AlertDataDirSize:
+		u, ok := ae.usage[service]
+		holds = ok && u.Bytes > rule.MaxMB<<20
+		message = fmt.Sprintf("%s's data directory is over %dMB (%dMB)", service, rule.MaxMB, u.Bytes>>20)
+	case AlertDiskFree:
+		u, ok := ae.usage[service]
+		holds = ok && u.TotalBytes > 0 && u.FreeBytes < uint64(rule.MinFreeMB)<<20
+		message = fmt.Sprintf("Under %dMB left on the disk with %s's data directory (%dMB)", rule.MinFreeMB, service, u.FreeBytes>>20)
+	default:
+		return Alert{}, false
+	}
+
+	return ae.transition(alertKey(rule, service), rule, service, holds, message, now)
+}
+
+func (ae *alertEngine) checkLogMatch(rule *AlertRule, key string, times []time.Time, now time.Time) (Alert, bool) {
+	prefix := rule.Name + "/"
+	if len(key) <= len(prefix) || key[:len(prefix)] != prefix {
+		return Alert{}, false
+	}
+	service := key[len(prefix):]
+
+	recent := pruneTimes(times, now.Add(-rule.Window))
+	ae.matches[key] = recent
+	message := fmt.Sprintf("%s logged %d lines matching %q in the last %s", service, len(recent), rule.Pattern, rule.Window)
+	return ae.transition(key, rule, service, len(recent) > 0, message, now)
+}
+
+// transition updates the active alert for key, returning it if it fired or
+// resolved. Suppressed services can still resolve alerts but don't fire any.
+func (ae *alertEngine) transition(key string, rule *AlertRule, service string, holds bool, message string, now time.Time) (Alert, bool) {
+	a, active := ae.active[key]
+	switch {
+	case holds && !active && !ae.suppressed(service):
+		a = &Alert{Rule: rule.Name, Service: service, State: AlertFiring, Message: message, Since: now}
+		ae.active[key] = a
+		return *a, true
+	case !holds && active:
+		delete(ae.active, key)
+		a.State = AlertResolved
+		a.Ended = &now
+		return *a, true
+	}
+	return Alert{}, false
+}
+
+func (ae *alertEngine) notify(a Alert) {
+	log.WithFields(log.Fields{
+		"rule":         a.Rule,
+		"service_name": a.Service,
+		"state":        a.State,
+	}).Warn(a.Message)
+
+	for _, n := range ae.notifiers {
+		if err := n.Notify(a); err != nil {
+			log.WithFields(log.Fields{
+				"rule": a.Rule,
+				"err":  err,
+			}).Warn("Couldn't send alert notification")
+		}
+	}
+}
+
+func alertKey(rule *AlertRule, service string) string {
+	return rule.Name + "/" + service
+}
+
+// pruneTimes drops the times before cutoff, times are in order
+func pruneTimes(times []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(cutoff) {
+		i++
+	}
+	return times[i:]
+}
@@ -0,0 +1,167 @@
+package guardian
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scopes a token can carry, each one includes everything the scopes before it
+// allow
+const (
+	ScopeRead     = "read"     // View status and logs
+	ScopeOperator = "operator" // Start and stop services
+	ScopeAdmin    = "admin"    // Change guardian settings
+)
+
+var scopeLevels = map[string]int{
+	ScopeRead:     1,
+	ScopeOperator: 2,
+	ScopeAdmin:    3,
+}
+
+type tokenClaims struct {
+	Subject   string   `json:"sub"`
+	Scope     string   `json:"scope"`  // Space separated, the OAuth2 convention
+	Scopes    []string `json:"scopes"` // Alternatively a list
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+// level returns the highest scope level granted by the claims
+func (c *tokenClaims) level() int {
+	level := 0
+	for _, s := range append(strings.Fields(c.Scope), c.Scopes...) {
+		if scopeLevels[s] > level {
+			level = scopeLevels[s]
+		}
+	}
+	return level
+}
+
+// jwtAuth verifies HS256 signed JWT bearer tokens
+type jwtAuth struct {
+	secret []byte
+	leeway time.Duration
+}
+
+// newJWTAuth returns an authenticator for tokens signed with secret, an empty
+// secret disables authentication
+func newJWTAuth(secret string) *jwtAuth {
+	if secret == "" {
+		return nil
+	}
+	return &jwtAuth{secret: []byte(secret), leeway: 30 * time.Second}
+}
+
+// verify checks the signature and time claims of the token and returns its
+// claims
+func (ja *jwtAuth) verify(token string) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return nil, errors.New("token must be signed with HS256")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, ja.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+	claims := &tokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, errors.New("malformed token payload")
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(ja.leeway)) {
+		return nil, errors.New("token has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(ja.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	return claims, nil
+}
+
+// require wraps h so it's only called for requests carrying a valid token
+// with at least the given scope. Routes without a scope are public.
+func (ja *jwtAuth) require(scope string, h http.HandlerFunc) http.HandlerFunc {
+	if ja == nil || scope == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			ErrorHandler(w, r, "Authentication required", errors.New("missing bearer token"), http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := ja.verify(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			ErrorHandler(w, r, "Invalid token", err, http.StatusUnauthorized)
+			return
+		}
+
+		if claims.level() < scopeLevels[scope] {
+			ErrorHandler(w, r, "Token doesn't allow this", errors.New("token needs the "+scope+" scope"), http.StatusForbidden)
+			return
+		}
+
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey, tokenPrincipal(token, claims))))
+	}
+}
+
+// tokenPrincipal names who a verified token was issued to, its subject or
+// the token itself if it doesn't have one
+func tokenPrincipal(token string, claims *tokenClaims) string {
+	if claims.Subject != "" {
+		return "sub:" + claims.Subject
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:8])
+}
+
+// principal returns who the request's verified token was issued to, or ""
+// when it wasn't authenticated
+func principal(r *http.Request) string {
+	p, _ := r.Context().Value(principalKey).(string)
+	return p
+}
+
+// bearerToken gets the token from the Authorization header, or from the
+// access_token query parameter since browsers can't set headers on websockets
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("access_token")
+}
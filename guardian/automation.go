@@ -0,0 +1,279 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoAutomationRule is returned for a rule name that isn't set up
+var ErrNoAutomationRule = errors.New("no automation rule with that name")
+
+// Actions an automation rule can take
+const (
+	AutomationStart   = ActionStart
+	AutomationStop    = ActionStop
+	AutomationRestart = ActionRestart
+	AutomationWebhook = "webhook"
+)
+
+// AutomationRule takes its actions when events of type On happen to Service
+// (any service if it's empty) Count times within Window, like "crashed" 3
+// times in 5m. Once it fires the count starts over, and it doesn't fire again
+// for Cooldown.
+type AutomationRule struct {
+	Name     string             `json:"name"`
+	On       string             `json:"on"`
+	Service  string             `json:"service,omitempty"`
+	Count    int                `json:"count"`
+	Window   time.Duration      `json:"window"`
+	Cooldown time.Duration      `json:"cooldown,omitempty"`
+	Actions  []AutomationAction `json:"actions"`
+}
+
+// AutomationAction is what a rule does when it fires: start, stop or restart
+// Service or the services matching Selector, or post to the webhook at URL.
+// A Service of "$service" is the service the rule fired for.
+type AutomationAction struct {
+	Type     string `json:"type"`
+	Service  string `json:"service,omitempty"`
+	Selector string `json:"selector,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// AutomationStatus is a rule along with when it last fired
+type AutomationStatus struct {
+	AutomationRule
+	Fired     int        `json:"fired"`
+	LastFired *time.Time `json:"last_fired,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// AutomationFiring is what a webhook action posts
+type AutomationFiring struct {
+	Rule    string    `json:"rule"`
+	Service string    `json:"service,omitempty"`
+	Event   Event     `json:"event"` // The event that made it fire
+	Time    time.Time `json:"time"`
+}
+
+// The service the rule fired for, in an action's Service
+const automationFiringService = "$service"
+
+type automationState struct {
+	rule      AutomationRule
+	selectors []Selector // Of each action, nil if it has none
+	hits      map[string][]time.Time
+	fired     int
+	lastFired time.Time
+	lastError string
+}
+
+type automations struct {
+	mux        sync.Mutex
+	rules      map[string]*automationState
+	publishing bool // Events are checked against the rules
+}
+
+func (rule AutomationRule) validate() ([]Selector, error) {
+	if rule.Name == "" {
+		return nil, errors.New("automation rules need a name")
+	}
+	switch rule.On {
+	case EventStarted, EventStopped, EventExited, EventCrashed, EventReloaded:
+	default:
+		return nil, fmt.Errorf("automation rule %s is on an unknown event type %q", rule.Name, rule.On)
+	}
+	if rule.Count > 1 && rule.Window <= 0 {
+		return nil, fmt.Errorf("automation rule %s needs a Window for its Count", rule.Name)
+	}
+	if len(rule.Actions) == 0 {
+		return nil, fmt.Errorf("automation rule %s has no actions", rule.Name)
+	}
+
+	selectors := make([]Selector, len(rule.Actions))
+	for i, a := range rule.Actions {
+		switch a.Type {
+		case AutomationStart, AutomationStop, AutomationRestart:
+			if (a.Service == "") == (a.Selector == "") {
+				return nil, fmt.Errorf("%s action of automation rule %s needs either a service or a selector", a.Type, rule.Name)
+			}
+			if a.Selector != "" {
+				sel, err := ParseSelector(a.Selector)
+				if err != nil {
+					return nil, fmt.Errorf("automation rule %s: %s", rule.Name, err)
+				}
+				selectors[i] = sel
+			}
+		case AutomationWebhook:
+			if a.URL == "" {
+				return nil, fmt.Errorf("webhook action of automation rule %s needs a URL", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("automation rule %s has an unknown action %q", rule.Name, a.Type)
+		}
+	}
+	return selectors, nil
+}
+
+// DecodeAutomationRule reads a rule in the shape it has in the config file,
+// with durations like "5m"
+func DecodeAutomationRule(b []byte) (AutomationRule, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return AutomationRule{}, err
+	}
+	var rule AutomationRule
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		WeaklyTypedInput: true,
+		Result:           &rule,
+	})
+	if err != nil {
+		return AutomationRule{}, err
+	}
+	if err := dec.Decode(raw); err != nil {
+		return AutomationRule{}, err
+	}
+	return rule, nil
+}
+
+// SetAutomationRule adds the rule, replacing the one with the same name if
+// there is one
+func (gg *GladiusGuardian) SetAutomationRule(rule AutomationRule) error {
+	selectors, err := rule.validate()
+	if err != nil {
+		return err
+	}
+	if rule.Count < 1 {
+		rule.Count = 1
+	}
+
+	gg.automations.mux.Lock()
+	gg.automations.rules[rule.Name] = &automationState{rule: rule, selectors: selectors, hits: make(map[string][]time.Time)}
+	publishing := gg.automations.publishing
+	gg.automations.publishing = true
+	gg.automations.mux.Unlock()
+	if !publishing {
+		gg.AddEventPublisher(automationPublisher{gg})
+	}
+
+	log.WithFields(log.Fields{
+		"rule": rule.Name,
+	}).Info("Set automation rule")
+	return nil
+}
+
+// RemoveAutomationRule removes the rule with the name
+func (gg *GladiusGuardian) RemoveAutomationRule(name string) error {
+	gg.automations.mux.Lock()
+	defer gg.automations.mux.Unlock()
+	if _, ok := gg.automations.rules[name]; !ok {
+		return ErrNoAutomationRule
+	}
+	delete(gg.automations.rules, name)
+	return nil
+}
+
+// AutomationRules returns every rule with when it last fired, sorted by name
+func (gg *GladiusGuardian) AutomationRules() []AutomationStatus {
+	gg.automations.mux.Lock()
+	defer gg.automations.mux.Unlock()
+	rules := make([]AutomationStatus, 0, len(gg.automations.rules))
+	for _, st := range gg.automations.rules {
+		status := AutomationStatus{AutomationRule: st.rule, Fired: st.fired, LastError: st.lastError}
+		if st.fired > 0 {
+			lastFired := st.lastFired
+			status.LastFired = &lastFired
+		}
+		rules = append(rules, status)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// automationPublisher checks every event against the automation rules
+type automationPublisher struct {
+	gg *GladiusGuardian
+}
+
+// Publish fires the rules the event completes, their actions are taken in
+// the background so a slow start doesn't hold up the events after it
+func (ap automationPublisher) Publish(ev Event) error {
+	gg := ap.gg
+	gg.automations.mux.Lock()
+	defer gg.automations.mux.Unlock()
+
+	for _, st := range gg.automations.rules {
+		rule := st.rule
+		if ev.Type != rule.On || ev.Service == "" || (rule.Service != "" && rule.Service != ev.Service) {
+			continue
+		}
+		hits := append(pruneTimes(st.hits[ev.Service], ev.Time.Add(-rule.Window)), ev.Time)
+		st.hits[ev.Service] = hits
+		if len(hits) < rule.Count {
+			continue
+		}
+		delete(st.hits, ev.Service)
+		if rule.Cooldown > 0 && ev.Time.Sub(st.lastFired) < rule.Cooldown {
+			continue
+		}
+		st.fired++
+		st.lastFired = ev.Time
+		go gg.fireAutomation(st, rule, ev)
+	}
+	return nil
+}
+
+// fireAutomation takes the rule's actions one after the other
+func (gg *GladiusGuardian) fireAutomation(st *automationState, rule AutomationRule, ev Event) {
+	log.WithFields(log.Fields{
+		"rule":         rule.Name,
+		"service_name": ev.Service,
+	}).Info("Automation rule fired")
+	gg.emit(Event{Type: EventAutomation, Message: fmt.Sprintf("rule %s fired for %s", rule.Name, ev.Service)})
+
+	var errs []string
+	for i, a := range rule.Actions {
+		var err error
+		switch a.Type {
+		case AutomationWebhook:
+			err = NewWebhookNotifier(a.URL).post(AutomationFiring{Rule: rule.Name, Service: ev.Service, Event: ev, Time: time.Now()})
+		default:
+			names := []string{a.Service}
+			if a.Service == automationFiringService {
+				names = []string{ev.Service}
+			}
+			if st.selectors[i] != nil {
+				names = gg.SelectServices(st.selectors[i])
+			}
+			for _, result := range gg.BatchAction(context.Background(), a.Type, names, nil, true) {
+				if !result.Success {
+					err = fmt.Errorf("%s %s: %s", a.Type, result.Service, result.Error)
+				}
+			}
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"rule":   rule.Name,
+				"action": a.Type,
+				"err":    err,
+			}).Warn("Automation action failed")
+			errs = append(errs, err.Error())
+		}
+	}
+
+	gg.automations.mux.Lock()
+	st.lastError = ""
+	if len(errs) > 0 {
+		st.lastError = errs[len(errs)-1]
+	}
+	gg.automations.mux.Unlock()
+}
@@ -0,0 +1,97 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backends a service can be run by, see ServiceOptions.Backend
+const (
+	BackendExec   = "exec"   // A child process of the guardian
+	BackendDocker = "docker" // A container run from the service's Image
+	BackendSSH    = "ssh"    // A process on the host in the service's SSHHost
+)
+
+// backend runs instances of services. Which one runs a service is picked by
+// its Backend option, where it's run and how is up to the backend, the
+// supervisor only deals with the instances it returns.
+type backend interface {
+	// validate returns an error if the backend can't run the service as it's
+	// registered
+	validate(name, execLocation string, opts ServiceOptions) error
+
+	// spawn starts an instance of the service with the environment, waiting
+	// up to the timeout for it to come up if it's set
+	spawn(ctx context.Context, gg *GladiusGuardian, name string, settings *serviceSettings, env []string, timeout *time.Duration) (instance, error)
+}
+
+var backends = map[string]backend{
+	BackendExec:   execBackend{},
+	BackendDocker: dockerBackend{},
+	BackendSSH:    sshBackend{},
+}
+
+// backendName returns the name of the backend that runs a service with the
+// options, without one set services with an image run in a container
+func backendName(opts ServiceOptions) string {
+	if opts.Backend != "" {
+		return opts.Backend
+	}
+	if opts.Image != "" {
+		return BackendDocker
+	}
+	return BackendExec
+}
+
+// lookupBackend returns the backend that runs a service with the options
+func lookupBackend(opts ServiceOptions) (backend, error) {
+	name := backendName(opts)
+	b, ok := backends[name]
+	if !ok {
+		known := make([]string, 0, len(backends))
+		for k := range backends {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown backend %q, it has to be one of %s", name, strings.Join(known, ", "))
+	}
+	return b, nil
+}
+
+// execBackend runs the service's executable as a child process
+type execBackend struct{}
+
+func (execBackend) validate(name, execLocation string, opts ServiceOptions) error {
+	if opts.Image != "" {
+		return fmt.Errorf("service %s has an image but runs with the %s backend", name, BackendExec)
+	}
+	if execLocation == "" {
+		return fmt.Errorf("service %s has neither an executable nor an image", name)
+	}
+	if _, err := exec.LookPath(hostPath(opts, execLocation)); err != nil {
+		return fmt.Errorf("executable of service %s isn't usable: %s", name, err)
+	}
+	return nil
+}
+
+func (execBackend) spawn(ctx context.Context, gg *GladiusGuardian, name string, settings *serviceSettings, env []string, timeout *time.Duration) (instance, error) {
+	return gg.spawnProcess(ctx, name, settings.execName, settings.opts, env, timeout)
+}
+
+// dockerBackend runs the service's image as a container
+type dockerBackend struct{}
+
+func (dockerBackend) validate(name, execLocation string, opts ServiceOptions) error {
+	if opts.Image == "" {
+		return fmt.Errorf("service %s runs with the %s backend but has no image", name, BackendDocker)
+	}
+	return nil
+}
+
+func (dockerBackend) spawn(ctx context.Context, gg *GladiusGuardian, name string, settings *serviceSettings, env []string, timeout *time.Duration) (instance, error) {
+	return gg.spawnContainer(ctx, name, settings.opts, env, timeout)
+}
@@ -0,0 +1,471 @@
+package guardian
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoBackup is returned when restoring a backup that doesn't exist
+var ErrNoBackup = errors.New("no backup with that id")
+
+// How many backups of each service are kept if nothing else is set
+const defaultBackupKeep = 5
+
+// Backup is an archive of a service's data directory
+type Backup struct {
+	ID      string    `json:"id"`
+	Service string    `json:"service"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+type backups struct {
+	mux  sync.Mutex // Held for a whole backup or restore so they don't overlap
+	dir  string
+	keep int
+}
+
+// SetupBackups sets where backups go, in a directory per service, and how
+// many of each service are kept before the oldest ones are removed. 0 keeps
+// the default of 5.
+func (gg *GladiusGuardian) SetupBackups(dir string, keep int) {
+	if keep <= 0 {
+		keep = defaultBackupKeep
+	}
+	gg.backups.mux.Lock()
+	defer gg.backups.mux.Unlock()
+	gg.backups.dir, gg.backups.keep = dir, keep
+}
+
+// backupSettings returns the service's data directory and backup hook
+func (gg *GladiusGuardian) backupSettings(name string) (ServiceOptions, error) {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	gg.mux.Unlock()
+	if !ok {
+		return ServiceOptions{}, ErrNotRegistered
+	}
+	if settings.opts.DataDir == "" {
+		return ServiceOptions{}, fmt.Errorf("service %s has no data directory", name)
+	}
+	return settings.opts, nil
+}
+
+func (b *backups) serviceDir(name string) (string, error) {
+	if b.dir == "" {
+		return "", errors.New("no backup directory set")
+	}
+	return filepath.Join(b.dir, name), nil
+}
+
+// BackupService archives the service's data directory to a gzipped tarball.
+// If the service has a BackupHook the hook is run first and the service is
+// left running, otherwise a running service is stopped for the backup and
+// started again after. The oldest backups past the retention are removed.
+func (gg *GladiusGuardian) BackupService(ctx context.Context, name string) (Backup, error) {
+	opts, err := gg.backupSettings(name)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	gg.backups.mux.Lock()
+	defer gg.backups.mux.Unlock()
+	dir, err := gg.backups.serviceDir(name)
+	if err != nil {
+		return Backup{}, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return Backup{}, err
+	}
+
+	if len(opts.BackupHook) > 0 {
+		if err := gg.runBackupHook(ctx, name, opts.BackupHook); err != nil {
+			return Backup{}, err
+		}
+	} else {
+		restart, err := gg.stopForData(ctx, name)
+		if err != nil {
+			return Backup{}, err
+		}
+		defer restart()
+	}
+
+	created := time.Now().UTC()
+	id := name + "-" + created.Format("20060102T150405.000Z") + ".tar.gz"
+	path := filepath.Join(dir, id)
+	if err := writeArchive(path, opts.DataDir); err != nil {
+		os.Remove(path)
+		return Backup{}, fmt.Errorf("couldn't archive %s: %s", opts.DataDir, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"backup":       id,
+		"size":         info.Size(),
+	}).Info("Backed up data directory")
+	gg.pruneBackups(name, dir)
+	return Backup{ID: id, Service: name, Size: info.Size(), Created: created}, nil
+}
+
+// RestoreBackup replaces the service's data directory with the contents of a
+// backup. A running service is stopped while it's restored and started again
+// after. The directory isn't touched if the backup can't be extracted.
+func (gg *GladiusGuardian) RestoreBackup(ctx context.Context, name, id string) error {
+	opts, err := gg.backupSettings(name)
+	if err != nil {
+		return err
+	}
+
+	gg.backups.mux.Lock()
+	defer gg.backups.mux.Unlock()
+	dir, err := gg.backups.serviceDir(name)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, id)
+	if filepath.Base(id) != id || !strings.HasSuffix(id, ".tar.gz") {
+		return fmt.Errorf("%w: %s", ErrNoBackup, id)
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrNoBackup, id)
+	}
+
+	// Extract next to the data directory so it can be swapped in with renames
+	parent := filepath.Dir(filepath.Clean(opts.DataDir))
+	staging, err := ioutil.TempDir(parent, ".restore-"+name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := extractArchive(path, staging); err != nil {
+		return fmt.Errorf("couldn't extract %s: %s", id, err)
+	}
+	if info, err := os.Stat(opts.DataDir); err == nil {
+		os.Chmod(staging, info.Mode().Perm())
+	}
+	if opts.DataDirOwner != "" {
+		if uid, gid, err := parseOwner(opts.DataDirOwner); err == nil {
+			os.Chown(staging, uid, gid)
+		}
+	}
+
+	restart, err := gg.stopForData(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer restart()
+
+	old := staging + ".old"
+	if err := os.Rename(opts.DataDir, old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(staging, opts.DataDir); err != nil {
+		os.Rename(old, opts.DataDir)
+		return err
+	}
+	os.RemoveAll(old)
+
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"backup":       id,
+	}).Info("Restored data directory")
+	return nil
+}
+
+// ListBackups returns the backups of a service, newest first
+func (gg *GladiusGuardian) ListBackups(name string) ([]Backup, error) {
+	if !gg.isRegistered(name) {
+		return nil, ErrNotRegistered
+	}
+	gg.backups.mux.Lock()
+	defer gg.backups.mux.Unlock()
+	dir, err := gg.backups.serviceDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return listBackups(name, dir)
+}
+
+func listBackups(name, dir string) ([]Backup, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Backup{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	list := make([]Backup, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".tar.gz") {
+			continue
+		}
+		list = append(list, Backup{ID: f.Name(), Service: name, Size: f.Size(), Created: f.ModTime()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID > list[j].ID })
+	return list, nil
+}
+
+// pruneBackups removes the oldest backups past the retention
+func (gg *GladiusGuardian) pruneBackups(name, dir string) {
+	list, err := listBackups(name, dir)
+	if err != nil || len(list) <= gg.backups.keep {
+		return
+	}
+	for _, b := range list[gg.backups.keep:] {
+		if err := os.Remove(filepath.Join(dir, b.ID)); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"backup":       b.ID,
+				"err":          err,
+			}).Warn("Couldn't remove old backup")
+		}
+	}
+}
+
+// runBackupHook runs the hook that gets the service's data into a consistent
+// state while it keeps running, its output goes to the service's log
+func (gg *GladiusGuardian) runBackupHook(ctx context.Context, name string, hook []string) error {
+	code, err := gg.Exec(ctx, name, hook, func(stream, line string) {
+		gg.AppendToLog(name, line)
+	})
+	if err != nil {
+		return fmt.Errorf("backup hook failed: %s", err)
+	}
+	if code != 0 {
+		return fmt.Errorf("backup hook exited with code %d", code)
+	}
+	return nil
+}
+
+// stopForData stops the service if it's running and returns a function that
+// starts it again, even if the request that stopped it is gone by then
+func (gg *GladiusGuardian) stopForData(ctx context.Context, name string) (func(), error) {
+	err := gg.StopServiceContext(ctx, name)
+	if errors.Is(err, ErrNotRunning) {
+		return func() {}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return func() {
+		if _, err := gg.startWithDependencies(context.Background(), name, nil); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"err":          err,
+			}).Warn("Couldn't start service again after its data directory was backed up or restored")
+		}
+	}, nil
+}
+
+// writeArchive writes the contents of dir to a gzipped tarball at path
+func writeArchive(path, dir string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		} else if !info.Mode().IsRegular() && !info.IsDir() {
+			return nil // Sockets, pipes and devices can't be restored anyway
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		src, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, src)
+		src.Close()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// extractArchive extracts a tarball written by writeArchive into dir,
+// refusing entries that would end up outside of it, symlinks pointing out of
+// it and entries written through a symlink
+func extractArchive(path, dir string) error {
+	dir = filepath.Clean(dir)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+
+	asRoot := os.Geteuid() == 0
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !inDir(dir, target) {
+			return fmt.Errorf("entry %s is outside of the data directory", header.Name)
+		}
+		// Links in the archive could point anywhere by the time a later entry
+		// is written through them
+		if err := checkNoSymlinks(dir, target); err != nil {
+			return fmt.Errorf("entry %s: %s", header.Name, err)
+		}
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			os.Chmod(target, mode)
+			dirs = append(dirs, dirTime{target, header.ModTime})
+		case tar.TypeReg:
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+			os.Chtimes(target, header.ModTime, header.ModTime)
+		case tar.TypeSymlink:
+			if err := checkLink(dir, target, header.Linkname); err != nil {
+				return fmt.Errorf("entry %s: %s", header.Name, err)
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		if asRoot {
+			os.Lchown(target, header.Uid, header.Gid)
+		}
+	}
+
+	// Writing files into directories changes their times, set them last
+	for _, d := range dirs {
+		os.Chtimes(d.path, d.mtime, d.mtime)
+	}
+	return nil
+}
+
+// inDir returns true if path is dir or inside it, both have to be clean
+func inDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(os.PathSeparator))
+}
+
+// checkNoSymlinks returns an error if path or any directory between dir and
+// it is a symlink, so writing to it can't end up outside of dir
+func checkNoSymlinks(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	}
+	cur := dir
+	for _, elem := range strings.Split(rel, string(os.PathSeparator)) {
+		if elem == "." {
+			continue
+		}
+		cur = filepath.Join(cur, elem)
+		fi, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil // Nothing below it exists either
+		} else if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", filepath.ToSlash(rel))
+		}
+	}
+	return nil
+}
+
+// checkLink returns an error unless link, the target of a symlink at path,
+// is relative and stays inside dir. It can only go up with leading "..", one
+// after a name could climb out from wherever an earlier link points.
+func checkLink(dir, path, link string) error {
+	link = filepath.FromSlash(link)
+	if link == "" || filepath.IsAbs(link) || strings.HasPrefix(link, string(os.PathSeparator)) || filepath.VolumeName(link) != "" {
+		return fmt.Errorf("link to %s has to be relative", link)
+	}
+	leading := true
+	for _, elem := range strings.Split(link, string(os.PathSeparator)) {
+		if elem == ".." && !leading {
+			return fmt.Errorf("link to %s can only have .. at the start", link)
+		} else if elem != ".." && elem != "." && elem != "" {
+			leading = false
+		}
+	}
+	if !inDir(dir, filepath.Join(filepath.Dir(path), link)) {
+		return fmt.Errorf("link to %s points outside of the data directory", link)
+	}
+	return nil
+}
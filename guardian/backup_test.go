@@ -0,0 +1,130 @@
+package guardian
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func writeTestArchive(t *testing.T, path string, entries []tarEntry) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0600, Size: int64(len(e.body))}
+		if e.typeflag == tar.TypeDir {
+			header.Mode = 0700
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchiveLinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries func(outside string) []tarEntry
+		wantErr bool
+	}{
+		{
+			name: "absolute link then a file through it",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "link", typeflag: tar.TypeSymlink, linkname: filepath.Join(outside, "x")},
+					{name: "link", typeflag: tar.TypeReg, body: "pwned"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "relative link out of the directory",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{{name: "link", typeflag: tar.TypeSymlink, linkname: "../x"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "climbing out through another link",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "sub", typeflag: tar.TypeDir},
+					{name: "sub/up", typeflag: tar.TypeSymlink, linkname: ".."},
+					{name: "sub/link", typeflag: tar.TypeSymlink, linkname: "up/../x"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "file in a linked directory",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "real", typeflag: tar.TypeDir},
+					{name: "link", typeflag: tar.TypeSymlink, linkname: "real"},
+					{name: "link/x", typeflag: tar.TypeReg, body: "data"},
+				}
+			},
+			wantErr: true,
+		},
+		{
+			name: "links inside the directory",
+			entries: func(outside string) []tarEntry {
+				return []tarEntry{
+					{name: "real", typeflag: tar.TypeDir},
+					{name: "real/x", typeflag: tar.TypeReg, body: "data"},
+					{name: "link", typeflag: tar.TypeSymlink, linkname: "real/x"},
+					{name: "real/up", typeflag: tar.TypeSymlink, linkname: "../link"},
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmp, err := ioutil.TempDir("", "gg-backup-test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmp)
+			outside := filepath.Join(tmp, "outside")
+			dir := filepath.Join(tmp, "data")
+			for _, d := range []string{outside, dir} {
+				if err := os.Mkdir(d, 0700); err != nil {
+					t.Fatal(err)
+				}
+			}
+			archive := filepath.Join(tmp, "backup.tar.gz")
+			writeTestArchive(t, archive, tt.entries(outside))
+
+			err = extractArchive(archive, dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractArchive() error = %v, want error %v", err, tt.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(outside, "x")); !os.IsNotExist(err) {
+				t.Errorf("file written outside of the data directory")
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long a new blue/green instance gets to become ready unless the service
+// says otherwise
+const defaultBlueGreenTimeout = 30 * time.Second
+
+// How long a start with a zero spawn timeout waits for the service to be
+// ready by default
+const defaultReadyTimeout = 30 * time.Second
+
+// blueGreenRestart starts a second instance of a running service on freshly
+// allocated ports and only stops the old one once the new one is ready, so
+// the service is never down. If the new instance doesn't become ready it's
+// killed and the old one keeps running.
+func (gg *GladiusGuardian) blueGreenRestart(ctx context.Context, name string) error {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	if !ok {
+		gg.mux.Unlock()
+		return fmt.Errorf("can't restart %s: %w", name, ErrNotRegistered)
+	}
+	old := gg.services[name]
+	if old == nil {
+		gg.mux.Unlock()
+		_, err := gg.startWithDependencies(ctx, name, nil)
+		return err
+	}
+	if backendName(settings.opts) != BackendExec || len(settings.opts.Ports) > 0 {
+		gg.mux.Unlock()
+		return fmt.Errorf("can't restart %s blue/green, it needs to run as a process on allocated ports", name)
+	}
+	timeout := gg.startTimeout()
+	gg.mux.Unlock()
+
+	// The old instance still holds its ports, so the new one is given others
+	before := gg.AllocatedPorts(name)
+	env, err := gg.ports.expandEnv(name, gg.startEnv(settings, nil))
+	var inst instance
+	if err == nil {
+		inst, err = gg.spawnProcess(ctx, name, settings.execName, settings.opts, env, timeout)
+	}
+	if err == nil {
+		if err = gg.waitUntilReady(name, settings.opts, blueGreenTimeout(settings.opts)); err != nil {
+			inst.kill()
+		}
+	}
+	if err == nil {
+		err = gg.replaceInstance(name, old, inst)
+	}
+	if err != nil {
+		// Give the ports back to the instance that's still running
+		gg.ports.mux.Lock()
+		gg.ports.allocated[name] = before
+		gg.ports.mux.Unlock()
+		return fmt.Errorf("blue/green restart of %s failed, the old instance is still running: %s", name, err)
+	}
+	return nil
+}
+
+func blueGreenTimeout(opts ServiceOptions) time.Duration {
+	if opts.BlueGreenTimeout <= 0 {
+		return defaultBlueGreenTimeout
+	}
+	return opts.BlueGreenTimeout
+}
+
+func readyTimeout(opts ServiceOptions) time.Duration {
+	if opts.ReadyTimeout <= 0 {
+		return defaultReadyTimeout
+	}
+	return opts.ReadyTimeout
+}
+
+// hasReadinessProbe returns true if the service's instance can be checked
+// with waitUntilReady, which only reaches processes on this host
+func hasReadinessProbe(gg *GladiusGuardian, name string, opts ServiceOptions) bool {
+	if backendName(opts) != BackendExec {
+		return false
+	}
+	return opts.ReadyPath != "" || len(gg.AllocatedPorts(name)) > 0
+}
+
+// waitUntilReady waits for every allocated port of the new instance to accept
+// connections, and for its ReadyPath to return a success if it has one
+func (gg *GladiusGuardian) waitUntilReady(name string, opts ServiceOptions, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	for {
+		err := portsReady(gg.AllocatedPorts(name))
+		if err == nil && opts.ReadyPath != "" {
+			err = httpReady(client, gg.advertisedPort(name), opts.ReadyPath)
+		}
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("instance wasn't ready after %s: %s", timeout, err)
+		}
+		time.Sleep(conditionPollInterval)
+	}
+}
+
+func portsReady(ports map[string]int) error {
+	for _, port := range ports {
+		conn, err := net.DialTimeout("tcp", "localhost:"+strconv.Itoa(port), time.Second)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+func httpReady(client *http.Client, port int, path string) error {
+	resp, err := client.Get("http://localhost:" + strconv.Itoa(port) + path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", path, resp.Status)
+	}
+	return nil
+}
+
+// replaceInstance has the supervisor switch the service over to the new
+// instance
+func (gg *GladiusGuardian) replaceInstance(name string, old, inst instance) error {
+	sv := gg.supervisor(name)
+	if sv == nil {
+		inst.kill()
+		return errors.New("the service isn't registered anymore")
+	}
+	return sv.do(supervisorCommand{kind: commandReplace, old: old, inst: inst})
+}
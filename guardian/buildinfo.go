@@ -0,0 +1,96 @@
+package guardian
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/spf13/viper"
+)
+
+// Set at build time with -ldflags, like
+// -X github.com/gladiusio/gladius-guardian/guardian.GitCommit=$(git rev-parse HEAD).
+// GitCommit and BuildDate fall back to what the Go toolchain stamped into the
+// binary, if anything.
+var (
+	BuildVersion = "dev"
+	GitCommit    = ""
+	BuildDate    = ""
+)
+
+// BuildDetails is which build of the guardian is running
+type BuildDetails struct {
+	Version    string `json:"version"`
+	APIVersion string `json:"api_version"`
+	GitCommit  string `json:"git_commit,omitempty"`
+	BuildDate  string `json:"build_date,omitempty"`
+	GoVersion  string `json:"go_version"`
+	Platform   string `json:"platform"`
+}
+
+// BuildInfo returns which build of the guardian is running, for bug reports
+func BuildInfo() BuildDetails {
+	info := BuildDetails{
+		Version:    BuildVersion,
+		APIVersion: Version,
+		GitCommit:  GitCommit,
+		BuildDate:  BuildDate,
+		GoVersion:  runtime.Version(),
+		Platform:   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok && GitCommit == "" {
+		modified := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				info.GitCommit = s.Value
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+		if modified && info.GitCommit != "" {
+			info.GitCommit += "-dirty"
+		}
+	}
+	return info
+}
+
+// ConfigSummary is how the guardian is set up, without anything secret
+type ConfigSummary struct {
+	ConfigFile     string   `json:"config_file,omitempty"`
+	Services       []string `json:"services"`
+	ActiveEnvSet   string   `json:"active_env_set,omitempty"`
+	TLS            bool     `json:"tls"`
+	Auth           bool     `json:"auth"`
+	ReadOnly       bool     `json:"read_only"`
+	DebugEndpoints bool     `json:"debug_endpoints"`
+	LeaderElection bool     `json:"leader_election"`
+}
+
+// AboutReport is the build of the guardian and a summary of its config
+type AboutReport struct {
+	BuildDetails
+	Config ConfigSummary `json:"config"`
+}
+
+// About returns the build of the guardian and a summary of its config
+func (gg *GladiusGuardian) About() *AboutReport {
+	summary := ConfigSummary{
+		ConfigFile:     viper.ConfigFileUsed(),
+		Services:       gg.registeredNames(),
+		TLS:            viper.GetString("TLSCertFile") != "",
+		Auth:           viper.GetString("JWTSecret") != "",
+		ReadOnly:       viper.GetBool("ReadOnly"),
+		DebugEndpoints: viper.GetBool("EnableDebugEndpoints"),
+		LeaderElection: gg.LeaderStatus().Enabled,
+	}
+
+	gg.envSets.mux.Lock()
+	summary.ActiveEnvSet = gg.envSets.active
+	gg.envSets.mux.Unlock()
+
+	return &AboutReport{BuildDetails: BuildInfo(), Config: summary}
+}
@@ -0,0 +1,83 @@
+package guardian
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// waitedChildren are the child processes something in the guardian waits on.
+// Zombies are only reaped by the stray scan if they aren't among them, like
+// ones adopted as a subreaper, a zombie reaped behind the back of whatever
+// waits on it would lose its exit status.
+type waitedChildren struct {
+	mux     sync.Mutex
+	pending int         // Calls of add in progress, their children aren't known yet
+	pids    map[int]int // Waits on each child
+}
+
+var waited = &waitedChildren{pids: make(map[int]int)}
+
+// add runs pick, which starts children or finds ones to wait on, and keeps
+// the PIDs it returns until done is called for each of them
+func (wc *waitedChildren) add(pick func() ([]int, error)) error {
+	wc.mux.Lock()
+	wc.pending++
+	wc.mux.Unlock()
+
+	pids, err := pick()
+
+	wc.mux.Lock()
+	defer wc.mux.Unlock()
+	wc.pending--
+	for _, pid := range pids {
+		wc.pids[pid]++
+	}
+	return err
+}
+
+// start starts the command and keeps its PID until done is called after it
+// was waited on
+func (wc *waitedChildren) start(cmd *exec.Cmd) error {
+	return wc.add(func() ([]int, error) {
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return []int{cmd.Process.Pid}, nil
+	})
+}
+
+// run starts the command and waits for it like cmd.Run
+func (wc *waitedChildren) run(cmd *exec.Cmd) error {
+	if err := wc.start(cmd); err != nil {
+		return err
+	}
+	defer wc.done(cmd.Process.Pid)
+	return cmd.Wait()
+}
+
+// wait waits for a process picked with add
+func (wc *waitedChildren) wait(p *os.Process) (*os.ProcessState, error) {
+	defer wc.done(p.Pid)
+	return p.Wait()
+}
+
+// done forgets a child once it was waited on
+func (wc *waitedChildren) done(pid int) {
+	wc.mux.Lock()
+	defer wc.mux.Unlock()
+	if wc.pids[pid]--; wc.pids[pid] <= 0 {
+		delete(wc.pids, pid)
+	}
+}
+
+// reap reaps the zombie unless something waits on it, or might once a
+// child being started is known. It returns false if it left it alone.
+func (wc *waitedChildren) reap(pid int) (bool, error) {
+	wc.mux.Lock()
+	defer wc.mux.Unlock()
+	if wc.pending > 0 || wc.pids[pid] > 0 {
+		return false, nil
+	}
+	return true, reapZombie(pid)
+}
@@ -0,0 +1,56 @@
+package guardian
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// waitForZombie waits until the process exited but wasn't waited on yet
+func waitForZombie(t *testing.T, pid int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		procs, err := listProcesses()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range procs {
+			if p.PID == pid && p.State == "Z" {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("process %d didn't become a zombie", pid)
+}
+
+func TestReapLeavesWaitedChildren(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "exit 3")
+	if err := waited.start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	waitForZombie(t, cmd.Process.Pid)
+
+	if reaped, err := waited.reap(cmd.Process.Pid); reaped || err != nil {
+		t.Fatalf("reap() = %v, %v, want the child left alone", reaped, err)
+	}
+	err := cmd.Wait()
+	waited.done(cmd.Process.Pid)
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 3 {
+		t.Fatalf("Wait() = %v, want exit status 3", err)
+	}
+}
+
+func TestReapUnwaitedZombie(t *testing.T) {
+	// Stands in for a process adopted as a subreaper, nothing waits on it
+	cmd := exec.Command("sh", "-c", "exit 0")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	waitForZombie(t, cmd.Process.Pid)
+
+	if reaped, err := waited.reap(cmd.Process.Pid); !reaped || err != nil {
+		t.Fatalf("reap() = %v, %v, want it reaped", reaped, err)
+	}
+}
@@ -0,0 +1,115 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// When the guardian started, start delays count from here
+var startedAt = time.Now()
+
+// How often unmet start conditions are checked again
+const conditionPollInterval = 500 * time.Millisecond
+
+// Longest a service waits for its start conditions unless it says otherwise
+const defaultConditionTimeout = time.Minute
+
+// waitForStartConditions blocks until the service's start conditions are all
+// met, it gives up after its StartConditionTimeout
+func (gg *GladiusGuardian) waitForStartConditions(ctx context.Context, name string) error {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	gg.mux.Unlock()
+	if !ok {
+		return nil // Reported by the caller
+	}
+	opts := settings.opts
+	if !opts.hasStartConditions() {
+		return nil
+	}
+
+	timeout := opts.StartConditionTimeout
+	if timeout <= 0 {
+		timeout = defaultConditionTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logged := false
+	for {
+		unmet := opts.unmetStartCondition()
+		if unmet == "" {
+			return nil
+		}
+		if !logged {
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"waiting_for":  unmet,
+			}).Info("Waiting for start conditions of service")
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("can't start %s, still waiting for %s", name, unmet)
+		case <-time.After(conditionPollInterval):
+		}
+	}
+}
+
+func (opts ServiceOptions) hasStartConditions() bool {
+	return opts.StartDelay > 0 || len(opts.WaitForFiles) > 0 || len(opts.WaitForAddresses) > 0 || opts.WaitForNetwork
+}
+
+// unmetStartCondition describes the first start condition that isn't met yet,
+// or returns an empty string
+func (opts ServiceOptions) unmetStartCondition() string {
+	if time.Since(startedAt) < opts.StartDelay {
+		return fmt.Sprintf("%s after the guardian started", opts.StartDelay)
+	}
+	for _, path := range opts.WaitForFiles {
+		if _, err := os.Stat(path); err != nil {
+			return "file " + path
+		}
+	}
+	for _, addr := range opts.WaitForAddresses {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err != nil {
+			return "address " + addr
+		}
+		conn.Close()
+	}
+	if opts.WaitForNetwork && !networkOnline() {
+		return "the network"
+	}
+	return ""
+}
+
+// networkOnline returns whether an interface other than loopback is up with a
+// routable address
+func networkOnline() bool {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return false
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.IsGlobalUnicast() {
+				return true
+			}
+		}
+	}
+	return false
+}
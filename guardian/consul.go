@@ -0,0 +1,91 @@
+package guardian
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ConsulRegistry registers services with a Consul agent, each with a TTL
+// check that passes while the service is running
+type ConsulRegistry struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewConsulRegistry returns a registry for the agent at url, like
+// http://localhost:8500. The token can be empty if ACLs are disabled.
+func NewConsulRegistry(url, token string) *ConsulRegistry {
+	return &ConsulRegistry{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func consulServiceID(service string) string {
+	return "gladius-" + service
+}
+
+// Register registers the service and passes its check
+func (cr *ConsulRegistry) Register(r Registration, ttl time.Duration) error {
+	body := map[string]interface{}{
+		"ID":      consulServiceID(r.Service),
+		"Name":    r.Service,
+		"Address": r.Address,
+		"Port":    r.Port,
+		"Tags":    r.Tags,
+		"Check": map[string]interface{}{
+			"CheckID": consulServiceID(r.Service),
+			"TTL":     ttl.String(),
+			// Clean up after a guardian that went away without deregistering
+			"DeregisterCriticalServiceAfter": (10 * ttl).String(),
+		},
+	}
+	if err := cr.put("/v1/agent/service/register", body); err != nil {
+		return err
+	}
+	return cr.Refresh(r.Service)
+}
+
+// Refresh passes the service's TTL check
+func (cr *ConsulRegistry) Refresh(service string) error {
+	return cr.put("/v1/agent/check/pass/"+consulServiceID(service), nil)
+}
+
+// Deregister removes the service and its check
+func (cr *ConsulRegistry) Deregister(service string) error {
+	return cr.put("/v1/agent/service/deregister/"+consulServiceID(service), nil)
+}
+
+func (cr *ConsulRegistry) put(path string, body interface{}) error {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("PUT", cr.url+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if cr.token != "" {
+		req.Header.Set("X-Consul-Token", cr.token)
+	}
+
+	resp, err := cr.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error talking to consul: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("consul returned %s for %s", resp.Status, path)
+	}
+	return nil
+}
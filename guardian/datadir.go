@@ -0,0 +1,107 @@
+package guardian
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// checkDataDir returns an error if the data directory options don't make
+// sense
+func checkDataDir(opts ServiceOptions) error {
+	if opts.DataDir == "" {
+		if opts.Chroot || opts.ConfineToDataDir || opts.DataDirOwner != "" {
+			return errors.New("no data directory set")
+		}
+		return nil
+	}
+	if !filepath.IsAbs(opts.DataDir) {
+		return fmt.Errorf("data directory %q isn't absolute", opts.DataDir)
+	}
+	if opts.DataDirOwner != "" {
+		if _, _, err := parseOwner(opts.DataDirOwner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareDataDir creates the service's data directory if it doesn't exist
+// yet, owned by DataDirOwner
+func prepareDataDir(name string, opts ServiceOptions) error {
+	if opts.DataDir == "" {
+		return nil
+	}
+	if _, err := os.Stat(opts.DataDir); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(opts.DataDir, 0750); err != nil {
+		return err
+	}
+	if opts.DataDirOwner != "" {
+		uid, gid, err := parseOwner(opts.DataDirOwner)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(opts.DataDir, uid, gid); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"data_dir":     opts.DataDir,
+		"owner":        opts.DataDirOwner,
+	}).Info("Created data directory")
+	return nil
+}
+
+// parseOwner looks up an owner like "gladius", "gladius:gladius" or
+// "1000:1000", without a group it's the user's primary one
+func parseOwner(owner string) (int, int, error) {
+	userName, groupName, hasGroup := strings.Cut(owner, ":")
+	uid, err := strconv.Atoi(userName)
+	gid := -1
+	if err != nil {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, fmt.Errorf("user %s doesn't have a numeric id", userName)
+		}
+		if !hasGroup {
+			if gid, err = strconv.Atoi(u.Gid); err != nil {
+				return 0, 0, fmt.Errorf("user %s doesn't have a numeric group id", userName)
+			}
+		}
+	}
+	if hasGroup {
+		if gid, err = strconv.Atoi(groupName); err != nil {
+			g, err := user.LookupGroup(groupName)
+			if err != nil {
+				return 0, 0, err
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return 0, 0, fmt.Errorf("group %s doesn't have a numeric id", groupName)
+			}
+		}
+	}
+	return uid, gid, nil
+}
+
+// hostPath returns where a path the service sees is outside its chroot
+func hostPath(opts ServiceOptions, path string) string {
+	if !opts.Chroot || path == "" {
+		return path
+	}
+	return filepath.Join(opts.DataDir, path)
+}
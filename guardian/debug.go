@@ -0,0 +1,73 @@
+package guardian
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+var publishOnce sync.Once
+
+// publishExpvars publishes the guardian's internal counters to expvar, it can
+// only be done once per process since expvar names are global
+func (gg *GladiusGuardian) publishExpvars() {
+	publishOnce.Do(func() {
+		expvar.Publish("goroutines", expvar.Func(func() interface{} {
+			return runtime.NumGoroutine()
+		}))
+		expvar.Publish("guardian", expvar.Func(func() interface{} {
+			return gg.debugCounters()
+		}))
+	})
+}
+
+type serviceCounters struct {
+	websocketMetrics
+	LogLines int `json:"log_lines"`
+	LogBytes int `json:"log_bytes"`
+}
+
+func (gg *GladiusGuardian) debugCounters() map[string]*serviceCounters {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	counters := make(map[string]*serviceCounters)
+	for name := range gg.registeredServices {
+		c := &serviceCounters{websocketMetrics: gg.logClients.metrics(name)}
+		if fsl := gg.logs.get(name); fsl != nil {
+			c.LogLines, c.LogBytes = fsl.Len(), fsl.Bytes()
+		}
+		counters[name] = c
+	}
+	return counters
+}
+
+// ExpvarHandler serves the published expvar variables
+func ExpvarHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	gg.publishExpvars()
+	return expvar.Handler().ServeHTTP
+}
+
+// PprofHandler serves the net/http/pprof profiles
+func PprofHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch profile := mux.Vars(r)["profile"]; profile {
+		case "":
+			pprof.Index(w, r)
+		case "cmdline":
+			pprof.Cmdline(w, r)
+		case "profile":
+			pprof.Profile(w, r)
+		case "symbol":
+			pprof.Symbol(w, r)
+		case "trace":
+			pprof.Trace(w, r)
+		default:
+			pprof.Handler(profile).ServeHTTP(w, r)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package guardian
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Free space below which the data directory is reported as a problem, unless
+// SetupDiagnostics says otherwise
+const defaultMinFreeSpace = 512 << 20
+
+// How far the wall clock can drift from the monotonic one since the guardian
+// started before it's reported as jumping
+const maxClockDrift = time.Minute
+
+// Earliest time the clock can sanely be at, anything before it means the
+// clock was never set, like on a board without a battery backed clock
+var earliestSaneTime = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// DiagnosticResult is the outcome of one check run by Doctor
+type DiagnosticResult struct {
+	Check   string `json:"check"`
+	Service string `json:"service,omitempty"`
+	OK      bool   `json:"ok"`
+	Detail  string `json:"detail"`
+}
+
+// DiagnosticReport is everything Doctor found, for attaching to support
+// requests
+type DiagnosticReport struct {
+	OK      bool               `json:"ok"`
+	Time    time.Time          `json:"time"`
+	Version string             `json:"version"`
+	OS      string             `json:"os"`
+	Results []DiagnosticResult `json:"results"`
+}
+
+type diagnosticSettings struct {
+	dataDir      string
+	minFreeSpace uint64
+}
+
+// SetupDiagnostics sets the data directory whose free space Doctor checks and
+// how much has to be left, 0 uses the default of 512MB
+func (gg *GladiusGuardian) SetupDiagnostics(dataDir string, minFreeSpace uint64) {
+	if minFreeSpace == 0 {
+		minFreeSpace = defaultMinFreeSpace
+	}
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+	gg.diagnostics = diagnosticSettings{dataDir: dataDir, minFreeSpace: minFreeSpace}
+}
+
+// Doctor checks the things that commonly keep services from working: space
+// left in the data directory, the executables of every registered service,
+// whether their ports are free and whether the clock is sane
+func (gg *GladiusGuardian) Doctor() *DiagnosticReport {
+	report := &DiagnosticReport{
+		OK:      true,
+		Time:    time.Now(),
+		Version: Version,
+		OS:      runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	add := func(check, service string, err error, detail string) {
+		result := DiagnosticResult{Check: check, Service: service, OK: err == nil, Detail: detail}
+		if err != nil {
+			result.Detail = err.Error()
+			report.OK = false
+		}
+		report.Results = append(report.Results, result)
+	}
+
+	gg.mux.Lock()
+	settings := gg.diagnostics
+	gg.mux.Unlock()
+	if settings.dataDir != "" {
+		detail, err := checkDiskSpace(settings.dataDir, settings.minFreeSpace)
+		add("disk_space", "", err, detail)
+	}
+
+	for _, name := range gg.registeredNames() {
+		gg.mux.Lock()
+		ss := gg.registeredServices[name]
+		running := gg.services[name] != nil
+		gg.mux.Unlock()
+		if ss == nil {
+			continue // Unregistered since
+		}
+
+		if backendName(ss.opts) == BackendExec {
+			detail, err := checkExecutable(ss.execName)
+			add("executable", name, err, detail)
+		}
+		if len(ss.opts.Ports) > 0 {
+			if running {
+				add("ports", name, nil, "in use by the running service")
+			} else {
+				add("ports", name, checkPorts(ss.opts.Ports), "free")
+			}
+		}
+	}
+
+	detail, err := checkClock(report.Time)
+	add("clock", "", err, detail)
+	return report
+}
+
+// registeredNames returns every registered service, disabled ones included,
+// in a stable order
+func (gg *GladiusGuardian) registeredNames() []string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+	names := make([]string, 0, len(gg.registeredServices))
+	for name := range gg.registeredServices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func checkDiskSpace(dir string, minFree uint64) (string, error) {
+	free, total, err := diskSpace(dir)
+	if err != nil {
+		return "", fmt.Errorf("couldn't get free space of %s: %s", dir, err)
+	}
+	detail := fmt.Sprintf("%s free of %s in %s", formatBytes(free), formatBytes(total), dir)
+	if free < minFree {
+		return "", fmt.Errorf("only %s, at least %s is needed", detail, formatBytes(minFree))
+	}
+	return detail, nil
+}
+
+func checkExecutable(execName string) (string, error) {
+	if execName == "" {
+		return "", fmt.Errorf("no executable configured")
+	}
+	path, err := exec.LookPath(execName)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s (%s)", path, fi.Mode()), nil
+}
+
+// checkClock catches a clock that was never set and one that jumped since the
+// guardian started, comparing the wall clock with the monotonic one
+func checkClock(now time.Time) (string, error) {
+	if now.Before(earliestSaneTime) {
+		return "", fmt.Errorf("clock is at %s, it was probably never set", now.Format(time.RFC3339))
+	}
+	drift := now.Round(0).Sub(startedAt.Round(0)) - now.Sub(startedAt)
+	if drift > maxClockDrift || drift < -maxClockDrift {
+		return "", fmt.Errorf("clock jumped by %s since the guardian started", drift.Round(time.Second))
+	}
+	return fmt.Sprintf("%s, drifted %s since the guardian started", now.Format(time.RFC3339), drift.Round(time.Millisecond)), nil
+}
+
+func formatBytes(b uint64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := uint64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
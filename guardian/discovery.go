@@ -0,0 +1,128 @@
+package guardian
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Registration is a running service as advertised to service discovery
+type Registration struct {
+	Service string   `json:"service"`
+	Address string   `json:"address,omitempty"`
+	Port    int      `json:"port,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	Status  string   `json:"status"`
+}
+
+// ServiceRegistry is a service discovery backend. Registrations expire unless
+// they're refreshed within the TTL, so services of a guardian that dies don't
+// linger.
+type ServiceRegistry interface {
+	Register(r Registration, ttl time.Duration) error
+	Refresh(service string) error
+	Deregister(service string) error
+}
+
+type discovery struct {
+	gg       *GladiusGuardian
+	registry ServiceRegistry
+	address  string
+	tags     []string
+	ttl      time.Duration
+
+	mux        sync.Mutex
+	registered map[string]bool
+}
+
+// SetupDiscovery registers services with the registry once they're up and
+// deregisters them when they stop. address is the address advertised for
+// them, empty lets the registry decide.
+func (gg *GladiusGuardian) SetupDiscovery(registry ServiceRegistry, address string, tags []string, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = 30 * time.Second
+	}
+	d := &discovery{
+		gg:         gg,
+		registry:   registry,
+		address:    address,
+		tags:       tags,
+		ttl:        ttl,
+		registered: make(map[string]bool),
+	}
+	gg.AddEventPublisher(d)
+
+	go func() {
+		for range time.Tick(ttl / 3) {
+			d.refresh()
+		}
+	}()
+}
+
+// Publish registers or deregisters the service the event is about
+func (d *discovery) Publish(ev Event) error {
+	switch ev.Type {
+	case EventStarted:
+		r := Registration{
+			Service: ev.Service,
+			Address: d.address,
+			Port:    d.gg.advertisedPort(ev.Service),
+			Tags:    d.tags,
+			Status:  "running",
+		}
+		if err := d.registry.Register(r, d.ttl); err != nil {
+			return err
+		}
+		d.mux.Lock()
+		d.registered[ev.Service] = true
+		d.mux.Unlock()
+	case EventStopped, EventExited, EventCrashed:
+		d.mux.Lock()
+		delete(d.registered, ev.Service)
+		d.mux.Unlock()
+		return d.registry.Deregister(ev.Service)
+	}
+	return nil
+}
+
+func (d *discovery) refresh() {
+	d.mux.Lock()
+	services := make([]string, 0, len(d.registered))
+	for service := range d.registered {
+		services = append(services, service)
+	}
+	d.mux.Unlock()
+
+	for _, service := range services {
+		if err := d.registry.Refresh(service); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": service,
+				"err":          err,
+			}).Warn("Couldn't refresh service registration")
+		}
+	}
+}
+
+// advertisedPort picks the port to advertise for a service: the first of its
+// configured ports, or else its first allocated port
+func (gg *GladiusGuardian) advertisedPort(service string) int {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[service]
+	gg.mux.Unlock()
+	if ok && len(settings.opts.Ports) > 0 {
+		return settings.opts.Ports[0]
+	}
+
+	allocated := gg.AllocatedPorts(service)
+	names := make([]string, 0, len(allocated))
+	for name := range allocated {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return 0
+	}
+	sort.Strings(names)
+	return allocated[names[0]]
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package guardian
+
+import "syscall"
+
+// diskSpace returns the bytes free for unprivileged users and the size of the
+// filesystem path is on
+func diskSpace(path string) (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
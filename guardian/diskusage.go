@@ -0,0 +1,117 @@
+package guardian
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DiskUsage is how much a service's data directory takes up and how much is
+// left on the filesystem it's on, as of the last scan
+type DiskUsage struct {
+	Path       string    `json:"path"`
+	Bytes      int64     `json:"bytes"`
+	Files      int64     `json:"files"`
+	FreeBytes  uint64    `json:"free_bytes,omitempty"`
+	TotalBytes uint64    `json:"total_bytes,omitempty"`
+	Scanned    time.Time `json:"scanned"`
+}
+
+// diskUsage holds what the last scan found for each service
+type diskUsage struct {
+	mux   sync.Mutex
+	usage map[string]DiskUsage
+}
+
+func (du *diskUsage) get(service string) *DiskUsage {
+	du.mux.Lock()
+	defer du.mux.Unlock()
+	u, ok := du.usage[service]
+	if !ok {
+		return nil
+	}
+	return &u
+}
+
+func (du *diskUsage) snapshot() map[string]DiskUsage {
+	du.mux.Lock()
+	defer du.mux.Unlock()
+	snapshot := make(map[string]DiskUsage, len(du.usage))
+	for name, u := range du.usage {
+		snapshot[name] = u
+	}
+	return snapshot
+}
+
+func (du *diskUsage) set(usage map[string]DiskUsage) {
+	du.mux.Lock()
+	defer du.mux.Unlock()
+	du.usage = usage
+}
+
+// StartDiskUsageScan measures the data directory of every service that has
+// one every interval. The sizes are reported in the status of each service
+// and to StatsD, and checked by data_dir_size and disk_free alert rules.
+func (gg *GladiusGuardian) StartDiskUsageScan(interval time.Duration) {
+	go func() {
+		gg.scanDiskUsage()
+		for range time.Tick(interval) {
+			gg.scanDiskUsage()
+		}
+	}()
+}
+
+func (gg *GladiusGuardian) scanDiskUsage() {
+	dirs := make(map[string]string)
+	gg.mux.Lock()
+	for name, settings := range gg.registeredServices {
+		if settings.opts.DataDir != "" {
+			dirs[name] = settings.opts.DataDir
+		}
+	}
+	gg.mux.Unlock()
+
+	usage := make(map[string]DiskUsage, len(dirs))
+	for name, dir := range dirs {
+		u := DiskUsage{Path: dir, Scanned: time.Now()}
+		var err error
+		if u.Bytes, u.Files, err = dirSize(dir); err != nil {
+			if !os.IsNotExist(err) {
+				log.WithFields(log.Fields{
+					"service_name": name,
+					"data_dir":     dir,
+					"err":          err,
+				}).Warn("Couldn't measure data directory")
+			}
+			continue // Not created until the service first starts
+		}
+		u.FreeBytes, u.TotalBytes, _ = diskSpace(dir)
+		usage[name] = u
+	}
+	gg.diskUsage.set(usage)
+}
+
+// dirSize adds up the size of every file under dir, symlinks aren't followed
+func dirSize(dir string) (int64, int64, error) {
+	if _, err := os.Lstat(dir); err != nil {
+		return 0, 0, err
+	}
+	var bytes, files int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil // Removed while walking
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			bytes += info.Size()
+			files++
+		}
+		return nil
+	})
+	return bytes, files, err
+}
@@ -0,0 +1,442 @@
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/tracing"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Label set on every container the guardian creates, holding the service name
+const containerServiceLabel = "io.gladius.guardian.service"
+
+// dockerClient talks to the Docker Engine API
+type dockerClient struct {
+	base   string
+	client *http.Client
+}
+
+// newDockerClient returns a client for the daemon at host, either
+// unix:///path/to/docker.sock or tcp://host:port
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %s", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &dockerClient{base: "http://docker", client: &http.Client{Transport: transport}}, nil
+	case "tcp", "http":
+		return &dockerClient{base: "http://" + u.Host, client: &http.Client{}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported docker host %q, must be unix:// or tcp://", host)
+	}
+}
+
+// dockerError is an error response from the daemon
+type dockerError struct {
+	status  int
+	Message string `json:"message"`
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker: %s (status %d)", e.Message, e.status)
+}
+
+func isDockerStatus(err error, status int) bool {
+	var de *dockerError
+	return errors.As(err, &de) && de.status == status
+}
+
+// do sends a request to the daemon and decodes the JSON response into out if
+// it isn't nil
+func (dc *dockerClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := dc.stream(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stream sends a request and returns the response for the caller to read, it
+// must be closed
+func (dc *dockerClient) stream(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, dc.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error talking to docker: %s", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		de := &dockerError{status: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(de); err != nil || de.Message == "" {
+			de.Message = http.StatusText(resp.StatusCode)
+		}
+		return nil, de
+	}
+	return resp, nil
+}
+
+// pull pulls an image, the daemon streams progress and reports failures in
+// the stream rather than the status code
+func (dc *dockerClient) pull(ctx context.Context, image string) error {
+	resp, err := dc.stream(ctx, "POST", "/images/create?fromImage="+url.QueryEscape(image), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var progress struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&progress); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if progress.Error != "" {
+			return fmt.Errorf("error pulling %s: %s", image, progress.Error)
+		}
+	}
+}
+
+type containerConfig struct {
+	Image        string
+	Cmd          []string `json:",omitempty"`
+	Env          []string
+	WorkingDir   string `json:",omitempty"`
+	Labels       map[string]string
+	ExposedPorts map[string]struct{} `json:",omitempty"`
+	HostConfig   hostConfig
+}
+
+type hostConfig struct {
+	Binds        []string                 `json:",omitempty"`
+	PortBindings map[string][]portBinding `json:",omitempty"`
+	OomScoreAdj  int                      `json:",omitempty"`
+	CpusetCpus   string                   `json:",omitempty"`
+
+	ReadonlyRootfs bool     `json:",omitempty"`
+	SecurityOpt    []string `json:",omitempty"`
+	CapAdd         []string `json:",omitempty"`
+	CapDrop        []string `json:",omitempty"`
+}
+
+type portBinding struct {
+	HostIP   string `json:"HostIp,omitempty"`
+	HostPort string
+}
+
+// parsePublishPorts turns [[ip:]host:]container[/protocol] mappings into the
+// exposed ports and port bindings of a container
+func parsePublishPorts(mappings []string) (map[string]struct{}, map[string][]portBinding, error) {
+	if len(mappings) == 0 {
+		return nil, nil, nil
+	}
+
+	exposed := make(map[string]struct{})
+	bindings := make(map[string][]portBinding)
+	for _, m := range mappings {
+		spec, proto := m, "tcp"
+		if i := strings.LastIndex(m, "/"); i >= 0 {
+			spec, proto = m[:i], m[i+1:]
+		}
+
+		parts := strings.Split(spec, ":")
+		var b portBinding
+		var containerPort string
+		switch len(parts) {
+		case 1: // Docker picks the host port
+			containerPort = parts[0]
+		case 2:
+			b.HostPort, containerPort = parts[0], parts[1]
+		case 3:
+			b.HostIP, b.HostPort, containerPort = parts[0], parts[1], parts[2]
+		default:
+			return nil, nil, fmt.Errorf("invalid port mapping %q, must be [[ip:]host:]container[/protocol]", m)
+		}
+
+		key := containerPort + "/" + proto
+		exposed[key] = struct{}{}
+		bindings[key] = append(bindings[key], b)
+	}
+	return exposed, bindings, nil
+}
+
+// containerInstance is a service running as a Docker container
+type containerInstance struct {
+	client  *dockerClient
+	id      string
+	image   string
+	envVars []string
+	mainPID int
+
+	stderrTail *lineTail // Last lines the container wrote to stderr
+}
+
+func (ci *containerInstance) pid() int         { return ci.mainPID }
+func (ci *containerInstance) env() []string    { return ci.envVars }
+func (ci *containerInstance) location() string { return "docker://" + ci.image }
+
+func (ci *containerInstance) kill() error {
+	return ci.client.do(context.Background(), "POST", "/containers/"+ci.id+"/kill", nil, nil)
+}
+
+// signal has docker send sig to the container's main process
+func (ci *containerInstance) signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("can't send %s to a container", sig)
+	}
+	path := "/containers/" + ci.id + "/kill?signal=" + strconv.Itoa(int(s))
+	return ci.client.do(context.Background(), "POST", path, nil, nil)
+}
+
+// spawnContainer replaces any old container of the service with a new one
+// from its image, streams its logs like a process's and watches for it to exit
+func (gg *GladiusGuardian) spawnContainer(ctx context.Context, name string, opts ServiceOptions, env []string, timeout *time.Duration) (_ instance, err error) {
+	ctx, span := tracing.Start(ctx, "guardian.spawnContainer")
+	span.SetAttribute("service.name", name)
+	span.SetAttribute("container.image", opts.Image)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	release, err := gg.spawns.acquire(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	dc, err := newDockerClient(viper.GetString("DockerHost"))
+	if err != nil {
+		return nil, err
+	}
+
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" {
+		env = append(append([]string{}, env...), "TRACEPARENT="+traceParent)
+	}
+
+	exposed, bindings, err := parsePublishPorts(opts.PublishPorts)
+	if err != nil {
+		return nil, err
+	}
+	config := containerConfig{
+		Image:        opts.Image,
+		Cmd:          opts.Args,
+		Env:          env,
+		WorkingDir:   opts.WorkingDir,
+		Labels:       map[string]string{containerServiceLabel: name},
+		ExposedPorts: exposed,
+		HostConfig: hostConfig{
+			Binds:          opts.Volumes,
+			PortBindings:   bindings,
+			OomScoreAdj:    opts.OOMScoreAdjust,
+			CpusetCpus:     opts.CPUAffinity,
+			ReadonlyRootfs: opts.ReadOnlyRoot,
+		},
+	}
+	if opts.NoNewPrivileges {
+		config.HostConfig.SecurityOpt = append(config.HostConfig.SecurityOpt, "no-new-privileges")
+	}
+	if opts.SeccompProfile != "" {
+		// The API takes the profile itself rather than a path to it
+		profile, err := ioutil.ReadFile(opts.SeccompProfile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read seccomp profile: %s", err)
+		}
+		config.HostConfig.SecurityOpt = append(config.HostConfig.SecurityOpt, "seccomp="+string(profile))
+	}
+	if opts.AppArmorProfile != "" {
+		config.HostConfig.SecurityOpt = append(config.HostConfig.SecurityOpt, "apparmor="+opts.AppArmorProfile)
+	}
+	if len(opts.Capabilities) > 0 {
+		config.HostConfig.CapDrop = []string{"ALL"}
+		for _, c := range opts.Capabilities {
+			config.HostConfig.CapAdd = append(config.HostConfig.CapAdd, canonicalCapability(c))
+		}
+	}
+
+	outSink, errSink, err := openOutput(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	streaming := false
+	defer func() {
+		if !streaming {
+			outSink.close()
+			errSink.close()
+		}
+	}()
+
+	// Left over from a previous run, or an unclean shutdown
+	containerName := "gladius-" + name
+	err = dc.do(ctx, "DELETE", "/containers/"+containerName+"?force=1", nil, nil)
+	if err != nil && !isDockerStatus(err, http.StatusNotFound) {
+		return nil, fmt.Errorf("error removing old container: %s", err)
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	createPath := "/containers/create?name=" + containerName
+	err = dc.do(ctx, "POST", createPath, config, &created)
+	if isDockerStatus(err, http.StatusNotFound) {
+		if err := dc.pull(ctx, opts.Image); err != nil {
+			return nil, err
+		}
+		err = dc.do(ctx, "POST", createPath, config, &created)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating container: %s", err)
+	}
+
+	ci := &containerInstance{client: dc, id: created.ID, image: opts.Image, envVars: env, stderrTail: newLineTail()}
+	if err := dc.do(ctx, "POST", "/containers/"+ci.id+"/start", nil, nil); err != nil {
+		dc.do(context.Background(), "DELETE", "/containers/"+ci.id+"?force=1", nil, nil)
+		log.WithFields(log.Fields{
+			"image": opts.Image,
+			"err":   err,
+		}).Warn("Couldn't start container")
+		return nil, fmt.Errorf("Error starting container: %s", err)
+	}
+
+	var inspect struct {
+		State struct {
+			Pid int
+		}
+	}
+	if err := dc.do(ctx, "GET", "/containers/"+ci.id+"/json", nil, &inspect); err == nil {
+		ci.mainPID = inspect.State.Pid
+	}
+
+	streaming = true
+	go gg.streamContainerLogs(name, ci, outSink, errSink)
+
+	exited := make(chan struct{})
+	var waitErr error
+	go gg.watchExit(name, ci, func() error {
+		defer close(exited)
+		waitErr = ci.wait()
+		dc.do(context.Background(), "DELETE", "/containers/"+ci.id+"?force=1", nil, nil)
+		return waitErr
+	})
+
+	// Wait for the container to start
+	select {
+	case <-time.After(*timeout):
+		return ci, nil
+	case <-exited:
+		return nil, newStartupError(name, waitErr, ci.stderrTail)
+	}
+}
+
+// wait blocks until the container exits, returning an error if it exited
+// with a non zero status
+func (ci *containerInstance) wait() error {
+	var result struct {
+		StatusCode int
+		Error      *struct {
+			Message string
+		}
+	}
+	err := ci.client.do(context.Background(), "POST", "/containers/"+ci.id+"/wait", nil, &result)
+	if err != nil {
+		return err
+	}
+	if result.Error != nil && result.Error.Message != "" {
+		return errors.New(result.Error.Message)
+	}
+	if result.StatusCode != 0 {
+		return &exitCodeError{code: result.StatusCode}
+	}
+	return nil
+}
+
+// streamContainerLogs sends the container's output to the sinks. The stream
+// is multiplexed, each frame has an 8 byte header with its length.
+func (gg *GladiusGuardian) streamContainerLogs(name string, ci *containerInstance, outSink, errSink *outputSink) {
+	resp, err := ci.client.stream(context.Background(), "GET",
+		"/containers/"+ci.id+"/logs?follow=1&stdout=1&stderr=1", nil)
+	if err != nil {
+		outSink.close()
+		errSink.close()
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"err":          err,
+		}).Warn("Couldn't stream container logs")
+		return
+	}
+	defer resp.Body.Close()
+
+	stdOut, outWriter := io.Pipe()
+	stdErr, errWriter := io.Pipe()
+	go gg.readLog(name, stdOut, outSink, nil)
+	go gg.readLog(name, stdErr, errSink, ci.stderrTail)
+	defer outWriter.Close()
+	defer errWriter.Close()
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(resp.Body, header); err != nil {
+			return
+		}
+		w := outWriter
+		if header[0] == 2 {
+			w = errWriter
+		}
+		if _, err := io.CopyN(w, resp.Body, int64(binary.BigEndian.Uint32(header[4:]))); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package guardian
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// StartServiceDryRun checks whether the service (or all of them) could be
+// started, along with whatever it depends on, without starting anything. It
+// returns every problem found by service name, empty if there are none.
+func (gg *GladiusGuardian) StartServiceDryRun(name string) map[string][]string {
+	if name == "all" || name == "" {
+		return gg.StartServicesDryRun(gg.serviceNames(name))
+	}
+	return gg.dryRun(gg.startOrder([]string{name}), name)
+}
+
+// StartServicesDryRun is StartServiceDryRun for a list of services, like the
+// ones SelectServices picked
+func (gg *GladiusGuardian) StartServicesDryRun(names []string) map[string][]string {
+	return gg.dryRun(gg.stateChangeOrder(names, true), "")
+}
+
+// dryRun checks the services in the order they'd be started, name is the one
+// that was asked for if it was just one
+func (gg *GladiusGuardian) dryRun(order []string, name string) map[string][]string {
+	problems := make(map[string][]string)
+	for _, sName := range order {
+		// Dependencies that are already up are fine, they're left running
+		if p := gg.startProblems(sName, sName == name); len(p) > 0 {
+			problems[sName] = p
+		}
+	}
+	return problems
+}
+
+// startProblems returns what would keep the service from starting
+func (gg *GladiusGuardian) startProblems(name string, mustBeStopped bool) []string {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	running := gg.services[name] != nil
+	gg.mux.Unlock()
+	if !ok {
+		return []string{"service isn't registered"}
+	}
+
+	problems := make([]string, 0)
+	if running && mustBeStopped {
+		problems = append(problems, ErrAlreadyRunning.Error())
+	}
+	problems = append(problems, gg.settingsProblems(name, settings)...)
+
+	// Ports the service is already listening on will be free once it stops
+	if !running {
+		if err := checkPorts(settings.opts.Ports); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// settingsProblems returns what's wrong with how the service is set up,
+// whatever else is running
+func (gg *GladiusGuardian) settingsProblems(name string, settings *serviceSettings) []string {
+	problems := make([]string, 0)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	opts := settings.opts
+
+	if _, err := lookupBackend(opts); err != nil {
+		add("%s", err)
+	}
+	if backendName(opts) == BackendExec {
+		if settings.execName == "" {
+			add("no executable configured")
+		} else if opts.Chroot && !filepath.IsAbs(settings.execName) {
+			add("executable %s of a chrooted service has to be an absolute path", settings.execName)
+		} else if _, err := exec.LookPath(hostPath(opts, settings.execName)); err != nil {
+			add("executable %s can't be run: %s", settings.execName, err)
+		}
+		if opts.WorkingDir != "" {
+			if fi, err := os.Stat(hostPath(opts, opts.WorkingDir)); err != nil {
+				add("working directory: %s", err)
+			} else if !fi.IsDir() {
+				add("working directory %s isn't a directory", opts.WorkingDir)
+			}
+		}
+	}
+
+	if err := checkOutput(StreamStdout, opts.Stdout); err != nil {
+		add("%s", err)
+	}
+	if err := checkOutput(StreamStderr, opts.Stderr); err != nil {
+		add("%s", err)
+	}
+	if err := checkLogFile(opts.LogFile); err != nil {
+		add("%s", err)
+	}
+	if err := checkGELFFields(opts.GELFFields); err != nil {
+		add("%s", err)
+	}
+	if err := checkScheduling(opts); err != nil {
+		add("%s", err)
+	}
+	if err := checkSandbox(opts); err != nil {
+		add("%s", err)
+	}
+
+	env, errs := checkEnv(name, gg.startEnv(settings, nil))
+	problems = append(problems, errs...)
+	if missing := missingEnv(env, opts.RequiredEnv); len(missing) > 0 {
+		add("missing environment variables: %s", strings.Join(missing, ", "))
+	}
+
+	for _, addr := range opts.WaitForAddresses {
+		if _, port, err := net.SplitHostPort(addr); err != nil {
+			add("address to wait for %q: %s", addr, err)
+		} else if _, err := strconv.Atoi(port); err != nil {
+			add("address to wait for %q doesn't have a numeric port", addr)
+		}
+	}
+	if opts.ReadyPath != "" && !strings.HasPrefix(opts.ReadyPath, "/") {
+		add("ready path %q has to start with a /", opts.ReadyPath)
+	}
+	if opts.ProxyURL != "" {
+		if u, err := url.Parse(opts.ProxyURL); err != nil {
+			add("proxy URL: %s", err)
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("proxy URL %q has to be an http or https URL", opts.ProxyURL)
+		}
+	}
+	switch opts.ReloadStrategy {
+	case "", ReloadRestart, ReloadSignal:
+	default:
+		add("unknown reload strategy %q", opts.ReloadStrategy)
+	}
+	if _, err := parseSignal(opts.ReloadSignal); err != nil {
+		add("reload signal: %s", err)
+	}
+
+	return problems
+}
+
+// checkEnv returns the environment with its templates filled in using
+// placeholder ports, so nothing is allocated, along with any malformed entries
+func checkEnv(service string, env []string) ([]string, []string) {
+	funcs := template.FuncMap{
+		"port": func(name string) int { return 0 },
+	}
+
+	expanded := make([]string, 0, len(env))
+	problems := make([]string, 0)
+	for _, e := range env {
+		if strings.Index(e, "=") <= 0 {
+			problems = append(problems, fmt.Sprintf("environment variable %q isn't in KEY=value form", e))
+			continue
+		}
+		if !strings.Contains(e, "{{") {
+			expanded = append(expanded, e)
+			continue
+		}
+
+		t, err := template.New(service).Funcs(funcs).Parse(e)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("bad template in environment variable %q: %s", e, err))
+			continue
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, nil); err != nil {
+			problems = append(problems, fmt.Sprintf("error expanding environment variable %q: %s", e, err))
+			continue
+		}
+		expanded = append(expanded, buf.String())
+	}
+	return expanded, problems
+}
+
+// missingEnv returns the names in required that aren't set in env
+func missingEnv(env, required []string) []string {
+	set := make(map[string]bool)
+	for _, e := range env {
+		set[strings.SplitN(e, "=", 2)[0]] = true
+	}
+
+	missing := make([]string, 0)
+	for _, name := range required {
+		if !set[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
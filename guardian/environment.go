@@ -0,0 +1,72 @@
+package guardian
+
+import (
+	"os"
+	"strings"
+)
+
+// A service is started with an environment built from these layers, each
+// overriding the variables of the ones before it:
+//
+//  1. The guardian's own environment, only if the service has
+//     InheritEnvironment set
+//  2. The default environment, see SetDefaultEnvironment
+//  3. The environment the service was registered with, along with its active
+//     environment set, see serviceEnv
+//  4. The variables given to the start itself, like the environment_vars of
+//     a set_state request
+//
+// Variables keep the position they first appeared at, with the value of the
+// last layer that sets them.
+
+// SetDefaultEnvironment sets the variables every service is started with
+// unless it sets them itself
+func (gg *GladiusGuardian) SetDefaultEnvironment(env []string) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+	gg.defaultEnv = append([]string{}, env...)
+}
+
+// configuredEnv returns the default environment overridden by the service's
+// own, what the service is started with before anything given to the start
+func (gg *GladiusGuardian) configuredEnv(settings *serviceSettings) []string {
+	gg.mux.Lock()
+	defaultEnv := gg.defaultEnv
+	gg.mux.Unlock()
+	return mergeEnv(defaultEnv, gg.serviceEnv(settings))
+}
+
+// startEnv returns the environment to start the service with, overridden by
+// the variables given to the start
+func (gg *GladiusGuardian) startEnv(settings *serviceSettings, callEnv []string) []string {
+	var inherited []string
+	if settings.opts.InheritEnvironment {
+		inherited = os.Environ()
+	}
+	return mergeEnv(inherited, gg.configuredEnv(settings), callEnv)
+}
+
+// mergeEnv merges the layers of KEY=value variables, later layers winning
+func mergeEnv(layers ...[]string) []string {
+	size := 0
+	for _, layer := range layers {
+		size += len(layer)
+	}
+	merged := make([]string, 0, size)
+	index := make(map[string]int, size)
+	for _, layer := range layers {
+		for _, v := range layer {
+			key := v
+			if i := strings.Index(v, "="); i >= 0 {
+				key = v[:i]
+			}
+			if i, ok := index[key]; ok {
+				merged[i] = v
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,100 @@
+package guardian
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]string
+		want   []string
+	}{
+		{"empty", nil, []string{}},
+		{"one layer", [][]string{{"A=1", "B=2"}}, []string{"A=1", "B=2"}},
+		{"later layer wins", [][]string{{"A=1"}, {"A=2"}}, []string{"A=2"}},
+		{"keeps first position", [][]string{{"A=1", "B=1"}, {"C=3", "A=2"}}, []string{"A=2", "B=1", "C=3"}},
+		{"variable without value", [][]string{{"A"}, {"A=1"}}, []string{"A=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeEnv(tt.layers...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeEnv() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartEnv(t *testing.T) {
+	os.Setenv("GG_TEST_INHERITED", "guardian")
+	os.Setenv("GG_TEST_SHARED", "guardian")
+	defer os.Unsetenv("GG_TEST_INHERITED")
+	defer os.Unsetenv("GG_TEST_SHARED")
+
+	tests := []struct {
+		name       string
+		inherit    bool
+		defaultEnv []string
+		serviceEnv []string
+		callEnv    []string
+		want       map[string]string // Missing when ""
+	}{
+		{
+			name: "not inherited",
+			want: map[string]string{"GG_TEST_INHERITED": "", "GG_TEST_SHARED": ""},
+		},
+		{
+			name:    "inherited",
+			inherit: true,
+			want:    map[string]string{"GG_TEST_INHERITED": "guardian", "GG_TEST_SHARED": "guardian"},
+		},
+		{
+			name:       "default overrides inherited",
+			inherit:    true,
+			defaultEnv: []string{"GG_TEST_SHARED=default"},
+			want:       map[string]string{"GG_TEST_INHERITED": "guardian", "GG_TEST_SHARED": "default"},
+		},
+		{
+			name:       "registration overrides default",
+			defaultEnv: []string{"GG_TEST_SHARED=default", "GG_TEST_DEFAULT=default"},
+			serviceEnv: []string{"GG_TEST_SHARED=service"},
+			want:       map[string]string{"GG_TEST_SHARED": "service", "GG_TEST_DEFAULT": "default"},
+		},
+		{
+			name:       "call overrides everything",
+			inherit:    true,
+			defaultEnv: []string{"GG_TEST_SHARED=default"},
+			serviceEnv: []string{"GG_TEST_SHARED=service"},
+			callEnv:    []string{"GG_TEST_SHARED=call"},
+			want:       map[string]string{"GG_TEST_INHERITED": "guardian", "GG_TEST_SHARED": "call"},
+		},
+		{
+			name:       "call adds variables",
+			serviceEnv: []string{"GG_TEST_SERVICE=service"},
+			callEnv:    []string{"GG_TEST_CALL=call"},
+			want:       map[string]string{"GG_TEST_SERVICE": "service", "GG_TEST_CALL": "call", "GG_TEST_INHERITED": ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gg := New()
+			gg.SetDefaultEnvironment(tt.defaultEnv)
+			settings := &serviceSettings{env: tt.serviceEnv, opts: ServiceOptions{InheritEnvironment: tt.inherit}}
+
+			got := make(map[string]string)
+			for _, v := range gg.startEnv(settings, tt.callEnv) {
+				if i := strings.Index(v, "="); i >= 0 {
+					got[v[:i]] = v[i+1:]
+				}
+			}
+			for key, want := range tt.want {
+				if got[key] != want {
+					t.Errorf("%s = %q, want %q", key, got[key], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoEnvSet is returned for an environment set that isn't defined
+var ErrNoEnvSet = errors.New("no environment set with that name")
+
+// envSets are named groups of environment variables, like the settings for
+// mainnet and testnet. One of them is active, services that list it in their
+// EnvSets get its variables on top of their own.
+type envSets struct {
+	mux    sync.Mutex
+	sets   map[string][]string
+	active string
+}
+
+// EnvSetStatus is the defined environment sets and the active one
+type EnvSetStatus struct {
+	Active string              `json:"active"`
+	Sets   map[string][]string `json:"sets"`
+}
+
+// SetEnvSets defines the environment sets and which one is active, without
+// touching running services
+func (gg *GladiusGuardian) SetEnvSets(sets map[string][]string, active string) error {
+	if _, ok := sets[active]; active != "" && !ok {
+		return fmt.Errorf("%w: %s", ErrNoEnvSet, active)
+	}
+
+	gg.envSets.mux.Lock()
+	defer gg.envSets.mux.Unlock()
+	gg.envSets.sets = make(map[string][]string, len(sets))
+	for name, env := range sets {
+		gg.envSets.sets[name] = append([]string{}, env...)
+	}
+	gg.envSets.active = active
+	return nil
+}
+
+// EnvSets returns the environment sets and which one is active
+func (gg *GladiusGuardian) EnvSets() EnvSetStatus {
+	gg.envSets.mux.Lock()
+	defer gg.envSets.mux.Unlock()
+	status := EnvSetStatus{Active: gg.envSets.active, Sets: make(map[string][]string, len(gg.envSets.sets))}
+	for name, env := range gg.envSets.sets {
+		status.Sets[name] = append([]string{}, env...)
+	}
+	return status
+}
+
+// SwitchEnvSet makes another environment set the active one and restarts the
+// running services that use the old or the new one, so they pick it up
+func (gg *GladiusGuardian) SwitchEnvSet(ctx context.Context, name string) ([]*ServiceResult, error) {
+	gg.envSets.mux.Lock()
+	if _, ok := gg.envSets.sets[name]; !ok {
+		gg.envSets.mux.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrNoEnvSet, name)
+	}
+	previous := gg.envSets.active
+	gg.envSets.active = name
+	gg.envSets.mux.Unlock()
+
+	log.WithFields(log.Fields{
+		"env_set":  name,
+		"previous": previous,
+	}).Info("Switched environment set")
+
+	affected := make([]string, 0)
+	gg.mux.Lock()
+	for sName, settings := range gg.registeredServices {
+		if gg.services[sName] != nil && (usesEnvSet(settings.opts, name) || usesEnvSet(settings.opts, previous)) {
+			affected = append(affected, sName)
+		}
+	}
+	gg.mux.Unlock()
+	sort.Strings(affected)
+
+	results := make([]*ServiceResult, 0, len(affected))
+	for _, sName := range affected {
+		results = append(results, gg.applyAction(ctx, ActionRestart, sName, nil, false))
+	}
+	gg.revision.bump()
+	return results, nil
+}
+
+func usesEnvSet(opts ServiceOptions, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, set := range opts.EnvSets {
+		if set == name {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceEnv returns the service's environment, with the variables of the
+// active environment set appended if the service uses it so they override
+// its own
+func (gg *GladiusGuardian) serviceEnv(settings *serviceSettings) []string {
+	gg.envSets.mux.Lock()
+	defer gg.envSets.mux.Unlock()
+	if !usesEnvSet(settings.opts, gg.envSets.active) {
+		return settings.env
+	}
+	env := make([]string, 0, len(settings.env)+len(gg.envSets.sets[gg.envSets.active]))
+	env = append(env, settings.env...)
+	return append(env, gg.envSets.sets[gg.envSets.active]...)
+}
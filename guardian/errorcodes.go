@@ -0,0 +1,131 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Machine readable codes of failed requests and of the failed services of bulk
+// requests. They're part of the API, new ones can be added but existing ones
+// must not change.
+const (
+	CodeBadRequest     = "bad_request"
+	CodeUnauthorized   = "unauthorized"
+	CodeForbidden      = "forbidden"
+	CodeNotFound       = "not_found"
+	CodeConflict       = "conflict"
+	CodeInvalid        = "invalid"
+	CodeRateLimited    = "rate_limited"
+	CodeTimeout        = "timeout"
+	CodeInternal       = "internal"
+	CodeBadGateway     = "bad_gateway"
+	CodeUnavailable    = "unavailable"
+	CodeFailed         = "failed"          // Anything else that went wrong with a service
+	CodePartialFailure = "partial_failure" // Some services of a bulk request failed, see the details
+
+	CodeNotRegistered     = "not_registered"
+	CodeAlreadyRegistered = "already_registered"
+	CodeDependencyCycle   = "dependency_cycle"
+	CodeNotRunning        = "not_running"
+	CodeAlreadyRunning    = "already_running"
+	CodeStartupFailed     = "startup_failed"
+	CodeStopTimedOut      = "stop_timed_out"
+	CodeSpawnRateLimited  = "spawn_rate_limited"
+	CodeNotLeader         = "not_leader"
+	CodePortInUse         = "port_in_use"
+	CodeNoTerminal        = "no_terminal"
+	CodeNoTemplate        = "no_template"
+	CodeNoEnvSet          = "no_env_set"
+	CodeNoBackup          = "no_backup"
+	CodeBadSignature      = "bad_signature"
+	CodeReadOnly          = "read_only"
+	CodePolicyDenied      = "policy_denied"
+	CodeNoAutomationRule  = "no_automation_rule"
+	CodeNoPhase           = "no_phase"
+	CodeUnsupported       = "unsupported_platform"
+)
+
+// The code of each error the guardian returns, checked in order with
+// errors.Is so wrapped errors get the code too
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrNotRegistered, CodeNotRegistered},
+	{ErrAlreadyRegistered, CodeAlreadyRegistered},
+	{ErrDependencyCycle, CodeDependencyCycle},
+	{ErrNotRunning, CodeNotRunning},
+	{ErrAlreadyRunning, CodeAlreadyRunning},
+	{ErrStopTimedOut, CodeStopTimedOut},
+	{ErrSpawnRateLimited, CodeSpawnRateLimited},
+	{ErrNotLeader, CodeNotLeader},
+	{ErrPortInUse, CodePortInUse},
+	{ErrNoTerminal, CodeNoTerminal},
+	{ErrNoTemplate, CodeNoTemplate},
+	{ErrNoEnvSet, CodeNoEnvSet},
+	{ErrNoBackup, CodeNoBackup},
+	{ErrBadSignature, CodeBadSignature},
+	{ErrReadOnly, CodeReadOnly},
+	{ErrPolicyDenied, CodePolicyDenied},
+	{ErrNoAutomationRule, CodeNoAutomationRule},
+	{ErrNoPhase, CodeNoPhase},
+	{ErrRateLimited, CodeRateLimited},
+	{ErrUnsupportedPlatform, CodeUnsupported},
+	{context.DeadlineExceeded, CodeTimeout},
+}
+
+// The code of a failure that isn't one of the known errors, by status
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          CodeBadRequest,
+	http.StatusUnauthorized:        CodeUnauthorized,
+	http.StatusForbidden:           CodeForbidden,
+	http.StatusNotFound:            CodeNotFound,
+	http.StatusConflict:            CodeConflict,
+	http.StatusUnprocessableEntity: CodeInvalid,
+	http.StatusTooManyRequests:     CodeRateLimited,
+	http.StatusBadGateway:          CodeBadGateway,
+	http.StatusServiceUnavailable:  CodeUnavailable,
+	http.StatusGatewayTimeout:      CodeTimeout,
+}
+
+// errorCode returns the code of an error, going by the status of the response
+// it's sent with if it isn't a known one. A status of 0 means it isn't sent
+// on its own, like the error of one service of a bulk request.
+func errorCode(err error, status int) string {
+	if err != nil {
+		for _, ec := range errorCodes {
+			if errors.Is(err, ec.err) {
+				return ec.code
+			}
+		}
+		var startupErr *StartupError
+		if errors.As(err, &startupErr) {
+			return CodeStartupFailed
+		}
+	}
+	if code, ok := statusCodes[status]; ok {
+		return code
+	}
+	if status == 0 {
+		return CodeFailed
+	}
+	return CodeInternal
+}
+
+func newResponseError(err error, status int, message string, details interface{}) *ResponseError {
+	re := &ResponseError{Code: errorCode(err, status), Message: message, Details: details, err: err}
+	if err != nil {
+		re.Message = err.Error()
+	}
+	return re
+}
+
+// resultsCode returns the code of a bulk request some of whose services
+// failed, the code of the failure if there was only one service
+func resultsCode(results []*ServiceResult) string {
+	if len(results) == 1 {
+		return results[0].Code
+	}
+	return CodePartialFailure
+}
@@ -0,0 +1,114 @@
+package guardian
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdRegistry stores services under <prefix>/<service>/<hostname> in etcd
+// through its v3 JSON gateway, attached to a lease so they expire if the
+// guardian stops refreshing them
+type EtcdRegistry struct {
+	url    string
+	prefix string
+	host   string
+	client *http.Client
+
+	mux    sync.Mutex
+	leases map[string]string // Lease ID of each registered service
+}
+
+// NewEtcdRegistry returns a registry for the etcd server at url, like
+// http://localhost:2379
+func NewEtcdRegistry(url, prefix string) *EtcdRegistry {
+	host, _ := os.Hostname()
+	return &EtcdRegistry{
+		url:    strings.TrimSuffix(url, "/"),
+		prefix: strings.TrimSuffix(prefix, "/"),
+		host:   host,
+		client: &http.Client{Timeout: 10 * time.Second},
+		leases: make(map[string]string),
+	}
+}
+
+func (er *EtcdRegistry) key(service string) string {
+	return er.prefix + "/" + service + "/" + er.host
+}
+
+// Register grants a lease and stores the registration under it
+func (er *EtcdRegistry) Register(r Registration, ttl time.Duration) error {
+	var lease struct {
+		ID string `json:"ID"`
+	}
+	if err := er.post("/v3/lease/grant", map[string]interface{}{"TTL": int64(ttl.Seconds())}, &lease); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	put := map[string]interface{}{
+		"key":   base64.StdEncoding.EncodeToString([]byte(er.key(r.Service))),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": lease.ID,
+	}
+	if err := er.post("/v3/kv/put", put, nil); err != nil {
+		return err
+	}
+
+	er.mux.Lock()
+	defer er.mux.Unlock()
+	er.leases[r.Service] = lease.ID
+	return nil
+}
+
+// Refresh keeps the service's lease alive
+func (er *EtcdRegistry) Refresh(service string) error {
+	er.mux.Lock()
+	id, ok := er.leases[service]
+	er.mux.Unlock()
+	if !ok {
+		return fmt.Errorf("%s isn't registered", service)
+	}
+	return er.post("/v3/lease/keepalive", map[string]interface{}{"ID": id}, nil)
+}
+
+// Deregister revokes the service's lease, which deletes its key
+func (er *EtcdRegistry) Deregister(service string) error {
+	er.mux.Lock()
+	id, ok := er.leases[service]
+	delete(er.leases, service)
+	er.mux.Unlock()
+	if !ok {
+		return nil
+	}
+	return er.post("/v3/lease/revoke", map[string]interface{}{"ID": id}, nil)
+}
+
+func (er *EtcdRegistry) post(path string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := er.client.Post(er.url+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("error talking to etcd: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("etcd returned %s for %s", resp.Status, path)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many events can be waiting for a slow subscriber before new ones are
+// dropped
+const subscriberQueueSize = 256
+
+// EventFilter picks the events a subscriber gets, an empty field matches
+// anything. Log lines are only sent to subscribers that ask for EventLog
+// by name, there are too many of them for everything else.
+type EventFilter struct {
+	Services []string
+	Types    []string
+}
+
+// Matches returns true if the filter lets the event through
+func (f EventFilter) Matches(ev Event) bool {
+	if len(f.Services) > 0 && !containsString(f.Services, ev.Service) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return ev.Type != EventLog
+	}
+	return containsString(f.Types, ev.Type)
+}
+
+// ParseEventFilter reads a filter from comma separated lists of services and
+// types, like the query of the events websocket
+func ParseEventFilter(services, types string) EventFilter {
+	var f EventFilter
+	for _, s := range strings.Split(services, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			f.Services = append(f.Services, s)
+		}
+	}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.Types = append(f.Types, t)
+		}
+	}
+	return f
+}
+
+type subscription struct {
+	droppedLogs uint64 // Log lines dropped since takeDroppedLogs, accessed atomically
+	filter      EventFilter
+	events      chan Event
+}
+
+// takeDroppedLogs returns how many log lines were dropped for the subscriber
+// since it was last called. They aren't warned about one by one like other
+// events, there would be a warning for every line.
+func (sub *subscription) takeDroppedLogs() uint64 {
+	return atomic.SwapUint64(&sub.droppedLogs, 0)
+}
+
+// eventBus is where every subsystem publishes what happens, event publishers,
+// the events websocket and Go code in the guardian all subscribe to it
+type eventBus struct {
+	logSubs int32 // Subscribers that get log lines, accessed atomically
+
+	mux    sync.Mutex
+	nextID uint64
+	subs   map[uint64]*subscription
+}
+
+// Subscribe returns a channel that gets the events matching the filter until
+// cancel is called, which closes it. Events are dropped rather than wait for
+// a subscriber that isn't keeping up.
+func (gg *GladiusGuardian) Subscribe(filter EventFilter) (<-chan Event, func()) {
+	sub, cancel := gg.bus.subscribe(filter)
+	return sub.events, cancel
+}
+
+// subscribe is Subscribe, returning the subscription itself
+func (eb *eventBus) subscribe(filter EventFilter) (*subscription, func()) {
+	sub := &subscription{filter: filter, events: make(chan Event, subscriberQueueSize)}
+
+	logs := containsString(filter.Types, EventLog)
+	eb.mux.Lock()
+	eb.nextID++
+	id := eb.nextID
+	eb.subs[id] = sub
+	if logs {
+		atomic.AddInt32(&eb.logSubs, 1)
+	}
+	eb.mux.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			eb.mux.Lock()
+			delete(eb.subs, id)
+			if logs {
+				atomic.AddInt32(&eb.logSubs, -1)
+			}
+			eb.mux.Unlock()
+			close(sub.events)
+		})
+	}
+	return sub, cancel
+}
+
+// publishesLogs returns true if anyone subscribed to log lines, so services
+// logging doesn't cost anything otherwise
+func (eb *eventBus) publishesLogs() bool {
+	return atomic.LoadInt32(&eb.logSubs) > 0
+}
+
+// publish sends the event to every subscriber it matches
+func (eb *eventBus) publish(ev Event) {
+	eb.mux.Lock()
+	defer eb.mux.Unlock()
+
+	for _, sub := range eb.subs {
+		if !sub.filter.Matches(ev) {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+			if ev.Type == EventLog {
+				atomic.AddUint64(&sub.droppedLogs, 1)
+				continue
+			}
+			log.WithFields(log.Fields{
+				"event_type":   ev.Type,
+				"service_name": ev.Service,
+			}).Warn("Event subscriber is falling behind, dropping event")
+		}
+	}
+}
+
+// StreamEvents sends the events matching the filter to the websocket as JSON
+// until it's closed
+func (gg *GladiusGuardian) StreamEvents(filter EventFilter, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // The upgrader already responded
+	}
+	defer conn.Close()
+
+	events, cancel := gg.Subscribe(filter)
+	defer cancel()
+
+	// Nothing is read from the client, reading only notices when it's gone
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case ev := <-events:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package guardian
+
+import (
+	"sync"
+)
+
+// How many events the guardian remembers if nothing else is set
+const defaultEventLogSize = 1000
+
+// eventLog is a ring buffer of the latest events, kept apart from the logs of
+// the services so what happened to them can be looked up later
+type eventLog struct {
+	mux    sync.Mutex
+	events []Event // Oldest first once full, starting at next
+	next   int
+	size   int
+	lastID uint64
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{events: make([]Event, 0, size), size: size}
+}
+
+// add gives the event the next id and stores it, dropping the oldest event if
+// the log is full
+func (el *eventLog) add(ev Event) Event {
+	el.mux.Lock()
+	defer el.mux.Unlock()
+	el.lastID++
+	ev.ID = el.lastID
+	if len(el.events) < el.size {
+		el.events = append(el.events, ev)
+	} else {
+		el.events[el.next] = ev
+		el.next = (el.next + 1) % el.size
+	}
+	return ev
+}
+
+// ordered returns the events oldest first, the lock has to be held
+func (el *eventLog) ordered() []Event {
+	ordered := make([]Event, 0, len(el.events))
+	ordered = append(ordered, el.events[el.next:]...)
+	return append(ordered, el.events[:el.next]...)
+}
+
+// SetEventLogSize sets how many events are kept, the newest ones are kept if
+// it's smaller than before
+func (gg *GladiusGuardian) SetEventLogSize(size int) {
+	if size <= 0 {
+		size = defaultEventLogSize
+	}
+	el := gg.eventLog
+	el.mux.Lock()
+	defer el.mux.Unlock()
+	events := el.ordered()
+	if len(events) > size {
+		events = events[len(events)-size:]
+	}
+	el.events = append(make([]Event, 0, size), events...)
+	el.next = 0
+	el.size = size
+}
+
+// EventQuery narrows down the events returned by Events
+type EventQuery struct {
+	Since   uint64 // Only events with a higher id
+	Service string // Only events of this service
+	Type    string // Only events of this type
+	Limit   int    // At most this many of the newest matching events, 0 is all
+}
+
+// Events returns the remembered events matching the query, oldest first
+func (gg *GladiusGuardian) Events(q EventQuery) []Event {
+	el := gg.eventLog
+	el.mux.Lock()
+	defer el.mux.Unlock()
+
+	events := make([]Event, 0)
+	for _, ev := range el.ordered() {
+		if ev.ID <= q.Since || (q.Service != "" && ev.Service != q.Service) || (q.Type != "" && ev.Type != q.Type) {
+			continue
+		}
+		events = append(events, ev)
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events
+}
+
+// ConfigReloaded records that the guardian's config was loaded again, from
+// where it says
+func (gg *GladiusGuardian) ConfigReloaded(message string) {
+	gg.emit(Event{Type: EventConfigReloaded, Message: message})
+}
@@ -0,0 +1,84 @@
+package guardian
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of service lifecycle events
+const (
+	EventRegistered = "registered"
+	EventStarting   = "starting" // Being spawned, started follows once it is up
+	EventStarted    = "started"
+	EventStopped    = "stopped"  // Stopped by the guardian
+	EventExited     = "exited"   // Exited cleanly on its own
+	EventCrashed    = "crashed"  // Exited with an error on its own
+	EventReloaded   = "reloaded" // Sent its reload signal
+
+	// The guardian's own config was loaded again, these have no service
+	EventConfigReloaded = "config_reloaded"
+	// An automation rule fired, these have no service either
+	EventAutomation = "automation"
+	// The guardian became ready or stopped being ready, see Ready
+	EventReady   = "ready"
+	EventUnready = "unready"
+
+	// A line a service logged, these are only published on the bus and
+	// aren't kept in the event log
+	EventLog = "log"
+)
+
+// Event is something that happened to a service
+type Event struct {
+	ID      uint64    `json:"id"` // Increases with every event, see Events
+	Type    string    `json:"type"`
+	Service string    `json:"service,omitempty"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message,omitempty"`
+	PID     int       `json:"pid,omitempty"`
+	Error   string    `json:"error,omitempty"`
+
+	// How the service ended, for the stopped, exited and crashed events
+	Exit *ExitStatus `json:"exit,omitempty"`
+}
+
+// EventPublisher sends events somewhere outside the guardian
+type EventPublisher interface {
+	Publish(ev Event) error
+}
+
+// AddEventPublisher sends every service lifecycle event to p. It's a
+// subscriber of its own so a slow publisher doesn't hold up the guardian.
+func (gg *GladiusGuardian) AddEventPublisher(p EventPublisher) {
+	events, _ := gg.Subscribe(EventFilter{})
+	go func() {
+		for ev := range events {
+			if err := p.Publish(ev); err != nil {
+				log.WithFields(log.Fields{
+					"event_type":   ev.Type,
+					"service_name": ev.Service,
+					"err":          err,
+				}).Debug("Couldn't publish event")
+			}
+		}
+	}()
+}
+
+// emit records the event in the event log and publishes it on the bus
+func (gg *GladiusGuardian) emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ev = gg.eventLog.add(ev)
+	gg.bus.publish(ev)
+}
+
+// source is what the event is about in subjects and topics, the service or
+// "guardian" for the guardian's own events
+func (ev Event) source() string {
+	if ev.Service == "" {
+		return "guardian"
+	}
+	return ev.Service
+}
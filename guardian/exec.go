@@ -0,0 +1,94 @@
+package guardian
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+)
+
+// Output streams of an exec'd command
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Exec runs a one-off command with the environment and working directory of
+// a registered service, like a diagnostic tool that needs the same settings.
+// Each line of output is passed to onLine as it's written. It returns the
+// exit code once the command is done, or -1 if it couldn't run to the end.
+// The command isn't tracked as a service, cancelling the context kills it.
+func (gg *GladiusGuardian) Exec(ctx context.Context, name string, command []string, onLine func(stream, line string)) (int, error) {
+	if len(command) == 0 {
+		return -1, errors.New("no command given")
+	}
+
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	inst := gg.services[name]
+	gg.mux.Unlock()
+	if !ok {
+		return -1, ErrNotRegistered
+	}
+
+	// The running instance has its ports filled in already
+	var env []string
+	if inst != nil {
+		env = inst.env()
+	} else {
+		var err error
+		if env, err = gg.ports.expandEnv(name, gg.startEnv(settings, nil)); err != nil {
+			return -1, err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Env = env
+	cmd.Dir = settings.opts.WorkingDir
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return -1, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return -1, err
+	}
+	if err := waited.start(cmd); err != nil {
+		return -1, fmt.Errorf("couldn't run %s: %s", command[0], err)
+	}
+
+	// Lines are passed on one at a time so onLine doesn't need to be safe
+	// for concurrent use
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	read := func(stream string, r io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			mux.Lock()
+			onLine(stream, scanner.Text())
+			mux.Unlock()
+		}
+	}
+	wg.Add(2)
+	go read(StreamStdout, stdout)
+	go read(StreamStderr, stderr)
+	wg.Wait() // Before Wait, which closes the pipes
+
+	err = cmd.Wait()
+	waited.done(cmd.Process.Pid)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case ctx.Err() != nil:
+		return -1, ctx.Err()
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		return exitErr.ExitCode(), nil
+	default:
+		return -1, err
+	}
+}
@@ -0,0 +1,233 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How an instance of a service ended
+const (
+	ExitClean    = "clean"    // Exited on its own with status 0
+	ExitStopped  = "stopped"  // Stopped by the guardian, however it went
+	ExitSignaled = "signaled" // Killed by a signal the guardian didn't send
+	ExitFailed   = "failed"   // Exited on its own with an error
+)
+
+// How many exits are kept for each service, and how many lines of stderr a
+// StartupError has at most
+const (
+	exitHistorySize   = 20
+	startupErrorLines = 10
+)
+
+// How long to wait for the rest of a service's output after it exited while
+// starting
+const startupOutputWait = 500 * time.Millisecond
+
+// ExitStatus is how an instance of a service ended
+type ExitStatus struct {
+	Class  string `json:"class"`
+	Code   int    `json:"code"` // -1 when killed by a signal or unknown
+	Signal string `json:"signal,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ExitRecord is an exit in a service's history
+type ExitRecord struct {
+	ExitStatus
+	PID   int       `json:"pid,omitempty"`
+	RunID string    `json:"run_id,omitempty"`
+	Time  time.Time `json:"time"`
+
+	// What the run was started with, with the values redacted. Overrides
+	// are the variables its start was given on top of the service's own.
+	Env       []string `json:"environment_vars,omitempty"`
+	Overrides []string `json:"environment_overrides,omitempty"`
+}
+
+// ExitInfo is how a run of a service ended
+type ExitInfo struct {
+	Service string `json:"service"`
+	ExitRecord
+}
+
+// exitCodeError is an exit status that didn't come from a process we waited
+// for ourselves, like a container's
+type exitCodeError struct {
+	code   int
+	signal string // Set instead of the code if it was killed by a signal
+}
+
+func (e *exitCodeError) Error() string {
+	if e.signal != "" {
+		return "signal: " + e.signal
+	}
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// StartupError is returned when a service exits before its spawn timeout is
+// over, with the last lines it wrote to stderr
+type StartupError struct {
+	Service string     `json:"service"`
+	Exit    ExitStatus `json:"exit"`
+	Stderr  []string   `json:"stderr"`
+}
+
+func (e *StartupError) Error() string {
+	reason := e.Exit.Error
+	if reason == "" {
+		reason = "exit status 0"
+	}
+	msg := fmt.Sprintf("%s exited while starting (%s)", e.Service, reason)
+	if len(e.Stderr) > 0 {
+		msg += ", last output on stderr: " + strings.Join(e.Stderr, "\n")
+	}
+	return msg
+}
+
+// newStartupError waits a little for the rest of what the service wrote to
+// stderr, if it's kept, before describing how it exited
+func newStartupError(name string, waitErr error, stderr *lineTail) *StartupError {
+	startupErr := &StartupError{Service: name, Exit: classifyExit(waitErr, false), Stderr: []string{}}
+	if stderr != nil {
+		stderr.wait(startupOutputWait)
+		startupErr.Stderr = stderr.get()
+	}
+	return startupErr
+}
+
+// lineTail keeps the last lines read from a stream
+type lineTail struct {
+	mux   sync.Mutex
+	lines []string
+	done  chan struct{} // Closed at the end of the stream
+}
+
+func newLineTail() *lineTail {
+	return &lineTail{done: make(chan struct{})}
+}
+
+func (lt *lineTail) add(line string) {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+	if len(lt.lines) >= startupErrorLines {
+		// Shift in place rather than reslice, which would reallocate
+		copy(lt.lines, lt.lines[1:])
+		lt.lines = lt.lines[:len(lt.lines)-1]
+	}
+	lt.lines = append(lt.lines, line)
+}
+
+func (lt *lineTail) get() []string {
+	lt.mux.Lock()
+	defer lt.mux.Unlock()
+	return append([]string{}, lt.lines...)
+}
+
+// wait waits up to d for the end of the stream
+func (lt *lineTail) wait(d time.Duration) {
+	select {
+	case <-lt.done:
+	case <-time.After(d):
+	}
+}
+
+// classifyExit works out how an instance ended from the error it was waited
+// for with and whether the guardian was stopping it
+func classifyExit(err error, stopRequested bool) ExitStatus {
+	status := ExitStatus{Code: -1}
+	if err == nil {
+		status.Code = 0
+	} else {
+		status.Error = err.Error()
+	}
+
+	var exitErr *exec.ExitError
+	var codeErr *exitCodeError
+	switch {
+	case errors.As(err, &exitErr):
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			status.Signal = ws.Signal().String()
+		} else {
+			status.Code = exitErr.ExitCode()
+		}
+	case errors.As(err, &codeErr):
+		status.Code, status.Signal = codeErr.code, codeErr.signal
+	}
+
+	switch {
+	case stopRequested:
+		status.Class = ExitStopped
+	case status.Signal != "":
+		status.Class = ExitSignaled
+	case err == nil:
+		status.Class = ExitClean
+	default:
+		status.Class = ExitFailed
+	}
+	return status
+}
+
+type exitHistory struct {
+	mux     sync.Mutex
+	records map[string][]ExitRecord
+}
+
+func (eh *exitHistory) add(name string, record ExitRecord) {
+	eh.mux.Lock()
+	defer eh.mux.Unlock()
+	records := append(eh.records[name], record)
+	if len(records) > exitHistorySize {
+		records = records[len(records)-exitHistorySize:]
+	}
+	eh.records[name] = records
+}
+
+func (eh *exitHistory) last(name string) *ExitRecord {
+	eh.mux.Lock()
+	defer eh.mux.Unlock()
+	records := eh.records[name]
+	if len(records) == 0 {
+		return nil
+	}
+	last := records[len(records)-1]
+	return &last
+}
+
+// ExitHistory returns how the service's last instances ended, oldest first
+func (gg *GladiusGuardian) ExitHistory(name string) []ExitRecord {
+	gg.exits.mux.Lock()
+	defer gg.exits.mux.Unlock()
+	return append([]ExitRecord{}, gg.exits.records[name]...)
+}
+
+// WaitForExit waits for the service to stop and returns how it ended. If it
+// isn't running it returns how it last ended, or ErrNotRunning if it never ran.
+func (gg *GladiusGuardian) WaitForExit(ctx context.Context, name string) (ExitInfo, error) {
+	sv := gg.supervisor(name)
+	if sv == nil {
+		return ExitInfo{}, ErrNotRegistered
+	}
+
+	h := sv.call(supervisorCommand{kind: commandHandle}).handle
+	if h == nil {
+		last := gg.exits.last(name)
+		if last == nil {
+			return ExitInfo{}, fmt.Errorf("can't wait for %s: %w", name, ErrNotRunning)
+		}
+		return ExitInfo{Service: name, ExitRecord: *last}, nil
+	}
+
+	select {
+	case <-h.Done():
+		return ExitInfo{Service: name, ExitRecord: h.exit}, nil
+	case <-ctx.Done():
+		return ExitInfo{}, ctx.Err()
+	}
+}
@@ -0,0 +1,237 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultFleetTimeout = 10 * time.Second
+
+// fleet is the other guardians this one aggregates, so their status and logs
+// can be seen and their services controlled from one place
+type fleet struct {
+	mux     sync.Mutex
+	self    string              // Name this node is listed under
+	peers   map[string]*url.URL // Base URLs of the peers by name
+	token   string              // Bearer token sent to the peers
+	timeout time.Duration
+}
+
+// FleetNode is what one node of the fleet returned, or why it couldn't
+type FleetNode struct {
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error *ResponseError  `json:"error,omitempty"`
+}
+
+// SetFleetPeers sets the guardians aggregated by the /fleet endpoints, peers
+// are base URLs like https://node2:7791 by name. This guardian is listed as
+// self. Requests to the peers use the bearer token if there is one.
+func (gg *GladiusGuardian) SetFleetPeers(self string, peers map[string]string, token string, timeout time.Duration) error {
+	parsed := make(map[string]*url.URL, len(peers))
+	for name, raw := range peers {
+		if name == self {
+			return fmt.Errorf("peer %s has the same name as this node", name)
+		}
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("bad URL for peer %s: %q", name, raw)
+		}
+		parsed[name] = u
+	}
+	if timeout <= 0 {
+		timeout = defaultFleetTimeout
+	}
+
+	gg.fleet.mux.Lock()
+	defer gg.fleet.mux.Unlock()
+	gg.fleet.self, gg.fleet.peers, gg.fleet.token, gg.fleet.timeout = self, parsed, token, timeout
+	return nil
+}
+
+func (f *fleet) settings() (string, map[string]*url.URL, string, time.Duration) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.self, f.peers, f.token, f.timeout
+}
+
+// peerURL returns the URL of an API path on a peer
+func peerURL(base *url.URL, apiPath string) *url.URL {
+	u := *base
+	u.Path = strings.TrimSuffix(base.Path, "/") + "/api/" + APIVersion + "/" + strings.TrimPrefix(apiPath, "/")
+	u.RawQuery = ""
+	return &u
+}
+
+// fetch gets an API path from every peer at the same time and returns the
+// data each one returned, or the field of it if there's one
+func (f *fleet) fetch(ctx context.Context, apiPath string, field string) map[string]*FleetNode {
+	_, peers, token, timeout := f.settings()
+	client := &http.Client{Timeout: timeout}
+
+	nodes := make(map[string]*FleetNode, len(peers))
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	for name, base := range peers {
+		wg.Add(1)
+		go func(name string, base *url.URL) {
+			defer wg.Done()
+			node := &FleetNode{}
+			resp, err := getFromPeer(ctx, client, peerURL(base, apiPath), token)
+			if err == nil && field != "" {
+				var fields map[string]json.RawMessage
+				if err = json.Unmarshal(resp, &fields); err == nil {
+					resp = fields[field]
+				}
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"peer": name,
+					"err":  err,
+				}).Debug("Couldn't reach fleet peer")
+				var re *ResponseError
+				if !errors.As(err, &re) {
+					re = &ResponseError{Code: CodeBadGateway, Message: err.Error()}
+				}
+				node.Error = re
+			} else {
+				node.Data = resp
+			}
+			mux.Lock()
+			nodes[name] = node
+			mux.Unlock()
+		}(name, base)
+	}
+	wg.Wait()
+	return nodes
+}
+
+func getFromPeer(ctx context.Context, client *http.Client, u *url.URL, token string) (json.RawMessage, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body := struct {
+		Success bool            `json:"success"`
+		Data    json.RawMessage `json:"data"`
+		Error   *ResponseError  `json:"error"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("bad response from peer (%s): %s", resp.Status, err)
+	}
+	if !body.Success {
+		if body.Error == nil {
+			return nil, fmt.Errorf("peer returned %s", resp.Status)
+		}
+		return nil, body.Error // Passed on with the peer's code
+	}
+	return body.Data, nil
+}
+
+// localNode encodes what this guardian would return itself
+func localNode(v interface{}) *FleetNode {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return &FleetNode{Error: newResponseError(err, http.StatusInternalServerError, "", nil)}
+	}
+	return &FleetNode{Data: b}
+}
+
+// FleetNodes returns the names of this node and its peers, sorted
+func (gg *GladiusGuardian) FleetNodes() []string {
+	self, peers, _, _ := gg.fleet.settings()
+	names := []string{self}
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func FleetNodesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got fleet nodes", true, nil, gg.FleetNodes())
+	}
+}
+
+func FleetStatusHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodes := gg.fleet.fetch(r.Context(), "/status", "services")
+		self, _, _, _ := gg.fleet.settings()
+		nodes[self] = localNode(statusResponse(r, gg.GetServicesStatus("all")))
+		ResponseHandler(w, r, "Got fleet status", true, nil, nodes)
+	}
+}
+
+func FleetLogsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		nodes := gg.fleet.fetch(r.Context(), "/service/logs", "")
+		self, _, _, _ := gg.fleet.settings()
+		nodes[self] = localNode(gg.storedLogs())
+		ResponseHandler(w, r, "Got fleet logs", true, nil, nodes)
+	}
+}
+
+// FleetProxyHandler passes a request through to the same API path on one of
+// the peers, with the fleet's token instead of the client's
+func FleetProxyHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		node := vars["node"]
+		_, peers, token, timeout := gg.fleet.settings()
+		base, ok := peers[node]
+		if !ok {
+			ErrorHandler(w, r, "Can't proxy to node", errors.New("no fleet peer with that name"), http.StatusNotFound)
+			return
+		}
+		target := peerURL(base, vars["path"])
+
+		proxy := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = target.Scheme
+				req.URL.Host = target.Host
+				req.URL.Path = target.Path
+				req.Host = target.Host
+				req.Header.Del("Authorization")
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+			},
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				log.WithFields(log.Fields{
+					"peer":   node,
+					"target": target.String(),
+					"err":    err,
+				}).Debug("Fleet proxy request failed")
+				ErrorHandler(w, r, "Couldn't reach node", err, http.StatusBadGateway)
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		q := r.URL.Query()
+		q.Del("access_token")
+		r.URL.RawQuery = q.Encode()
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
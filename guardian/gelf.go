@@ -0,0 +1,195 @@
+package guardian
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	gelfChunkSize = 1420 // Fits in an ethernet frame with the headers
+	gelfMaxChunks = 128
+	gelfLevelInfo = 6 // Syslog severity log lines are sent with
+
+	// How often at most lines dropped because shipping them fell behind are
+	// warned about
+	gelfDropWarnInterval = 10 * time.Second
+)
+
+var gelfFieldName = regexp.MustCompile(`^[\w.\-]+$`)
+
+// checkGELFFields returns what's wrong with the names of additional GELF
+// fields, they're sent with an underscore in front
+func checkGELFFields(fields map[string]string) error {
+	for name := range fields {
+		if !gelfFieldName.MatchString(name) || name == "id" {
+			return fmt.Errorf("GELF field name %q has to be letters, digits, _, . or - and can't be id", name)
+		}
+	}
+	return nil
+}
+
+// gelfWriter sends GELF messages to Graylog, chunked over UDP or null byte
+// delimited over TCP. It connects lazily and reconnects after errors.
+type gelfWriter struct {
+	mux     sync.Mutex
+	network string
+	addr    string
+	conn    net.Conn
+}
+
+func (gw *gelfWriter) send(msg []byte) error {
+	gw.mux.Lock()
+	defer gw.mux.Unlock()
+
+	if gw.conn == nil {
+		conn, err := net.DialTimeout(gw.network, gw.addr, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("error connecting to Graylog: %s", err)
+		}
+		gw.conn = conn
+	}
+
+	var err error
+	if gw.network == "tcp" {
+		_, err = gw.conn.Write(append(msg, 0))
+	} else {
+		err = gw.writeChunked(msg)
+	}
+	if err != nil {
+		gw.conn.Close()
+		gw.conn = nil
+		return fmt.Errorf("error sending to Graylog: %s", err)
+	}
+	return nil
+}
+
+// writeChunked sends the message as one datagram, or as chunks with a header
+// of the chunk magic bytes, the message id, the chunk's number and how many
+// there are if it doesn't fit in one
+func (gw *gelfWriter) writeChunked(msg []byte) error {
+	if len(msg) <= gelfChunkSize {
+		_, err := gw.conn.Write(msg)
+		return err
+	}
+
+	const header = 12
+	size := gelfChunkSize - header
+	count := (len(msg) + size - 1) / size
+	if count > gelfMaxChunks {
+		return fmt.Errorf("message of %d bytes needs more than %d chunks", len(msg), gelfMaxChunks)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	chunk := make([]byte, 0, gelfChunkSize)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(msg) {
+			end = len(msg)
+		}
+		chunk = append(chunk[:0], 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, msg[i*size:end]...)
+		if _, err := gw.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gw *gelfWriter) close() {
+	gw.mux.Lock()
+	defer gw.mux.Unlock()
+	if gw.conn != nil {
+		gw.conn.Close()
+		gw.conn = nil
+	}
+}
+
+// StartGELF ships every line of the service logs to Graylog at the address,
+// over "udp" or "tcp". Messages have the service as their _service field, the
+// fields given here and the GELFFields of the service as additional ones.
+func (gg *GladiusGuardian) StartGELF(network, address string, fields map[string]string) error {
+	if network != "udp" && network != "tcp" {
+		return fmt.Errorf("unknown GELF protocol %q, must be udp or tcp", network)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("GELF address: %s", err)
+	}
+	if err := checkGELFFields(fields); err != nil {
+		return err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "gladius-guardian"
+	}
+
+	gw := &gelfWriter{network: network, addr: address}
+	sub, _ := gg.bus.subscribe(EventFilter{Types: []string{EventLog}})
+	go func() {
+		defer gw.close()
+		var dropped uint64
+		var warned time.Time
+		for ev := range sub.events {
+			if dropped += sub.takeDroppedLogs(); dropped > 0 && time.Since(warned) >= gelfDropWarnInterval {
+				log.WithFields(log.Fields{
+					"address": address,
+					"dropped": dropped,
+				}).Warn("Shipping logs to Graylog is falling behind, dropped log lines")
+				dropped = 0
+				warned = time.Now()
+			}
+			if strings.TrimSpace(ev.Message) == "" {
+				continue // Graylog rejects messages without a short_message
+			}
+
+			msg := map[string]interface{}{
+				"version":       "1.1",
+				"host":          host,
+				"short_message": ev.Message,
+				"timestamp":     float64(ev.Time.UnixNano()) / float64(time.Second),
+				"level":         gelfLevelInfo,
+				"_service":      ev.Service,
+			}
+			for k, v := range fields {
+				msg["_"+k] = v
+			}
+			for k, v := range gg.gelfFields(ev.Service) {
+				msg["_"+k] = v
+			}
+			b, err := json.Marshal(msg)
+			if err == nil {
+				err = gw.send(b)
+			}
+			if err != nil {
+				log.WithFields(log.Fields{
+					"service_name": ev.Service,
+					"err":          err,
+				}).Debug("Couldn't ship log line to Graylog")
+			}
+		}
+	}()
+	return nil
+}
+
+// gelfFields returns the additional GELF fields of the service
+func (gg *GladiusGuardian) gelfFields(name string) map[string]string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+	if settings, ok := gg.registeredServices[name]; ok {
+		return settings.opts.GELFFields
+	}
+	return nil
+}
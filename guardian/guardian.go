@@ -2,18 +2,24 @@ package guardian
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/gladiusio/gladius-guardian/tracing"
 	"github.com/gorilla/websocket"
 	multierror "github.com/hashicorp/go-multierror"
 	log "github.com/sirupsen/logrus"
-	"github.com/spf13/viper"
 )
 
 var upgrader = websocket.Upgrader{
@@ -22,14 +28,66 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true }, // So we can run locally
 }
 
+var (
+	// ErrAlreadyRunning is returned when starting a service that's running
+	ErrAlreadyRunning = errors.New("service is already running")
+	// ErrNotRunning is returned when stopping a service that isn't running
+	ErrNotRunning = errors.New("service is not running")
+	// ErrStopTimedOut is returned when a killed service didn't exit within its
+	// StopTimeout
+	ErrStopTimedOut = errors.New("service didn't exit after being killed")
+	// ErrNotRegistered is returned for a service that isn't registered
+	ErrNotRegistered = errors.New("no service registered with that name")
+)
+
+// How long stopping a service waits for it to exit by default
+const defaultStopTimeout = 10 * time.Second
+
+// How long starts wait for services to come up until SetTimeout is called
+const defaultSpawnTimeout = 5 * time.Second
+
 // New returns a new GladiusGuardian object with the specified spawn timeout
 func New() *GladiusGuardian {
 	return &GladiusGuardian{
 		mux:                &sync.Mutex{},
 		registeredServices: make(map[string]*serviceSettings),
-		services:           make(map[string]*exec.Cmd),
-		serviceLogs:        make(map[string]*FixedSizeLog),
-		serviceWebSockets:  make(map[string][]*websocket.Conn),
+		services:           make(map[string]instance),
+		supervisors:        make(map[string]*supervisor),
+		logs:               newLogStore(),
+		defaultTimeout:     defaultSpawnTimeout,
+		logClients:         newLogBroadcaster(),
+		operations:         newOperationStore(),
+		revision:           newStateRevision(),
+		health:             &healthChecks{checks: make(map[string]ReadinessCheck)},
+		stats:              newStatsStore(),
+		bus:                &eventBus{subs: make(map[uint64]*subscription)},
+		ports:              newPortManager(0, 0),
+		strays:             &strayProcesses{},
+		maintenance:        &maintenanceMode{services: make(map[string]bool)},
+		terminals:          &terminalClients{conns: make(map[string][]*websocket.Conn)},
+		envSets:            &envSets{sets: make(map[string][]string)},
+		exits:              &exitHistory{records: make(map[string][]ExitRecord)},
+		spawns:             &spawnLimits{},
+		fleet:              &fleet{self: "local", timeout: defaultFleetTimeout},
+		leadership:         &leadership{},
+		backups:            &backups{keep: defaultBackupKeep},
+		diskUsage:          &diskUsage{},
+		housekeeping:       &housekeeping{stats: make(map[string]*PruneStats)},
+		eventLog:           newEventLog(defaultEventLogSize),
+		plugins:            &plugins{},
+		automations:        &automations{rules: make(map[string]*automationState)},
+		phases:             &phases{},
+		restarts:           &restarts{states: make(map[string]*restartState)},
+		views:              &statusViews{starting: make(map[string]bool), overrides: make(map[string][]string)},
+		statusCache:        &statusCache{},
+		templates: &serviceTemplates{
+			templates: make(map[string]ServiceTemplate),
+			instances: make(map[string]templateInstance),
+		},
+		handoff: &handoffResources{
+			listeners: make(map[string]net.Listener),
+			inherited: make(map[string]int),
+		},
 	}
 }
 
@@ -37,246 +95,699 @@ func New() *GladiusGuardian {
 type GladiusGuardian struct {
 	mux                *sync.Mutex
 	spawnTimeout       *time.Duration
+	defaultTimeout     time.Duration // Used while spawnTimeout isn't set
+	warnedTimeout      bool          // That spawnTimeout isn't set
+	defaultEnv         []string      // See SetDefaultEnvironment
 	registeredServices map[string]*serviceSettings
-	services           map[string]*exec.Cmd
-	serviceLogs        map[string]*FixedSizeLog
-	serviceWebSockets  map[string][]*websocket.Conn
+	services           map[string]instance
+	supervisors        map[string]*supervisor
+	logs               *logStore
+	logClients         *logBroadcaster
+	operations         *operationStore
+	revision           *stateRevision
+	health             *healthChecks
+	stats              *statsStore
+	bus                *eventBus
+	alerts             *alertEngine
+	ports              *portManager
+	strays             *strayProcesses
+	handoff            *handoffResources
+	maintenance        *maintenanceMode
+	terminals          *terminalClients
+	envSets            *envSets
+	exits              *exitHistory
+	spawns             *spawnLimits
+	fleet              *fleet
+	leadership         *leadership
+	backups            *backups
+	diskUsage          *diskUsage
+	housekeeping       *housekeeping
+	eventLog           *eventLog
+	plugins            *plugins
+	automations        *automations
+	phases             *phases
+	restarts           *restarts
+	views              *statusViews
+	statusCache        *statusCache
+	templates          *serviceTemplates
+	diagnostics        diagnosticSettings
+	subreaper          bool
 }
 
 type serviceSettings struct {
 	env      []string
 	execName string
+	opts     ServiceOptions
+	disabled bool // Skipped when acting on "all" services
 }
 
 type serviceStatus struct {
-	Running  bool     `json:"running"`
-	PID      int      `json:"pid"`
-	Env      []string `json:"environment_vars"`
-	Location string   `json:"executable_location"`
+	State    string     `json:"state"` // stopped, starting or running
+	Running  bool       `json:"running"`
+	PID      int        `json:"pid"`
+	Env      []string   `json:"environment_vars"`
+	Location string     `json:"executable_location"`
+	Ports    []PortInfo `json:"ports,omitempty"`
+
+	// Variables the start was given on top of the service's own environment,
+	// with the values redacted. environment_vars has what they merged into.
+	Overrides []string `json:"environment_overrides,omitempty"`
+
+	AllocatedPorts map[string]int `json:"allocated_ports,omitempty"`
+
+	// Left alone by automatic restarts and alerts, see SetMaintenance
+	Maintenance bool `json:"maintenance,omitempty"`
+
+	// Left out when starting or stopping all services, see SetEnabled
+	Disabled bool `json:"disabled,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Template the service was instantiated from, see InstantiateTemplate
+	Template string `json:"template,omitempty"`
+
+	// How the service last stopped, see ExitHistory
+	LastExit *ExitRecord `json:"last_exit,omitempty"`
+
+	// Restarts after crashes, see ServiceOptions.RestartOnFailure
+	Restart *RestartStatus `json:"restart,omitempty"`
+
+	// Size of the data directory as of the last scan, see StartDiskUsageScan
+	DataDir *DiskUsage `json:"data_dir,omitempty"`
+
+	// Found by the last stray process scan, see StartStrayScan
+	Orphans []*ProcessInfo `json:"orphans,omitempty"`
+	Zombies []*ProcessInfo `json:"zombies,omitempty"`
 }
 
-func newServiceStatus(p *exec.Cmd) *serviceStatus {
+func newServiceStatus(p instance) *serviceStatus {
 	if p != nil {
 		return &serviceStatus{
+			State:    StateRunning,
 			Running:  true,
-			PID:      p.Process.Pid,
-			Env:      p.Env,
-			Location: p.Path,
+			PID:      p.pid(),
+			Env:      p.env(),
+			Location: p.location(),
+			Ports:    listeningPorts(p.pid()),
 		}
 	}
 	return &serviceStatus{
+		State:   StateStopped,
 		Running: false,
 	}
 }
 
-func (gg *GladiusGuardian) RegisterService(name, execLocation string, env []string) {
+// RegisterService registers a service with no options, see
+// RegisterServiceWithOptions
+func (gg *GladiusGuardian) RegisterService(name, execLocation string, env []string) error {
+	return gg.RegisterServiceWithOptions(name, execLocation, env, ServiceOptions{})
+}
+
+// RegisterServiceWithOptions registers a service with optional settings. The
+// name has to be free, otherwise ErrAlreadyRegistered is returned, and the
+// executable has to exist unless the service runs from an image.
+func (gg *GladiusGuardian) RegisterServiceWithOptions(name, execLocation string, env []string, opts ServiceOptions) error {
+	return gg.register(name, execLocation, env, opts, false)
+}
+
+// ReplaceService is RegisterServiceWithOptions, replacing the registration of
+// a service with that name if there is one. A running instance keeps running
+// with its old settings until it's restarted.
+func (gg *GladiusGuardian) ReplaceService(name, execLocation string, env []string, opts ServiceOptions) error {
+	return gg.register(name, execLocation, env, opts, true)
+}
+
+func (gg *GladiusGuardian) register(name, execLocation string, env []string, opts ServiceOptions, replace bool) error {
+	if err := validateRegistration(name, execLocation, opts); err != nil {
+		return err
+	}
+
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
 
+	if _, ok := gg.registeredServices[name]; ok && !replace {
+		return fmt.Errorf("can't register %s: %w", name, ErrAlreadyRegistered)
+	}
+	if cycle := gg.dependencyCycleLocked(name, opts.DependsOn); cycle != nil {
+		return fmt.Errorf("can't register %s: %w: %s", name, ErrDependencyCycle, strings.Join(cycle, " -> "))
+	}
+
 	log.WithFields(log.Fields{
 		"service_name":     name,
 		"exec_location":    execLocation,
 		"environment_vars": strings.Join(env, ", "),
 	}).Debug("Registered new service")
-	gg.registeredServices[name] = &serviceSettings{env: env, execName: execLocation}
-	gg.services[name] = nil // So it's still returned when we list services
+	gg.registeredServices[name] = &serviceSettings{env: env, execName: execLocation, opts: opts, disabled: opts.Disabled}
+	if _, ok := gg.supervisors[name]; !ok {
+		gg.supervisors[name] = newSupervisor(gg, name)
+		gg.services[name] = nil // So it's still returned when we list services
+	}
+	gg.publishViewsLocked()
+	gg.revision.bump()
 
-	// Start websocket watcher
-	gg.serviceWebSockets[name] = make([]*websocket.Conn, 0)
+	gg.emit(Event{Type: EventRegistered, Service: name})
+	return nil
 }
 
-func (gg *GladiusGuardian) updateWebsocketLog(serviceName, logLine string) {
+// SetTimeout sets how long starts wait for services to come up. With a zero
+// timeout a start returns as soon as the service is spawned, or once its
+// readiness probe passes if it has one, see ServiceOptions.ReadyTimeout.
+func (gg *GladiusGuardian) SetTimeout(t *time.Duration) {
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
-	for _, conn := range gg.serviceWebSockets[serviceName] {
-		conn.WriteMessage(websocket.TextMessage, []byte(logLine))
-	}
+
+	gg.spawnTimeout = t
 }
 
-func (gg *GladiusGuardian) SetTimeout(t *time.Duration) {
+// SetDefaultTimeout sets the spawn timeout used until SetTimeout is called, 0
+// keeps the built in one
+func (gg *GladiusGuardian) SetDefaultTimeout(t time.Duration) {
+	if t <= 0 {
+		t = defaultSpawnTimeout
+	}
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
 
-	gg.spawnTimeout = t
+	gg.defaultTimeout = t
+}
+
+// StatusQuery narrows down what GetServicesStatusFiltered returns
+type StatusQuery struct {
+	RunningOnly bool     // Leave out services that aren't running
+	ExcludeEnv  bool     // Leave out the environment variables of each service
+	Selector    Selector // Only services whose labels match, if set
 }
 
 func (gg *GladiusGuardian) GetServicesStatus(name string) map[string]*serviceStatus {
-	gg.mux.Lock()
-	defer gg.mux.Unlock()
+	return gg.GetServicesStatusFiltered(name, StatusQuery{})
+}
+
+// GetServicesStatusFiltered returns the status of the service (or all of them)
+// narrowed down by the query. It's read from the latest status snapshot, so
+// it doesn't wait on starts, and the statuses are shared between callers and
+// mustn't be changed.
+func (gg *GladiusGuardian) GetServicesStatusFiltered(name string, q StatusQuery) map[string]*serviceStatus {
+	snapshot := gg.statusSnapshot()
+
+	services := make(map[string]*serviceStatus)
+	add := func(serviceName string, status *serviceStatus) {
+		if q.Selector != nil && !q.Selector.Matches(status.Labels) {
+			return
+		}
+		if q.RunningOnly && !status.Running {
+			return
+		}
+		if q.ExcludeEnv {
+			withoutEnv := *status
+			withoutEnv.Env = nil
+			withoutEnv.Overrides = nil
+			if status.LastExit != nil {
+				lastExit := *status.LastExit
+				lastExit.Env, lastExit.Overrides = nil, nil
+				withoutEnv.LastExit = &lastExit
+			}
+			status = &withoutEnv
+		}
+		services[serviceName] = status
+	}
 
 	if name == "all" || name == "" {
-		services := make(map[string]*serviceStatus)
-		for serviceName, service := range gg.services {
-			services[serviceName] = newServiceStatus(service)
+		for serviceName, status := range snapshot {
+			add(serviceName, status)
 		}
 		return services
 	}
 
-	services := make(map[string]*serviceStatus)
-	services[name] = newServiceStatus(gg.services[name])
+	status := snapshot[name]
+	if status == nil {
+		status = newServiceStatus(nil)
+	}
+	add(name, status)
 	return services
+}
+
+// SetEnabled enables or disables a service. Disabled services keep their
+// settings, logs and stats and can still be started on their own, but are
+// skipped when starting or stopping "all" services. They're still stopped when
+// the guardian shuts down, see StopAllServices.
+func (gg *GladiusGuardian) SetEnabled(name string, enabled bool) error {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
 
+	settings, ok := gg.registeredServices[name]
+	if !ok {
+		return ErrNotRegistered
+	}
+	settings.disabled = !enabled
+	gg.publishViewsLocked()
+	gg.revision.bump()
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"enabled":      enabled,
+	}).Info("Changed whether service is enabled")
+	return nil
 }
 
-func (gg *GladiusGuardian) StopService(name string) error {
+// StatusRevision returns a number that increases every time a service is
+// registered, started or stops
+func (gg *GladiusGuardian) StatusRevision() uint64 {
+	return gg.revision.current()
+}
+
+// WaitForStatusChange blocks until the status revision is past since or the
+// context is done, it returns the current revision
+func (gg *GladiusGuardian) WaitForStatusChange(ctx context.Context, since uint64) uint64 {
+	return gg.revision.wait(ctx, since)
+}
+
+func (gg *GladiusGuardian) isRegistered(name string) bool {
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
+	_, ok := gg.registeredServices[name]
+	return ok
+}
 
-	if name == "all" || name == "" {
-		var result *multierror.Error
-		for sName := range gg.registeredServices {
-			err := gg.stopServiceInternal(sName)
-			if err != nil {
-				result = multierror.Append(result, fmt.Errorf("error stopping service %s: %s", sName, err))
-			}
-			continue
+// serviceNames resolves a service name that could be "all" to the names of the
+// services it refers to, "all" leaves out disabled services
+func (gg *GladiusGuardian) serviceNames(name string) []string {
+	if name != "all" && name != "" {
+		return []string{name}
+	}
+
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	names := make([]string, 0, len(gg.registeredServices))
+	for sName, settings := range gg.registeredServices {
+		if !settings.disabled {
+			names = append(names, sName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Actions that can be applied to services
+const (
+	ActionStart   = "start"
+	ActionStop    = "stop"
+	ActionRestart = "restart"
+)
+
+// SetServiceState starts or stops the service (or all of them) and returns the
+// result for each one. In idempotent mode a service that's already in the
+// desired state is a successful no-op rather than an error.
+func (gg *GladiusGuardian) SetServiceState(ctx context.Context, name string, running bool, env []string, idempotent bool) []*ServiceResult {
+	return gg.SetServicesState(ctx, gg.serviceNames(name), running, env, idempotent)
+}
+
+// SetServiceStateAsync is like SetServiceState but runs in the background,
+// returning an operation to track the progress of each service
+func (gg *GladiusGuardian) SetServiceStateAsync(ctx context.Context, name string, running bool, env []string, idempotent bool) *Operation {
+	return gg.SetServicesStateAsync(ctx, gg.serviceNames(name), running, env, idempotent)
+}
+
+// SetServicesState is SetServiceState for a list of services, like the ones
+// SelectServices picked. When starting them dependencies go first.
+func (gg *GladiusGuardian) SetServicesState(ctx context.Context, names []string, running bool, env []string, idempotent bool) []*ServiceResult {
+	return gg.BatchAction(ctx, runningAction(running), gg.stateChangeOrder(names, running), env, idempotent)
+}
+
+// SetServicesStateAsync is like SetServicesState but runs in the background
+func (gg *GladiusGuardian) SetServicesStateAsync(ctx context.Context, names []string, running bool, env []string, idempotent bool) *Operation {
+	return gg.BatchActionAsync(ctx, runningAction(running), gg.stateChangeOrder(names, running), env, idempotent)
+}
+
+// stateChangeOrder returns the order to change the state of the services in,
+// when starting them dependencies go first
+func (gg *GladiusGuardian) stateChangeOrder(names []string, running bool) []string {
+	if !running || len(names) < 2 {
+		return names
+	}
+
+	included := make(map[string]bool)
+	for _, n := range names {
+		included[n] = true
+	}
+	ordered := make([]string, 0, len(names))
+	for _, n := range gg.startOrder(names) {
+		if included[n] {
+			ordered = append(ordered, n)
+		}
+	}
+	return ordered
+}
+
+// BatchAction applies the action to each of the named services in order and
+// returns the result for each one
+func (gg *GladiusGuardian) BatchAction(ctx context.Context, action string, names []string, env []string, idempotent bool) []*ServiceResult {
+	results := make([]*ServiceResult, 0, len(names))
+	for _, name := range names {
+		results = append(results, gg.applyAction(ctx, action, name, env, idempotent))
+	}
+	return results
+}
+
+// BatchActionAsync is like BatchAction but runs in the background, returning
+// an operation to track the progress of each service. The context is only used
+// to continue its trace, cancelling it doesn't affect the operation.
+func (gg *GladiusGuardian) BatchActionAsync(ctx context.Context, action string, names []string, env []string, idempotent bool) *Operation {
+	ctx = tracing.Detach(ctx)
+	return gg.operations.start(action, names, func(name string) *ServiceResult {
+		return gg.applyAction(ctx, action, name, env, idempotent)
+	})
+}
+
+func runningAction(running bool) string {
+	if running {
+		return ActionStart
+	}
+	return ActionStop
+}
+
+func (gg *GladiusGuardian) applyAction(ctx context.Context, action, name string, env []string, idempotent bool) *ServiceResult {
+	var err error
+	switch action {
+	case ActionStart:
+		_, err = gg.startWithDependencies(ctx, name, env)
+	case ActionStop:
+		err = gg.StopServiceContext(ctx, name)
+	case ActionRestart:
+		gg.mux.Lock()
+		settings, ok := gg.registeredServices[name]
+		gg.mux.Unlock()
+		if ok && settings.opts.BlueGreen {
+			err = gg.blueGreenRestart(ctx, name)
+			break
+		}
+
+		// Restarting a stopped service just starts it
+		err = gg.StopServiceContext(ctx, name)
+		if errors.Is(err, ErrNotRunning) {
+			err = nil
 		}
-		err := result.ErrorOrNil()
+		if err == nil {
+			_, err = gg.startWithDependencies(ctx, name, env)
+		}
+	default:
+		err = fmt.Errorf("unknown action %s", action)
+	}
+
+	if idempotent && (errors.Is(err, ErrAlreadyRunning) || errors.Is(err, ErrNotRunning)) {
+		return &ServiceResult{Service: name, Success: true, NoOp: true}
+	}
+	return newServiceResult(name, err)
+}
+
+// GetOperation returns the current state of a background operation
+func (gg *GladiusGuardian) GetOperation(id string) (*Operation, bool) {
+	return gg.operations.get(id)
+}
+
+// StopService stops a service, or every enabled one when the name is "all"
+func (gg *GladiusGuardian) StopService(name string) error {
+	return gg.StopServiceContext(context.Background(), name)
+}
+
+// StopServiceContext is StopService, traced as part of the context's trace
+func (gg *GladiusGuardian) StopServiceContext(ctx context.Context, name string) (err error) {
+	_, span := tracing.Start(ctx, "guardian.StopService")
+	span.SetAttribute("service.name", name)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	if name == "all" || name == "" {
+		return gg.stopServices(ctx, gg.serviceNames(name))
+	}
+
+	return gg.stopServiceInternal(ctx, name)
+}
+
+// StopAllServices stops every registered service, disabled ones included, for
+// when none of them may keep running, like when the guardian shuts down
+func (gg *GladiusGuardian) StopAllServices() error {
+	return gg.stopServices(context.Background(), gg.registeredNames())
+}
+
+func (gg *GladiusGuardian) stopServices(ctx context.Context, names []string) error {
+	var result *multierror.Error
+	for _, sName := range names {
+		err := gg.stopServiceInternal(ctx, sName)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"err": err,
-			}).Warn("Error stoping one or more service")
+			result = multierror.Append(result, fmt.Errorf("error stopping service %s: %s", sName, err))
 		}
-		return result.ErrorOrNil()
 	}
+	err := result.ErrorOrNil()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Error stoping one or more service")
+	}
+	return err
+}
 
-	return gg.stopServiceInternal(name)
+// StartService starts a service, or every one when the name is "all", and
+// returns a handle to the run of it that was started. There's no handle when
+// starting all of them.
+func (gg *GladiusGuardian) StartService(name string, env []string) (*ServiceHandle, error) {
+	return gg.StartServiceContext(context.Background(), name, env)
 }
 
-func (gg *GladiusGuardian) StartService(name string, env []string) error {
+// StartServiceContext is StartService, traced as part of the context's trace
+func (gg *GladiusGuardian) StartServiceContext(ctx context.Context, name string, env []string) (*ServiceHandle, error) {
 	if name == "all" || name == "" {
 		var result *multierror.Error
-		for sName := range gg.registeredServices {
-			err := gg.startServiceInternal(sName, env)
+		for _, sName := range gg.stateChangeOrder(gg.serviceNames(name), true) {
+			_, err := gg.startServiceInternal(ctx, sName, env)
 			if err != nil {
 				result = multierror.Append(result, fmt.Errorf("error starting service %s: %s", sName, err))
 			}
 		}
-		return result.ErrorOrNil()
+		return nil, result.ErrorOrNil()
+	}
+
+	return gg.startWithDependencies(ctx, name, env)
+}
+
+// startWithDependencies starts whatever the service depends on that isn't
+// running yet, then the service itself
+func (gg *GladiusGuardian) startWithDependencies(ctx context.Context, name string, env []string) (*ServiceHandle, error) {
+	for _, dep := range gg.startOrder([]string{name}) {
+		if dep == name {
+			break
+		}
+		_, err := gg.startServiceInternal(ctx, dep, env)
+		if err != nil && !errors.Is(err, ErrAlreadyRunning) {
+			return nil, fmt.Errorf("can't start %s, dependency %s failed: %w", name, dep, err)
+		}
 	}
 
-	return gg.startServiceInternal(name, env)
+	return gg.startServiceInternal(ctx, name, env)
 }
 
-func (gg *GladiusGuardian) startServiceInternal(name string, env []string) error {
+// startOrder returns the services along with everything they depend on, with
+// dependencies ahead of the services that need them
+func (gg *GladiusGuardian) startOrder(names []string) []string {
 	gg.mux.Lock()
 	defer gg.mux.Unlock()
 
-	serviceSettings, ok := gg.registeredServices[name]
-	if !ok {
-		return errors.New("attempted to start unregistered service")
+	order := make([]string, 0, len(names))
+	visited := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		if settings, ok := gg.registeredServices[name]; ok {
+			for _, dep := range settings.opts.DependsOn {
+				visit(dep)
+			}
+		}
+		order = append(order, name)
 	}
-
-	if gg.services[name] != nil {
-		return fmt.Errorf("can't start %s because it's already running", name)
+	for _, name := range names {
+		visit(name)
 	}
+	return order
+}
 
-	if len(env) == 0 {
-		env = viper.GetStringSlice("DefaultEnvironment")
-	}
+func (gg *GladiusGuardian) startServiceInternal(ctx context.Context, name string, env []string) (_ *ServiceHandle, err error) {
+	ctx, span := tracing.Start(ctx, "guardian.StartService")
+	span.SetAttribute("service.name", name)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 
-	if err := gg.checkTimeout(); err != nil {
-		return err
+	// Checked before taking the lock since it can take a while
+	if err := gg.waitForStartConditions(ctx, name); err != nil {
+		return nil, err
 	}
 
-	p, err := gg.spawnProcess(name, serviceSettings.execName, serviceSettings.env, gg.spawnTimeout)
-	if err != nil {
-		return err
+	sv := gg.supervisor(name)
+	if sv == nil {
+		return nil, fmt.Errorf("can't start %s: %w", name, ErrNotRegistered)
 	}
-	gg.services[name] = p
-	log.WithFields(log.Fields{
-		"service_name":     name,
-		"exec_location":    serviceSettings.execName,
-		"environment_vars": strings.Join(env, ", "),
-	}).Debug("Started service")
-	return nil
+	res := sv.call(supervisorCommand{kind: commandStart, ctx: ctx, env: env})
+	if res.err != nil {
+		return nil, res.err
+	}
+	return res.handle, nil
 }
 
-func (gg *GladiusGuardian) stopServiceInternal(name string) error {
-	serviceSettings, ok := gg.registeredServices[name]
-	if !ok {
-		return errors.New("attempted to stop unregistered service")
+// stopServiceInternal kills the service and waits for it to exit, for at
+// most its StopTimeout
+func (gg *GladiusGuardian) stopServiceInternal(ctx context.Context, name string) error {
+	sv := gg.supervisor(name)
+	if sv == nil {
+		return fmt.Errorf("can't stop %s: %w", name, ErrNotRegistered)
+	}
+	gg.cancelRestart(name)
+	res := sv.call(supervisorCommand{kind: commandStop})
+	if res.err != nil || res.handle == nil {
+		return res.err
 	}
 
-	service := gg.services[name]
-	if service == nil {
-		return errors.New("service is not running so can not stop")
+	gg.mux.Lock()
+	timeout := gg.registeredServices[name].opts.StopTimeout
+	gg.mux.Unlock()
+	if timeout <= 0 {
+		timeout = defaultStopTimeout
 	}
 
-	err := service.Process.Kill()
-	if err != nil {
+	select {
+	case <-res.handle.Done():
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("stopped waiting for %s to exit: %s", name, ctx.Err())
+	case <-time.After(timeout):
 		log.WithFields(log.Fields{
-			"service_name":     name,
-			"exec_location":    serviceSettings.execName,
-			"environment_vars": strings.Join(serviceSettings.env, ", "),
-			"err":              err,
-		}).Warn("Couldn't kill service")
-		return errors.New("couldn't kill service, error was: " + err.Error())
+			"service_name": name,
+			"pid":          res.handle.PID,
+			"timeout":      timeout,
+		}).Error("Service refused to die after being killed")
+		return fmt.Errorf("%s (pid %d) is still running %s after being killed: %w", name, res.handle.PID, timeout, ErrStopTimedOut)
 	}
-
-	return nil
 }
 
-func (gg *GladiusGuardian) AddLogClient(serviceName string, w http.ResponseWriter, r *http.Request) {
-	gg.mux.Lock()
-	defer gg.mux.Unlock()
-
+// AddLogClient upgrades the request to a websocket that follows the
+// service's log, it returns ErrNotRegistered without upgrading it if there's
+// no such service
+func (gg *GladiusGuardian) AddLogClient(serviceName string, w http.ResponseWriter, r *http.Request) error {
+	if !gg.isRegistered(serviceName) {
+		return ErrNotRegistered
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Warn(err)
-		return
+		return nil // The upgrader already responded
 	}
 
-	gg.serviceWebSockets[serviceName] = append(gg.serviceWebSockets[serviceName], conn)
+	gg.logClients.add(serviceName, conn)
+	return nil
 }
 
 func (gg *GladiusGuardian) AppendToLog(serviceName, line string) {
-	if gg.serviceLogs[serviceName] == nil {
-		gg.serviceLogs[serviceName] = NewFixedSizeLog(viper.GetInt("MaxLogLines"))
+	gg.logs.append(serviceName, line) // Add to our internal fixed size log
+	gg.stats.logLine(serviceName, line)
+	if gg.alerts != nil {
+		gg.alerts.logLine(serviceName, line)
+	}
+	gg.logClients.broadcast(serviceName, line)
+	if gg.bus.publishesLogs() {
+		gg.bus.publish(Event{Type: EventLog, Service: serviceName, Time: time.Now(), Message: line})
 	}
-	gg.serviceLogs[serviceName].Append(line) // Add to our internal fixed size log
-	gg.updateWebsocketLog(serviceName, line)
 }
 
-func (gg *GladiusGuardian) checkTimeout() error {
-	if gg.spawnTimeout == nil {
-		return errors.New("spawn timeout not set, please set it before a process is spawned")
+// readLog sends each line read from r to out, the service's log if it's nil,
+// until it's closed, keeping the last ones in tail if there is one
+func (gg *GladiusGuardian) readLog(name string, r io.ReadCloser, out *outputSink, tail *lineTail) {
+	defer r.Close()
+	if tail != nil {
+		defer close(tail.done)
+	}
+	if out == nil {
+		out = &outputSink{name: name, log: true}
+	}
+	defer out.close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// One copy of the line is shared by the log, its clients and the tail
+		line := scanner.Text()
+		out.write(gg, line)
+		if tail != nil {
+			tail.add(line)
+		}
 	}
-	return nil
 }
 
-func (gg *GladiusGuardian) spawnProcess(name, location string, env []string, timeout *time.Duration) (*exec.Cmd, error) {
-	p := exec.Command(location)
-	p.Env = env
+// startTimeout returns how long starts wait for services to come up, the
+// default one with a warning if SetTimeout wasn't called. The guardian's lock
+// has to be held.
+func (gg *GladiusGuardian) startTimeout() *time.Duration {
+	if gg.spawnTimeout != nil {
+		return gg.spawnTimeout
+	}
+	if !gg.warnedTimeout {
+		gg.warnedTimeout = true
+		log.WithFields(log.Fields{
+			"default_timeout": gg.defaultTimeout,
+		}).Warn("Spawn timeout not set, using the default")
+	}
+	timeout := gg.defaultTimeout
+	return &timeout
+}
 
-	// Create standard err and out pipes
-	stdOut, err := p.StdoutPipe()
+func (gg *GladiusGuardian) spawnProcess(ctx context.Context, name, location string, opts ServiceOptions, env []string, timeout *time.Duration) (_ instance, err error) {
+	ctx, span := tracing.Start(ctx, "guardian.spawnProcess")
+	span.SetAttribute("service.name", name)
+	span.SetAttribute("exec.location", location)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	release, err := gg.spawns.acquire(ctx, name)
 	if err != nil {
-		return nil, fmt.Errorf("Error creating StdoutPipe for command: %s", err)
+		return nil, err
 	}
-	stdErr, err := p.StderrPipe()
-	if err != nil {
-		return nil, fmt.Errorf("Error creating StderrPipe for command: %s", err)
+	defer release()
+
+	if opts.Chroot && !filepath.IsAbs(location) {
+		return nil, fmt.Errorf("Executable %s of a chrooted service has to be an absolute path", location)
+	}
+	if err := prepareDataDir(name, opts); err != nil {
+		return nil, fmt.Errorf("Error creating data directory: %s", err)
 	}
 
-	// Read both of those in
-	scanner := bufio.NewScanner(stdOut)
-	stdErrScanner := bufio.NewScanner(stdErr)
-	go func() {
-		defer stdOut.Close()
-		for scanner.Scan() {
-			gg.AppendToLog(name, scanner.Text())
-		}
-	}()
-	go func() {
-		defer stdErr.Close()
-		for stdErrScanner.Scan() {
-			gg.AppendToLog(name, stdErrScanner.Text())
-		}
-	}()
+	p := exec.Command(hostPath(opts, location), opts.Args...)
+	p.Env = env
+	p.Dir = hostPath(opts, opts.WorkingDir)
+	subreaper := gg.subreaper
+	if subreaper {
+		p.Env = append(append([]string{}, env...), serviceMarkerEnv+"="+name)
+	}
+
+	// Let the service continue our trace if it supports it
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" {
+		p.Env = append(append([]string{}, p.Env...), "TRACEPARENT="+traceParent)
+	}
+
+	execPath, envVars := p.Path, p.Env
+	if err := sandbox(name, p, opts); err != nil {
+		return nil, fmt.Errorf("Error setting up sandbox: %s", err)
+	}
 
 	// Start the command
-	err = p.Start()
+	var inst *processInstance
+	if opts.PTY {
+		inst, err = gg.startOnPTY(name, p)
+	} else {
+		inst, err = gg.startWithPipes(name, p, opts)
+	}
 	if err != nil {
 		log.WithFields(log.Fields{
 			"exec_location":    location,
@@ -286,29 +797,89 @@ func (gg *GladiusGuardian) spawnProcess(name, location string, env []string, tim
 		return nil, fmt.Errorf("Error starting process: %s", err)
 	}
 
-	go func() {
-		err := p.Wait()
-		gg.services[name] = nil // Set out service to nil when it dies
-		if err != nil {
-			// Only log errors if we didn't kill it
-			if err.Error() != "signal: killed" {
-				log.WithFields(log.Fields{
-					"exec_location":    location,
-					"environment_vars": strings.Join(env, ", "),
-					"err":              err,
-				}).Error("Service errored out")
-				gg.AppendToLog(name, "Exiting... "+err.Error())
+	inst.service, inst.subreaper = name, subreaper
+	inst.execPath, inst.envVars = execPath, envVars
+	applyScheduling(name, p.Process.Pid, opts)
+	exited := make(chan struct{})
+	var waitErr error
+	go gg.watchExit(name, inst, func() error {
+		defer close(exited)
+		defer inst.closeInput()
+		waitErr = p.Wait()
+		waited.done(p.Process.Pid)
+		if subreaper && waitErr == nil {
+			// A clean exit might just mean the service daemonized
+			if daemons := reparented(name, p.Process.Pid); len(daemons) > 0 {
+				waitErr = inst.follow(daemons)
 			}
 		}
-	}()
+		return waitErr
+	})
 
 	// Wait for the process to start
-	time.Sleep(*timeout)
-	if p.ProcessState != nil { // ProcessState is only non-nil if p.Wait() concludes
-		if p.ProcessState.Exited() {
-			return nil, fmt.Errorf("process %s already exited, check the logs for errors", name)
+	select {
+	case <-time.After(*timeout):
+	case <-exited:
+		return nil, newStartupError(name, waitErr, inst.stderrTail)
+	}
+	return inst, nil
+
+}
+
+// startWithPipes starts the command with its output going where the service's
+// Stdout and Stderr say and its input open for WriteStdin
+func (gg *GladiusGuardian) startWithPipes(name string, p *exec.Cmd, opts ServiceOptions) (*processInstance, error) {
+	outSink, errSink, err := openOutput(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	started := false
+	defer func() {
+		if !started {
+			outSink.close()
+			errSink.close()
 		}
+	}()
+
+	// Create standard err and out pipes, our own rather than StdoutPipe and
+	// StderrPipe since Wait closes those as soon as the process exits and
+	// anything still in them would be lost
+	stdOut, stdOutWrite, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("Error creating stdout pipe for command: %s", err)
+	}
+	p.Stdout = stdOutWrite
+	defer stdOutWrite.Close()
+	stdErr, stdErrWrite, err := os.Pipe()
+	if err != nil {
+		stdOut.Close()
+		return nil, fmt.Errorf("Error creating stderr pipe for command: %s", err)
+	}
+	p.Stderr = stdErrWrite
+	defer stdErrWrite.Close()
+
+	// Our own pipe rather than StdinPipe, so the write end is a file that
+	// can be handed to a new guardian process
+	stdinRead, stdinWrite, err := os.Pipe()
+	if err != nil {
+		stdOut.Close()
+		stdErr.Close()
+		return nil, fmt.Errorf("Error creating stdin pipe for command: %s", err)
+	}
+	p.Stdin = stdinRead
+	defer stdinRead.Close() // The child has its own copy once it's started
+
+	if err := waited.start(p); err != nil {
+		stdOut.Close()
+		stdErr.Close()
+		stdinWrite.Close()
+		return nil, err
 	}
-	return p, nil
 
+	// Read both of those in
+	started = true
+	inst := &processInstance{cmd: p, stdout: stdOut, stderr: stdErr, stdin: stdinWrite, stderrTail: newLineTail()}
+	go gg.readLog(name, stdOut, outSink, nil)
+	go gg.readLog(name, stdErr, errSink, inst.stderrTail)
+	return inst, nil
 }
@@ -0,0 +1,39 @@
+package guardian
+
+// ServiceHandle is one run of a service, from when it was started until it
+// exits. It lets code embedding the guardian wait for a one-shot task to
+// finish or react to a service exiting without polling its status.
+type ServiceHandle struct {
+	Service string
+	PID     int
+	RunID   string // Unique to this run of the service
+
+	overrides []string // Redacted, see ExitRecord.Overrides
+	done      chan struct{}
+	exit      ExitRecord
+}
+
+func newServiceHandle(name string, inst instance) *ServiceHandle {
+	return &ServiceHandle{
+		Service: name,
+		PID:     inst.pid(),
+		RunID:   newOperationID(),
+		done:    make(chan struct{}),
+	}
+}
+
+// Done returns a channel that's closed once the run is over
+func (h *ServiceHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait waits for the run to be over and returns how it ended
+func (h *ServiceHandle) Wait() ExitStatus {
+	<-h.done
+	return h.exit.ExitStatus
+}
+
+func (h *ServiceHandle) finish(exit ExitRecord) {
+	h.exit = exit
+	close(h.done)
+}
@@ -0,0 +1,380 @@
+package guardian
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variable pointing a re-executed guardian at the state left by
+// the old one
+const handoffEnv = "GLADIUS_GUARDIAN_HANDOFF"
+
+// handoffState is what a guardian hands to the process it execs into
+type handoffState struct {
+	Services       []handoffService          `json:"services"`
+	AllocatedPorts map[string]map[string]int `json:"allocated_ports"`
+	SpawnTimeout   *time.Duration            `json:"spawn_timeout"`
+	Listeners      map[string]int            `json:"listeners"` // File descriptors by name
+	Logs           map[string][]string       `json:"logs"`
+	Maintenance    MaintenanceStatus         `json:"maintenance"`
+	EnvSet         string                    `json:"env_set"`
+	Instances      []templateInstance        `json:"instances"`
+}
+
+// handoffResources are the things besides services that are handed over on
+// re-exec
+type handoffResources struct {
+	mux        sync.Mutex
+	listeners  map[string]net.Listener
+	inherited  map[string]int // Listener FDs left by the previous process
+	beforeExec []func()
+}
+
+// Listen returns a TCP listener for addr that is handed over when the
+// guardian re-execs, so connections queue up instead of being refused while
+// the new process starts. If the previous process handed over a listener with
+// this name it's used instead of opening a new one.
+func (gg *GladiusGuardian) Listen(name, addr string) (net.Listener, error) {
+	gg.handoff.mux.Lock()
+	defer gg.handoff.mux.Unlock()
+
+	var l net.Listener
+	var err error
+	if fd, ok := gg.handoff.inherited[name]; ok {
+		delete(gg.handoff.inherited, name)
+		l, err = net.FileListener(os.NewFile(uintptr(fd), name))
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gg.handoff.listeners[name] = l
+	return l, nil
+}
+
+// BeforeReexec adds a function that's run before the guardian re-execs, like
+// gracefully shutting down an HTTP server so requests in flight finish
+func (gg *GladiusGuardian) BeforeReexec(fn func()) {
+	gg.handoff.mux.Lock()
+	defer gg.handoff.mux.Unlock()
+	gg.handoff.beforeExec = append(gg.handoff.beforeExec, fn)
+}
+
+// handoffService is a running service, its output pipes stay open across the
+// exec under the same file descriptor numbers
+type handoffService struct {
+	Name     string   `json:"name"`
+	PID      int      `json:"pid"`
+	Location string   `json:"location"`
+	Env      []string `json:"env"`
+	StdoutFD int      `json:"stdout_fd"`
+	StderrFD int      `json:"stderr_fd"`
+	StdinFD  int      `json:"stdin_fd,omitempty"`
+	PTY      bool     `json:"pty,omitempty"` // StdoutFD is the terminal
+}
+
+// The executable we were started from, looked up before an update can rename
+// it since Linux reports the renamed path afterwards
+var startExecutable, startExecutableErr = os.Executable()
+
+// adoptedInstance is a service started by the guardian process before an exec,
+// it's still our child so it can be waited on as usual
+type adoptedInstance struct {
+	proc     *os.Process
+	envVars  []string
+	execPath string
+	stdin    *os.File
+	pty      bool // stdin is the master side of its terminal
+}
+
+func (ai *adoptedInstance) pid() int         { return ai.proc.Pid }
+func (ai *adoptedInstance) env() []string    { return ai.envVars }
+func (ai *adoptedInstance) location() string { return ai.execPath }
+func (ai *adoptedInstance) input() *os.File  { return ai.stdin }
+
+func (ai *adoptedInstance) terminal() *os.File {
+	if ai.pty {
+		return ai.stdin
+	}
+	return nil
+}
+func (ai *adoptedInstance) kill() error { return ai.proc.Kill() }
+
+func (ai *adoptedInstance) signal(sig os.Signal) error { return ai.proc.Signal(sig) }
+
+// Reexec replaces the guardian with a fresh copy of its executable, keeping
+// the running services, their logs and the listeners opened with Listen. The
+// process ID stays the same, so services are still our children. Only services
+// running as processes survive, anything else is stopped first.
+func (gg *GladiusGuardian) Reexec() error {
+	executable, err := startExecutable, startExecutableErr
+	if err != nil {
+		return err
+	}
+
+	// Duplicate the listeners before the hooks get a chance to close them
+	state := handoffState{Listeners: make(map[string]int), Logs: make(map[string][]string)}
+	files := make([]*os.File, 0)
+	gg.handoff.mux.Lock()
+	for name, l := range gg.handoff.listeners {
+		fl, ok := l.(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fl.File()
+		if err != nil {
+			gg.handoff.mux.Unlock()
+			return fmt.Errorf("error handing over listener %s: %s", name, err)
+		}
+		state.Listeners[name] = int(f.Fd())
+		files = append(files, f)
+	}
+	hooks := gg.handoff.beforeExec
+	gg.handoff.mux.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	gg.mux.Lock()
+	defer gg.mux.Unlock() // Only reached if the exec fails
+
+	state.AllocatedPorts = make(map[string]map[string]int)
+	state.SpawnTimeout = gg.spawnTimeout
+	state.Maintenance = gg.Maintenance()
+	state.EnvSet = gg.EnvSets().Active
+	state.Instances = gg.templateInstances()
+	for name, inst := range gg.services {
+		pi, ok := inst.(*processInstance)
+		if inst == nil {
+			continue
+		}
+		if !ok || pi.stdout == nil || (pi.stderr == nil && !pi.pty) {
+			log.WithFields(log.Fields{
+				"service_name": name,
+			}).Warn("Service can't be handed over, stopping it")
+			inst.kill() // Its supervisor would need the lock we're holding
+			continue
+		}
+		hs := handoffService{
+			Name:     name,
+			PID:      pi.pid(),
+			Location: pi.location(),
+			Env:      pi.env(),
+			StdoutFD: int(pi.stdout.Fd()),
+			PTY:      pi.pty,
+		}
+		files = append(files, pi.stdout)
+		if !pi.pty {
+			hs.StderrFD = int(pi.stderr.Fd())
+			files = append(files, pi.stderr)
+		}
+		if pi.stdin != nil && !pi.pty {
+			hs.StdinFD = int(pi.stdin.Fd())
+			files = append(files, pi.stdin)
+		}
+		state.Services = append(state.Services, hs)
+	}
+	for service := range gg.registeredServices {
+		state.AllocatedPorts[service] = gg.AllocatedPorts(service)
+		if fsl := gg.logs.get(service); fsl != nil {
+			state.Logs[service] = fsl.LogLines()
+		}
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("gladius-guardian-handoff-%d.json", os.Getpid()))
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"executable": executable,
+		"services":   len(state.Services),
+	}).Info("Handing services over to a new guardian process")
+	return execGuardian(executable, files, append(os.Environ(), handoffEnv+"="+path))
+}
+
+// AdoptServices takes over the services a previous guardian process handed
+// over when it exec'd into this one. Services need to be registered first.
+func (gg *GladiusGuardian) AdoptServices() (int, error) {
+	path := os.Getenv(handoffEnv)
+	if path == "" {
+		return 0, nil
+	}
+	os.Unsetenv(handoffEnv) // So services we start don't see it
+	defer os.Remove(path)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	var state handoffState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return 0, fmt.Errorf("invalid handoff state: %s", err)
+	}
+
+	if state.SpawnTimeout != nil {
+		gg.SetTimeout(state.SpawnTimeout)
+	}
+
+	// Services instantiated through the API have to be registered again
+	// before they can be adopted
+	for _, inst := range state.Instances {
+		if err := gg.InstantiateTemplate(inst.Template, inst.Name, inst.Params, inst.Env); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": inst.Name,
+				"err":          err,
+			}).Warn("Couldn't register service from template again")
+		}
+	}
+	gg.ports.mux.Lock()
+	for service, ports := range state.AllocatedPorts {
+		if len(ports) > 0 {
+			gg.ports.allocated[service] = ports
+		}
+	}
+	gg.ports.mux.Unlock()
+
+	gg.maintenance.mux.Lock()
+	gg.maintenance.all = gg.maintenance.all || state.Maintenance.All
+	for _, service := range state.Maintenance.Services {
+		gg.maintenance.services[service] = true
+	}
+	gg.maintenance.mux.Unlock()
+
+	// Running services have the set that was active, even if it was switched
+	// since the config was written
+	gg.envSets.mux.Lock()
+	if _, ok := gg.envSets.sets[state.EnvSet]; ok {
+		gg.envSets.active = state.EnvSet
+	}
+	gg.envSets.mux.Unlock()
+
+	for service, lines := range state.Logs {
+		for _, line := range lines {
+			gg.AppendToLog(service, line)
+		}
+	}
+
+	gg.handoff.mux.Lock()
+	for name, fd := range state.Listeners {
+		gg.handoff.inherited[name] = fd
+	}
+	gg.handoff.mux.Unlock()
+
+	adopted := 0
+	var errs []string
+	for _, hs := range state.Services {
+		if err := gg.adopt(hs); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", hs.Name, err))
+			continue
+		}
+		adopted++
+	}
+	if len(errs) > 0 {
+		return adopted, fmt.Errorf("couldn't adopt some services: %v", errs)
+	}
+	return adopted, nil
+}
+
+func (gg *GladiusGuardian) adopt(hs handoffService) error {
+	if hs.PTY {
+		return gg.adoptTerminal(hs)
+	}
+	stdout := os.NewFile(uintptr(hs.StdoutFD), hs.Name+"-stdout")
+	stderr := os.NewFile(uintptr(hs.StderrFD), hs.Name+"-stderr")
+	var stdin *os.File
+	if hs.StdinFD > 0 {
+		stdin = os.NewFile(uintptr(hs.StdinFD), hs.Name+"-stdin")
+	}
+	proc, err := os.FindProcess(hs.PID)
+	if err != nil {
+		return err
+	}
+
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[hs.Name]
+	gg.mux.Unlock()
+	if !ok {
+		stdout.Close()
+		stderr.Close()
+		if stdin != nil {
+			stdin.Close()
+		}
+		return errors.New("service isn't registered anymore, leaving it running")
+	}
+	outSink, errSink, err := openOutput(hs.Name, settings.opts)
+	if err != nil {
+		// It's running already, its output is better off in the log than lost
+		log.WithFields(log.Fields{
+			"service_name": hs.Name,
+			"err":          err,
+		}).Warn("Couldn't open service output, sending it to the log")
+		outSink, errSink = nil, nil
+	}
+
+	inst := &adoptedInstance{proc: proc, envVars: hs.Env, execPath: hs.Location, stdin: stdin}
+	go gg.readLog(hs.Name, stdout, outSink, nil)
+	go gg.readLog(hs.Name, stderr, errSink, nil)
+	gg.watchAdopted(hs, inst)
+	return nil
+}
+
+// adoptTerminal takes over a service running on a terminal, whose master side
+// is both its output and input
+func (gg *GladiusGuardian) adoptTerminal(hs handoffService) error {
+	master := os.NewFile(uintptr(hs.StdoutFD), hs.Name+"-pty")
+	proc, err := os.FindProcess(hs.PID)
+	if err != nil {
+		return err
+	}
+
+	if !gg.isRegistered(hs.Name) {
+		master.Close()
+		return errors.New("service isn't registered anymore, leaving it running")
+	}
+
+	inst := &adoptedInstance{proc: proc, envVars: hs.Env, execPath: hs.Location, stdin: master, pty: true}
+	go gg.readTerminal(hs.Name, master)
+	gg.watchAdopted(hs, inst)
+	return nil
+}
+
+// watchAdopted tracks an adopted service as running until it exits
+func (gg *GladiusGuardian) watchAdopted(hs handoffService, inst *adoptedInstance) {
+	proc := inst.proc
+	waited.add(func() ([]int, error) { return []int{proc.Pid}, nil })
+	gg.supervisor(hs.Name).do(supervisorCommand{kind: commandAdopt, inst: inst})
+	go gg.watchExit(hs.Name, inst, func() error {
+		if inst.stdin != nil && !inst.pty {
+			defer inst.stdin.Close()
+		}
+		state, err := waited.wait(proc)
+		if err != nil {
+			return err
+		}
+		if !state.Success() {
+			return &exec.ExitError{ProcessState: state}
+		}
+		return nil
+	})
+
+	log.WithFields(log.Fields{
+		"service_name": hs.Name,
+		"pid":          hs.PID,
+	}).Info("Adopted running service")
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package guardian
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// execGuardian execs into executable, keeping files open so the new process
+// can pick them up
+func execGuardian(executable string, files []*os.File, env []string) error {
+	for _, f := range files {
+		if _, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFD, 0); errno != 0 {
+			return fmt.Errorf("error keeping %s open: %s", f.Name(), errno)
+		}
+	}
+	return syscall.Exec(executable, os.Args, env)
+}
@@ -0,0 +1,7 @@
+package guardian
+
+import "os"
+
+func execGuardian(executable string, files []*os.File, env []string) error {
+	return ErrUnsupportedPlatform
+}
@@ -0,0 +1,107 @@
+package guardian
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the guardian lock can be held before the guardian counts as wedged
+const wedgedTimeout = 2 * time.Second
+
+// ReadinessCheck returns an error if the guardian isn't ready yet
+type ReadinessCheck func() error
+
+type healthChecks struct {
+	mux    sync.Mutex
+	checks map[string]ReadinessCheck
+
+	checked bool // Ready has been run at least once
+	ready   bool // What it returned the last time
+}
+
+// AddReadinessCheck adds a check that has to pass for the guardian to report
+// itself ready, subsystems use this to hold off readiness until they're up
+func (gg *GladiusGuardian) AddReadinessCheck(name string, check ReadinessCheck) {
+	gg.health.mux.Lock()
+	defer gg.health.mux.Unlock()
+
+	gg.health.checks[name] = check
+}
+
+// Live returns an error if the guardian looks wedged, that is its lock can't
+// be taken in a reasonable amount of time
+func (gg *GladiusGuardian) Live() error {
+	locked := make(chan struct{})
+	go func() {
+		gg.mux.Lock()
+		gg.mux.Unlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return nil
+	case <-time.After(wedgedTimeout):
+		return errors.New("guardian lock has been held for over " + wedgedTimeout.String())
+	}
+}
+
+// Ready runs every readiness check and returns the failures keyed by check
+// name, along with the names of every check that was run
+func (gg *GladiusGuardian) Ready() (map[string]string, []string) {
+	gg.health.mux.Lock()
+	checks := make(map[string]ReadinessCheck, len(gg.health.checks)+2)
+	for name, check := range gg.health.checks {
+		checks[name] = check
+	}
+	gg.health.mux.Unlock()
+
+	checks["live"] = gg.Live
+	checks["services_registered"] = func() error {
+		gg.mux.Lock()
+		defer gg.mux.Unlock()
+		if len(gg.registeredServices) == 0 {
+			return errors.New("no services registered")
+		}
+		return nil
+	}
+
+	names := make([]string, 0, len(checks))
+	failures := make(map[string]string)
+	for name, check := range checks {
+		names = append(names, name)
+		if err := check(); err != nil {
+			failures[name] = err.Error()
+		}
+	}
+	sort.Strings(names)
+	gg.readinessChanged(failures)
+	return failures, names
+}
+
+// readinessChanged emits an event when the guardian becomes ready or stops
+// being ready
+func (gg *GladiusGuardian) readinessChanged(failures map[string]string) {
+	ready := len(failures) == 0
+	gg.health.mux.Lock()
+	changed := !gg.health.checked || gg.health.ready != ready
+	gg.health.checked, gg.health.ready = true, ready
+	gg.health.mux.Unlock()
+	if !changed {
+		return
+	}
+
+	if ready {
+		gg.emit(Event{Type: EventReady})
+		return
+	}
+	failed := make([]string, 0, len(failures))
+	for name, failure := range failures {
+		failed = append(failed, name+": "+failure)
+	}
+	sort.Strings(failed)
+	gg.emit(Event{Type: EventUnready, Message: strings.Join(failed, ", ")})
+}
@@ -0,0 +1,199 @@
+package guardian
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PruneRule removes files matching any of its glob Paths, like rotated logs
+// ("/var/log/gladius/*.log.*") or crash bundles, once they're older than
+// MaxAge. If there's a MaxMB the oldest of the rest are removed until they add
+// up to less than that. Directories matching a path are removed as a whole.
+type PruneRule struct {
+	Name   string
+	Paths  []string
+	MaxAge time.Duration
+	MaxMB  int64
+}
+
+// PruneStats is what the last run of a housekeeping task removed
+type PruneStats struct {
+	Task    string    `json:"task"`
+	LastRun time.Time `json:"last_run"`
+	Removed int       `json:"removed"`
+	Freed   int64     `json:"freed_bytes"`
+	Total   int64     `json:"total_removed"` // Over the guardian's life
+	Error   string    `json:"error,omitempty"`
+}
+
+// The housekeeping task that prunes the exit history of every service
+const pruneRunHistory = "run_history"
+
+type housekeeping struct {
+	mux   sync.Mutex
+	stats map[string]*PruneStats
+}
+
+func (hk *housekeeping) record(task string, removed int, freed int64, err error) {
+	hk.mux.Lock()
+	defer hk.mux.Unlock()
+	s, ok := hk.stats[task]
+	if !ok {
+		s = &PruneStats{Task: task}
+		hk.stats[task] = s
+	}
+	s.LastRun, s.Removed, s.Freed, s.Error = time.Now(), removed, freed, ""
+	s.Total += int64(removed)
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// StartHousekeeping runs the prune rules every interval, along with pruning
+// exits older than historyMaxAge from the exit history of each service if
+// it's set
+func (gg *GladiusGuardian) StartHousekeeping(interval time.Duration, rules []PruneRule, historyMaxAge time.Duration) error {
+	for _, rule := range rules {
+		if rule.Name == "" || rule.Name == pruneRunHistory {
+			return fmt.Errorf("prune rule needs a name other than %q", pruneRunHistory)
+		}
+		if len(rule.Paths) == 0 {
+			return fmt.Errorf("prune rule %s has no paths", rule.Name)
+		}
+		if rule.MaxAge <= 0 && rule.MaxMB <= 0 {
+			return fmt.Errorf("prune rule %s needs MaxAge or MaxMB", rule.Name)
+		}
+		for _, p := range rule.Paths {
+			if _, err := filepath.Match(p, ""); err != nil {
+				return fmt.Errorf("prune rule %s has a bad path %q: %s", rule.Name, p, err)
+			}
+		}
+	}
+
+	go func() {
+		for {
+			gg.runHousekeeping(rules, historyMaxAge)
+			time.Sleep(interval)
+		}
+	}()
+	return nil
+}
+
+func (gg *GladiusGuardian) runHousekeeping(rules []PruneRule, historyMaxAge time.Duration) {
+	for _, rule := range rules {
+		removed, freed, err := pruneFiles(rule, time.Now())
+		gg.housekeeping.record(rule.Name, removed, freed, err)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"rule": rule.Name,
+				"err":  err,
+			}).Warn("Couldn't prune everything")
+		}
+		if removed > 0 {
+			log.WithFields(log.Fields{
+				"rule":        rule.Name,
+				"removed":     removed,
+				"freed_bytes": freed,
+			}).Info("Pruned old files")
+		}
+	}
+
+	if historyMaxAge > 0 {
+		removed := gg.exits.prune(time.Now().Add(-historyMaxAge))
+		gg.housekeeping.record(pruneRunHistory, removed, 0, nil)
+	}
+}
+
+// Housekeeping returns what each housekeeping task removed the last time it
+// ran, sorted by task
+func (gg *GladiusGuardian) Housekeeping() []PruneStats {
+	gg.housekeeping.mux.Lock()
+	defer gg.housekeeping.mux.Unlock()
+	stats := make([]PruneStats, 0, len(gg.housekeeping.stats))
+	for _, s := range gg.housekeeping.stats {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Task < stats[j].Task })
+	return stats
+}
+
+type pruneCandidate struct {
+	path  string
+	size  int64
+	mtime time.Time
+}
+
+// pruneFiles removes what the rule matches that's past its age or size and
+// returns how many paths it removed and how many bytes that freed
+func pruneFiles(rule PruneRule, now time.Time) (int, int64, error) {
+	seen := make(map[string]bool)
+	candidates := make([]pruneCandidate, 0)
+	for _, pattern := range rule.Paths {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			info, err := os.Lstat(path)
+			if err != nil {
+				continue
+			}
+			size := info.Size()
+			if info.IsDir() {
+				size, _, _ = dirSize(path)
+			}
+			candidates = append(candidates, pruneCandidate{path: path, size: size, mtime: info.ModTime()})
+		}
+	}
+	// Oldest first
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].mtime.Before(candidates[j].mtime) })
+
+	var total int64
+	for _, c := range candidates {
+		total += c.size
+	}
+
+	removed, freed := 0, int64(0)
+	var errs []error
+	for _, c := range candidates {
+		tooOld := rule.MaxAge > 0 && now.Sub(c.mtime) > rule.MaxAge
+		tooBig := rule.MaxMB > 0 && total > rule.MaxMB<<20
+		if !tooOld && !tooBig {
+			break // Everything after is newer
+		}
+		if err := os.RemoveAll(c.path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+		freed += c.size
+		total -= c.size
+	}
+	if len(errs) > 0 {
+		return removed, freed, fmt.Errorf("couldn't remove %d paths, first: %w", len(errs), errs[0])
+	}
+	return removed, freed, nil
+}
+
+// prune drops exits from before cutoff and returns how many it dropped
+func (eh *exitHistory) prune(cutoff time.Time) int {
+	eh.mux.Lock()
+	defer eh.mux.Unlock()
+	removed := 0
+	for name, records := range eh.records {
+		i := 0
+		for i < len(records) && records[i].Time.Before(cutoff) {
+			i++
+		}
+		removed += i
+		eh.records[name] = records[i:]
+	}
+	return removed
+}
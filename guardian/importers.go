@@ -0,0 +1,342 @@
+package guardian
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ServiceDefinition is everything needed to register a service, in the config
+// file it's a [Services.<name>] table with an Executable or an Image
+type ServiceDefinition struct {
+	Name        string `mapstructure:"-"`
+	Executable  string
+	Environment []string
+
+	ServiceOptions `mapstructure:",squash"`
+}
+
+// RegisterDefinition registers a service from its definition, the default
+// environment is added in front of its own
+func (gg *GladiusGuardian) RegisterDefinition(def ServiceDefinition, defaultEnv []string) error {
+	env := append(append([]string{}, defaultEnv...), def.Environment...)
+	return gg.RegisterServiceWithOptions(def.Name, def.Executable, env, def.ServiceOptions)
+}
+
+// ReplaceDefinition is RegisterDefinition, replacing the registration of a
+// service with the same name like ReplaceService
+func (gg *GladiusGuardian) ReplaceDefinition(def ServiceDefinition, defaultEnv []string) error {
+	env := append(append([]string{}, defaultEnv...), def.Environment...)
+	return gg.ReplaceService(def.Name, def.Executable, env, def.ServiceOptions)
+}
+
+// ImportFile reads service definitions from a docker-compose file or a
+// Procfile, picked by the file name
+func ImportFile(path string) ([]ServiceDefinition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".yml") || strings.HasSuffix(lower, ".yaml") {
+		return ImportCompose(f)
+	}
+	return ImportProcfile(f)
+}
+
+// ImportProcfile turns each "name: command" line of a Procfile into a service
+// that runs the command with /bin/sh, like foreman does
+func ImportProcfile(r io.Reader) ([]ServiceDefinition, error) {
+	defs := make([]ServiceDefinition, 0)
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected name: command", lineNum)
+		}
+		name, command := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if command == "" {
+			return nil, fmt.Errorf("line %d: %s has no command", lineNum, name)
+		}
+
+		def := ServiceDefinition{Name: name, Executable: "/bin/sh"}
+		def.Args = []string{"-c", command}
+		defs = append(defs, def)
+	}
+	return defs, scanner.Err()
+}
+
+type composeFile struct {
+	Services map[string]composeService `yaml:"services"`
+}
+
+type composeService struct {
+	Image       string        `yaml:"image"`
+	Command     interface{}   `yaml:"command"`
+	Entrypoint  interface{}   `yaml:"entrypoint"`
+	Environment interface{}   `yaml:"environment"`
+	Ports       []interface{} `yaml:"ports"`
+	Volumes     []interface{} `yaml:"volumes"`
+	DependsOn   interface{}   `yaml:"depends_on"`
+}
+
+// ImportCompose turns the services of a docker-compose file into container
+// services, with their command, environment, ports, volumes and dependencies
+func ImportCompose(r io.Reader) ([]ServiceDefinition, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var cf composeFile
+	if err := yaml.Unmarshal(b, &cf); err != nil {
+		return nil, fmt.Errorf("error parsing compose file: %s", err)
+	}
+	if len(cf.Services) == 0 {
+		return nil, errors.New("no services found, only version 2 and later compose files are supported")
+	}
+
+	names := make([]string, 0, len(cf.Services))
+	for name := range cf.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	defs := make([]ServiceDefinition, 0, len(names))
+	for _, name := range names {
+		cs := cf.Services[name]
+		if cs.Image == "" {
+			return nil, fmt.Errorf("service %s has no image, build it and set one", name)
+		}
+		if cs.Entrypoint != nil {
+			log.WithFields(log.Fields{
+				"service_name": name,
+			}).Warn("Entrypoint isn't supported, the image's default is used")
+		}
+
+		def := ServiceDefinition{Name: name}
+		def.Image = cs.Image
+		if def.Args, err = composeCommand(cs.Command); err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err)
+		}
+		def.Environment = composeEnvironment(cs.Environment)
+		def.DependsOn = composeDependsOn(cs.DependsOn)
+		for _, p := range cs.Ports {
+			port, err := composePort(p)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %s", name, err)
+			}
+			def.PublishPorts = append(def.PublishPorts, port)
+		}
+		for _, v := range cs.Volumes {
+			volume, err := composeVolume(v)
+			if err != nil {
+				return nil, fmt.Errorf("service %s: %s", name, err)
+			}
+			def.Volumes = append(def.Volumes, volume)
+		}
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
+
+// composeCommand accepts the string and list forms of a command
+func composeCommand(v interface{}) ([]string, error) {
+	switch c := v.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return splitCommand(c)
+	case []interface{}:
+		return stringList(c), nil
+	default:
+		return nil, fmt.Errorf("invalid command %v", v)
+	}
+}
+
+// composeEnvironment accepts the list and map forms of an environment
+func composeEnvironment(v interface{}) []string {
+	switch e := v.(type) {
+	case []interface{}:
+		return stringList(e)
+	case map[interface{}]interface{}:
+		env := make([]string, 0, len(e))
+		for k, val := range e {
+			if val == nil {
+				val = ""
+			}
+			env = append(env, fmt.Sprintf("%v=%v", k, val))
+		}
+		sort.Strings(env)
+		return env
+	}
+	return nil
+}
+
+// composeDependsOn accepts the list and (long syntax) map forms of depends_on
+func composeDependsOn(v interface{}) []string {
+	switch d := v.(type) {
+	case []interface{}:
+		return stringList(d)
+	case map[interface{}]interface{}:
+		deps := make([]string, 0, len(d))
+		for k := range d {
+			deps = append(deps, fmt.Sprint(k))
+		}
+		sort.Strings(deps)
+		return deps
+	}
+	return nil
+}
+
+func composePort(v interface{}) (string, error) {
+	switch p := v.(type) {
+	case string:
+		return p, nil
+	case int:
+		return strconv.Itoa(p), nil
+	case map[interface{}]interface{}:
+		if p["target"] == nil {
+			return "", fmt.Errorf("port %v has no target", v)
+		}
+		port := fmt.Sprint(p["target"])
+		if p["published"] != nil {
+			port = fmt.Sprintf("%v:%s", p["published"], port)
+		}
+		if p["protocol"] != nil {
+			port += "/" + fmt.Sprint(p["protocol"])
+		}
+		return port, nil
+	}
+	return "", fmt.Errorf("invalid port %v", v)
+}
+
+func composeVolume(v interface{}) (string, error) {
+	switch vol := v.(type) {
+	case string:
+		return vol, nil
+	case map[interface{}]interface{}:
+		if vol["source"] == nil || vol["target"] == nil {
+			return "", fmt.Errorf("volume %v needs a source and target", v)
+		}
+		bind := fmt.Sprintf("%v:%v", vol["source"], vol["target"])
+		if ro, _ := vol["read_only"].(bool); ro {
+			bind += ":ro"
+		}
+		return bind, nil
+	}
+	return "", fmt.Errorf("invalid volume %v", v)
+}
+
+func stringList(l []interface{}) []string {
+	s := make([]string, 0, len(l))
+	for _, v := range l {
+		s = append(s, fmt.Sprint(v))
+	}
+	return s
+}
+
+// splitCommand splits a command line into arguments, handling quotes and
+// backslash escapes like a shell would
+func splitCommand(command string) ([]string, error) {
+	args := make([]string, 0)
+	var current strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range command {
+		switch {
+		case escaped:
+			current.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				current.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote, inArg = c, true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", command)
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+var bareKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// WriteServicesTOML writes the definitions as [Services.<name>] tables that
+// can be added to the config file
+func WriteServicesTOML(w io.Writer, defs []ServiceDefinition) error {
+	bw := bufio.NewWriter(w)
+	for i, def := range defs {
+		name := def.Name
+		if !bareKey.MatchString(name) {
+			name = strconv.Quote(name)
+		}
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintf(bw, "[Services.%s]\n", name)
+
+		writeTOMLString(bw, "Executable", def.Executable)
+		writeTOMLStrings(bw, "Args", def.Args)
+		writeTOMLStrings(bw, "Environment", def.Environment)
+		writeTOMLStrings(bw, "DependsOn", def.DependsOn)
+		writeTOMLString(bw, "Image", def.Image)
+		writeTOMLStrings(bw, "Volumes", def.Volumes)
+		writeTOMLStrings(bw, "PublishPorts", def.PublishPorts)
+	}
+	return bw.Flush()
+}
+
+func writeTOMLString(w io.Writer, key, value string) {
+	if value != "" {
+		fmt.Fprintf(w, "%s = %s\n", key, strconv.Quote(value))
+	}
+}
+
+func writeTOMLStrings(w io.Writer, key string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, strconv.Quote(v))
+	}
+	fmt.Fprintf(w, "%s = [%s]\n", key, strings.Join(quoted, ", "))
+}
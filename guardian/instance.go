@@ -0,0 +1,132 @@
+package guardian
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// instance is a running copy of a service, whichever backend runs it
+type instance interface {
+	pid() int // Host PID of the main process, 0 if there isn't one
+	env() []string
+	location() string // Executable or image the instance was started from
+	kill() error
+	signal(sig os.Signal) error
+}
+
+// processInstance is a service started as a child process
+type processInstance struct {
+	cmd *exec.Cmd
+
+	// What the service was run as, the command itself runs the sandbox
+	// subcommand for sandboxed services
+	execPath string
+	envVars  []string
+
+	// Read ends of the output pipes and the write end of the input one, kept
+	// so they can be handed to a new guardian process
+	stdout, stderr *os.File
+	stdin          *os.File
+	pty            bool // stdout and stdin are both the terminal's master side
+
+	// Last lines written to stderr, there's no separate stderr on a terminal
+	stderrTail *lineTail
+
+	service   string
+	subreaper bool // Started while the guardian is a subreaper
+
+	mux      sync.Mutex
+	daemons  []*os.Process // Followed after the main process daemonized
+	stopping bool
+}
+
+func (pi *processInstance) pid() int {
+	pi.mux.Lock()
+	defer pi.mux.Unlock()
+	if len(pi.daemons) > 0 {
+		return pi.daemons[0].Pid
+	}
+	return pi.cmd.Process.Pid
+}
+
+func (pi *processInstance) env() []string   { return pi.envVars }
+func (pi *processInstance) input() *os.File { return pi.stdin }
+
+func (pi *processInstance) terminal() *os.File {
+	if pi.pty {
+		return pi.stdout
+	}
+	return nil
+}
+
+// closeInput closes our end of the input pipe once the process is gone, a
+// terminal is closed by whatever reads it instead so no output is lost
+func (pi *processInstance) closeInput() {
+	if !pi.pty && pi.stdin != nil {
+		pi.stdin.Close()
+	}
+}
+func (pi *processInstance) location() string { return pi.execPath }
+
+// signal signals the main process, or the daemons it left behind
+func (pi *processInstance) signal(sig os.Signal) error {
+	pi.mux.Lock()
+	daemons := pi.daemons
+	pi.mux.Unlock()
+	if len(daemons) == 0 {
+		return pi.cmd.Process.Signal(sig)
+	}
+	var err error
+	for _, d := range daemons {
+		if sigErr := d.Signal(sig); sigErr != nil {
+			err = sigErr
+		}
+	}
+	return err
+}
+
+// kill kills the main process, or the daemons it left behind, along with any
+// of its descendants that were re-parented to us
+func (pi *processInstance) kill() error {
+	pi.mux.Lock()
+	pi.stopping = true
+	daemons := pi.daemons
+	pi.mux.Unlock()
+
+	var err error
+	if len(daemons) == 0 {
+		err = pi.cmd.Process.Kill()
+	}
+	for _, d := range daemons {
+		if killErr := d.Kill(); killErr != nil {
+			err = killErr
+		}
+	}
+	if !pi.subreaper {
+		return err
+	}
+
+	// Followed daemons are reaped by follow, anything else here
+	followed := make(map[int]bool)
+	for _, d := range daemons {
+		followed[d.Pid] = true
+	}
+	for _, d := range reparented(pi.service, pi.cmd.Process.Pid) {
+		if !followed[d.Pid] && d.Kill() == nil {
+			go waited.wait(d)
+		} else {
+			waited.done(d.Pid)
+		}
+	}
+	return err
+}
+
+// watchExit waits for the instance to exit and lets the service's supervisor
+// know how it went. wait returns the exit error.
+func (gg *GladiusGuardian) watchExit(name string, inst instance, wait func() error) {
+	err := wait()
+	if sv := gg.supervisor(name); sv != nil {
+		sv.commands <- supervisorCommand{kind: commandExited, inst: inst, err: err}
+	}
+}
@@ -0,0 +1,146 @@
+package guardian
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Label keys are lowercase since the config file doesn't keep the case of
+// keys, values are kept to what can be written in a selector
+var (
+	labelKeyPattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9_./-]*$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9_./-]*$`)
+)
+
+// validateLabels returns an error if one of the labels of a service can't be
+// used in a selector
+func validateLabels(name string, labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) {
+			return fmt.Errorf("invalid label %q of service %s, keys have to be lowercase letters, digits, '_', '.', '/' or '-'", key, name)
+		}
+		if !labelValuePattern.MatchString(value) {
+			return fmt.Errorf("invalid value %q of label %s of service %s, it can only have letters, digits, '_', '.', '/' or '-'", value, key, name)
+		}
+	}
+	return nil
+}
+
+type selectorTerm struct {
+	key    string
+	value  string
+	negate bool // The label must not be set to value, or not be set at all
+	exists bool // Only whether the label is set matters
+}
+
+// Selector picks services by their labels. It's a comma separated list of
+// terms that all have to match: "role=edge" and "role!=edge" compare the
+// value of a label, "role" and "!role" whether the service has it at all.
+type Selector []selectorTerm
+
+// ParseSelector parses a selector like "role=edge,net!=testnet"
+func ParseSelector(s string) (Selector, error) {
+	sel := make(Selector, 0)
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		var t selectorTerm
+		if key, value, ok := strings.Cut(term, "!="); ok {
+			t = selectorTerm{key: key, value: value, negate: true}
+		} else if key, value, ok := strings.Cut(term, "="); ok {
+			t = selectorTerm{key: key, value: value}
+		} else if strings.HasPrefix(term, "!") {
+			t = selectorTerm{key: term[1:], exists: true, negate: true}
+		} else {
+			t = selectorTerm{key: term, exists: true}
+		}
+		t.key = strings.TrimSpace(t.key)
+		t.value = strings.TrimSpace(t.value)
+		if !labelKeyPattern.MatchString(t.key) || !labelValuePattern.MatchString(t.value) {
+			return nil, fmt.Errorf("invalid selector term %q", term)
+		}
+		sel = append(sel, t)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty selector %q", s)
+	}
+	return sel, nil
+}
+
+// Matches returns true if the labels match every term of the selector
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, t := range sel {
+		value, ok := labels[t.key]
+		matched := ok
+		if !t.exists {
+			matched = ok && value == t.value
+		}
+		if matched == t.negate {
+			return false
+		}
+	}
+	return true
+}
+
+func (sel Selector) String() string {
+	terms := make([]string, 0, len(sel))
+	for _, t := range sel {
+		switch {
+		case t.exists && t.negate:
+			terms = append(terms, "!"+t.key)
+		case t.exists:
+			terms = append(terms, t.key)
+		case t.negate:
+			terms = append(terms, t.key+"!="+t.value)
+		default:
+			terms = append(terms, t.key+"="+t.value)
+		}
+	}
+	return strings.Join(terms, ",")
+}
+
+// SelectServices returns the names of the services whose labels match the
+// selector, sorted. Like "all" it leaves out disabled services.
+func (gg *GladiusGuardian) SelectServices(sel Selector) []string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	names := make([]string, 0)
+	for name, settings := range gg.registeredServices {
+		if !settings.disabled && sel.Matches(settings.opts.Labels) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// labelsOf returns a copy of the labels of every service that has some
+func (gg *GladiusGuardian) labelsOf() map[string]map[string]string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	labels := make(map[string]map[string]string)
+	for name, settings := range gg.registeredServices {
+		if len(settings.opts.Labels) > 0 {
+			labels[name] = copyLabels(settings.opts.Labels)
+		}
+	}
+	return labels
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,114 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotLeader is returned when starting a service on a guardian that's
+// standing by for the leader
+var ErrNotLeader = errors.New("this guardian isn't the leader")
+
+// LeaderLock is a lock only one of a set of redundant guardians can hold, the
+// one holding it is the leader and the only one running services
+type LeaderLock interface {
+	// Acquire blocks until the lock is held or the context is done. The
+	// returned channel is closed if the lock is lost.
+	Acquire(ctx context.Context) (<-chan struct{}, error)
+	// Release gives up the lock
+	Release() error
+}
+
+// LeaderStatus is whether this guardian is the leader of its set
+type LeaderStatus struct {
+	Enabled bool      `json:"enabled"` // False when there's no leader election
+	Leader  bool      `json:"leader"`
+	Since   time.Time `json:"since,omitempty"` // When it last became leader or stood down
+}
+
+type leadership struct {
+	mux    sync.Mutex
+	status LeaderStatus
+}
+
+// LeaderStatus returns whether this guardian is the leader
+func (gg *GladiusGuardian) LeaderStatus() LeaderStatus {
+	gg.leadership.mux.Lock()
+	defer gg.leadership.mux.Unlock()
+	return gg.leadership.status
+}
+
+// checkLeader returns ErrNotLeader if there's leader election and this
+// guardian isn't the leader
+func (gg *GladiusGuardian) checkLeader() error {
+	status := gg.LeaderStatus()
+	if status.Enabled && !status.Leader {
+		return ErrNotLeader
+	}
+	return nil
+}
+
+func (gg *GladiusGuardian) setLeader(leader bool) {
+	gg.leadership.mux.Lock()
+	gg.leadership.status.Leader = leader
+	gg.leadership.status.Since = time.Now()
+	gg.leadership.mux.Unlock()
+	gg.revision.bump()
+}
+
+// RunLeaderElection makes the guardian stand by until it holds the lock.
+// Services can't be started until then, once it's the leader every enabled
+// service is started. If the lock is lost every service is stopped right away
+// so two guardians never run them at the same time, and it stands by again.
+func (gg *GladiusGuardian) RunLeaderElection(ctx context.Context, lock LeaderLock) {
+	gg.leadership.mux.Lock()
+	gg.leadership.status = LeaderStatus{Enabled: true, Since: time.Now()}
+	gg.leadership.mux.Unlock()
+
+	go func() {
+		defer lock.Release()
+		for ctx.Err() == nil {
+			log.Info("Standing by until this guardian is the leader")
+			lost, err := lock.Acquire(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.WithFields(log.Fields{
+						"err": err,
+					}).Warn("Couldn't acquire leader lock")
+					sleep(ctx, leaderRetryInterval)
+				}
+				continue
+			}
+
+			gg.setLeader(true)
+			log.Info("This guardian is the leader now, starting services")
+			if _, err := gg.StartService("all", nil); err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Warn("Couldn't start every service after becoming the leader")
+			}
+
+			select {
+			case <-lost:
+				log.Warn("Lost the leader lock, stopping services")
+			case <-ctx.Done():
+			}
+			gg.setLeader(false)
+			gg.StopAllServices()
+		}
+	}()
+}
+
+// How long to wait before trying to get the leader lock again after an error
+const leaderRetryInterval = 5 * time.Second
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,257 @@
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsulLock is a leader lock on a Consul key, held through a session that's
+// renewed while the guardian is alive. If the guardian dies the session
+// expires after its TTL and the lock goes to one of the others.
+type ConsulLock struct {
+	url    string
+	token  string
+	key    string
+	ttl    time.Duration
+	client *http.Client
+
+	mux     sync.Mutex
+	session string
+	done    chan struct{} // Closed on Release to stop renewing the session
+}
+
+// NewConsulLock returns a lock on the key for the agent at url, like
+// http://localhost:8500. The token can be empty if ACLs are disabled.
+func NewConsulLock(url, token, key string, ttl time.Duration) *ConsulLock {
+	if ttl < 10*time.Second {
+		ttl = 10 * time.Second // Consul's minimum
+	}
+	return &ConsulLock{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  token,
+		key:    strings.TrimPrefix(key, "/"),
+		ttl:    ttl,
+		client: &http.Client{},
+	}
+}
+
+// Acquire creates a session and waits until the key can be locked with it
+func (cl *ConsulLock) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	var session struct {
+		ID string `json:"ID"`
+	}
+	err := cl.do(ctx, "PUT", "/v1/session/create", map[string]interface{}{
+		"Name":      "gladius-guardian",
+		"TTL":       cl.ttl.String(),
+		"Behavior":  "release",
+		"LockDelay": "5s",
+	}, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	index := uint64(0)
+	for {
+		var acquired bool
+		if err := cl.do(ctx, "PUT", "/v1/kv/"+cl.key+"?acquire="+session.ID, host, &acquired); err != nil {
+			cl.destroy(session.ID)
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+
+		// Wait for the holder to let go, or its session to expire
+		if index, err = cl.waitForRelease(ctx, index); err != nil {
+			cl.destroy(session.ID)
+			return nil, err
+		}
+	}
+
+	lost := make(chan struct{})
+	done := make(chan struct{})
+	cl.mux.Lock()
+	cl.session, cl.done = session.ID, done
+	cl.mux.Unlock()
+	go cl.renew(session.ID, lost, done)
+	return lost, nil
+}
+
+// waitForRelease blocks until the key changes after index, like when its
+// holder lets go, and returns the new index
+func (cl *ConsulLock) waitForRelease(ctx context.Context, index uint64) (uint64, error) {
+	path := "/v1/kv/" + cl.key + "?" + url.Values{"index": {strconv.FormatUint(index, 10)}, "wait": {"1m"}}.Encode()
+	req, err := cl.request(ctx, "GET", path, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := cl.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error talking to consul: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return 0, fmt.Errorf("consul returned %s for key %s", resp.Status, cl.key)
+	}
+	newIndex, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return newIndex, nil
+}
+
+// renew keeps the session alive, closing lost if it can't be renewed or the
+// key isn't locked with it anymore
+func (cl *ConsulLock) renew(session string, lost, done chan struct{}) {
+	defer close(lost)
+	ticker := time.NewTicker(cl.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cl.ttl/3)
+		err := cl.do(ctx, "PUT", "/v1/session/renew/"+session, nil, nil)
+		var pairs []struct {
+			Session string `json:"Session"`
+		}
+		if err == nil {
+			err = cl.do(ctx, "GET", "/v1/kv/"+cl.key, nil, &pairs)
+		}
+		cancel()
+		if err != nil || len(pairs) == 0 || pairs[0].Session != session {
+			return
+		}
+	}
+}
+
+// Release destroys the session, which unlocks the key
+func (cl *ConsulLock) Release() error {
+	cl.mux.Lock()
+	session, done := cl.session, cl.done
+	cl.session, cl.done = "", nil
+	cl.mux.Unlock()
+	if done == nil {
+		return nil
+	}
+	close(done)
+	return cl.destroy(session)
+}
+
+func (cl *ConsulLock) destroy(session string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return cl.do(ctx, "PUT", "/v1/session/destroy/"+session, nil, nil)
+}
+
+func (cl *ConsulLock) request(ctx context.Context, method, path string, body interface{}) (*http.Request, error) {
+	var b []byte
+	switch v := body.(type) {
+	case nil:
+	case string:
+		b = []byte(v)
+	default:
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, cl.url+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	if cl.token != "" {
+		req.Header.Set("X-Consul-Token", cl.token)
+	}
+	return req.WithContext(ctx), nil
+}
+
+func (cl *ConsulLock) do(ctx context.Context, method, path string, body, out interface{}) error {
+	req, err := cl.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := cl.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error talking to consul: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("consul returned %s for %s", resp.Status, path)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// FileLock is a leader lock on a file, for guardians on the same host or
+// sharing a filesystem that supports locks. The lock goes away with the
+// process holding it.
+type FileLock struct {
+	path string
+
+	mux  sync.Mutex
+	file *os.File
+}
+
+// NewFileLock returns a lock on the file at path, it's created if needed
+func NewFileLock(path string) *FileLock {
+	return &FileLock{path: path}
+}
+
+// Acquire tries to lock the file every second until it gets it
+func (fl *FileLock) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	f, err := os.OpenFile(fl.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := lockFile(f)
+		if err == nil {
+			break
+		}
+		if err != errLocked {
+			f.Close()
+			return nil, err
+		}
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		}
+	}
+
+	// Say who holds it, for whoever looks at the file
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+
+	fl.mux.Lock()
+	fl.file = f
+	fl.mux.Unlock()
+	// A held file lock is only lost when the process goes away
+	return make(chan struct{}), nil
+}
+
+// Release closes the file, which unlocks it
+func (fl *FileLock) Release() error {
+	fl.mux.Lock()
+	defer fl.mux.Unlock()
+	if fl.file == nil {
+		return nil
+	}
+	err := fl.file.Close()
+	fl.file = nil
+	return err
+}
@@ -0,0 +1,12 @@
+package guardian
+
+import (
+	"errors"
+	"os"
+)
+
+var errLocked = errors.New("file is locked by another process")
+
+func lockFile(f *os.File) error {
+	return ErrUnsupportedPlatform
+}
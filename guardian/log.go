@@ -1,25 +1,65 @@
 package guardian
 
 import (
-	"container/list"
+	"math"
 	"sync"
+	"unicode/utf8"
 )
 
-// FixedSizeLog is a log storage that only keeps a max number of entries, and
-// deletes old ones
+// What the logs of all services can take together and each of them on its
+// own by default, see SetLogBudget
+const (
+	defaultLogBudget     = 32 << 20
+	defaultServiceLogCap = 1 << 20
+)
+
+// What a line costs on top of its text, so services logging lots of short
+// lines are accounted for too
+const logLineOverhead = 32
+
+type logLine struct {
+	text string
+	seq  uint64 // Order lines were logged in across every service
+}
+
+func (ll logLine) size() int {
+	return len(ll.text) + logLineOverhead
+}
+
+// FixedSizeLog is a log storage that only keeps up to a max number of bytes
+// (and optionally lines) of lines, and deletes old ones
 type FixedSizeLog struct {
-	logList    *list.List // Linked list for efficient popping of old elements
-	maxLogSize int        // How many lines can our log be before we delete old lines
-	mux        sync.Mutex
+	lines    []logLine // Ring buffer, the oldest line is at start
+	start    int
+	count    int
+	bytes    int
+	maxBytes int // How big our log can be before we delete old lines
+	maxLines int // How many lines it can have on top of that, 0 for any
+	seq      uint64
+	mux      sync.Mutex
 }
 
 // NewFixedSizeLog returns a new FixedSizeLog with the specified max size of
 // log entries to keep
+//
+// Deprecated: logs are kept within a byte budget now, use NewByteLimitedLog.
 func NewFixedSizeLog(maxSize int) *FixedSizeLog {
+	if maxSize < 1 {
+		maxSize = 1 // It always kept the last line
+	}
 	return &FixedSizeLog{
-		logList:    list.New(),
-		maxLogSize: maxSize,
-		mux:        sync.Mutex{},
+		maxBytes: math.MaxInt32,
+		maxLines: maxSize,
+		mux:      sync.Mutex{},
+	}
+}
+
+// NewByteLimitedLog returns a new FixedSizeLog that keeps up to maxBytes of
+// log lines
+func NewByteLimitedLog(maxBytes int) *FixedSizeLog {
+	return &FixedSizeLog{
+		maxBytes: maxBytes,
+		mux:      sync.Mutex{},
 	}
 }
 
@@ -28,18 +68,209 @@ func (fsl *FixedSizeLog) Append(line string) {
 	fsl.mux.Lock()
 	defer fsl.mux.Unlock()
 
-	// Delete the first element if our list grows too long
-	if fsl.logList.Len() >= fsl.maxLogSize {
-		fsl.logList.Remove(fsl.logList.Front())
+	fsl.seq++
+	fsl.appendLocked(logLine{text: line, seq: fsl.seq})
+}
+
+// appendLocked adds the line, deleting old ones to make room for it, and
+// returns by how many bytes the log grew
+func (fsl *FixedSizeLog) appendLocked(line logLine) int {
+	if line.size() > fsl.maxBytes {
+		if fsl.maxBytes <= logLineOverhead {
+			return 0
+		}
+		// Cut at a rune boundary, clients are sent lines as text messages
+		// and drop the connection on invalid UTF-8
+		cut := fsl.maxBytes - logLineOverhead
+		for cut > 0 && !utf8.RuneStart(line.text[cut]) {
+			cut--
+		}
+		line.text = line.text[:cut]
 	}
-	fsl.logList.PushBack(line) // Always add the line to the log
+	before := fsl.bytes
+	for fsl.count > 0 && (fsl.bytes+line.size() > fsl.maxBytes || (fsl.maxLines > 0 && fsl.count >= fsl.maxLines)) {
+		fsl.popLocked()
+	}
+
+	if fsl.count == len(fsl.lines) {
+		// Full, grow it with the oldest line first again
+		grown := make([]logLine, 0, 2*len(fsl.lines)+16)
+		grown = append(grown, fsl.lines[fsl.start:]...)
+		grown = append(grown, fsl.lines[:fsl.start]...)
+		fsl.lines, fsl.start = grown[:cap(grown)], 0
+	}
+	fsl.lines[(fsl.start+fsl.count)%len(fsl.lines)] = line
+	fsl.count++
+	fsl.bytes += line.size()
+	return fsl.bytes - before
+}
+
+// popLocked deletes the oldest line and returns its size
+func (fsl *FixedSizeLog) popLocked() int {
+	line := fsl.lines[fsl.start]
+	fsl.lines[fsl.start] = logLine{}
+	fsl.start = (fsl.start + 1) % len(fsl.lines)
+	fsl.count--
+	fsl.bytes -= line.size()
+	return line.size()
+}
+
+// oldestLocked returns when the oldest line was logged, false if it's empty
+func (fsl *FixedSizeLog) oldestLocked() (uint64, bool) {
+	if fsl.count == 0 {
+		return 0, false
+	}
+	return fsl.lines[fsl.start].seq, true
 }
 
 // LogLines returns a string slice representing the underlying values
 func (fsl *FixedSizeLog) LogLines() []string {
-	toReturn := make([]string, 0, 1000)
-	for e := fsl.logList.Front(); e != nil; e = e.Next() {
-		toReturn = append(toReturn, e.Value.(string))
+	fsl.mux.Lock()
+	defer fsl.mux.Unlock()
+
+	toReturn := make([]string, 0, fsl.count)
+	for i := 0; i < fsl.count; i++ {
+		toReturn = append(toReturn, fsl.lines[(fsl.start+i)%len(fsl.lines)].text)
 	}
 	return toReturn
 }
+
+// Len returns how many lines are in the log
+func (fsl *FixedSizeLog) Len() int {
+	fsl.mux.Lock()
+	defer fsl.mux.Unlock()
+
+	return fsl.count
+}
+
+// Bytes returns how much the lines in the log take
+func (fsl *FixedSizeLog) Bytes() int {
+	fsl.mux.Lock()
+	defer fsl.mux.Unlock()
+
+	return fsl.bytes
+}
+
+// logStore keeps the log of every service within a budget for all of them,
+// once it's used up the oldest lines of any service go first
+type logStore struct {
+	mux        sync.Mutex
+	logs       map[string]*FixedSizeLog
+	budget     int
+	serviceCap int
+	maxLines   int // Per service, 0 for any, see SetMaxLogLines
+	total      int
+	seq        uint64
+}
+
+func newLogStore() *logStore {
+	return &logStore{logs: make(map[string]*FixedSizeLog), budget: defaultLogBudget, serviceCap: defaultServiceLogCap}
+}
+
+// SetLogBudget sets how many bytes of log lines are kept for all services
+// together and for each one, 0 keeps the default for either. Logs already
+// over them lose their oldest lines.
+func (gg *GladiusGuardian) SetLogBudget(total, perService int) {
+	if total <= 0 {
+		total = defaultLogBudget
+	}
+	if perService <= 0 {
+		perService = defaultServiceLogCap
+	}
+
+	ls := gg.logs
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	ls.budget, ls.serviceCap = total, perService
+	for _, fsl := range ls.logs {
+		fsl.mux.Lock()
+		fsl.maxBytes = perService
+		for fsl.bytes > perService {
+			ls.total -= fsl.popLocked()
+		}
+		fsl.mux.Unlock()
+	}
+	ls.evictLocked()
+}
+
+// SetMaxLogLines caps how many lines each service's log keeps on top of its
+// byte budget, 0 removes the cap. It's what the MaxLogLines setting did before
+// logs were kept within a byte budget.
+func (gg *GladiusGuardian) SetMaxLogLines(maxLines int) {
+	if maxLines < 0 {
+		maxLines = 0
+	}
+
+	ls := gg.logs
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	ls.maxLines = maxLines
+	for _, fsl := range ls.logs {
+		fsl.mux.Lock()
+		fsl.maxLines = maxLines
+		for maxLines > 0 && fsl.count > maxLines {
+			ls.total -= fsl.popLocked()
+		}
+		fsl.mux.Unlock()
+	}
+}
+
+// append adds the line to the service's log
+func (ls *logStore) append(name, line string) {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+
+	fsl := ls.logs[name]
+	if fsl == nil {
+		fsl = NewByteLimitedLog(ls.serviceCap)
+		fsl.maxLines = ls.maxLines
+		ls.logs[name] = fsl
+	}
+	ls.seq++
+	fsl.mux.Lock()
+	ls.total += fsl.appendLocked(logLine{text: line, seq: ls.seq})
+	fsl.mux.Unlock()
+	ls.evictLocked()
+}
+
+// evictLocked deletes the oldest lines across all services until they're
+// within the budget
+func (ls *logStore) evictLocked() {
+	for ls.total > ls.budget {
+		var oldest *FixedSizeLog
+		var oldestSeq uint64
+		for _, fsl := range ls.logs {
+			fsl.mux.Lock()
+			seq, ok := fsl.oldestLocked()
+			fsl.mux.Unlock()
+			if ok && (oldest == nil || seq < oldestSeq) {
+				oldest, oldestSeq = fsl, seq
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		oldest.mux.Lock()
+		ls.total -= oldest.popLocked()
+		oldest.mux.Unlock()
+	}
+}
+
+// get returns the service's log, nil if it hasn't logged anything
+func (ls *logStore) get(name string) *FixedSizeLog {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+	return ls.logs[name]
+}
+
+// all returns the lines kept for each service
+func (ls *logStore) all() map[string][]string {
+	ls.mux.Lock()
+	defer ls.mux.Unlock()
+
+	lines := make(map[string][]string, len(ls.logs))
+	for name, fsl := range ls.logs {
+		lines[name] = fsl.LogLines()
+	}
+	return lines
+}
@@ -0,0 +1,44 @@
+package guardian
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestByteLimitedLogCutsAtRuneBoundary(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"ascii", "abcdefgh", "abcdef"},
+		{"cut inside a rune", "abcde" + "é" + "x", "abcde"},
+		{"cut after a rune", "abcd" + "é" + "xy", "abcdé"},
+		{"only multi-byte runes", strings.Repeat("日", 4), "日日"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsl := NewByteLimitedLog(logLineOverhead + 6)
+			fsl.Append(tt.line)
+			got := fsl.LogLines()
+			if len(got) != 1 || got[0] != tt.want {
+				t.Fatalf("LogLines() = %q, want [%q]", got, tt.want)
+			}
+			if !utf8.ValidString(got[0]) {
+				t.Errorf("%q isn't valid UTF-8", got[0])
+			}
+		})
+	}
+}
+
+func TestFixedSizeLogKeepsLines(t *testing.T) {
+	fsl := NewFixedSizeLog(2)
+	for _, line := range []string{"one", "two", strings.Repeat("x", 1<<20)} {
+		fsl.Append(line)
+	}
+	if got, want := fsl.LogLines(), []string{"two", strings.Repeat("x", 1<<20)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LogLines() kept %d lines, want the last 2 untouched", len(got))
+	}
+}
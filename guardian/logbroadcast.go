@@ -0,0 +1,349 @@
+package guardian
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Log lines are sent to websocket clients in batches, at most this long after
+// the first line of a batch was logged or once this many lines are waiting
+const (
+	logBatchInterval = 50 * time.Millisecond
+	logBatchLines    = 64
+)
+
+// How long a message can take to be written to a log client before the client
+// is dropped, so a stalled one doesn't hold up the service's log
+const logWriteTimeout = 5 * time.Second
+
+// How many messages can wait for each log client, once they're all waiting
+// new ones are dropped for that client instead of holding up the service
+const logClientQueue = 16
+
+// Buffers batches are put together in, each batch is copied out of them to be
+// queued for the clients so they can be reused right away
+var logBatchBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// logStream is the websocket clients following a service's log and the lines
+// waiting to be sent to them
+type logStream struct {
+	name    string
+	mux     sync.Mutex
+	conns   []*logClient
+	pending []string
+	lines   uint64    // Logged by the service so far, with clients or not
+	sent    time.Time // When clients were last sent anything
+	queued  time.Time // When the first pending line was queued
+
+	dropped uint64        // Lines that couldn't be sent to a client, counted per client
+	batches uint64        // Batches sent
+	latency time.Duration // Between queueing and sending each batch, added up
+
+	timer     *time.Timer // Reused for every batch
+	scheduled bool
+}
+
+// logClient is a websocket following a service's log, messages are queued
+// for it and written by its own goroutine so a slow client only holds up
+// itself
+type logClient struct {
+	conn     *websocket.Conn
+	queue    chan logMessage // Closed once the client is removed from its stream
+	closeMsg []byte          // Close frame sent after the queue, if it's closed normally
+	done     chan struct{}   // Closed once the connection is closed
+}
+
+// logMessage is one websocket message queued for a log client
+type logMessage struct {
+	messageType int
+	data        []byte
+	lines       int // Log lines in it, counted as dropped if it can't be sent
+}
+
+// logBroadcaster sends the lines services log to the websocket clients
+// following them, each message holds one or more lines separated by newlines
+type logBroadcaster struct {
+	mux     sync.Mutex
+	streams map[string]*logStream
+}
+
+func newLogBroadcaster() *logBroadcaster {
+	return &logBroadcaster{streams: make(map[string]*logStream)}
+}
+
+func (lb *logBroadcaster) stream(name string) *logStream {
+	lb.mux.Lock()
+	defer lb.mux.Unlock()
+	s := lb.streams[name]
+	if s == nil {
+		s = &logStream{name: name}
+		lb.streams[name] = s
+	}
+	return s
+}
+
+// add has the connection follow the service's log
+func (lb *logBroadcaster) add(name string, conn *websocket.Conn) {
+	c := &logClient{conn: conn, queue: make(chan logMessage, logClientQueue), done: make(chan struct{})}
+	s := lb.stream(name)
+	s.mux.Lock()
+	s.conns = append(s.conns, c)
+	s.mux.Unlock()
+	go s.write(c)
+}
+
+// write sends the client its queued messages until the queue is closed, then
+// the close frame if there's one. If a write fails the client is removed and
+// what's left in its queue is dropped.
+func (s *logStream) write(c *logClient) {
+	defer close(c.done)
+	failed := false
+	for msg := range c.queue {
+		if failed {
+			s.drop(msg.lines)
+			continue
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(logWriteTimeout))
+		if err := c.conn.WriteMessage(msg.messageType, msg.data); err != nil {
+			failed = true
+			s.mux.Lock()
+			s.dropped += uint64(msg.lines)
+			s.removeLocked(c)
+			s.mux.Unlock()
+			c.conn.Close()
+		}
+	}
+	if !failed {
+		if c.closeMsg != nil {
+			c.conn.WriteControl(websocket.CloseMessage, c.closeMsg, time.Now().Add(time.Second))
+		}
+		c.conn.Close()
+	}
+}
+
+func (s *logStream) drop(lines int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.dropped += uint64(lines)
+}
+
+// removeLocked forgets the client and closes its queue, unless it was already
+// removed
+func (s *logStream) removeLocked(c *logClient) {
+	for i, conn := range s.conns {
+		if conn == c {
+			copy(s.conns[i:], s.conns[i+1:])
+			s.conns[len(s.conns)-1] = nil
+			s.conns = s.conns[:len(s.conns)-1]
+			close(c.queue)
+			return
+		}
+	}
+}
+
+// clients returns how many websocket clients follow the service's log
+func (lb *logBroadcaster) clients(name string) int {
+	s := lb.stream(name)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.conns)
+}
+
+// websocketMetrics is how sending a service's log to websocket clients goes,
+// counted since the guardian started
+type websocketMetrics struct {
+	Clients          int     `json:"websocket_clients"`
+	DroppedLines     uint64  `json:"websocket_dropped_lines"` // Per client, the ones too slow to keep up or gone
+	Batches          uint64  `json:"websocket_batches"`
+	AvgBroadcastTime float64 `json:"websocket_avg_broadcast_ms"` // From a batch's first line being logged to it being queued for the clients
+}
+
+func (lb *logBroadcaster) metrics(name string) websocketMetrics {
+	s := lb.stream(name)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	m := websocketMetrics{Clients: len(s.conns), DroppedLines: s.dropped, Batches: s.batches}
+	if s.batches > 0 {
+		m.AvgBroadcastTime = float64(s.latency) / float64(s.batches) / float64(time.Millisecond)
+	}
+	return m
+}
+
+// closeReason is the JSON reason of the close frames sent to log clients
+type closeReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// closeAll sends every client a close frame with the reason, after the lines
+// still waiting, and forgets them. The services are closed at the same time
+// so stalled clients only hold up shutdown for one write timeout.
+func (lb *logBroadcaster) closeAll(code int, reason closeReason) {
+	lb.mux.Lock()
+	streams := lb.streams
+	lb.streams = make(map[string]*logStream)
+	lb.mux.Unlock()
+	var wg sync.WaitGroup
+	for _, s := range streams {
+		wg.Add(1)
+		go func(s *logStream) {
+			defer wg.Done()
+			s.close(code, reason)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// CloseLogClients tells every log websocket client the guardian is going
+// away, so they can reconnect once it's back instead of waiting on a dead
+// connection
+func (gg *GladiusGuardian) CloseLogClients() {
+	gg.logClients.closeAll(websocket.CloseGoingAway, closeReason{Code: CodeUnavailable, Message: "guardian is shutting down"})
+}
+
+// close has each client sent what's queued for it and then the close frame,
+// and waits for that
+func (s *logStream) close(code int, reason closeReason) {
+	b, _ := json.Marshal(reason)
+	msg := websocket.FormatCloseMessage(code, string(b))
+
+	s.mux.Lock()
+	s.flushLocked()
+	clients := append([]*logClient(nil), s.conns...)
+	for _, c := range clients {
+		c.closeMsg = msg
+		s.removeLocked(c)
+	}
+	s.mux.Unlock()
+
+	for _, c := range clients {
+		<-c.done
+	}
+}
+
+// broadcast queues the line for the service's clients, it's dropped if there
+// aren't any
+func (lb *logBroadcaster) broadcast(name, line string) {
+	s := lb.stream(name)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.lines++
+	if len(s.conns) == 0 {
+		return
+	}
+
+	if len(s.pending) == 0 {
+		s.queued = time.Now()
+	}
+	s.pending = append(s.pending, line)
+	if len(s.pending) >= logBatchLines {
+		s.flushLocked()
+	} else if !s.scheduled {
+		s.scheduled = true
+		if s.timer == nil {
+			s.timer = time.AfterFunc(logBatchInterval, s.flush)
+		} else {
+			s.timer.Reset(logBatchInterval)
+		}
+	}
+}
+
+func (s *logStream) flush() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.flushLocked()
+}
+
+// flushLocked sends the waiting lines as one message to every client, dropping
+// the ones it can't be sent to
+func (s *logStream) flushLocked() {
+	if s.scheduled {
+		s.timer.Stop()
+		s.scheduled = false
+	}
+	if len(s.pending) == 0 {
+		return
+	}
+	buf := logBatchBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer logBatchBuffers.Put(buf)
+	for i, line := range s.pending {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+		s.pending[i] = "" // So the lines can be collected
+	}
+	lines := len(s.pending)
+	s.pending = s.pending[:0]
+	s.writeLocked(logMessage{messageType: websocket.TextMessage, data: append([]byte(nil), buf.Bytes()...), lines: lines})
+	s.batches++
+	s.latency += s.sent.Sub(s.queued)
+}
+
+// writeLocked queues the message for every client without waiting, it's
+// dropped for the ones whose queue is full. Clients it can't be written to
+// within logWriteTimeout are dropped by their writer.
+func (s *logStream) writeLocked(msg logMessage) {
+	for _, c := range s.conns {
+		select {
+		case c.queue <- msg:
+		default:
+			s.dropped += uint64(msg.lines)
+		}
+	}
+	s.sent = time.Now()
+}
+
+// logHeartbeat is sent to log clients that weren't sent anything for a while,
+// as a binary message so it can't be mistaken for lines
+type logHeartbeat struct {
+	Type    string `json:"type"` // Always "heartbeat"
+	Service string `json:"service"`
+	State   string `json:"state"`
+	Seq     uint64 `json:"seq"` // Lines the service logged so far
+}
+
+// StartLogHeartbeats sends a heartbeat with the state of its service to each
+// log client that wasn't sent anything for the interval, so an idle log can
+// be told apart from a service that stopped
+func (gg *GladiusGuardian) StartLogHeartbeats(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			gg.sendLogHeartbeats(interval)
+		}
+	}()
+}
+
+func (gg *GladiusGuardian) sendLogHeartbeats(idle time.Duration) {
+	lb := gg.logClients
+	lb.mux.Lock()
+	streams := make([]*logStream, 0, len(lb.streams))
+	for _, s := range lb.streams {
+		streams = append(streams, s)
+	}
+	lb.mux.Unlock()
+
+	views := gg.serviceViews()
+	for _, s := range streams {
+		state := StateStopped
+		if view := views[s.name]; view.inst != nil {
+			state = StateRunning
+		} else if view.starting {
+			state = StateStarting
+		}
+
+		s.mux.Lock()
+		if len(s.conns) > 0 && time.Since(s.sent) >= idle {
+			b, _ := json.Marshal(logHeartbeat{Type: "heartbeat", Service: s.name, State: state, Seq: s.lines})
+			s.writeLocked(logMessage{messageType: websocket.BinaryMessage, data: b})
+		}
+		s.mux.Unlock()
+	}
+}
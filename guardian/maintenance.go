@@ -0,0 +1,74 @@
+package guardian
+
+import (
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maintenanceMode tracks what an operator is working on, the guardian leaves
+// services in maintenance alone: no automatic restarts or reloads and no
+// alerts
+type maintenanceMode struct {
+	mux      sync.Mutex
+	all      bool
+	services map[string]bool
+}
+
+// MaintenanceStatus is what's in maintenance mode
+type MaintenanceStatus struct {
+	All      bool     `json:"all"`
+	Services []string `json:"services"`
+}
+
+// SetMaintenance puts the service, or with "all" the whole guardian, in or out
+// of maintenance mode
+func (gg *GladiusGuardian) SetMaintenance(name string, enabled bool) error {
+	if name != "all" && name != "" {
+		gg.mux.Lock()
+		_, ok := gg.registeredServices[name]
+		gg.mux.Unlock()
+		if !ok {
+			return ErrNotRegistered
+		}
+	}
+
+	gg.maintenance.mux.Lock()
+	if name == "all" || name == "" {
+		gg.maintenance.all = enabled
+	} else if enabled {
+		gg.maintenance.services[name] = true
+	} else {
+		delete(gg.maintenance.services, name)
+	}
+	gg.maintenance.mux.Unlock()
+	gg.revision.bump()
+
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"enabled":      enabled,
+	}).Info("Changed maintenance mode")
+	return nil
+}
+
+// InMaintenance returns whether the service is in maintenance mode, on its own
+// or because the whole guardian is
+func (gg *GladiusGuardian) InMaintenance(name string) bool {
+	gg.maintenance.mux.Lock()
+	defer gg.maintenance.mux.Unlock()
+	return gg.maintenance.all || gg.maintenance.services[name]
+}
+
+// Maintenance returns what's currently in maintenance mode
+func (gg *GladiusGuardian) Maintenance() MaintenanceStatus {
+	gg.maintenance.mux.Lock()
+	defer gg.maintenance.mux.Unlock()
+
+	status := MaintenanceStatus{All: gg.maintenance.all, Services: make([]string, 0)}
+	for name := range gg.maintenance.services {
+		status.Services = append(status.Services, name)
+	}
+	sort.Strings(status.Services)
+	return status
+}
@@ -0,0 +1,325 @@
+package guardian
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DNS-SD service type the guardian API is announced as
+const mdnsServiceType = "_gladius-guardian._tcp.local."
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// DNS record types and classes used by the responder
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN    = 1
+	dnsCacheFlush = 0x8000 // Set on records only we answer for
+)
+
+// How long other hosts can cache our records
+const mdnsTTL = 120
+
+// MDNSResponder answers mDNS queries for the guardian API so clients on the
+// LAN can find it without knowing its address
+type MDNSResponder struct {
+	gg       *GladiusGuardian
+	conn     *net.UDPConn
+	port     int
+	instance string // Full instance name, like myhost._gladius-guardian._tcp.local.
+	host     string // Host name, like myhost.local.
+	services bool
+}
+
+// StartMDNS announces the API listening on port as a DNS-SD service and
+// answers queries for it. instance defaults to the hostname. When services is
+// set the ports of running services are listed in the TXT record too.
+func (gg *GladiusGuardian) StartMDNS(port int, instance string, services bool) (*MDNSResponder, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	hostname = strings.Split(hostname, ".")[0]
+	if instance == "" {
+		instance = hostname
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("error joining the mDNS group: %s", err)
+	}
+
+	mr := &MDNSResponder{
+		gg:       gg,
+		conn:     conn,
+		port:     port,
+		instance: strings.Replace(instance, ".", "\\.", -1) + "." + mdnsServiceType,
+		host:     hostname + ".local.",
+		services: services,
+	}
+	go mr.serve()
+
+	// Announce ourselves a couple of times so caches pick us up right away
+	go func() {
+		for i := 0; i < 2; i++ {
+			mr.send(mr.response(0, nil, mdnsTTL), mdnsGroup)
+			time.Sleep(time.Second)
+		}
+	}()
+
+	log.WithFields(log.Fields{
+		"instance": mr.instance,
+		"port":     port,
+	}).Info("Announcing the guardian over mDNS")
+	return mr, nil
+}
+
+// Shutdown tells the LAN we're going away and stops answering queries
+func (mr *MDNSResponder) Shutdown() {
+	mr.send(mr.response(0, nil, 0), mdnsGroup)
+	mr.conn.Close()
+}
+
+func (mr *MDNSResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := mr.conn.ReadFromUDP(buf)
+		if err != nil {
+			return // Closed
+		}
+		id, questions, err := parseDNSQuery(buf[:n])
+		if err != nil || !mr.answers(questions) {
+			continue
+		}
+
+		// Queries from a port other than 5353 are one-shot queries that
+		// want a unicast reply, with the query's ID and questions
+		if src.Port != mdnsGroup.Port {
+			mr.send(mr.response(id, questions, 10), src)
+		} else {
+			mr.send(mr.response(0, nil, mdnsTTL), mdnsGroup)
+		}
+	}
+}
+
+func (mr *MDNSResponder) send(msg []byte, to *net.UDPAddr) {
+	if _, err := mr.conn.WriteToUDP(msg, to); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Debug("Couldn't send mDNS response")
+	}
+}
+
+// answers returns whether any of the questions are about us
+func (mr *MDNSResponder) answers(questions []dnsQuestion) bool {
+	for _, q := range questions {
+		switch strings.ToLower(q.name) {
+		case mdnsServiceType, strings.ToLower(mr.instance):
+			return true
+		case strings.ToLower(mr.host):
+			if q.qtype == dnsTypeA || q.qtype == dnsTypeANY {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// response builds a message with every record we have, the few of them fit in
+// a single packet
+func (mr *MDNSResponder) response(id uint16, questions []dnsQuestion, ttl uint32) []byte {
+	records := [][]byte{
+		dnsRecord(mdnsServiceType, dnsTypePTR, dnsClassIN, ttl, dnsName(mr.instance)),
+		dnsRecord(mr.instance, dnsTypeSRV, dnsClassIN|dnsCacheFlush, ttl, srvData(mr.port, mr.host)),
+		dnsRecord(mr.instance, dnsTypeTXT, dnsClassIN|dnsCacheFlush, ttl, txtData(mr.txt())),
+	}
+	for _, ip := range localIPv4s() {
+		records = append(records, dnsRecord(mr.host, dnsTypeA, dnsClassIN|dnsCacheFlush, ttl, ip))
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, []uint16{id, 0x8400, uint16(len(questions)), uint16(len(records)), 0, 0})
+	for _, q := range questions {
+		b.Write(dnsName(q.name))
+		binary.Write(&b, binary.BigEndian, []uint16{q.qtype, dnsClassIN})
+	}
+	for _, r := range records {
+		b.Write(r)
+	}
+	return b.Bytes()
+}
+
+// txt returns the TXT record entries, the API version and optionally a
+// service=port entry for each running service with a known port
+func (mr *MDNSResponder) txt() []string {
+	entries := []string{"api=" + APIPrefix, "version=" + Version}
+	if !mr.services {
+		return entries
+	}
+
+	serviceEntries := make([]string, 0)
+	for name, status := range mr.gg.GetServicesStatus("all") {
+		if !status.Running {
+			continue
+		}
+		if port := mr.gg.advertisedPort(name); port != 0 {
+			serviceEntries = append(serviceEntries, fmt.Sprintf("%s=%d", name, port))
+		}
+	}
+	sort.Strings(serviceEntries)
+	return append(entries, serviceEntries...)
+}
+
+func localIPv4s() [][]byte {
+	ips := make([][]byte, 0)
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				ips = append(ips, []byte(ip4))
+			}
+		}
+	}
+	return ips
+}
+
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+}
+
+// parseDNSQuery returns the ID and questions of a query, responses from other
+// hosts are ignored
+func parseDNSQuery(msg []byte) (uint16, []dnsQuestion, error) {
+	if len(msg) < 12 {
+		return 0, nil, errors.New("message too short")
+	}
+	id := binary.BigEndian.Uint16(msg[0:])
+	if binary.BigEndian.Uint16(msg[2:])&0x8000 != 0 {
+		return 0, nil, errors.New("not a query")
+	}
+
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+	questions := make([]dnsQuestion, 0, count)
+	offset := 12
+	for i := 0; i < count; i++ {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil || next+4 > len(msg) {
+			return 0, nil, errors.New("malformed question")
+		}
+		questions = append(questions, dnsQuestion{name: name, qtype: binary.BigEndian.Uint16(msg[next:])})
+		offset = next + 4
+	}
+	return id, questions, nil
+}
+
+// readDNSName reads a possibly compressed name at offset, returning it and
+// the offset after it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	labels := make([]string, 0)
+	next := -1
+	for jumps := 0; jumps < 20; {
+		if offset >= len(msg) {
+			return "", 0, errors.New("name out of bounds")
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(msg) {
+				return "", 0, errors.New("pointer out of bounds")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3FFF)
+			jumps++
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errors.New("label out of bounds")
+			}
+			label := string(msg[offset+1 : offset+1+length])
+			labels = append(labels, strings.Replace(label, ".", "\\.", -1))
+			offset += 1 + length
+		}
+	}
+	return "", 0, errors.New("too many compression pointers")
+}
+
+// dnsName encodes a name, dots escaped with a backslash are part of a label
+func dnsName(name string) []byte {
+	var b bytes.Buffer
+	label := make([]byte, 0, 63)
+	flush := func() {
+		b.WriteByte(byte(len(label)))
+		b.Write(label)
+		label = label[:0]
+	}
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name):
+			i++
+			label = append(label, name[i])
+		case name[i] == '.':
+			flush()
+		default:
+			label = append(label, name[i])
+		}
+	}
+	if len(label) > 0 {
+		flush()
+	}
+	b.WriteByte(0)
+	return b.Bytes()
+}
+
+func dnsRecord(name string, rtype, class uint16, ttl uint32, data []byte) []byte {
+	var b bytes.Buffer
+	b.Write(dnsName(name))
+	binary.Write(&b, binary.BigEndian, rtype)
+	binary.Write(&b, binary.BigEndian, class)
+	binary.Write(&b, binary.BigEndian, ttl)
+	binary.Write(&b, binary.BigEndian, uint16(len(data)))
+	b.Write(data)
+	return b.Bytes()
+}
+
+func srvData(port int, target string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, []uint16{0, 0, uint16(port)}) // Priority, weight, port
+	b.Write(dnsName(target))
+	return b.Bytes()
+}
+
+func txtData(entries []string) []byte {
+	var b bytes.Buffer
+	for _, e := range entries {
+		if len(e) > 255 {
+			e = e[:255]
+		}
+		b.WriteByte(byte(len(e)))
+		b.WriteString(e)
+	}
+	return b.Bytes()
+}
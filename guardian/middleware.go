@@ -0,0 +1,50 @@
+package guardian
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CORSHandler wraps h with CORS handling for the given origins, methods and
+// headers. An origin of "*" allows any origin, and no origins disables CORS
+// entirely.
+func CORSHandler(h http.Handler, allowedOrigins, allowedMethods, allowedHeaders []string) http.Handler {
+	if len(allowedOrigins) == 0 {
+		return h
+	}
+
+	methods := strings.Join(allowedMethods, ", ")
+	headers := strings.Join(allowedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !originAllowed(origin, allowedOrigins) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+
+		// Answer preflight requests here, the router would reject the OPTIONS
+		// method on most routes
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func originAllowed(origin string, allowedOrigins []string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package guardian
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const mqttKeepAlive = 60 * time.Second
+
+// MQTTPublisher publishes events at QoS 0 to the MQTT 3.1.1 topic
+// <prefix>/<service>/<event type>
+type MQTTPublisher struct {
+	mux      sync.Mutex
+	addr     string
+	prefix   string
+	clientID string
+	username string
+	password string
+	conn     net.Conn
+	stop     chan struct{}
+}
+
+// NewMQTTPublisher returns a publisher for the MQTT broker at addr, like
+// localhost:1883. It connects lazily and reconnects after errors.
+func NewMQTTPublisher(addr, topicPrefix, clientID, username, password string) *MQTTPublisher {
+	return &MQTTPublisher{
+		addr:     strings.TrimPrefix(addr, "tcp://"),
+		prefix:   strings.TrimSuffix(topicPrefix, "/"),
+		clientID: clientID,
+		username: username,
+		password: password,
+	}
+}
+
+// Publish sends the event as JSON
+func (mp *MQTTPublisher) Publish(ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	mp.mux.Lock()
+	defer mp.mux.Unlock()
+
+	if mp.conn == nil {
+		if err := mp.connect(); err != nil {
+			return err
+		}
+	}
+
+	var body bytes.Buffer
+	writeMQTTString(&body, mp.prefix+"/"+ev.source()+"/"+ev.Type)
+	body.Write(payload)
+
+	if err := mp.write(0x30, body.Bytes()); err != nil {
+		mp.disconnect()
+		return fmt.Errorf("error publishing to MQTT: %s", err)
+	}
+	return nil
+}
+
+func (mp *MQTTPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", mp.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("error connecting to MQTT: %s", err)
+	}
+	mp.conn = conn
+
+	var body bytes.Buffer
+	writeMQTTString(&body, "MQTT")
+	body.WriteByte(4)   // Protocol level 3.1.1
+	flags := byte(0x02) // Clean session
+	if mp.username != "" {
+		flags |= 0x80
+		if mp.password != "" {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(mqttKeepAlive.Seconds()))
+	writeMQTTString(&body, mp.clientID)
+	if mp.username != "" {
+		writeMQTTString(&body, mp.username)
+		if mp.password != "" {
+			writeMQTTString(&body, mp.password)
+		}
+	}
+
+	if err := mp.write(0x10, body.Bytes()); err != nil {
+		mp.disconnect()
+		return fmt.Errorf("error connecting to MQTT: %s", err)
+	}
+
+	// Wait for the CONNACK
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		mp.disconnect()
+		return fmt.Errorf("error reading MQTT CONNACK: %s", err)
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		mp.disconnect()
+		return fmt.Errorf("MQTT broker refused connection with code %d", ack[3])
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// Ping well inside the keepalive, and drain whatever the broker sends back
+	mp.stop = make(chan struct{})
+	go io.Copy(ioutil.Discard, conn)
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(mqttKeepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				mp.mux.Lock()
+				if mp.conn != nil {
+					if err := mp.write(0xC0, nil); err != nil {
+						mp.disconnect()
+					}
+				}
+				mp.mux.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}(mp.stop)
+	return nil
+}
+
+func (mp *MQTTPublisher) disconnect() {
+	if mp.conn != nil {
+		mp.conn.Close()
+		mp.conn = nil
+	}
+	if mp.stop != nil {
+		close(mp.stop)
+		mp.stop = nil
+	}
+}
+
+// write sends a packet with the fixed header byte and body
+func (mp *MQTTPublisher) write(header byte, body []byte) error {
+	if len(body) > 268435455 {
+		return errors.New("MQTT packet too large")
+	}
+
+	var packet bytes.Buffer
+	packet.WriteByte(header)
+	// Remaining length is a variable length integer
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet.WriteByte(b)
+		if length == 0 {
+			break
+		}
+	}
+	packet.Write(body)
+
+	mp.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := mp.conn.Write(packet.Bytes())
+	return err
+}
+
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
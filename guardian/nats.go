@@ -0,0 +1,96 @@
+package guardian
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSPublisher publishes events to NATS on the subject
+// <prefix>.<service>.<event type>
+type NATSPublisher struct {
+	mux    sync.Mutex
+	addr   string
+	prefix string
+	conn   net.Conn
+}
+
+// NewNATSPublisher returns a publisher for the NATS server at url, like
+// nats://localhost:4222. It connects lazily and reconnects after errors.
+func NewNATSPublisher(url, subjectPrefix string) *NATSPublisher {
+	return &NATSPublisher{
+		addr:   strings.TrimPrefix(url, "nats://"),
+		prefix: strings.TrimSuffix(subjectPrefix, "."),
+	}
+}
+
+// Publish sends the event as JSON
+func (np *NATSPublisher) Publish(ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	np.mux.Lock()
+	defer np.mux.Unlock()
+
+	if np.conn == nil {
+		if err := np.connect(); err != nil {
+			return err
+		}
+	}
+
+	subject := np.prefix + "." + ev.source() + "." + ev.Type
+	np.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err = fmt.Fprintf(np.conn, "PUB %s %d\r\n%s\r\n", subject, len(payload), payload)
+	if err != nil {
+		np.conn.Close()
+		np.conn = nil
+		return fmt.Errorf("error publishing to NATS: %s", err)
+	}
+	return nil
+}
+
+func (np *NATSPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", np.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("error connecting to NATS: %s", err)
+	}
+
+	// The server greets us with an INFO line before anything else
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	info, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting: %q", info)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	_, err = fmt.Fprint(conn, `CONNECT {"verbose":false,"pedantic":false,"name":"gladius-guardian"}`+"\r\n")
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("error connecting to NATS: %s", err)
+	}
+	np.conn = conn
+
+	// Answer the server's keepalive pings or it'll drop us
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PING") {
+				np.mux.Lock()
+				fmt.Fprint(conn, "PONG\r\n")
+				np.mux.Unlock()
+			}
+		}
+	}()
+	return nil
+}
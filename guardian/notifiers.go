@@ -0,0 +1,74 @@
+package guardian
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// WebhookNotifier posts alerts as JSON to a URL
+type WebhookNotifier struct {
+	URL    string
+	client *http.Client
+}
+
+// NewWebhookNotifier returns a notifier posting to url
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify posts the alert
+func (wn *WebhookNotifier) Notify(a Alert) error {
+	return wn.post(a)
+}
+
+// post posts v as JSON
+func (wn *WebhookNotifier) post(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	resp, err := wn.client.Post(wn.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error posting to webhook: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// EmailNotifier emails alerts through an SMTP server
+type EmailNotifier struct {
+	Server   string // host:port
+	From     string
+	To       []string
+	Username string
+	Password string
+}
+
+// Notify emails the alert
+func (en *EmailNotifier) Notify(a Alert) error {
+	subject := fmt.Sprintf("[%s] %s: %s", strings.ToUpper(a.State), a.Rule, a.Service)
+	msg := "From: " + en.From + "\r\n" +
+		"To: " + strings.Join(en.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"\r\n" + a.Message + "\r\n"
+
+	var auth smtp.Auth
+	if en.Username != "" {
+		host, _, err := net.SplitHostPort(en.Server)
+		if err != nil {
+			return fmt.Errorf("bad SMTP server address: %s", err)
+		}
+		auth = smtp.PlainAuth("", en.Username, en.Password, host)
+	}
+	return smtp.SendMail(en.Server, auth, en.From, en.To, []byte(msg))
+}
@@ -0,0 +1,163 @@
+package guardian
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Version is the guardian API version reported in the OpenAPI document
+const Version = "0.1.0"
+
+// OpenAPISpec generates the OpenAPI 3 document for the versioned guardian API
+// from the route table
+func OpenAPISpec() map[string]interface{} {
+	paths := make(map[string]interface{})
+
+	for _, rt := range routes() {
+		operation := map[string]interface{}{
+			"operationId": rt.name,
+			"summary":     rt.summary,
+			"responses": map[string]interface{}{
+				"200": responseRef("Success"),
+				"400": responseRef("Bad request"),
+			},
+		}
+
+		if rt.scope != "" {
+			operation["security"] = []interface{}{
+				map[string]interface{}{"bearerAuth": []string{rt.scope}},
+			}
+			operation["responses"].(map[string]interface{})["401"] = responseRef("Missing or invalid token")
+			operation["responses"].(map[string]interface{})["403"] = responseRef("Token lacks the required scope")
+		}
+
+		if rt.mutating {
+			operation["responses"].(map[string]interface{})["403"] = responseRef("Forbidden, or the guardian is read-only")
+		}
+
+		if len(rt.params) > 0 {
+			params := make([]interface{}, 0, len(rt.params))
+			for _, p := range rt.params {
+				params = append(params, map[string]interface{}{
+					"name":        p.name,
+					"in":          p.in,
+					"description": p.description,
+					"required":    p.required,
+					"schema":      map[string]interface{}{"type": p.kind},
+				})
+			}
+			operation["parameters"] = params
+		}
+
+		if len(rt.body) > 0 {
+			properties := make(map[string]interface{})
+			required := make([]string, 0)
+			for _, f := range rt.body {
+				properties[f.name] = fieldSchema(f)
+				if f.required {
+					required = append(required, f.name)
+				}
+			}
+			schema := map[string]interface{}{"type": "object", "properties": properties}
+			if len(required) > 0 {
+				schema["required"] = required
+			}
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schema},
+				},
+			}
+		}
+
+		// Routes without a method accept anything, document them as a GET since
+		// that's what a websocket upgrade uses
+		method := strings.ToLower(rt.method)
+		if method == "" {
+			method = "get"
+		}
+
+		item, ok := paths[rt.path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[rt.path] = item
+		}
+		item[method] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Gladius Guardian",
+			"version": Version,
+		},
+		"servers": []interface{}{
+			map[string]interface{}{"url": APIPrefix},
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{
+					"type":         "http",
+					"scheme":       "bearer",
+					"bearerFormat": "JWT",
+					"description":  "Only enforced when the guardian has a JWTSecret configured",
+				},
+			},
+			"schemas": map[string]interface{}{
+				"Response": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"success":  map[string]interface{}{"type": "boolean"},
+						"message":  map[string]interface{}{"type": "string"},
+						"data":     map[string]interface{}{},
+						"error":    map[string]interface{}{"$ref": "#/components/schemas/Error"},
+						"endpoint": map[string]interface{}{"type": "string"},
+						"noop":     map[string]interface{}{"type": "boolean"},
+					},
+				},
+				"Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"code":    map[string]interface{}{"type": "string", "description": "Machine readable code, like not_running"},
+						"message": map[string]interface{}{"type": "string"},
+						"details": map[string]interface{}{},
+					},
+				},
+			},
+		},
+	}
+}
+
+func responseRef(description string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": map[string]interface{}{"$ref": "#/components/schemas/Response"},
+			},
+		},
+	}
+}
+
+func fieldSchema(f bodyField) map[string]interface{} {
+	schema := map[string]interface{}{"type": f.kind, "description": f.description}
+	if f.kind == "array" {
+		schema["items"] = map[string]interface{}{"type": "string"}
+	}
+	return schema
+}
+
+// OpenAPIHandler serves the OpenAPI document, it isn't wrapped in the usual
+// response so code generators can consume it directly
+func OpenAPIHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(OpenAPISpec()); err != nil {
+			ErrorHandler(w, r, "Could not encode OpenAPI document", err, http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package guardian
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	multierror "github.com/hashicorp/go-multierror"
+)
+
+// How long finished operations are kept around to be queried
+const operationRetention = time.Hour
+
+// ServiceResult is the outcome of an action on a single service
+type ServiceResult struct {
+	Service string `json:"service"`
+	Success bool   `json:"success"`
+	NoOp    bool   `json:"noop,omitempty"` // Already in the requested state
+	Error   string `json:"error,omitempty"`
+	Code    string `json:"code,omitempty"` // Error code, see the Code constants
+
+	// How the service ended if it exited while starting
+	Startup *StartupError `json:"startup,omitempty"`
+}
+
+func newServiceResult(name string, err error) *ServiceResult {
+	result := &ServiceResult{Service: name, Success: err == nil}
+	if err != nil {
+		result.Error = err.Error()
+		result.Code = errorCode(err, 0)
+	}
+	var startupErr *StartupError
+	if errors.As(err, &startupErr) {
+		result.Startup = startupErr
+	}
+	return result
+}
+
+// startupErrors returns the StartupErrors of the results by service, or nil if
+// there aren't any
+func startupErrors(results []*ServiceResult) map[string]*StartupError {
+	var errs map[string]*StartupError
+	for _, r := range results {
+		if r.Startup != nil {
+			if errs == nil {
+				errs = make(map[string]*StartupError)
+			}
+			errs[r.Service] = r.Startup
+		}
+	}
+	return errs
+}
+
+// resultsError combines the errors of the failed results into one, or nil if
+// they all succeeded
+func resultsError(results []*ServiceResult) error {
+	if len(results) == 1 && !results[0].Success {
+		return errors.New(results[0].Error)
+	}
+
+	var result *multierror.Error
+	for _, r := range results {
+		if !r.Success {
+			result = multierror.Append(result, fmt.Errorf("error with service %s: %s", r.Service, r.Error))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// allNoOps returns true if none of the results needed to do anything
+func allNoOps(results []*ServiceResult) bool {
+	for _, r := range results {
+		if !r.NoOp {
+			return false
+		}
+	}
+	return len(results) > 0
+}
+
+// Operation tracks an action running in the background on one or more
+// services
+type Operation struct {
+	ID       string           `json:"id"`
+	Action   string           `json:"action"`
+	Done     bool             `json:"done"`
+	Total    int              `json:"total"`
+	Finished int              `json:"finished"`
+	Results  []*ServiceResult `json:"results"`
+	Created  time.Time        `json:"created"`
+	Ended    *time.Time       `json:"ended,omitempty"`
+}
+
+type operationStore struct {
+	mux        sync.Mutex
+	operations map[string]*Operation
+}
+
+func newOperationStore() *operationStore {
+	return &operationStore{operations: make(map[string]*Operation)}
+}
+
+// start runs action on each of the services in the background and returns the
+// operation tracking it
+func (ops *operationStore) start(action string, services []string, fn func(name string) *ServiceResult) *Operation {
+	ops.mux.Lock()
+	defer ops.mux.Unlock()
+
+	ops.prune()
+
+	op := &Operation{
+		ID:      newOperationID(),
+		Action:  action,
+		Total:   len(services),
+		Results: make([]*ServiceResult, 0, len(services)),
+		Created: time.Now(),
+	}
+	ops.operations[op.ID] = op
+
+	go func() {
+		for _, name := range services {
+			result := fn(name)
+
+			ops.mux.Lock()
+			op.Results = append(op.Results, result)
+			op.Finished++
+			ops.mux.Unlock()
+		}
+
+		ops.mux.Lock()
+		now := time.Now()
+		op.Done = true
+		op.Ended = &now
+		ops.mux.Unlock()
+	}()
+
+	return op.copy()
+}
+
+// get returns a copy of the operation so it can be read while it's updated
+func (ops *operationStore) get(id string) (*Operation, bool) {
+	ops.mux.Lock()
+	defer ops.mux.Unlock()
+
+	op, ok := ops.operations[id]
+	if !ok {
+		return nil, false
+	}
+	return op.copy(), true
+}
+
+// prune removes operations that finished longer ago than the retention period
+func (ops *operationStore) prune() {
+	for id, op := range ops.operations {
+		if op.Done && time.Since(*op.Ended) > operationRetention {
+			delete(ops.operations, id)
+		}
+	}
+}
+
+func (op *Operation) copy() *Operation {
+	c := *op
+	c.Results = append(make([]*ServiceResult, 0, len(op.Results)), op.Results...)
+	return &c
+}
+
+func newOperationID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,200 @@
+package guardian
+
+import "time"
+
+// ServiceOptions are optional per-service settings, in the config file they're
+// set in a [Services.<name>] table
+type ServiceOptions struct {
+	// Register the service disabled, see SetEnabled
+	Disabled bool
+
+	// Phase the service is started in by StartTarget, see SetPhases
+	Phase string
+
+	// Start the service when the guardian starts, see Autostart
+	Autostart bool
+
+	// Labels of the service, like role=edge or net=mainnet, returned in its
+	// status, used to pick services with a Selector and sent as tags of its
+	// StatsD metrics. Keys are lowercase.
+	Labels map[string]string
+
+	// Arguments passed to the executable, or the command of a container
+	Args []string
+
+	// Directory the service (and commands run with Exec) start in, inside the
+	// container for ones that run from an image
+	WorkingDir string
+
+	// Environment sets the service uses, when one of them is the active set
+	// its variables are added to the service's environment
+	EnvSets []string
+
+	// Environment variables the service needs, it isn't started without them
+	RequiredEnv []string
+
+	// Start the service with the guardian's own environment under the one it's
+	// given, see startEnv for which variables win
+	InheritEnvironment bool
+
+	// Where the service's standard output and error go: "log" (the default)
+	// is the service's log, "discard" drops it and anything else is the
+	// absolute path of a file it's appended to. Stderr can also be "stdout" to
+	// go wherever stdout does. Services on a PTY log both.
+	Stdout string
+	Stderr string
+
+	// Absolute path of a file what goes to the service's log is appended to
+	// as well, for tools that tail it. The log keeps it as usual.
+	LogFile string
+
+	// Additional fields the service's log lines are shipped to Graylog with,
+	// see StartGELF
+	GELFFields map[string]string
+
+	// Run the executable on a pseudo terminal, for console style tools that
+	// operators attach to. Its output goes to the log as usual. Linux only.
+	PTY bool
+
+	// Scheduling priorities: the nice level (-20 to 19), I/O class
+	// ("realtime", "best-effort" or "idle") with its priority (0 to 7, lower
+	// is higher) and how much more (up to 1000) or less (down to -1000) likely
+	// the OOM killer is to pick the service. Nice and I/O priorities are only
+	// set for processes and need Linux, as does OOMScoreAdjust. Raising
+	// priorities needs root.
+	Nice           int
+	IOClass        string
+	IOPriority     int
+	OOMScoreAdjust int
+
+	// CPU cores the service is pinned to, like "2-3" or "0,2,4", to keep it
+	// off the ones latency-sensitive workloads use. Linux only.
+	CPUAffinity string
+
+	// Sandbox the service: run it in new Linux namespaces ("mount", "pid",
+	// "network" with only loopback, "ipc" and "uts"), keep it and its children
+	// from gaining privileges through setuid executables and make the
+	// filesystem read-only for it except for WritablePaths. Other platforms
+	// run the service without a sandbox. Containers have namespaces of their
+	// own already, only NoNewPrivileges and ReadOnlyRoot apply to them.
+	Namespaces      []string
+	NoNewPrivileges bool
+	ReadOnlyRoot    bool
+	WritablePaths   []string
+
+	// Seccomp filter and AppArmor profile the service is confined by, applied
+	// as it's started. For processes SeccompProfile is the path of a compiled
+	// BPF program, like one exported with libseccomp's seccomp_export_bpf, for
+	// containers it's a Docker seccomp profile. Setting a filter implies
+	// NoNewPrivileges, the kernel requires it. Linux only like the sandbox.
+	SeccompProfile  string
+	AppArmorProfile string
+
+	// Capabilities the service keeps when the guardian runs as root, like
+	// ["CAP_NET_BIND_SERVICE"], every other one is dropped. Without any it
+	// keeps all of root's. Linux only like the sandbox.
+	Capabilities []string
+
+	// Directory the service keeps its data in, created on its first start and
+	// then owned by DataDirOwner ("user", "user:group" or numeric ids) if set.
+	// With ConfineToDataDir it's the only place the service can write, and
+	// with Chroot it's the service's root directory, so the executable (its
+	// path and WorkingDir are inside the chroot) and what it needs have to be
+	// in there. Only for processes, confining them needs Linux like the
+	// sandbox.
+	DataDir          string
+	DataDirOwner     string
+	ConfineToDataDir bool
+	Chroot           bool
+
+	// Services started before this one when it's started, registering a
+	// service that ends up depending on itself fails with ErrDependencyCycle
+	DependsOn []string
+
+	// Base URL of the service's own HTTP API, like http://localhost:3001, and
+	// the paths under it that can be reached through the guardian
+	ProxyURL     string
+	ProxyPaths   []string
+	ProxyTimeout time.Duration
+
+	// TCP ports the service listens on, checked before it's started so a
+	// conflict is reported instead of the service crashing
+	Ports []int
+
+	// What runs the service: "exec" runs its executable as a child process,
+	// "docker" runs its Image as a container and "ssh" runs the executable on
+	// SSHHost ([user@]host[:port]). Empty picks docker for services with an
+	// image and exec for the rest.
+	Backend string
+	SSHHost string
+
+	// Run the service as a container from this image instead of running its
+	// executable. Volumes are host:container binds and PublishPorts are
+	// [[ip:]host:]container[/protocol] mappings, like with docker run.
+	Image        string
+	Volumes      []string
+	PublishPorts []string
+
+	// Restart the service when its executable is replaced, like when a new
+	// build is dropped in
+	RestartOnChange bool
+
+	// Restart the service when it crashes, waiting RestartBackoff (1s by
+	// default) and twice as long after each crash up to MaxRestartBackoff (a
+	// minute). After MaxRestarts (5) restarts within RestartWindow (10m) it's
+	// left stopped. Its status has where it's at, see RestartStatus.
+	RestartOnFailure  bool
+	MaxRestarts       int
+	RestartWindow     time.Duration
+	RestartBackoff    time.Duration
+	MaxRestartBackoff time.Duration
+
+	// Config files the service reads, when one changes the service is
+	// restarted or, with a ReloadStrategy of "signal", reloaded
+	ConfigFiles    []string
+	ReloadStrategy string
+
+	// Signal that makes the service reload its config, like SIGHUP (the
+	// default) or USR1
+	ReloadSignal string
+
+	// Conditions checked before the service is started: time since the
+	// guardian started, files that have to exist, host:port addresses that
+	// have to accept connections and whether the network has to be up. The
+	// start fails if they aren't met within StartConditionTimeout (a minute
+	// by default).
+	StartDelay            time.Duration
+	WaitForFiles          []string
+	WaitForAddresses      []string
+	WaitForNetwork        bool
+	StartConditionTimeout time.Duration
+
+	// Restart by starting a new instance on newly allocated ports and only
+	// stopping the old one once the new one's ports accept connections (and
+	// ReadyPath on its advertised port returns a success, if set) within
+	// BlueGreenTimeout. Only for processes without fixed Ports.
+	BlueGreen        bool
+	ReadyPath        string
+	BlueGreenTimeout time.Duration
+
+	// With a zero spawn timeout starts return as soon as the service is
+	// spawned, unless it can be probed like a blue/green instance, then they
+	// wait up to ReadyTimeout (30s by default) for it to be ready instead
+	ReadyTimeout time.Duration
+
+	// Command run before the data directory is backed up, with the service's
+	// environment and working directory, to get its data in a consistent
+	// state while it keeps running, like ["gladius-controld", "flush"].
+	// Without one the service is stopped for the backup.
+	BackupHook []string
+
+	// How long stopping the service waits for it to exit after it's killed
+	// before reporting that it refused to, 10s by default
+	StopTimeout time.Duration
+}
+
+// Ways of applying a change to a service's config files
+const (
+	ReloadRestart = "restart"
+	ReloadSignal  = "signal"
+)
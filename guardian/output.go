@@ -0,0 +1,185 @@
+package guardian
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Where a service's stdout and stderr go, see ServiceOptions.Stdout. Anything
+// else is the path of a file.
+const (
+	OutputLog     = "log"     // The service's log, the default
+	OutputDiscard = "discard" // Nowhere
+	OutputStdout  = "stdout"  // Wherever stdout goes, only for stderr
+)
+
+// outputSink is where one of a service's output streams goes
+type outputSink struct {
+	name string
+	log  bool
+	tee  *outputFile // Gets what goes to the log as well, see LogFile
+	file *outputFile
+}
+
+// outputFile is a file output is appended to, shared by both streams when
+// they go to the same one
+type outputFile struct {
+	mux  sync.Mutex
+	path string
+	f    *os.File
+	refs int
+}
+
+// checkOutput returns what's wrong with where a stream goes
+func checkOutput(stream, dest string) error {
+	switch dest {
+	case "", OutputLog, OutputDiscard:
+	case OutputStdout:
+		if stream != StreamStderr {
+			return fmt.Errorf("%s can't go to stdout, only stderr can", stream)
+		}
+	default:
+		if !filepath.IsAbs(dest) {
+			return fmt.Errorf("%s file %s has to be an absolute path", stream, dest)
+		}
+	}
+	return nil
+}
+
+// checkLogFile returns what's wrong with the file the log is copied to
+func checkLogFile(path string) error {
+	if path != "" && !filepath.IsAbs(path) {
+		return fmt.Errorf("log file %s has to be an absolute path", path)
+	}
+	return nil
+}
+
+// openOutput opens where the service's stdout and stderr go, both sinks have
+// to be closed
+func openOutput(name string, opts ServiceOptions) (stdout, stderr *outputSink, err error) {
+	if err := checkOutput(StreamStdout, opts.Stdout); err != nil {
+		return nil, nil, err
+	}
+	if err := checkOutput(StreamStderr, opts.Stderr); err != nil {
+		return nil, nil, err
+	}
+	if err := checkLogFile(opts.LogFile); err != nil {
+		return nil, nil, err
+	}
+
+	var tee *outputFile
+	if opts.LogFile != "" {
+		if tee, err = openOutputFile(opts.LogFile); err != nil {
+			return nil, nil, err
+		}
+		defer tee.release() // Each sink that tees holds on to it
+	}
+
+	stdout, err = newOutputSink(name, opts.Stdout, tee)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Stderr == OutputStdout {
+		stderr = &outputSink{name: name, log: stdout.log, tee: stdout.tee.hold(), file: stdout.file.hold()}
+		return stdout, stderr, nil
+	}
+	stderr, err = newOutputSink(name, opts.Stderr, tee)
+	if err != nil {
+		stdout.close()
+		return nil, nil, err
+	}
+	return stdout, stderr, nil
+}
+
+func newOutputSink(name, dest string, tee *outputFile) (*outputSink, error) {
+	switch dest {
+	case "", OutputLog:
+		return &outputSink{name: name, log: true, tee: tee.hold()}, nil
+	case OutputDiscard:
+		return &outputSink{name: name}, nil
+	}
+	f, err := openOutputFile(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &outputSink{name: name, file: f}, nil
+}
+
+// openOutputFile opens the file to append output to, creating it and its
+// directory if they don't exist
+func openOutputFile(path string) (*outputFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("Error creating output directory: %s", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening output file: %s", err)
+	}
+	return &outputFile{path: path, f: f, refs: 1}, nil
+}
+
+// write sends a line of output where it goes
+func (s *outputSink) write(gg *GladiusGuardian, line string) {
+	if s.log {
+		gg.AppendToLog(s.name, line)
+		s.tee.write(s.name, line)
+	}
+	s.file.write(s.name, line)
+}
+
+// close lets go of the sink's files
+func (s *outputSink) close() {
+	s.tee.release()
+	s.file.release()
+}
+
+// write appends the line to the file, if writing fails it's closed and the
+// rest of the output dropped
+func (of *outputFile) write(name, line string) {
+	if of == nil {
+		return
+	}
+	of.mux.Lock()
+	defer of.mux.Unlock()
+	if of.f == nil {
+		return
+	}
+	if _, err := of.f.WriteString(line + "\n"); err != nil {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"path":         of.path,
+			"err":          err,
+		}).Warn("Couldn't write service output, dropping the rest of it")
+		of.f.Close()
+		of.f = nil
+	}
+}
+
+// hold takes another reference to the file, it's open until every one of them
+// is released
+func (of *outputFile) hold() *outputFile {
+	if of == nil {
+		return nil
+	}
+	of.mux.Lock()
+	defer of.mux.Unlock()
+	of.refs++
+	return of
+}
+
+func (of *outputFile) release() {
+	if of == nil {
+		return
+	}
+	of.mux.Lock()
+	defer of.mux.Unlock()
+	of.refs--
+	if of.refs == 0 && of.f != nil {
+		of.f.Close()
+		of.f = nil
+	}
+}
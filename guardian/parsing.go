@@ -26,3 +26,12 @@ func getJSONFields(w http.ResponseWriter, r *http.Request, fields ...string) (ma
 
 	return vals, nil
 }
+
+// getStringArray returns the strings in a JSON array
+func getStringArray(b []byte) []string {
+	vals := make([]string, 0)
+	jsonparser.ArrayEach(b, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
+		vals = append(vals, string(value))
+	})
+	return vals
+}
@@ -0,0 +1,127 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrNoPhase is returned for a target that isn't one of the phases
+var ErrNoPhase = errors.New("no such phase")
+
+// Phase is a stage of bringing the node up and the services assigned to it
+type Phase struct {
+	Name     string   `json:"name"`
+	Services []string `json:"services"`
+}
+
+// phases are the stages services are started in by StartTarget, in order
+type phases struct {
+	mux   sync.Mutex
+	order []string
+}
+
+// SetPhases sets the stages services are brought up in, in order, like init,
+// core and extras. Services are assigned to one with ServiceOptions.Phase.
+func (gg *GladiusGuardian) SetPhases(order []string) error {
+	seen := make(map[string]bool, len(order))
+	for _, name := range order {
+		if name == "" {
+			return errors.New("phase names can't be empty")
+		}
+		if seen[name] {
+			return fmt.Errorf("phase %s is listed twice", name)
+		}
+		seen[name] = true
+	}
+
+	gg.phases.mux.Lock()
+	defer gg.phases.mux.Unlock()
+	gg.phases.order = append([]string{}, order...)
+	return nil
+}
+
+// Phases returns every phase in order with the services assigned to it,
+// disabled ones left out
+func (gg *GladiusGuardian) Phases() []Phase {
+	gg.phases.mux.Lock()
+	order := gg.phases.order
+	gg.phases.mux.Unlock()
+
+	members := gg.phaseMembers()
+	phases := make([]Phase, 0, len(order))
+	for _, name := range order {
+		phases = append(phases, Phase{Name: name, Services: append([]string{}, members[name]...)})
+	}
+	return phases
+}
+
+// phaseMembers returns the enabled services of each phase, sorted by name
+func (gg *GladiusGuardian) phaseMembers() map[string][]string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	members := make(map[string][]string)
+	for name, settings := range gg.registeredServices {
+		if phase := settings.opts.Phase; phase != "" && !settings.disabled {
+			members[phase] = append(members[phase], name)
+		}
+	}
+	for _, names := range members {
+		sort.Strings(names)
+	}
+	return members
+}
+
+// Autostart starts every enabled service that has Autostart set, along with
+// what they depend on, in dependency order. It's for when the guardian comes
+// up, like at boot, services still running from before a re-exec are left
+// alone. It returns the result for each service.
+func (gg *GladiusGuardian) Autostart(ctx context.Context) []*ServiceResult {
+	gg.mux.Lock()
+	names := make([]string, 0)
+	for name, settings := range gg.registeredServices {
+		if settings.opts.Autostart && !settings.disabled {
+			names = append(names, name)
+		}
+	}
+	gg.mux.Unlock()
+	sort.Strings(names)
+
+	return gg.SetServicesState(ctx, names, true, nil, true)
+}
+
+// StartTarget starts the services of every phase up to and including the
+// target one, like a systemd target. A phase is only started once all services
+// of the ones before it are up, if any of them fail the later phases are left
+// alone. Services already running count as started. It returns the result for
+// each service it got to.
+func (gg *GladiusGuardian) StartTarget(ctx context.Context, target string) ([]*ServiceResult, error) {
+	gg.phases.mux.Lock()
+	order := gg.phases.order
+	gg.phases.mux.Unlock()
+
+	end := -1
+	for i, name := range order {
+		if name == target {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		return nil, fmt.Errorf("can't start target %s: %w", target, ErrNoPhase)
+	}
+
+	members := gg.phaseMembers()
+	results := make([]*ServiceResult, 0)
+	for _, phase := range order[:end+1] {
+		phaseResults := gg.SetServicesState(ctx, members[phase], true, nil, true)
+		results = append(results, phaseResults...)
+		if err := resultsError(phaseResults); err != nil {
+			return results, fmt.Errorf("can't start target %s, phase %s failed: %w", target, phase, err)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,91 @@
+package guardian
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the guardian's own PID file
+const guardianPIDFile = "gladius-guardian.pid"
+
+// pidFiles keeps a <service>.pid file for each running service
+type pidFiles struct {
+	dir string
+}
+
+// SetupPIDFiles writes the guardian's PID to gladius-guardian.pid in dir, and
+// keeps a <service>.pid file there for each running service. Files left over
+// for services that aren't running are removed. The returned function removes
+// all of them, it should be called once services are stopped.
+func (gg *GladiusGuardian) SetupPIDFiles(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	pf := &pidFiles{dir: dir}
+	if err := pf.write(guardianPIDFile, os.Getpid()); err != nil {
+		return nil, err
+	}
+
+	gg.mux.Lock()
+	services := make([]string, 0, len(gg.registeredServices))
+	for name := range gg.registeredServices {
+		services = append(services, name)
+	}
+	gg.mux.Unlock()
+	running := gg.runningPIDs("all")
+	for _, name := range services {
+		if pid, ok := running[name]; ok {
+			if err := pf.write(name+".pid", pid); err != nil {
+				return nil, err
+			}
+		} else {
+			pf.remove(name + ".pid")
+		}
+	}
+	gg.AddEventPublisher(pf)
+
+	return func() {
+		for _, name := range services {
+			pf.remove(name + ".pid")
+		}
+		pf.remove(guardianPIDFile)
+	}, nil
+}
+
+// Publish writes or removes the PID file of the service the event is about
+func (pf *pidFiles) Publish(ev Event) error {
+	switch ev.Type {
+	case EventStarted:
+		return pf.write(ev.Service+".pid", ev.PID)
+	case EventStopped, EventExited, EventCrashed:
+		return pf.remove(ev.Service + ".pid")
+	}
+	return nil
+}
+
+// write replaces the file in one go so readers never see it half written
+func (pf *pidFiles) write(name string, pid int) error {
+	path := filepath.Join(pf.dir, name)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing PID file: %s", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+func (pf *pidFiles) remove(name string) error {
+	err := os.Remove(filepath.Join(pf.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"file": name,
+			"err":  err,
+		}).Warn("Couldn't remove PID file")
+		return err
+	}
+	return nil
+}
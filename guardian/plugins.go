@@ -0,0 +1,192 @@
+package guardian
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrPolicyDenied is returned when a plugin doesn't allow what was asked
+var ErrPolicyDenied = errors.New("denied by a plugin")
+
+// Hooks a plugin can be run on
+const (
+	HookEvent         = "event"          // Every lifecycle event, the answer is ignored
+	HookAllowStart    = "allow_start"    // Before a service is started
+	HookShouldRestart = "should_restart" // Before a service is restarted on its own, like after a change
+)
+
+// How long a plugin gets to answer if its Timeout isn't set
+const defaultPluginTimeout = 5 * time.Second
+
+// Plugin is an executable the guardian runs on some hooks, to extend what it
+// does without changing the guardian. Each time it's run it's given a
+// PluginRequest as JSON on stdin and writes a PluginResponse as JSON to
+// stdout. If it fails or doesn't answer within Timeout the decision is
+// allowed, unless it's FailClosed.
+type Plugin struct {
+	Name       string
+	Command    []string
+	Hooks      []string
+	Timeout    time.Duration
+	FailClosed bool
+}
+
+// PluginRequest is what a plugin is run with
+type PluginRequest struct {
+	Hook    string `json:"hook"`
+	Service string `json:"service,omitempty"`
+	Reason  string `json:"reason,omitempty"` // Why it's being restarted
+	Event   *Event `json:"event,omitempty"`
+}
+
+// PluginResponse is a plugin's answer, an empty one allows it
+type PluginResponse struct {
+	Deny   bool   `json:"deny"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type plugins struct {
+	mux        sync.Mutex
+	plugins    []Plugin
+	publishing bool // Events are published to the event hook
+}
+
+// hooked returns the plugins run on the hook
+func (ps *plugins) hooked(hook string) []Plugin {
+	ps.mux.Lock()
+	defer ps.mux.Unlock()
+	hooked := make([]Plugin, 0)
+	for _, p := range ps.plugins {
+		for _, h := range p.Hooks {
+			if h == hook {
+				hooked = append(hooked, p)
+				break
+			}
+		}
+	}
+	return hooked
+}
+
+// SetPlugins replaces the plugins the guardian runs and the hooks they're run
+// on: event, allow_start and should_restart
+func (gg *GladiusGuardian) SetPlugins(plugins []Plugin) error {
+	for _, p := range plugins {
+		if p.Name == "" || len(p.Command) == 0 {
+			return errors.New("every plugin needs a name and a command")
+		}
+		if len(p.Hooks) == 0 {
+			return fmt.Errorf("plugin %s isn't run on any hooks", p.Name)
+		}
+		for _, h := range p.Hooks {
+			switch h {
+			case HookEvent, HookAllowStart, HookShouldRestart:
+			default:
+				return fmt.Errorf("plugin %s has an unknown hook %q", p.Name, h)
+			}
+		}
+		if _, err := exec.LookPath(p.Command[0]); err != nil {
+			return fmt.Errorf("plugin %s can't be run: %s", p.Name, err)
+		}
+	}
+
+	gg.plugins.mux.Lock()
+	gg.plugins.plugins = plugins
+	publishing := gg.plugins.publishing
+	gg.plugins.publishing = true
+	gg.plugins.mux.Unlock()
+	if !publishing {
+		gg.AddEventPublisher(pluginPublisher{gg})
+	}
+	return nil
+}
+
+// allowed asks every plugin on the hook whether to go ahead, the first one to
+// deny it decides
+func (gg *GladiusGuardian) allowed(req PluginRequest) error {
+	for _, p := range gg.plugins.hooked(req.Hook) {
+		resp, err := runPlugin(p, req)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"plugin":       p.Name,
+				"hook":         req.Hook,
+				"service_name": req.Service,
+				"err":          err,
+			}).Warn("Plugin failed")
+			if p.FailClosed {
+				return fmt.Errorf("%w: %s failed: %s", ErrPolicyDenied, p.Name, err)
+			}
+			continue
+		}
+		if resp.Deny {
+			reason := resp.Reason
+			if reason == "" {
+				reason = "no reason given"
+			}
+			return fmt.Errorf("%w: %s says %s", ErrPolicyDenied, p.Name, reason)
+		}
+	}
+	return nil
+}
+
+// runPlugin runs the plugin with the request and reads its answer
+func runPlugin(p Plugin, req PluginRequest) (PluginResponse, error) {
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = defaultPluginTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	in, err := json.Marshal(req)
+	if err != nil {
+		return PluginResponse{}, err
+	}
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	if err := waited.run(cmd); err != nil {
+		if ctx.Err() != nil {
+			return PluginResponse{}, fmt.Errorf("no answer within %s", timeout)
+		}
+		return PluginResponse{}, fmt.Errorf("%s %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var resp PluginResponse
+	if len(bytes.TrimSpace(out.Bytes())) == 0 {
+		return resp, nil
+	}
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil {
+		return PluginResponse{}, fmt.Errorf("invalid answer: %s", err)
+	}
+	return resp, nil
+}
+
+// pluginPublisher runs the plugins on the event hook for every event
+type pluginPublisher struct {
+	gg *GladiusGuardian
+}
+
+// Publish runs the plugins one after the other, the events are queued like
+// they are for any publisher
+func (pp pluginPublisher) Publish(ev Event) error {
+	var errs []string
+	for _, p := range pp.gg.plugins.hooked(HookEvent) {
+		if _, err := runPlugin(p, PluginRequest{Hook: HookEvent, Service: ev.Service, Event: &ev}); err != nil {
+			errs = append(errs, p.Name+": "+err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
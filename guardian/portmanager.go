@@ -0,0 +1,154 @@
+package guardian
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// ErrPortInUse is returned when a port a service needs is already taken
+var ErrPortInUse = errors.New("port is already in use")
+
+// portManager hands out free ports to services, a service keeps the ports it
+// was given across restarts as long as they stay free
+type portManager struct {
+	mux       sync.Mutex
+	min, max  int                       // Range to allocate from, 0 lets the OS pick
+	allocated map[string]map[string]int // By service then port name
+}
+
+func newPortManager(min, max int) *portManager {
+	return &portManager{min: min, max: max, allocated: make(map[string]map[string]int)}
+}
+
+// SetPortRange sets the range ports are allocated from, a min of 0 lets the
+// OS pick any free port
+func (gg *GladiusGuardian) SetPortRange(min, max int) {
+	gg.ports.mux.Lock()
+	defer gg.ports.mux.Unlock()
+
+	gg.ports.min, gg.ports.max = min, max
+}
+
+// AllocatedPorts returns the ports allocated to a service by name
+func (gg *GladiusGuardian) AllocatedPorts(service string) map[string]int {
+	gg.ports.mux.Lock()
+	defer gg.ports.mux.Unlock()
+
+	ports := make(map[string]int)
+	for name, port := range gg.ports.allocated[service] {
+		ports[name] = port
+	}
+	return ports
+}
+
+// allocate returns the service's port with the given name, allocating a free
+// one if it doesn't have one or its old one has been taken
+func (pm *portManager) allocate(service, name string) (int, error) {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+
+	if port, ok := pm.allocated[service][name]; ok && portFree(port) {
+		return port, nil
+	}
+
+	port, err := pm.findFree()
+	if err != nil {
+		return 0, err
+	}
+	if pm.allocated[service] == nil {
+		pm.allocated[service] = make(map[string]int)
+	}
+	pm.allocated[service][name] = port
+	return port, nil
+}
+
+// findFree returns a free port that isn't allocated to any service
+func (pm *portManager) findFree() (int, error) {
+	taken := make(map[int]bool)
+	for _, ports := range pm.allocated {
+		for _, port := range ports {
+			taken[port] = true
+		}
+	}
+
+	if pm.min <= 0 {
+		for i := 0; i < 10; i++ {
+			l, err := net.Listen("tcp", ":0")
+			if err != nil {
+				return 0, fmt.Errorf("couldn't find a free port: %s", err)
+			}
+			port := l.Addr().(*net.TCPAddr).Port
+			l.Close()
+			if !taken[port] {
+				return port, nil
+			}
+		}
+		return 0, errors.New("couldn't find a free port")
+	}
+
+	for port := pm.min; port <= pm.max; port++ {
+		if !taken[port] && portFree(port) {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no free ports left between %d and %d", pm.min, pm.max)
+}
+
+// portFree returns true if nothing is listening on the TCP port
+func portFree(port int) bool {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// checkPorts returns an error naming every declared port that's in use
+func checkPorts(ports []int) error {
+	inUse := make([]string, 0)
+	for _, port := range ports {
+		if !portFree(port) {
+			inUse = append(inUse, strconv.Itoa(port))
+		}
+	}
+	if len(inUse) > 0 {
+		return fmt.Errorf("%w: %s", ErrPortInUse, strings.Join(inUse, ", "))
+	}
+	return nil
+}
+
+// expandEnv fills in templates in the environment, {{port "name"}} is replaced
+// with the port allocated to the service under that name
+func (pm *portManager) expandEnv(service string, env []string) ([]string, error) {
+	funcs := template.FuncMap{
+		"port": func(name string) (int, error) {
+			return pm.allocate(service, name)
+		},
+	}
+
+	expanded := make([]string, 0, len(env))
+	for _, e := range env {
+		if !strings.Contains(e, "{{") {
+			expanded = append(expanded, e)
+			continue
+		}
+
+		t, err := template.New(service).Funcs(funcs).Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("bad template in environment variable %q: %s", e, err)
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, nil); err != nil {
+			return nil, fmt.Errorf("error expanding environment variable %q: %s", e, err)
+		}
+		expanded = append(expanded, buf.String())
+	}
+	return expanded, nil
+}
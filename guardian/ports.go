@@ -0,0 +1,8 @@
+package guardian
+
+// PortInfo is a port a process is listening on
+type PortInfo struct {
+	Protocol string `json:"protocol"` // tcp, tcp6, udp or udp6
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+}
@@ -0,0 +1,120 @@
+package guardian
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Socket states in /proc/net, TCP sockets are listening and UDP ones are bound
+// but not connected
+const (
+	tcpListen  = "0A"
+	udpUnbound = "07"
+)
+
+// listeningPorts returns the ports the process is listening on, found by
+// matching the socket inodes in its fd table against /proc/net
+func listeningPorts(pid int) []PortInfo {
+	inodes := socketInodes(pid)
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	ports := make([]PortInfo, 0)
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		state := tcpListen
+		if strings.HasPrefix(proto, "udp") {
+			state = udpUnbound
+		}
+		for _, p := range readProcNet(proto, state) {
+			if inodes[p.inode] {
+				ports = append(ports, p.PortInfo)
+			}
+		}
+	}
+	return ports
+}
+
+func socketInodes(pid int) map[string]bool {
+	fdDir := fmt.Sprintf("/proc/%d/fd", pid)
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return nil
+	}
+
+	inodes := make(map[string]bool)
+	for _, fd := range fds {
+		link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(link, "socket:[") {
+			inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+		}
+	}
+	return inodes
+}
+
+type procSocket struct {
+	PortInfo
+	inode string
+}
+
+// readProcNet parses /proc/net/<proto> returning the sockets in state
+func readProcNet(proto, state string) []procSocket {
+	f, err := os.Open("/proc/net/" + proto)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	sockets := make([]procSocket, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || fields[3] != state {
+			continue
+		}
+		addr, port, err := parseProcNetAddress(fields[1])
+		if err != nil {
+			continue
+		}
+		sockets = append(sockets, procSocket{
+			PortInfo: PortInfo{Protocol: proto, Address: addr, Port: port},
+			inode:    fields[9],
+		})
+	}
+	return sockets
+}
+
+// parseProcNetAddress parses an address like 0100007F:1F90, the IP is hex in
+// host byte order in groups of 4 bytes
+func parseProcNetAddress(s string) (string, int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return "", 0, fmt.Errorf("bad address %s", s)
+	}
+
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return "", 0, fmt.Errorf("bad address %s", s)
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad port %s", s)
+	}
+	return ip.String(), int(port), nil
+}
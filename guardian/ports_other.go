@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package guardian
+
+// listeningPorts isn't supported outside of Linux
+func listeningPorts(pid int) []PortInfo {
+	return nil
+}
@@ -0,0 +1,80 @@
+package guardian
+
+import "errors"
+
+// ErrUnsupportedPlatform is returned for features that aren't available on the
+// platform the guardian is running on
+var ErrUnsupportedPlatform = errors.New("not supported on this platform")
+
+// ProcessInfo is a process and its descendants
+type ProcessInfo struct {
+	PID      int            `json:"pid"`
+	PPID     int            `json:"ppid"`
+	Command  string         `json:"command"`
+	State    string         `json:"state"`
+	RSS      int64          `json:"rss_bytes"`
+	Children []*ProcessInfo `json:"children,omitempty"`
+
+	exe  string   // Resolved executable, empty if it couldn't be read
+	args []string // Command line arguments, including the program
+}
+
+// ProcessTree returns the process tree of the running service (or all of
+// them), services that aren't running are left out
+func (gg *GladiusGuardian) ProcessTree(name string) (map[string]*ProcessInfo, error) {
+	pids := gg.runningPIDs(name)
+	if len(pids) == 0 {
+		return map[string]*ProcessInfo{}, nil
+	}
+
+	procs, err := listProcesses()
+	if err != nil {
+		return nil, err
+	}
+
+	byPID, children := indexProcesses(procs)
+	trees := make(map[string]*ProcessInfo)
+	for serviceName, pid := range pids {
+		if root, ok := byPID[pid]; ok {
+			trees[serviceName] = buildTree(root, children, make(map[int]bool))
+		}
+	}
+	return trees, nil
+}
+
+// runningPIDs returns the PIDs of the running service (or all of them)
+func (gg *GladiusGuardian) runningPIDs(name string) map[string]int {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	pids := make(map[string]int)
+	for serviceName, p := range gg.services {
+		if p != nil && p.pid() != 0 && (name == "all" || name == "" || name == serviceName) {
+			pids[serviceName] = p.pid()
+		}
+	}
+	return pids
+}
+
+// indexProcesses maps each process by its PID, and each PID to its children
+func indexProcesses(procs []*ProcessInfo) (map[int]*ProcessInfo, map[int][]*ProcessInfo) {
+	byPID := make(map[int]*ProcessInfo)
+	children := make(map[int][]*ProcessInfo)
+	for _, p := range procs {
+		byPID[p.PID] = p
+		children[p.PPID] = append(children[p.PPID], p)
+	}
+	return byPID, children
+}
+
+func buildTree(p *ProcessInfo, children map[int][]*ProcessInfo, seen map[int]bool) *ProcessInfo {
+	seen[p.PID] = true
+	node := *p
+	node.Children = nil
+	for _, c := range children[p.PID] {
+		if !seen[c.PID] {
+			node.Children = append(node.Children, buildTree(c, children, seen))
+		}
+	}
+	return &node
+}
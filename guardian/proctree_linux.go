@@ -0,0 +1,98 @@
+package guardian
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listProcesses reads every process from /proc
+func listProcesses() ([]*ProcessInfo, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("error reading /proc: %s", err)
+	}
+
+	pageSize := int64(os.Getpagesize())
+	procs := make([]*ProcessInfo, 0, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		p, err := readProcess(pid, pageSize)
+		if err != nil {
+			continue // It probably exited while we were looking
+		}
+		procs = append(procs, p)
+	}
+	return procs, nil
+}
+
+func readProcess(pid int, pageSize int64) (*ProcessInfo, error) {
+	stat, err := readProcStat(pid)
+	if err != nil {
+		return nil, err
+	}
+	ppid, err := strconv.Atoi(stat.fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ProcessInfo{PID: pid, PPID: ppid, Command: stat.comm, State: stat.fields[0]}
+
+	if cmdline, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid)); err == nil && len(cmdline) > 0 {
+		p.args = strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		p.Command = strings.Join(p.args, " ")
+	}
+
+	// Only readable for our own processes unless we're root
+	p.exe, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+
+	if statm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid)); err == nil {
+		if fields := strings.Fields(string(statm)); len(fields) > 1 {
+			pages, _ := strconv.ParseInt(fields[1], 10, 64)
+			p.RSS = pages * pageSize
+		}
+	}
+	return p, nil
+}
+
+type procStat struct {
+	comm   string
+	fields []string // Fields after the command, starting with the state
+}
+
+// readProcStat parses /proc/<pid>/stat, the command is in parentheses and can
+// contain spaces so everything is split after its last closing parenthesis
+func readProcStat(pid int) (*procStat, error) {
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	open, end := strings.IndexByte(s, '('), strings.LastIndexByte(s, ')')
+	if open < 0 || end < open {
+		return nil, fmt.Errorf("malformed stat for %d", pid)
+	}
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("malformed stat for %d", pid)
+	}
+	return &procStat{comm: s[open+1 : end], fields: fields}, nil
+}
+
+// reapZombie collects the exit status of one of our own zombie children
+func reapZombie(pid int) error {
+	var status syscall.WaitStatus
+	_, err := syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+	return err
+}
+
+// terminateProcess sends SIGTERM to a process that isn't one of ours
+func terminateProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
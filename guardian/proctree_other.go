@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package guardian
+
+func listProcesses() ([]*ProcessInfo, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+func reapZombie(pid int) error {
+	return ErrUnsupportedPlatform
+}
+
+func terminateProcess(pid int) error {
+	return ErrUnsupportedPlatform
+}
@@ -0,0 +1,102 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultProxyTimeout = 10 * time.Second
+
+// proxyTarget returns the URL to proxy a request for the path to, if the
+// service allows it
+func (gg *GladiusGuardian) proxyTarget(name, reqPath string) (*url.URL, time.Duration, error) {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	gg.mux.Unlock()
+	if !ok {
+		return nil, 0, errors.New("service isn't registered")
+	}
+
+	opts := settings.opts
+	if opts.ProxyURL == "" {
+		return nil, 0, errors.New("service doesn't have a ProxyURL configured")
+	}
+
+	reqPath = path.Clean("/" + reqPath)
+	if !pathAllowed(reqPath, opts.ProxyPaths) {
+		return nil, 0, fmt.Errorf("path %s isn't in the service's ProxyPaths", reqPath)
+	}
+
+	base, err := url.Parse(opts.ProxyURL)
+	if err != nil {
+		return nil, 0, fmt.Errorf("bad ProxyURL: %s", err)
+	}
+	target := *base
+	target.Path = strings.TrimSuffix(base.Path, "/") + reqPath
+
+	timeout := opts.ProxyTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyTimeout
+	}
+	return &target, timeout, nil
+}
+
+// pathAllowed returns true if p is one of the allowed paths or under one
+func pathAllowed(p string, allowed []string) bool {
+	for _, a := range allowed {
+		a = path.Clean("/" + a)
+		if p == a || strings.HasPrefix(p, strings.TrimSuffix(a, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func ProxyHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		sn := vars["service_name"]
+
+		target, timeout, err := gg.proxyTarget(sn, vars["path"])
+		if err != nil {
+			ErrorHandler(w, r, "Can't proxy to service", err, http.StatusForbidden)
+			return
+		}
+
+		proxy := &httputil.ReverseProxy{
+			Director: func(req *http.Request) {
+				req.URL.Scheme = target.Scheme
+				req.URL.Host = target.Host
+				req.URL.Path = target.Path
+				req.Host = target.Host
+				// Don't hand the guardian's credentials to the service
+				req.Header.Del("Authorization")
+			},
+			ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+				log.WithFields(log.Fields{
+					"service_name": sn,
+					"target":       target.String(),
+					"err":          err,
+				}).Debug("Proxy request failed")
+				ErrorHandler(w, r, "Couldn't reach service", err, http.StatusBadGateway)
+			},
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		q := r.URL.Query()
+		q.Del("access_token")
+		r.URL.RawQuery = q.Encode()
+		proxy.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,184 @@
+package guardian
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// terminalInstance is an instance running on a pseudo terminal
+type terminalInstance interface {
+	terminal() *os.File // Master side, nil if it isn't on one
+}
+
+// terminalClients are the websockets attached to each service's terminal
+type terminalClients struct {
+	mux   sync.Mutex
+	conns map[string][]*websocket.Conn
+}
+
+func (tc *terminalClients) add(service string, conn *websocket.Conn) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	tc.conns[service] = append(tc.conns[service], conn)
+}
+
+func (tc *terminalClients) remove(service string, conn *websocket.Conn) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	conns := tc.conns[service]
+	for i, c := range conns {
+		if c == conn {
+			tc.conns[service] = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+}
+
+// send writes terminal output to every attached client, dropping ones that
+// went away
+func (tc *terminalClients) send(service string, b []byte) {
+	tc.mux.Lock()
+	conns := append([]*websocket.Conn{}, tc.conns[service]...)
+	tc.mux.Unlock()
+	for _, conn := range conns {
+		if err := conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+			conn.Close()
+			tc.remove(service, conn)
+		}
+	}
+}
+
+// startOnPTY starts the command with a new pseudo terminal as its stdin,
+// stdout and stderr
+func (gg *GladiusGuardian) startOnPTY(name string, p *exec.Cmd) (*processInstance, error) {
+	master, slave, err := openPTY()
+	if err != nil {
+		return nil, fmt.Errorf("Error opening a terminal for command: %s", err)
+	}
+	defer slave.Close() // The child has its own copy once it's started
+
+	p.Stdin, p.Stdout, p.Stderr = slave, slave, slave
+	setPTYAttr(p)
+	if err := waited.start(p); err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	go gg.readTerminal(name, master)
+	return &processInstance{cmd: p, stdout: master, stdin: master, pty: true}, nil
+}
+
+// readTerminal sends what the service writes to its terminal to attached
+// clients as is, and adds it to the log line by line
+func (gg *GladiusGuardian) readTerminal(name string, master *os.File) {
+	defer master.Close()
+	buf := make([]byte, 4096)
+	var partial string
+	for {
+		n, err := master.Read(buf)
+		if n > 0 {
+			gg.terminals.send(name, append([]byte{}, buf[:n]...))
+
+			lines := strings.Split(partial+string(buf[:n]), "\n")
+			partial = lines[len(lines)-1]
+			for _, line := range lines[:len(lines)-1] {
+				gg.AppendToLog(name, strings.TrimRight(line, "\r"))
+			}
+		}
+		if err != nil {
+			// Reads fail with EIO once the process is gone
+			if partial != "" {
+				gg.AppendToLog(name, strings.TrimRight(partial, "\r"))
+			}
+			return
+		}
+	}
+}
+
+// terminalMessage is a text message from an attached client, binary messages
+// are written to the terminal as they are
+type terminalMessage struct {
+	Type string `json:"type"` // input or resize
+	Data string `json:"data"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// ErrNoTerminal is returned when attaching to a service that isn't running on
+// a terminal
+var ErrNoTerminal = errors.New("service isn't running on a terminal, set PTY in its options")
+
+// AttachTerminal upgrades the request to a websocket connected to the
+// terminal of the running service. Output is sent as binary messages, binary
+// messages from the client are typed into the terminal and text messages are
+// JSON like {"type": "resize", "cols": 80, "rows": 24} or
+// {"type": "input", "data": "ls\r"}.
+func (gg *GladiusGuardian) AttachTerminal(name string, w http.ResponseWriter, r *http.Request) error {
+	master, err := gg.terminalOf(name)
+	if err != nil {
+		return err
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil // The upgrader already responded
+	}
+	gg.terminals.add(name, conn)
+	defer func() {
+		gg.terminals.remove(name, conn)
+		conn.Close()
+	}()
+
+	for {
+		kind, b, err := conn.ReadMessage()
+		if err != nil {
+			return nil
+		}
+		if kind == websocket.BinaryMessage {
+			master.Write(b)
+			continue
+		}
+
+		var msg terminalMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case "input":
+			master.Write([]byte(msg.Data))
+		case "resize":
+			if err := resizePTY(master, msg.Cols, msg.Rows); err != nil {
+				log.WithFields(log.Fields{
+					"service_name": name,
+					"err":          err,
+				}).Debug("Couldn't resize terminal")
+			}
+		}
+	}
+}
+
+func (gg *GladiusGuardian) terminalOf(name string) (*os.File, error) {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	if _, ok := gg.registeredServices[name]; !ok {
+		return nil, ErrNotRegistered
+	}
+	inst := gg.services[name]
+	if inst == nil {
+		return nil, fmt.Errorf("can't attach to %s: %w", name, ErrNotRunning)
+	}
+	if ti, ok := inst.(terminalInstance); ok && ti.terminal() != nil {
+		return ti.terminal(), nil
+	}
+	return nil, ErrNoTerminal
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package guardian
+
+import (
+	"os"
+	"os/exec"
+)
+
+func openPTY() (*os.File, *os.File, error) {
+	return nil, nil, ErrUnsupportedPlatform
+}
+
+func setPTYAttr(p *exec.Cmd) {}
+
+func resizePTY(master *os.File, cols, rows int) error {
+	return ErrUnsupportedPlatform
+}
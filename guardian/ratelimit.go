@@ -0,0 +1,118 @@
+package guardian
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned for requests over the client's rate limit
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// rateLimiter is a token bucket limiter keyed by client, so one misbehaving
+// client can't hammer the control endpoints for everyone else
+type rateLimiter struct {
+	mux       sync.Mutex
+	rate      float64 // Tokens added per second
+	burst     float64 // Max tokens a bucket can hold
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute requests per client on
+// average with bursts of up to burst requests. A perMinute of 0 or less
+// disables limiting.
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastPrune: time.Now(),
+	}
+}
+
+// allow takes a token from the client's bucket, if there isn't one it returns
+// how long until there will be
+func (rl *rateLimiter) allow(key string) (bool, time.Duration) {
+	rl.mux.Lock()
+	defer rl.mux.Unlock()
+
+	now := time.Now()
+	rl.prune(now)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune drops buckets that have refilled completely, they're identical to a
+// fresh bucket so there's no reason to keep them around
+func (rl *rateLimiter) prune(now time.Time) {
+	if now.Sub(rl.lastPrune) < time.Minute {
+		return
+	}
+	rl.lastPrune = now
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// limit wraps h so requests over the client's limit are rejected
+func (rl *rateLimiter) limit(h http.HandlerFunc) http.HandlerFunc {
+	if rl == nil {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, wait := rl.allow(clientKey(r))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			ErrorHandler(w, r, "Too many requests, slow down", ErrRateLimited, http.StatusTooManyRequests)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// clientKey identifies the client making a request, by who its token was
+// issued to once auth verified it and otherwise by its IP. Unverified headers
+// are ignored, a client could make up a new one for every request.
+func clientKey(r *http.Request) string {
+	if p := principal(r); p != "" {
+		return p
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
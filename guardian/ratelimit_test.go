@@ -0,0 +1,91 @@
+package guardian
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func signToken(t *testing.T, secret string, claims tokenClaims) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	b, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(header + "." + payload))
+	return header + "." + payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	const secret = "test-secret"
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tests := []struct {
+		name   string
+		auth   *jwtAuth
+		header func(i int) string
+		remote func(i int) string
+		want   []int // Status of each request in turn
+	}{
+		{
+			name:   "rotating unverified headers from one IP",
+			header: func(i int) string { return fmt.Sprintf("Bearer made-up-%d", i) },
+			remote: func(i int) string { return fmt.Sprintf("10.0.0.1:%d", 40000+i) },
+			want:   []int{200, 200, 429, 429},
+		},
+		{
+			name:   "different IPs",
+			remote: func(i int) string { return fmt.Sprintf("10.0.0.%d:40000", i+1) },
+			want:   []int{200, 200, 200, 200},
+		},
+		{
+			name: "tokens with the same subject",
+			auth: newJWTAuth(secret),
+			header: func(i int) string {
+				return "Bearer " + signToken(t, secret, tokenClaims{Subject: "ops", Scope: ScopeOperator, NotBefore: int64(i)})
+			},
+			remote: func(i int) string { return fmt.Sprintf("10.0.0.%d:40000", i+1) },
+			want:   []int{200, 200, 429, 429},
+		},
+		{
+			name: "tokens with different subjects from one IP",
+			auth: newJWTAuth(secret),
+			header: func(i int) string {
+				return "Bearer " + signToken(t, secret, tokenClaims{Subject: fmt.Sprintf("ops%d", i), Scope: ScopeOperator})
+			},
+			remote: func(i int) string { return "10.0.0.1:40000" },
+			want:   []int{200, 200, 200, 200},
+		},
+		{
+			name:   "invalid tokens are rejected before they're limited",
+			auth:   newJWTAuth(secret),
+			header: func(i int) string { return fmt.Sprintf("Bearer made-up-%d", i) },
+			remote: func(i int) string { return "10.0.0.1:40000" },
+			want:   []int{401, 401, 401, 401},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.auth.require(ScopeOperator, newRateLimiter(1, 2).limit(ok))
+			for i, want := range tt.want {
+				r := httptest.NewRequest("PUT", "/service/set_state/all", nil)
+				r.RemoteAddr = tt.remote(i)
+				if tt.header != nil {
+					r.Header.Set("Authorization", tt.header(i))
+				}
+				w := httptest.NewRecorder()
+				h(w, r)
+				if w.Code != want {
+					t.Errorf("request %d: status %d, want %d", i, w.Code, want)
+				}
+			}
+		})
+	}
+}
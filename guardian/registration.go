@@ -0,0 +1,114 @@
+package guardian
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ErrAlreadyRegistered is returned when registering a service under a name
+// that's taken, ReplaceService replaces it instead
+var ErrAlreadyRegistered = errors.New("a service with that name is already registered")
+
+// ErrDependencyCycle is returned when registering a service would have it
+// depend on itself through its dependencies, it could never be started
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// Service names end up in URLs, unit and container names and file names, so
+// they're kept to what all of those allow
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// dependencyCycleLocked returns the services a registration of name with
+// these dependencies would go through to depend on itself, starting and
+// ending with name, or nil if it wouldn't. The guardian's lock has to be held.
+func (gg *GladiusGuardian) dependencyCycleLocked(name string, dependsOn []string) []string {
+	names := []string{name}
+	for other := range gg.registeredServices {
+		if other != name {
+			names = append(names, other)
+		}
+	}
+	deps := func(service string) []string {
+		if service == name {
+			return dependsOn
+		}
+		return gg.registeredServices[service].opts.DependsOn
+	}
+
+	// Anything already registered can't be in a cycle, so every one found
+	// goes through name
+	for _, cycle := range dependencyCycles(names, deps) {
+		for i, service := range cycle {
+			if service == name {
+				rotated := append(append([]string{}, cycle[i:len(cycle)-1]...), cycle[:i]...)
+				return append(rotated, name)
+			}
+		}
+	}
+	return nil
+}
+
+// validateRegistration returns an error if a service can't be registered with
+// that name and executable, or isn't one its backend can run
+func validateRegistration(name, execLocation string, opts ServiceOptions) error {
+	if name == "all" || !serviceNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid service name %q, it has to start with a letter or digit followed by letters, digits, '_', '.' or '-'", name)
+	}
+	if err := validateLabels(name, opts.Labels); err != nil {
+		return err
+	}
+	b, err := lookupBackend(opts)
+	if err != nil {
+		return fmt.Errorf("service %s: %s", name, err)
+	}
+	return b.validate(name, execLocation, opts)
+}
+
+// ServiceRegistration is how a service is registered, which GetServicesStatus
+// only shows part of while it's running
+type ServiceRegistration struct {
+	Name        string
+	Executable  string
+	Environment []string // With the values redacted
+	Enabled     bool
+	Template    string `json:",omitempty"` // Template it was instantiated from
+
+	ServiceOptions
+}
+
+// ListServices returns the registration of every service, sorted by name
+func (gg *GladiusGuardian) ListServices() []ServiceRegistration {
+	gg.mux.Lock()
+	registrations := make([]ServiceRegistration, 0, len(gg.registeredServices))
+	for name, settings := range gg.registeredServices {
+		opts := settings.opts
+		opts.Disabled = settings.disabled
+		opts.Labels = copyLabels(opts.Labels)
+		registrations = append(registrations, ServiceRegistration{
+			Name:           name,
+			Executable:     settings.execName,
+			Environment:    redactEnv(settings.env),
+			Enabled:        !settings.disabled,
+			ServiceOptions: opts,
+		})
+	}
+	gg.mux.Unlock()
+
+	for i := range registrations {
+		registrations[i].Template = gg.templateOf(registrations[i].Name)
+	}
+	sort.Slice(registrations, func(i, j int) bool { return registrations[i].Name < registrations[j].Name })
+	return registrations
+}
+
+// redactEnv hides the values of environment variables, they can be secrets
+func redactEnv(env []string) []string {
+	redacted := make([]string, 0, len(env))
+	for _, v := range env {
+		key, _, _ := strings.Cut(v, "=")
+		redacted = append(redacted, key+"=REDACTED")
+	}
+	return redacted
+}
@@ -0,0 +1,69 @@
+package guardian
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long a reloaded service has to stay up for the reload to count as done
+const reloadSettleTime = time.Second
+
+// ReloadService sends the service its ReloadSignal (SIGHUP by default) so it
+// picks up config changes without being restarted, then makes sure it's still
+// running a moment later
+func (gg *GladiusGuardian) ReloadService(name string) error {
+	gg.mux.Lock()
+	settings, ok := gg.registeredServices[name]
+	inst := gg.services[name]
+	gg.mux.Unlock()
+	if !ok {
+		return fmt.Errorf("can't reload %s: %w", name, ErrNotRegistered)
+	}
+	if inst == nil {
+		return fmt.Errorf("can't reload %s: %w", name, ErrNotRunning)
+	}
+
+	sig, err := parseSignal(settings.opts.ReloadSignal)
+	if err != nil {
+		return err
+	}
+	if err := gg.supervisor(name).do(supervisorCommand{kind: commandSignal, sig: sig}); err != nil {
+		return fmt.Errorf("couldn't signal %s: %s", name, err)
+	}
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"signal":       sig,
+	}).Info("Reloading service")
+	gg.emit(Event{Type: EventReloaded, Service: name, PID: inst.pid(), Message: "sent " + sig.String()})
+
+	time.Sleep(reloadSettleTime)
+	gg.mux.Lock()
+	current := gg.services[name]
+	gg.mux.Unlock()
+	if current != inst {
+		return fmt.Errorf("%s exited after being sent %s, check the logs for errors", name, sig)
+	}
+	return nil
+}
+
+// parseSignal reads a signal name like SIGHUP or HUP, or a signal number.
+// Empty means SIGHUP.
+func parseSignal(s string) (os.Signal, error) {
+	if s == "" {
+		return syscall.SIGHUP, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return syscall.Signal(n), nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(s), "SIG")
+	if sig, ok := signalsByName[name]; ok {
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unknown signal %s", s)
+}
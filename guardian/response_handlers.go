@@ -1,43 +1,169 @@
 package guardian
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
+	"strings"
 )
 
+// Response is the envelope every versioned endpoint answers with, Data holds
+// what was asked for and Error is set when the request failed
 type Response struct {
+	Success  bool           `json:"success"`
+	Message  string         `json:"message"`
+	Data     interface{}    `json:"data"`
+	Error    *ResponseError `json:"error,omitempty"`
+	Endpoint string         `json:"endpoint"`
+	NoOp     bool           `json:"noop,omitempty"`
+}
+
+// ResponseError is why a request failed. Code is one of the Code constants
+// and is what clients should branch on, Details has more about the failure
+// for some endpoints, like the result of each service of a bulk request.
+type ResponseError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+
+	err error // What it came from, the legacy envelope only has its message
+}
+
+func (re *ResponseError) Error() string {
+	return re.Message
+}
+
+// legacyResponse is the envelope the unversioned routes have always answered
+// with, the gladius UI depends on it so it must not change
+type legacyResponse struct {
 	Message  string      `json:"message"`
 	Success  bool        `json:"success"`
 	Error    string      `json:"error"`
 	Response interface{} `json:"response"`
 	Endpoint string      `json:"endpoint"`
+	NoOp     bool        `json:"noop,omitempty"`
+}
+
+// envelope returns the response in the shape of the API version the request
+// was made against
+func envelope(r *http.Request, resp Response) interface{} {
+	if apiVersion(r) != legacyAPIVersion {
+		return resp
+	}
+	legacy := legacyResponse{
+		Message:  resp.Message,
+		Success:  resp.Success,
+		Response: resp.Data,
+		Endpoint: resp.Endpoint,
+		NoOp:     resp.NoOp,
+	}
+	if resp.Error != nil {
+		if resp.Error.err != nil {
+			legacy.Error = resp.Error.err.Error()
+		}
+		if resp.Error.Details != nil {
+			legacy.Response = resp.Error.Details
+		}
+	}
+	return legacy
 }
 
 // ErrorHandler - Default Error Handler
 func ErrorHandler(w http.ResponseWriter, r *http.Request, m string, e error, statusCode int) {
+	ErrorDetailsHandler(w, r, m, e, statusCode, nil)
+}
+
+// ErrorDetailsHandler - Error response with more about what went wrong, like
+// the result of each service of a bulk request
+func ErrorDetailsHandler(w http.ResponseWriter, r *http.Request, m string, e error, statusCode int, details interface{}) {
 	w.WriteHeader(statusCode)
 
-	ResponseHandler(w, r, m, false, e, nil)
+	writeResponse(w, r, Response{
+		Message:  m,
+		Success:  false,
+		Error:    newResponseError(e, statusCode, m, details),
+		Endpoint: r.URL.String(),
+	})
 }
 
-func ResponseHandler(w http.ResponseWriter, r *http.Request, m string, success bool, err error, res interface{}) {
-	errorString := ""
+// resultsErrorHandler - Error response for a request on several services some
+// of which failed, coded by what went wrong with them
+func resultsErrorHandler(w http.ResponseWriter, r *http.Request, m string, results []*ServiceResult, statusCode int, details interface{}) {
+	w.WriteHeader(statusCode)
 
+	re := newResponseError(resultsError(results), statusCode, m, details)
+	re.Code = resultsCode(results)
+	writeResponse(w, r, Response{
+		Message:  m,
+		Success:  false,
+		Error:    re,
+		Endpoint: r.URL.String(),
+	})
+}
+
+// NoOpResponseHandler - Successful response for a request that didn't need to
+// change anything
+func NoOpResponseHandler(w http.ResponseWriter, r *http.Request, m string, res interface{}) {
+	writeResponse(w, r, Response{
+		Message:  m,
+		Success:  true,
+		Data:     res,
+		Endpoint: r.URL.String(),
+		NoOp:     true,
+	})
+}
+
+// CachedResponseHandler - Successful response with an ETag, if it matches the
+// client's If-None-Match header only a 304 is sent
+func CachedResponseHandler(w http.ResponseWriter, r *http.Request, m string, res interface{}) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(envelope(r, Response{
+		Message:  m,
+		Success:  true,
+		Data:     res,
+		Endpoint: r.URL.String(),
+	}))
 	if err != nil {
-		errorString = err.Error()
+		ErrorHandler(w, r, "Could not parse response JSON", err, http.StatusInternalServerError)
+		return
 	}
 
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Write(buf.Bytes())
+}
+
+func ResponseHandler(w http.ResponseWriter, r *http.Request, m string, success bool, err error, res interface{}) {
 	responseStruct := Response{
 		Message:  m,
 		Success:  success,
-		Error:    errorString,
-		Response: res,
+		Data:     res,
 		Endpoint: r.URL.String(),
 	}
+	if err != nil || !success {
+		responseStruct.Error = newResponseError(err, 0, m, nil)
+	}
+
+	writeResponse(w, r, responseStruct)
+}
 
+func writeResponse(w http.ResponseWriter, r *http.Request, responseStruct Response) {
 	enc := json.NewEncoder(w)
 	enc.SetEscapeHTML(false) // So we can have an & come through in our URL's
-	parseErr := enc.Encode(responseStruct)
+	parseErr := enc.Encode(envelope(r, responseStruct))
 
 	if parseErr != nil {
 		ErrorHandler(w, r, "Could not parse response JSON", parseErr, http.StatusInternalServerError)
@@ -0,0 +1,241 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of the restart policy, see ServiceOptions.RestartOnFailure
+const (
+	defaultMaxRestarts       = 5
+	defaultRestartWindow     = 10 * time.Minute
+	defaultRestartBackoff    = time.Second
+	defaultMaxRestartBackoff = time.Minute
+)
+
+// RestartStatus is where a service that's restarted when it crashes is at,
+// returned in its status once it crashed within its RestartWindow
+type RestartStatus struct {
+	Remaining      int        `json:"remaining"`                 // Restarts left within the window
+	BackoffSeconds float64    `json:"backoff_seconds,omitempty"` // How long the pending restart waits
+	NextRetry      *time.Time `json:"next_retry,omitempty"`      // When the pending restart happens
+	GaveUp         bool       `json:"gave_up,omitempty"`         // Used up its restarts, it's left stopped
+}
+
+type restartPolicy struct {
+	max        int
+	window     time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func newRestartPolicy(opts ServiceOptions) restartPolicy {
+	p := restartPolicy{max: opts.MaxRestarts, window: opts.RestartWindow, backoff: opts.RestartBackoff, maxBackoff: opts.MaxRestartBackoff}
+	if p.max <= 0 {
+		p.max = defaultMaxRestarts
+	}
+	if p.window <= 0 {
+		p.window = defaultRestartWindow
+	}
+	if p.backoff <= 0 {
+		p.backoff = defaultRestartBackoff
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = defaultMaxRestartBackoff
+	}
+	return p
+}
+
+// delay returns how long to wait before the restart after these many, the
+// backoff doubling each time
+func (p restartPolicy) delay(restarts int) time.Duration {
+	d := p.backoff
+	for i := 0; i < restarts && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.maxBackoff {
+		d = p.maxBackoff
+	}
+	return d
+}
+
+type restartState struct {
+	policy   restartPolicy
+	restarts []time.Time // Within the window, oldest first
+	timer    *time.Timer // Pending restart, nil if there isn't one
+	delay    time.Duration
+	next     time.Time
+	gaveUp   bool
+}
+
+// prune forgets the restarts that fell out of the window
+func (st *restartState) prune(now time.Time) {
+	i := 0
+	for i < len(st.restarts) && now.Sub(st.restarts[i]) > st.policy.window {
+		i++
+	}
+	st.restarts = st.restarts[i:]
+}
+
+// restarts restarts services that crashed, see ServiceOptions.RestartOnFailure
+type restarts struct {
+	mux    sync.Mutex
+	states map[string]*restartState
+}
+
+// restartAfterCrash schedules a restart of the service if it's restarted on
+// failure and has restarts left, the guardian's lock mustn't be held
+func (gg *GladiusGuardian) restartAfterCrash(name string) {
+	gg.mux.Lock()
+	settings := gg.registeredServices[name]
+	gg.mux.Unlock()
+	if settings == nil || !settings.opts.RestartOnFailure {
+		return
+	}
+	if gg.InMaintenance(name) {
+		log.WithFields(log.Fields{
+			"service_name": name,
+		}).Info("Not restarting crashed service in maintenance mode")
+		return
+	}
+
+	policy := newRestartPolicy(settings.opts)
+	r := gg.restarts
+	r.mux.Lock()
+	st := r.states[name]
+	if st == nil {
+		st = &restartState{}
+		r.states[name] = st
+	}
+	st.policy = policy
+	now := time.Now()
+	st.prune(now)
+	if st.timer != nil {
+		r.mux.Unlock()
+		return // Already pending
+	}
+	if len(st.restarts) >= policy.max {
+		st.gaveUp = true
+		r.mux.Unlock()
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"restarts":     policy.max,
+			"window":       policy.window,
+		}).Error("Service keeps crashing, not restarting it anymore")
+		gg.revision.bump()
+		return
+	}
+	delay := policy.delay(len(st.restarts))
+	st.gaveUp = false
+	st.delay = delay
+	st.next = now.Add(delay)
+	st.restarts = append(st.restarts, now)
+	st.timer = time.AfterFunc(delay, func() { gg.retryStart(name) })
+	r.mux.Unlock()
+
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"backoff":      delay,
+	}).Info("Restarting crashed service after backoff")
+	gg.revision.bump()
+}
+
+// retryStart is the pending restart of a crashed service, another one is
+// scheduled if starting it fails
+func (gg *GladiusGuardian) retryStart(name string) {
+	r := gg.restarts
+	r.mux.Lock()
+	if st := r.states[name]; st != nil {
+		st.timer = nil
+	}
+	r.mux.Unlock()
+	gg.revision.bump()
+
+	if gg.InMaintenance(name) {
+		return
+	}
+	if err := gg.allowed(PluginRequest{Hook: HookShouldRestart, Service: name, Reason: "crashed"}); err != nil {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"err":          err,
+		}).Info("Not restarting crashed service")
+		return
+	}
+	_, err := gg.startWithDependencies(context.Background(), name, nil)
+	if err != nil && !errors.Is(err, ErrAlreadyRunning) {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"err":          err,
+		}).Warn("Couldn't restart crashed service")
+		gg.restartAfterCrash(name)
+	}
+}
+
+// cancelRestart drops the pending restart of the service, like when it's
+// stopped on purpose
+func (gg *GladiusGuardian) cancelRestart(name string) {
+	r := gg.restarts
+	r.mux.Lock()
+	st := r.states[name]
+	cancelled := st != nil && st.timer != nil
+	if cancelled {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	r.mux.Unlock()
+	if cancelled {
+		gg.revision.bump()
+	}
+}
+
+// restartStatus returns where the service's restarts are at, nil if it
+// didn't crash within its window
+func (gg *GladiusGuardian) restartStatus(name string) *RestartStatus {
+	r := gg.restarts
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	st := r.states[name]
+	if st == nil {
+		return nil
+	}
+	st.prune(time.Now())
+	if len(st.restarts) == 0 && st.timer == nil && !st.gaveUp {
+		return nil
+	}
+
+	status := &RestartStatus{Remaining: st.policy.max - len(st.restarts), GaveUp: st.gaveUp}
+	if st.timer != nil {
+		next := st.next
+		status.NextRetry = &next
+		status.BackoffSeconds = st.delay.Seconds()
+	}
+	return status
+}
+
+// ResetRestarts forgets the service's crashes and drops its pending restart,
+// for once whatever made it crash is fixed. A service that ran out of restarts
+// gets its full budget back, it's left stopped until it's started again.
+func (gg *GladiusGuardian) ResetRestarts(name string) error {
+	if !gg.isRegistered(name) {
+		return fmt.Errorf("can't reset restarts of %s: %w", name, ErrNotRegistered)
+	}
+
+	r := gg.restarts
+	r.mux.Lock()
+	if st := r.states[name]; st != nil && st.timer != nil {
+		st.timer.Stop()
+	}
+	delete(r.states, name)
+	r.mux.Unlock()
+
+	log.WithFields(log.Fields{
+		"service_name": name,
+	}).Info("Reset restarts of service")
+	gg.revision.bump()
+	return nil
+}
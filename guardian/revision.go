@@ -0,0 +1,54 @@
+package guardian
+
+import (
+	"context"
+	"sync"
+)
+
+// stateRevision counts changes to service state so clients can wait for the
+// next one instead of polling
+type stateRevision struct {
+	mux     sync.Mutex
+	rev     uint64
+	changed chan struct{} // Closed and replaced on every change
+}
+
+func newStateRevision() *stateRevision {
+	return &stateRevision{changed: make(chan struct{})}
+}
+
+// bump records a change and wakes everyone waiting for one
+func (sr *stateRevision) bump() {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+
+	sr.rev++
+	close(sr.changed)
+	sr.changed = make(chan struct{})
+}
+
+func (sr *stateRevision) current() uint64 {
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	return sr.rev
+}
+
+// wait blocks until the revision is past since or the context is done, and
+// returns the current revision
+func (sr *stateRevision) wait(ctx context.Context, since uint64) uint64 {
+	for {
+		sr.mux.Lock()
+		rev, changed := sr.rev, sr.changed
+		sr.mux.Unlock()
+
+		if rev > since {
+			return rev
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return rev
+		}
+	}
+}
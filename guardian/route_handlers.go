@@ -1,12 +1,18 @@
 package guardian
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/buger/jsonparser"
 	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
@@ -14,12 +20,163 @@ func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, "There's nothing here, check our API docs at https://github.com/gladiusio/gladius-guardian", true, nil, "")
 }
 
+type healthReport struct {
+	Checks   []string          `json:"checks"`
+	Failures map[string]string `json:"failures"`
+}
+
+// HealthzHandler reports whether the guardian process is alive and not wedged
+func HealthzHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := gg.Live(); err != nil {
+			ErrorHandler(w, r, "Guardian is wedged", err, http.StatusServiceUnavailable)
+			return
+		}
+		ResponseHandler(w, r, "Guardian is alive", true, nil, nil)
+	}
+}
+
+// ReadyzHandler reports whether the guardian is fully up and able to manage
+// services
+func ReadyzHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		failures, checks := gg.Ready()
+		report := healthReport{Checks: checks, Failures: failures}
+		if len(failures) > 0 {
+			ErrorDetailsHandler(w, r, "Guardian isn't ready", errors.New("one or more readiness checks failed"), http.StatusServiceUnavailable, report)
+			return
+		}
+		ResponseHandler(w, r, "Guardian is ready", true, nil, report)
+	}
+}
+
+// AboutHandler returns which build of the guardian is running and how it's set
+// up, for bug reports
+func AboutHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got guardian build info", true, nil, gg.About())
+	}
+}
+
+// ValidateConfigHandler reports every problem with how the registered services
+// are set up
+func ValidateConfigHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		problems := gg.ValidateConfig()
+		if len(problems) > 0 {
+			ErrorDetailsHandler(w, r, "Config has problems", errors.New("found problems with the config"), http.StatusUnprocessableEntity, problems)
+			return
+		}
+		ResponseHandler(w, r, "Config is valid", true, nil, problems)
+	}
+}
+
+// DiagnosticsHandler runs the guardian's self checks, the report is returned
+// whether or not they pass
+func DiagnosticsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := gg.Doctor()
+		if !report.OK {
+			ResponseHandler(w, r, "Found problems, see the failed checks", true, nil, report)
+			return
+		}
+		ResponseHandler(w, r, "All checks passed", true, nil, report)
+	}
+}
+
 func GetServicesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		sn := vars["service_name"]
 
-		ResponseHandler(w, r, "Got service status", true, nil, gg.GetServicesStatus(sn))
+		q := StatusQuery{}
+		q.RunningOnly, _ = strconv.ParseBool(r.URL.Query().Get("running_only"))
+		if exclude := r.URL.Query().Get("exclude"); exclude != "" {
+			for _, field := range strings.Split(exclude, ",") {
+				switch field {
+				case "env", "environment_vars":
+					q.ExcludeEnv = true
+				default:
+					ErrorHandler(w, r, "Can only exclude env", errors.New("unknown field "+field), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if selector := r.URL.Query().Get("selector"); selector != "" {
+			sel, err := ParseSelector(selector)
+			if err != nil {
+				ErrorHandler(w, r, "Couldn't parse 'selector'", err, http.StatusBadRequest)
+				return
+			}
+			q.Selector = sel
+		}
+
+		// The UI polls this, so let it skip downloading an unchanged status
+		CachedResponseHandler(w, r, "Got service status", statusResponse(r, gg.GetServicesStatusFiltered(sn, q)))
+	}
+}
+
+// The longest a status request can be held open waiting for a change
+const maxStatusWait = 60 * time.Second
+
+type statusChange struct {
+	Revision uint64      `json:"revision"`
+	Changed  bool        `json:"changed"`
+	Services interface{} `json:"services"`
+}
+
+func GetProcessTreeHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		trees, err := gg.ProcessTree(vars["service_name"])
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't get process tree", err, http.StatusInternalServerError)
+			return
+		}
+		ResponseHandler(w, r, "Got process tree", true, nil, trees)
+	}
+}
+
+func WaitForStatusHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		since := gg.StatusRevision()
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			since, err = strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				ErrorHandler(w, r, "Couldn't parse since, must be a revision number", err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		wait := time.Duration(0)
+		if s := r.URL.Query().Get("wait"); s != "" {
+			var err error
+			wait, err = time.ParseDuration(s)
+			if err != nil {
+				ErrorHandler(w, r, "Couldn't parse wait, must be a duration like 30s", err, http.StatusBadRequest)
+				return
+			}
+		}
+		if wait > maxStatusWait {
+			wait = maxStatusWait
+		}
+
+		rev := gg.StatusRevision()
+		if wait > 0 && rev <= since {
+			// Outlast the server's write timeout for this request only
+			http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 5*time.Second))
+
+			ctx, cancel := context.WithTimeout(r.Context(), wait)
+			rev = gg.WaitForStatusChange(ctx, since)
+			cancel()
+		}
+
+		ResponseHandler(w, r, "Got service status", true, nil, statusChange{
+			Revision: rev,
+			Changed:  rev > since,
+			Services: statusResponse(r, gg.GetServicesStatus("all")),
+		})
 	}
 }
 
@@ -40,14 +197,16 @@ func ServiceStateHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *htt
 		vars := mux.Vars(r)
 		sn := vars["service_name"]
 
+		names, q, err := targetServices(gg, r, sn)
+		if err != nil {
+			selectorErrorHandler(w, r, err)
+			return
+		}
+
 		environmentVars := make([]string, 0)
 
-		// Defaults will be used if empty, so only specify if we have some to add
+		// These override the service's own environment for this start
 		if envBytes, ok := vals["environment_vars"]; ok {
-			// Add our defaults just in case, they can be overriden if they are redefined
-			environmentVars = append(environmentVars, viper.GetStringSlice("DefaultEnvironment")...)
-
-			// Add the desired environment vars
 			jsonparser.ArrayEach(envBytes, func(value []byte, dataType jsonparser.ValueType, offset int, err error) {
 				environmentVars = append(environmentVars, string(value))
 			})
@@ -60,24 +219,214 @@ func ServiceStateHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *htt
 			return
 		}
 
+		idempotent := viper.GetBool("IdempotentStateChanges")
+		if q := r.URL.Query().Get("idempotent"); q != "" {
+			idempotent, _ = strconv.ParseBool(q)
+		}
+
+		// Report what would go wrong without starting anything
+		if r.URL.Query().Get("dry_run") == "true" && setRunning {
+			problems := gg.StartServiceDryRun(sn)
+			if q.Selector != nil {
+				problems = gg.StartServicesDryRun(names)
+			}
+			if len(problems) > 0 {
+				ErrorDetailsHandler(w, r, "Service can't be started", errors.New("found problems starting service"), http.StatusUnprocessableEntity, problems)
+				return
+			}
+			ResponseHandler(w, r, "Service can be started", true, nil, problems)
+			return
+		}
+
+		// Hand back an operation to poll instead of waiting for the services
+		if r.URL.Query().Get("async") == "true" {
+			op := gg.SetServicesStateAsync(r.Context(), names, setRunning, environmentVars, idempotent)
+			w.WriteHeader(http.StatusAccepted)
+			ResponseHandler(w, r, "Started operation, check its progress at /operations/"+op.ID, true, nil, op)
+			return
+		}
+
 		// Start or stop the service
+		results := gg.SetServicesState(r.Context(), names, setRunning, environmentVars, idempotent)
 		if setRunning {
-			err = gg.StartService(sn, environmentVars)
-			if err != nil {
-				ErrorHandler(w, r, "Error starting service", err, http.StatusBadRequest)
+			if resultsError(results) != nil {
+				// Say how the services that exited while starting ended, the
+				// unversioned routes only ever had the startup errors
+				var details interface{} = results
+				if apiVersion(r) == legacyAPIVersion {
+					details = startupErrors(results)
+				}
+				resultsErrorHandler(w, r, "Error starting service", results, http.StatusBadRequest, details)
 				return
 			}
-			ResponseHandler(w, r, "Attempted to start service, check logs to make sure it didn't fail after timeout", true, nil, gg.GetServicesStatus(sn))
+			if allNoOps(results) {
+				NoOpResponseHandler(w, r, "Service already running, nothing to do", statusResponse(r, gg.GetServicesStatusFiltered(sn, q)))
+				return
+			}
+			ResponseHandler(w, r, "Attempted to start service, check logs to make sure it didn't fail after timeout", true, nil, statusResponse(r, gg.GetServicesStatusFiltered(sn, q)))
 		} else {
-			err = gg.StopService(sn)
-			if err != nil {
-				ErrorHandler(w, r, "Error stoping service", err, http.StatusBadRequest)
+			if resultsError(results) != nil {
+				resultsErrorHandler(w, r, "Error stoping service", results, http.StatusBadRequest, nil)
+				return
+			}
+			if allNoOps(results) {
+				NoOpResponseHandler(w, r, "Service already stopped, nothing to do", statusResponse(r, gg.GetServicesStatusFiltered(sn, q)))
 				return
 			}
 			time.Sleep(200 * time.Millisecond)
-			ResponseHandler(w, r, "Stopped Service", true, nil, gg.GetServicesStatus(sn))
+			ResponseHandler(w, r, "Stopped Service", true, nil, statusResponse(r, gg.GetServicesStatusFiltered(sn, q)))
+		}
+
+	}
+}
+
+// targetServices returns the services a request on the service applies to.
+// For "all" they can be narrowed down with the selector query parameter, the
+// returned query picks the status of the same services.
+func targetServices(gg *GladiusGuardian, r *http.Request, sn string) ([]string, StatusQuery, error) {
+	selector := r.URL.Query().Get("selector")
+	if selector == "" {
+		return gg.serviceNames(sn), StatusQuery{}, nil
+	}
+	if sn != "all" {
+		return nil, StatusQuery{}, errors.New("a selector can only narrow down all services")
+	}
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, StatusQuery{}, err
+	}
+	names := gg.SelectServices(sel)
+	if len(names) == 0 {
+		return nil, StatusQuery{}, noMatchError{sel}
+	}
+	return names, StatusQuery{Selector: sel}, nil
+}
+
+// noMatchError is returned by targetServices when no services match
+type noMatchError struct{ sel Selector }
+
+func (e noMatchError) Error() string {
+	return "no services match " + e.sel.String()
+}
+
+// selectorErrorHandler - Error response for a selector that couldn't be used
+func selectorErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var noneErr noMatchError
+	if errors.As(err, &noneErr) {
+		ErrorHandler(w, r, "No services match the selector", err, http.StatusNotFound)
+		return
+	}
+	ErrorHandler(w, r, "Couldn't use 'selector'", err, http.StatusBadRequest)
+}
+
+// RestartServicesHandler restarts the service, all of them or the ones
+// matching a selector
+func RestartServicesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vals, err := getJSONFields(w, r, "environment_vars")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+
+		names, _, err := targetServices(gg, r, mux.Vars(r)["service_name"])
+		if err != nil {
+			selectorErrorHandler(w, r, err)
+			return
+		}
+
+		environmentVars := make([]string, 0)
+		if envBytes, ok := vals["environment_vars"]; ok {
+			environmentVars = append(environmentVars, getStringArray(envBytes)...)
+		}
+
+		idempotent := viper.GetBool("IdempotentStateChanges")
+		if q := r.URL.Query().Get("idempotent"); q != "" {
+			idempotent, _ = strconv.ParseBool(q)
+		}
+
+		if r.URL.Query().Get("async") == "true" {
+			op := gg.BatchActionAsync(r.Context(), ActionRestart, names, environmentVars, idempotent)
+			w.WriteHeader(http.StatusAccepted)
+			ResponseHandler(w, r, "Started operation, check its progress at /operations/"+op.ID, true, nil, op)
+			return
+		}
+
+		results := gg.BatchAction(r.Context(), ActionRestart, names, environmentVars, idempotent)
+		if resultsError(results) != nil {
+			resultsErrorHandler(w, r, "Error restarting one or more services", results, http.StatusBadRequest, results)
+			return
+		}
+		ResponseHandler(w, r, "Restarted services", true, nil, results)
+	}
+}
+
+func BatchHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vals, err := getJSONFields(w, r, "action", "services", "selector", "environment_vars", "idempotent", "async")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		_, hasServices := vals["services"]
+		_, hasSelector := vals["selector"]
+		if hasServices == hasSelector {
+			ErrorHandler(w, r, "Need either 'services' or 'selector' in request", errors.New("no services specified"), http.StatusBadRequest)
+			return
+		}
+
+		action := string(vals["action"])
+		switch action {
+		case ActionStart, ActionStop, ActionRestart:
+		default:
+			ErrorHandler(w, r, "'action' must be one of start, stop or restart", errors.New("unknown action"), http.StatusBadRequest)
+			return
+		}
+
+		var services []string
+		if hasSelector {
+			sel, err := ParseSelector(string(vals["selector"]))
+			if err != nil {
+				selectorErrorHandler(w, r, err)
+				return
+			}
+			services = gg.SelectServices(sel)
+			if len(services) == 0 {
+				selectorErrorHandler(w, r, noMatchError{sel})
+				return
+			}
+		} else {
+			services = getStringArray(vals["services"])
+			if len(services) == 0 {
+				ErrorHandler(w, r, "Need at least one service in 'services'", errors.New("no services specified"), http.StatusBadRequest)
+				return
+			}
+		}
+
+		environmentVars := make([]string, 0)
+		if envBytes, ok := vals["environment_vars"]; ok {
+			environmentVars = append(environmentVars, getStringArray(envBytes)...)
+		}
+
+		idempotent := viper.GetBool("IdempotentStateChanges")
+		if b, ok := vals["idempotent"]; ok {
+			idempotent, _ = strconv.ParseBool(string(b))
 		}
 
+		if async, _ := strconv.ParseBool(string(vals["async"])); async {
+			op := gg.BatchActionAsync(r.Context(), action, services, environmentVars, idempotent)
+			w.WriteHeader(http.StatusAccepted)
+			ResponseHandler(w, r, "Started operation, check its progress at /operations/"+op.ID, true, nil, op)
+			return
+		}
+
+		results := gg.BatchAction(r.Context(), action, services, environmentVars, idempotent)
+		if resultsError(results) != nil {
+			// Some services may have succeeded, so still return every result
+			resultsErrorHandler(w, r, "Error with one or more services", results, http.StatusBadRequest, results)
+			return
+		}
+		ResponseHandler(w, r, "Applied "+action+" to services", true, nil, results)
 	}
 }
 
@@ -107,20 +456,622 @@ func SetStartTimeoutHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *
 
 func GetOldLogsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		toReturn := make(map[string]([]string))
-		for name, fsl := range gg.serviceLogs {
-			toReturn[name] = fsl.LogLines()
-		}
-		ResponseHandler(w, r, "Got logs", true, nil, toReturn)
+		ResponseHandler(w, r, "Got logs", true, nil, gg.storedLogs())
 	}
 }
 
+// storedLogs returns the log lines kept for each service
+func (gg *GladiusGuardian) storedLogs() map[string][]string {
+	return gg.logs.all()
+}
+
 func GetNewLogsWebSocketHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		sn := vars["service_name"]
-		if sn != "" {
-			gg.AddLogClient(sn, w, r)
+		if err := gg.AddLogClient(sn, w, r); err != nil {
+			ErrorHandler(w, r, "Couldn't follow service log", err, http.StatusNotFound)
+		}
+	}
+}
+
+func AttachTerminalHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := gg.AttachTerminal(mux.Vars(r)["service_name"], w, r)
+		if err != nil {
+			status := http.StatusNotFound
+			if errors.Is(err, ErrNotRunning) || errors.Is(err, ErrNoTerminal) {
+				status = http.StatusConflict
+			}
+			ErrorHandler(w, r, "Couldn't attach to service", err, status)
+		}
+	}
+}
+
+func GetOperationHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		op, ok := gg.GetOperation(vars["operation_id"])
+		if !ok {
+			ErrorHandler(w, r, "Couldn't find operation", errors.New("no operation with that ID"), http.StatusNotFound)
+			return
+		}
+		ResponseHandler(w, r, "Got operation", true, nil, op)
+	}
+}
+
+func GetAlertsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got active alerts", true, nil, gg.ActiveAlerts())
+	}
+}
+
+func GetMaintenanceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got maintenance mode", true, nil, gg.Maintenance())
+	}
+}
+
+func GetEventsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		q := EventQuery{Service: query.Get("service"), Type: query.Get("type")}
+		if s := query.Get("since"); s != "" {
+			var err error
+			q.Since, err = strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				ErrorHandler(w, r, "Couldn't parse since, must be an event id", err, http.StatusBadRequest)
+				return
+			}
+		}
+		if s := query.Get("limit"); s != "" {
+			var err error
+			q.Limit, err = strconv.Atoi(s)
+			if err != nil {
+				ErrorHandler(w, r, "Couldn't parse limit, must be a number", err, http.StatusBadRequest)
+				return
+			}
+		}
+		ResponseHandler(w, r, "Got events", true, nil, gg.Events(q))
+	}
+}
+
+func StreamEventsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		gg.StreamEvents(ParseEventFilter(query.Get("service"), query.Get("type")), w, r)
+	}
+}
+
+func GetHousekeepingHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got housekeeping stats", true, nil, gg.Housekeeping())
+	}
+}
+
+func LeaderHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got leader status", true, nil, gg.LeaderStatus())
+	}
+}
+
+func SetMaintenanceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vals, err := getJSONFields(w, r, "enabled")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		enabled, err := strconv.ParseBool(string(vals["enabled"]))
+		if err != nil {
+			ErrorHandler(w, r, "Need 'enabled' as a bool in request", err, http.StatusBadRequest)
+			return
+		}
+		if err := gg.SetMaintenance(mux.Vars(r)["service_name"], enabled); err != nil {
+			ErrorHandler(w, r, "Couldn't change maintenance mode", err, http.StatusNotFound)
+			return
+		}
+		ResponseHandler(w, r, "Changed maintenance mode", true, nil, gg.Maintenance())
+	}
+}
+
+func ListServicesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got registered services", true, nil, gg.ListServices())
+	}
+}
+
+func ExportSnapshotHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		b, err := encodeSnapshot(gg.ExportSnapshot(), format)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't export snapshot", err, http.StatusBadRequest)
+			return
 		}
+		if format == "yaml" || format == "yml" {
+			w.Header().Set("Content-Type", "application/x-yaml")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write(b)
+	}
+}
+
+func ImportSnapshotHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't read body", err, http.StatusBadRequest)
+			return
+		}
+		snapshot, err := decodeSnapshot(body)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse snapshot", err, http.StatusBadRequest)
+			return
+		}
+
+		results, err := gg.ImportSnapshot(r.Context(), snapshot)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't import snapshot", err, http.StatusBadRequest)
+			return
+		}
+		if resultsError(results) != nil {
+			resultsErrorHandler(w, r, "Imported snapshot with errors", results, http.StatusOK, results)
+			return
+		}
+		ResponseHandler(w, r, "Imported snapshot", true, nil, results)
+	}
+}
+
+func GetAutomationRulesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got automation rules", true, nil, gg.AutomationRules())
+	}
+}
+
+func SetAutomationRuleHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't read body", err, http.StatusBadRequest)
+			return
+		}
+		rule, err := DecodeAutomationRule(body)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse automation rule", err, http.StatusBadRequest)
+			return
+		}
+		rule.Name = mux.Vars(r)["rule_name"]
+
+		if err := gg.SetAutomationRule(rule); err != nil {
+			ErrorHandler(w, r, "Couldn't set automation rule", err, http.StatusBadRequest)
+			return
+		}
+		ResponseHandler(w, r, "Set automation rule", true, nil, nil)
+	}
+}
+
+func RemoveAutomationRuleHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := gg.RemoveAutomationRule(mux.Vars(r)["rule_name"]); err != nil {
+			ErrorHandler(w, r, "Couldn't remove automation rule", err, http.StatusNotFound)
+			return
+		}
+		ResponseHandler(w, r, "Removed automation rule", true, nil, nil)
+	}
+}
+
+func GetPhasesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got phases", true, nil, gg.Phases())
+	}
+}
+
+func StartTargetHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, err := gg.StartTarget(r.Context(), mux.Vars(r)["phase"])
+		if errors.Is(err, ErrNoPhase) {
+			ErrorHandler(w, r, "Couldn't start target", err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			// The services of earlier phases may be up, so still return every result
+			resultsErrorHandler(w, r, "Error with one or more services", results, http.StatusBadRequest, results)
+			return
+		}
+		ResponseHandler(w, r, "Started target", true, nil, results)
+	}
+}
+
+func GetTemplatesHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got service templates", true, nil, gg.Templates())
+	}
+}
+
+func InstantiateTemplateHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vals, err := getJSONFields(w, r, "name", "params")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		name, err := jsonparser.ParseString(vals["name"])
+		if err != nil || name == "" {
+			ErrorHandler(w, r, "Need 'name' as a string in request", err, http.StatusBadRequest)
+			return
+		}
+		params := make(map[string]string)
+		if b, ok := vals["params"]; ok {
+			if err := json.Unmarshal(b, &params); err != nil {
+				ErrorHandler(w, r, "Couldn't parse params, must be an object of strings", err, http.StatusBadRequest)
+				return
+			}
+		}
+
+		err = gg.InstantiateTemplate(mux.Vars(r)["template_name"], name, params, nil)
+		if err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, ErrNoTemplate) {
+				status = http.StatusNotFound
+			} else if errors.Is(err, ErrAlreadyRegistered) {
+				status = http.StatusConflict
+			}
+			ErrorHandler(w, r, "Couldn't instantiate template", err, status)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		ResponseHandler(w, r, "Registered service from template", true, nil, statusResponse(r, gg.GetServicesStatus(name)))
+	}
+}
+
+func GetEnvSetsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Got environment sets", true, nil, gg.EnvSets())
+	}
+}
+
+// SwitchEnvSetHandler changes the active environment set, the response has the
+// result of restarting each service that uses it
+func SwitchEnvSetHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vals, err := getJSONFields(w, r, "name")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		name, err := jsonparser.ParseString(vals["name"])
+		if err != nil || name == "" {
+			ErrorHandler(w, r, "Need 'name' as a string in request", err, http.StatusBadRequest)
+			return
+		}
+
+		results, err := gg.SwitchEnvSet(r.Context(), name)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't switch environment set", err, http.StatusNotFound)
+			return
+		}
+		if resultsError(results) != nil {
+			resultsErrorHandler(w, r, "Switched environment set, some services didn't restart", results, http.StatusInternalServerError, results)
+			return
+		}
+		ResponseHandler(w, r, "Switched environment set", true, nil, results)
+	}
+}
+
+// SelfUpdateHandler installs a signed guardian release and restarts into it,
+// running services are handed over to the new process
+func SelfUpdateHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, err := ParseUpdateKey(viper.GetString("UpdatePublicKey"))
+		if err != nil {
+			ErrorHandler(w, r, "Updates need an UpdatePublicKey to be configured", err, http.StatusBadRequest)
+			return
+		}
+
+		vals, err := getJSONFields(w, r, "url")
+		if err != nil {
+			return
+		}
+		url := viper.GetString("UpdateURL")
+		if vals["url"] != nil {
+			url = string(vals["url"])
+		}
+		if url == "" {
+			ErrorHandler(w, r, "No release URL given or configured", errors.New("missing url"), http.StatusBadRequest)
+			return
+		}
+
+		if err := DownloadUpdate(r.Context(), url, key); err != nil {
+			ErrorHandler(w, r, "Couldn't install update", err, http.StatusBadGateway)
+			return
+		}
+
+		ResponseHandler(w, r, "Update installed, restarting the guardian", true, nil, nil)
+		go reexecSoon(gg)
+	}
+}
+
+// SetServiceEnabledHandler enables or disables the service, disabled ones are
+// left out when starting or stopping all services
+func SetServiceEnabledHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vals, err := getJSONFields(w, r, "enabled")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		enabled, err := strconv.ParseBool(string(vals["enabled"]))
+		if err != nil {
+			ErrorHandler(w, r, "Need 'enabled' as a bool in request", err, http.StatusBadRequest)
+			return
+		}
+		sn := mux.Vars(r)["service_name"]
+		if err := gg.SetEnabled(sn, enabled); err != nil {
+			ErrorHandler(w, r, "Couldn't change whether service is enabled", err, http.StatusNotFound)
+			return
+		}
+		ResponseHandler(w, r, "Changed whether service is enabled", true, nil, statusResponse(r, gg.GetServicesStatus(sn)))
+	}
+}
+
+// WriteStdinHandler writes a line to the standard input of a running service
+func WriteStdinHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vals, err := getJSONFields(w, r, "line")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		if _, ok := vals["line"]; !ok {
+			ErrorHandler(w, r, "Need 'line' in request", errors.New("missing line"), http.StatusBadRequest)
+			return
+		}
+		line, err := jsonparser.ParseString(vals["line"])
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse line, must be a string", err, http.StatusBadRequest)
+			return
+		}
+
+		if err := gg.WriteStdin(mux.Vars(r)["service_name"], line); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotRunning) {
+				status = http.StatusConflict
+			}
+			ErrorHandler(w, r, "Couldn't write to service", err, status)
+			return
+		}
+		ResponseHandler(w, r, "Wrote to service", true, nil, nil)
+	}
+}
+
+// ReloadServiceHandler sends the service its reload signal so it rereads its
+// config without restarting
+func ReloadServiceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sn := mux.Vars(r)["service_name"]
+		if err := gg.ReloadService(sn); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNotRunning) {
+				status = http.StatusConflict
+			}
+			ErrorHandler(w, r, "Couldn't reload service", err, status)
+			return
+		}
+		ResponseHandler(w, r, "Reloaded service", true, nil, statusResponse(r, gg.GetServicesStatus(sn)))
+	}
+}
+
+func BackupServiceHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["service_name"]
+		if !gg.isRegistered(name) {
+			ErrorHandler(w, r, "Couldn't back up service", ErrNotRegistered, http.StatusNotFound)
+			return
+		}
+		backup, err := gg.BackupService(r.Context(), name)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't back up service", err, http.StatusInternalServerError)
+			return
+		}
+		ResponseHandler(w, r, "Backed up service", true, nil, backup)
+	}
+}
+
+func ListBackupsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["service_name"]
+		if !gg.isRegistered(name) {
+			ErrorHandler(w, r, "Couldn't list backups", ErrNotRegistered, http.StatusNotFound)
+			return
+		}
+		list, err := gg.ListBackups(name)
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't list backups", err, http.StatusInternalServerError)
+			return
+		}
+		ResponseHandler(w, r, "Got backups", true, nil, list)
+	}
+}
+
+func RestoreBackupHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["service_name"]
+		if !gg.isRegistered(name) {
+			ErrorHandler(w, r, "Couldn't restore backup", ErrNotRegistered, http.StatusNotFound)
+			return
+		}
+		vals, err := getJSONFields(w, r, "backup")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		if _, ok := vals["backup"]; !ok {
+			ErrorHandler(w, r, "Need 'backup' in request", errors.New("missing backup"), http.StatusBadRequest)
+			return
+		}
+		id, err := jsonparser.ParseString(vals["backup"])
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse backup, must be a string", err, http.StatusBadRequest)
+			return
+		}
+
+		if err := gg.RestoreBackup(r.Context(), name, id); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrNoBackup) {
+				status = http.StatusNotFound
+			}
+			ErrorHandler(w, r, "Couldn't restore backup", err, status)
+			return
+		}
+		ResponseHandler(w, r, "Restored backup", true, nil, statusResponse(r, gg.GetServicesStatus(name)))
+	}
+}
+
+// Longest an exec'd command can run, and how long it gets if none is asked for
+const (
+	maxExecTimeout     = 10 * time.Minute
+	defaultExecTimeout = time.Minute
+)
+
+// GetExitHistoryHandler returns how the service's last instances ended
+func GetExitHistoryHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["service_name"]
+		if !gg.isRegistered(name) {
+			ErrorHandler(w, r, "Couldn't get exit history", ErrNotRegistered, http.StatusNotFound)
+			return
+		}
+		ResponseHandler(w, r, "Got exit history", true, nil, gg.ExitHistory(name))
+	}
+}
+
+// ResetRestartsHandler forgets the service's crashes and drops its pending
+// restart, giving it its full restart budget back
+func ResetRestartsHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := gg.ResetRestarts(mux.Vars(r)["service_name"]); err != nil {
+			ErrorHandler(w, r, "Couldn't reset restarts", err, http.StatusNotFound)
+			return
+		}
+		ResponseHandler(w, r, "Reset restarts", true, nil, nil)
+	}
+}
+
+type exitWait struct {
+	Exited bool      `json:"exited"`
+	Exit   *ExitInfo `json:"exit,omitempty"`
+}
+
+// WaitForExitHandler waits up to the wait query parameter for the service to
+// stop and returns how it ended, or how it last ended if it isn't running
+func WaitForExitHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["service_name"]
+		if !gg.isRegistered(name) {
+			ErrorHandler(w, r, "Couldn't wait for service", ErrNotRegistered, http.StatusNotFound)
+			return
+		}
+
+		wait := maxStatusWait
+		if s := r.URL.Query().Get("wait"); s != "" {
+			var err error
+			wait, err = time.ParseDuration(s)
+			if err != nil {
+				ErrorHandler(w, r, "Couldn't parse wait, must be a duration like 30s", err, http.StatusBadRequest)
+				return
+			}
+		}
+		if wait > maxStatusWait {
+			wait = maxStatusWait
+		}
+
+		// Outlast the server's write timeout for this request only
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + 5*time.Second))
+
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		exit, err := gg.WaitForExit(ctx, name)
+		cancel()
+		switch {
+		case errors.Is(err, ErrNotRunning):
+			ErrorHandler(w, r, "Service never ran", err, http.StatusConflict)
+		case errors.Is(err, context.DeadlineExceeded):
+			ResponseHandler(w, r, "Service is still running", true, nil, exitWait{})
+		case err != nil:
+			ErrorHandler(w, r, "Couldn't wait for service", err, http.StatusInternalServerError)
+		default:
+			ResponseHandler(w, r, "Service exited", true, nil, exitWait{Exited: true, Exit: &exit})
+		}
+	}
+}
+
+// ExecHandler runs a one-off command in a service's environment, its output
+// is streamed back as newline delimited JSON ending with the exit code
+func ExecHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vals, err := getJSONFields(w, r, "command", "timeout")
+		if err != nil {
+			ErrorHandler(w, r, "Couldn't parse body", err, http.StatusBadRequest)
+			return
+		}
+		command := getStringArray(vals["command"])
+		if len(command) == 0 {
+			ErrorHandler(w, r, "Need 'command' as an array in request", errors.New("no command specified"), http.StatusBadRequest)
+			return
+		}
+		timeout := defaultExecTimeout
+		if b, ok := vals["timeout"]; ok {
+			t, err := strconv.Atoi(string(b))
+			if err != nil || t <= 0 {
+				ErrorHandler(w, r, "Couldn't parse timeout, must be in seconds", err, http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(t) * time.Second
+		}
+		if timeout > maxExecTimeout {
+			timeout = maxExecTimeout
+		}
+
+		sn := mux.Vars(r)["service_name"]
+		if !gg.isRegistered(sn) {
+			ErrorHandler(w, r, "Couldn't run command", ErrNotRegistered, http.StatusNotFound)
+			return
+		}
+
+		rc := http.NewResponseController(w)
+		rc.SetWriteDeadline(time.Now().Add(timeout + 5*time.Second))
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		code, err := gg.Exec(ctx, sn, command, func(stream, line string) {
+			enc.Encode(map[string]string{"stream": stream, "line": line})
+			rc.Flush()
+		})
+		result := map[string]interface{}{"exit_code": code}
+		if err != nil {
+			result["error"] = err.Error()
+		}
+		enc.Encode(result)
+	}
+}
+
+// RestartHandler re-execs the guardian, running services are handed over to
+// the new process
+func RestartHandler(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ResponseHandler(w, r, "Restarting the guardian", true, nil, nil)
+		go reexecSoon(gg)
+	}
+}
+
+func reexecSoon(gg *GladiusGuardian) {
+	time.Sleep(time.Second) // Let the response go out first
+	if err := gg.Reexec(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Couldn't restart the guardian")
 	}
 }
@@ -0,0 +1,741 @@
+package guardian
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gladiusio/gladius-guardian/tracing"
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+// routeParam describes a path or query parameter of a route
+type routeParam struct {
+	name        string
+	in          string // "path" or "query"
+	kind        string // JSON schema type
+	description string
+	required    bool
+}
+
+// bodyField describes a field of a JSON request body
+type bodyField struct {
+	name        string
+	kind        string // JSON schema type, "array" fields hold strings
+	description string
+	required    bool
+}
+
+// route is a single API endpoint. The same table is used to register the
+// handlers and to generate the OpenAPI document, so the two can't drift apart.
+type route struct {
+	name     string
+	method   string // Empty allows any method
+	path     string
+	summary  string
+	params   []routeParam
+	body     []bodyField
+	control  bool   // Control routes change service state and are rate limited
+	mutating bool   // Mutating routes are refused when the guardian is read-only
+	scope    string // Scope a token needs to use the route, empty is public
+	debug    bool   // Debug routes are only registered when enabled in the config
+	handler  func(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request)
+}
+
+var serviceNameParam = routeParam{
+	name:        "service_name",
+	in:          "path",
+	kind:        "string",
+	description: "Name of a registered service, or \"all\"",
+	required:    true,
+}
+
+// Narrows down "all" to the services whose labels match
+var selectorParam = routeParam{
+	name:        "selector",
+	in:          "query",
+	kind:        "string",
+	description: "Only the services whose labels match, like role=edge,net!=testnet, with a service name of all",
+}
+
+var ruleNameParam = routeParam{
+	name:        "rule_name",
+	in:          "path",
+	kind:        "string",
+	description: "Name of an automation rule",
+	required:    true,
+}
+
+// routes returns the guardian API routes
+func routes() []route {
+	return []route{
+		{
+			name:    "index",
+			method:  "GET",
+			path:    "/",
+			summary: "Points to the API docs",
+			handler: func(gg *GladiusGuardian) func(w http.ResponseWriter, r *http.Request) { return IndexHandler },
+		},
+		{
+			name:    "openapi",
+			method:  "GET",
+			path:    "/openapi.json",
+			summary: "OpenAPI document describing this API",
+			handler: OpenAPIHandler,
+		},
+		{
+			name:    "healthz",
+			method:  "GET",
+			path:    "/healthz",
+			summary: "Whether the guardian process is alive and not wedged",
+			handler: HealthzHandler,
+		},
+		{
+			name:    "readyz",
+			method:  "GET",
+			path:    "/readyz",
+			summary: "Whether the guardian is fully up, with the result of each readiness check",
+			handler: ReadyzHandler,
+		},
+		{
+			name:    "getAbout",
+			method:  "GET",
+			path:    "/about",
+			summary: "Version, git commit, build date, Go version and platform of the guardian, with a summary of its config",
+			scope:   ScopeRead,
+			handler: AboutHandler,
+		},
+		{
+			name:    "validateConfig",
+			method:  "GET",
+			path:    "/config/validate",
+			summary: "Check how every service is set up, their dependencies and fixed ports without starting anything, like gladius-guardian check-config",
+			scope:   ScopeRead,
+			handler: ValidateConfigHandler,
+		},
+		{
+			name:    "getDiagnostics",
+			method:  "GET",
+			path:    "/diagnostics",
+			summary: "Check disk space, service executables, ports and the clock, for troubleshooting and support requests",
+			scope:   ScopeRead,
+			handler: DiagnosticsHandler,
+		},
+		{
+			name:    "getServiceStatus",
+			method:  "GET",
+			path:    "/service/stats/{service_name}",
+			summary: "Get the status of one or all services",
+			params: []routeParam{
+				serviceNameParam,
+				{name: "running_only", in: "query", kind: "boolean", description: "Only return running services"},
+				{name: "exclude", in: "query", kind: "string", description: "Comma separated fields to leave out, only env is supported"},
+				selectorParam,
+			},
+			scope:   ScopeRead,
+			handler: GetServicesHandler,
+		},
+		{
+			name:    "getProcessTree",
+			method:  "GET",
+			path:    "/service/tree/{service_name}",
+			summary: "Get the processes of one or all running services, with their children",
+			params:  []routeParam{serviceNameParam},
+			scope:   ScopeRead,
+			handler: GetProcessTreeHandler,
+		},
+		{
+			name:    "listServices",
+			method:  "GET",
+			path:    "/services",
+			summary: "How every service is registered, running or not, with environment variable values redacted",
+			scope:   ScopeRead,
+			handler: ListServicesHandler,
+		},
+		{
+			name:    "waitForStatus",
+			method:  "GET",
+			path:    "/status",
+			summary: "Get the status of all services, optionally waiting for it to change",
+			params: []routeParam{
+				{name: "since", in: "query", kind: "integer", description: "Revision the client last saw, defaults to the current one"},
+				{name: "wait", in: "query", kind: "string", description: "How long to wait for a change past since, like 30s, at most 60s"},
+			},
+			scope:   ScopeRead,
+			handler: WaitForStatusHandler,
+		},
+		{
+			name:    "setServiceState",
+			method:  "PUT",
+			path:    "/service/set_state/{service_name}",
+			summary: "Start or stop one or all services",
+			params: []routeParam{
+				serviceNameParam,
+				selectorParam,
+				{name: "async", in: "query", kind: "boolean", description: "Return an operation ID immediately instead of waiting"},
+				{name: "idempotent", in: "query", kind: "boolean", description: "Treat a service already in the desired state as success"},
+				{name: "dry_run", in: "query", kind: "boolean", description: "Only check whether the services could be started and report every problem found"},
+			},
+			body: []bodyField{
+				{name: "running", kind: "boolean", description: "Desired run state", required: true},
+				{name: "environment_vars", kind: "array", description: "Environment variables in KEY=value form"},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  ServiceStateHandler,
+		},
+		{
+			name:    "restartServices",
+			method:  "POST",
+			path:    "/service/restart/{service_name}",
+			summary: "Restart one or all services, a stopped service is just started",
+			params: []routeParam{
+				serviceNameParam,
+				selectorParam,
+				{name: "async", in: "query", kind: "boolean", description: "Return an operation ID immediately instead of waiting"},
+				{name: "idempotent", in: "query", kind: "boolean", description: "Treat a service already in the desired state as success"},
+			},
+			body: []bodyField{
+				{name: "environment_vars", kind: "array", description: "Environment variables in KEY=value form"},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  RestartServicesHandler,
+		},
+		{
+			name:    "setServiceEnabled",
+			method:  "PUT",
+			path:    "/service/enabled/{service_name}",
+			summary: "Enable or disable a service, disabled services are skipped when starting or stopping all of them",
+			params:  []routeParam{serviceNameParam},
+			body: []bodyField{
+				{name: "enabled", kind: "boolean", description: "Whether the service is enabled", required: true},
+			},
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  SetServiceEnabledHandler,
+		},
+		{
+			name:    "writeStdin",
+			method:  "POST",
+			path:    "/service/stdin/{service_name}",
+			summary: "Write a line to the standard input of a running service, for ones that take console commands",
+			params: []routeParam{
+				{name: "service_name", in: "path", kind: "string", description: "Name of a registered service", required: true},
+			},
+			body: []bodyField{
+				{name: "line", kind: "string", description: "Line to write, a newline is added if it's missing", required: true},
+			},
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  WriteStdinHandler,
+		},
+		{
+			name:    "getExitHistory",
+			method:  "GET",
+			path:    "/service/exits/{service_name}",
+			summary: "Get how the service's last instances ended, oldest first",
+			params:  []routeParam{serviceNameParam},
+			scope:   ScopeRead,
+			handler: GetExitHistoryHandler,
+		},
+		{
+			name:     "resetRestarts",
+			method:   "POST",
+			path:     "/service/reset_restarts/{service_name}",
+			summary:  "Forget a service's crashes and drop its pending restart, giving it back its full restart budget",
+			params:   []routeParam{serviceNameParam},
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  ResetRestartsHandler,
+		},
+		{
+			name:    "waitForExit",
+			method:  "GET",
+			path:    "/service/wait/{service_name}",
+			summary: "Wait for the service to stop and get how it ended, or how it last ended if it isn't running",
+			params: []routeParam{
+				serviceNameParam,
+				{name: "wait", in: "query", kind: "string", description: "How long to wait for it to stop, like 30s, at most and by default 60s"},
+			},
+			scope:   ScopeRead,
+			handler: WaitForExitHandler,
+		},
+		{
+			name:    "execCommand",
+			method:  "POST",
+			path:    "/service/exec/{service_name}",
+			summary: "Run a one-off command with a service's environment and working directory, output is streamed as newline delimited JSON ending with the exit code",
+			params:  []routeParam{serviceNameParam},
+			body: []bodyField{
+				{name: "command", kind: "array", description: "The command and its arguments", required: true},
+				{name: "timeout", kind: "integer", description: "Seconds before the command is killed, defaults to 60"},
+			},
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  ExecHandler,
+		},
+		{
+			name:     "reloadService",
+			method:   "POST",
+			path:     "/service/reload/{service_name}",
+			summary:  "Send a service its reload signal so it rereads its config without restarting",
+			params:   []routeParam{serviceNameParam},
+			control:  true,
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  ReloadServiceHandler,
+		},
+		{
+			name:     "backupService",
+			method:   "POST",
+			path:     "/service/backup/{service_name}",
+			summary:  "Archive a service's data directory, stopping it for the backup unless it has a backup hook",
+			params:   []routeParam{serviceNameParam},
+			control:  true,
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  BackupServiceHandler,
+		},
+		{
+			name:    "listBackups",
+			method:  "GET",
+			path:    "/service/backups/{service_name}",
+			summary: "List the backups of a service's data directory, newest first",
+			params:  []routeParam{serviceNameParam},
+			scope:   ScopeRead,
+			handler: ListBackupsHandler,
+		},
+		{
+			name:    "restoreBackup",
+			method:  "POST",
+			path:    "/service/restore/{service_name}",
+			summary: "Replace a service's data directory with one of its backups, stopping it while it's restored",
+			params:  []routeParam{serviceNameParam},
+			body: []bodyField{
+				{name: "backup", kind: "string", description: "Id of the backup to restore", required: true},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  RestoreBackupHandler,
+		},
+		{
+			name:    "batchAction",
+			method:  "POST",
+			path:    "/service/batch",
+			summary: "Start, stop or restart a list of services in one request",
+			body: []bodyField{
+				{name: "action", kind: "string", description: "One of start, stop or restart", required: true},
+				{name: "services", kind: "array", description: "Names of the services, applied in order"},
+				{name: "selector", kind: "string", description: "Label selector picking the services instead, like role=edge"},
+				{name: "environment_vars", kind: "array", description: "Environment variables in KEY=value form"},
+				{name: "idempotent", kind: "boolean", description: "Treat a service already in the desired state as success"},
+				{name: "async", kind: "boolean", description: "Return an operation ID immediately instead of waiting"},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  BatchHandler,
+		},
+		{
+			name:    "getOperation",
+			method:  "GET",
+			path:    "/operations/{operation_id}",
+			summary: "Get the progress and per-service results of an async operation",
+			params: []routeParam{
+				{name: "operation_id", in: "path", kind: "string", description: "ID returned by an async request", required: true},
+			},
+			scope:   ScopeRead,
+			handler: GetOperationHandler,
+		},
+		{
+			name:    "setStartTimeout",
+			method:  "POST",
+			path:    "/service/set_timeout",
+			summary: "Set how long to wait for a service to start",
+			body: []bodyField{
+				{name: "timeout", kind: "integer", description: "Timeout in seconds", required: true},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  SetStartTimeoutHandler,
+		},
+		{
+			name:    "selfUpdate",
+			method:  "POST",
+			path:    "/guardian/update",
+			summary: "Install a signed guardian release and restart into it without stopping services",
+			body: []bodyField{
+				{name: "url", kind: "string", description: "Release to install, defaults to the configured UpdateURL"},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  SelfUpdateHandler,
+		},
+		{
+			name:     "restart",
+			method:   "POST",
+			path:     "/guardian/restart",
+			summary:  "Restart the guardian process without stopping services or dropping connections",
+			control:  true,
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  RestartHandler,
+		},
+		{
+			name:    "exportSnapshot",
+			method:  "GET",
+			path:    "/snapshot",
+			summary: "Export how every service is registered and whether it's running, environment included, to import on another node",
+			params: []routeParam{
+				{name: "format", in: "query", kind: "string", description: "json (the default) or yaml"},
+			},
+			scope:   ScopeAdmin,
+			handler: ExportSnapshotHandler,
+		},
+		{
+			name:     "importSnapshot",
+			method:   "POST",
+			path:     "/snapshot",
+			summary:  "Register the services of an exported JSON or YAML snapshot, replacing ones with the same name, and start or stop each to match it",
+			control:  true,
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  ImportSnapshotHandler,
+		},
+		{
+			name:    "getLogs",
+			method:  "GET",
+			path:    "/service/logs",
+			summary: "Get the stored log lines of every service",
+			scope:   ScopeRead,
+			handler: GetOldLogsHandler,
+		},
+		{
+			name:    "streamLogs",
+			path:    "/service/ws/logs/{service_name}",
+			summary: "Websocket streaming new log lines of a service, each message holds one or more lines separated by newlines, 404 for services that aren't registered",
+			params:  []routeParam{serviceNameParam},
+			scope:   ScopeRead,
+			handler: GetNewLogsWebSocketHandler,
+		},
+		{
+			name:    "attachTerminal",
+			method:  "GET",
+			path:    "/service/ws/attach/{service_name}",
+			summary: "Websocket attached to the terminal of a service running with PTY set, for interactive use",
+			params: []routeParam{
+				{name: "service_name", in: "path", kind: "string", description: "Name of a registered service", required: true},
+			},
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  AttachTerminalHandler,
+		},
+		{
+			name:    "proxy",
+			method:  "GET",
+			path:    "/service/proxy/{service_name}/{path:.*}",
+			summary: "Pass a request through to one of the service's own allow-listed HTTP endpoints",
+			params: []routeParam{
+				{name: "service_name", in: "path", kind: "string", description: "Name of a registered service", required: true},
+				{name: "path", in: "path", kind: "string", description: "Path on the service's API, must be in its ProxyPaths", required: true},
+			},
+			scope:   ScopeRead,
+			handler: ProxyHandler,
+		},
+		{
+			name:    "getFleetNodes",
+			method:  "GET",
+			path:    "/fleet",
+			summary: "Names of this node and the peer guardians it aggregates",
+			scope:   ScopeRead,
+			handler: FleetNodesHandler,
+		},
+		{
+			name:    "getFleetStatus",
+			method:  "GET",
+			path:    "/fleet/status",
+			summary: "Status of the services on every node of the fleet, with an error for nodes that couldn't be reached",
+			scope:   ScopeRead,
+			handler: FleetStatusHandler,
+		},
+		{
+			name:    "getFleetLogs",
+			method:  "GET",
+			path:    "/fleet/logs",
+			summary: "Stored log lines of every service on every node of the fleet",
+			scope:   ScopeRead,
+			handler: FleetLogsHandler,
+		},
+		{
+			name:    "fleetProxy",
+			path:    "/fleet/{node}/{path:.*}",
+			summary: "Pass a request through to the same API path on a peer, authenticated with the fleet token",
+			params: []routeParam{
+				{name: "node", in: "path", kind: "string", description: "Name of a fleet peer", required: true},
+				{name: "path", in: "path", kind: "string", description: "API path on the peer, without the /api/v1 prefix", required: true},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  FleetProxyHandler,
+		},
+		{
+			name:    "getAlerts",
+			method:  "GET",
+			path:    "/alerts",
+			summary: "Alerts that are currently firing",
+			scope:   ScopeRead,
+			handler: GetAlertsHandler,
+		},
+		{
+			name:    "getMaintenance",
+			method:  "GET",
+			path:    "/maintenance",
+			summary: "Whether the guardian and which services are in maintenance mode",
+			scope:   ScopeRead,
+			handler: GetMaintenanceHandler,
+		},
+		{
+			name:    "getEvents",
+			method:  "GET",
+			path:    "/events",
+			summary: "Get the latest lifecycle events of the services and the guardian, oldest first",
+			params: []routeParam{
+				{name: "since", in: "query", kind: "integer", description: "Only events with a higher id than this"},
+				{name: "service", in: "query", kind: "string", description: "Only events of this service"},
+				{name: "type", in: "query", kind: "string", description: "Only events of this type, like crashed"},
+				{name: "limit", in: "query", kind: "integer", description: "Only the newest this many events"},
+			},
+			scope:   ScopeRead,
+			handler: GetEventsHandler,
+		},
+		{
+			name:    "streamEvents",
+			method:  "GET",
+			path:    "/events/ws",
+			summary: "Websocket streaming events as they happen, log lines too if they're asked for with a type of log",
+			params: []routeParam{
+				{name: "service", in: "query", kind: "string", description: "Only events of these services, comma separated"},
+				{name: "type", in: "query", kind: "string", description: "Only events of these types, comma separated"},
+			},
+			scope:   ScopeRead,
+			handler: StreamEventsHandler,
+		},
+		{
+			name:    "getHousekeeping",
+			method:  "GET",
+			path:    "/housekeeping",
+			summary: "What each housekeeping task pruned the last time it ran",
+			scope:   ScopeRead,
+			handler: GetHousekeepingHandler,
+		},
+		{
+			name:    "getLeader",
+			method:  "GET",
+			path:    "/leader",
+			summary: "Whether this guardian is the leader of its redundant set, only the leader runs services",
+			scope:   ScopeRead,
+			handler: LeaderHandler,
+		},
+		{
+			name:    "setMaintenance",
+			method:  "PUT",
+			path:    "/maintenance/{service_name}",
+			summary: "Put one or all services in or out of maintenance mode, which stops automatic restarts and alerts",
+			params:  []routeParam{serviceNameParam},
+			body: []bodyField{
+				{name: "enabled", kind: "boolean", description: "Whether maintenance mode is on", required: true},
+			},
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  SetMaintenanceHandler,
+		},
+		{
+			name:    "getTemplates",
+			method:  "GET",
+			path:    "/templates",
+			summary: "The service templates services can be instantiated from",
+			scope:   ScopeRead,
+			handler: GetTemplatesHandler,
+		},
+		{
+			name:    "instantiateTemplate",
+			method:  "POST",
+			path:    "/templates/{template_name}/instantiate",
+			summary: "Register a new service from a template with its parameters filled in, it isn't started",
+			params: []routeParam{
+				{name: "template_name", in: "path", kind: "string", description: "Name of a service template", required: true},
+			},
+			body: []bodyField{
+				{name: "name", kind: "string", description: "Name of the new service", required: true},
+				{name: "params", kind: "object", description: "Values of the template's parameters by name"},
+			},
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  InstantiateTemplateHandler,
+		},
+		{
+			name:    "getPhases",
+			method:  "GET",
+			path:    "/phases",
+			summary: "The phases services are brought up in, in order, with the services of each",
+			scope:   ScopeRead,
+			handler: GetPhasesHandler,
+		},
+		{
+			name:    "startTarget",
+			method:  "POST",
+			path:    "/targets/{phase}/start",
+			summary: "Start the services of every phase up to this one, a phase at a time, stopping at the first that fails",
+			params: []routeParam{
+				{name: "phase", in: "path", kind: "string", description: "Name of the last phase to start", required: true},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  StartTargetHandler,
+		},
+		{
+			name:    "getEnvSets",
+			method:  "GET",
+			path:    "/env_sets",
+			summary: "The environment sets and which one is active",
+			scope:   ScopeRead,
+			handler: GetEnvSetsHandler,
+		},
+		{
+			name:    "switchEnvSet",
+			method:  "PUT",
+			path:    "/env_sets/active",
+			summary: "Make another environment set the active one, restarting the running services that use it",
+			body: []bodyField{
+				{name: "name", kind: "string", description: "Name of the environment set", required: true},
+			},
+			control:  true,
+			mutating: true,
+			scope:    ScopeOperator,
+			handler:  SwitchEnvSetHandler,
+		},
+		{
+			name:    "getAutomationRules",
+			method:  "GET",
+			path:    "/automation/rules",
+			summary: "The automation rules and when each last fired",
+			scope:   ScopeRead,
+			handler: GetAutomationRulesHandler,
+		},
+		{
+			name:    "setAutomationRule",
+			method:  "PUT",
+			path:    "/automation/rules/{rule_name}",
+			summary: "Add or replace an automation rule, which takes actions when events happen to services",
+			params:  []routeParam{ruleNameParam},
+			body: []bodyField{
+				{name: "on", kind: "string", description: "Type of event the rule counts, like crashed", required: true},
+				{name: "service", kind: "string", description: "Only count events of this service"},
+				{name: "count", kind: "integer", description: "How many events it takes to fire, 1 if it's left out"},
+				{name: "window", kind: "string", description: "Duration the events have to happen within, like 5m"},
+				{name: "cooldown", kind: "string", description: "Duration the rule doesn't fire again for after it fires"},
+				{name: "actions", kind: "array", description: "What to do when it fires, each with a type of start, stop, restart or webhook and a service, selector or url", required: true},
+			},
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  SetAutomationRuleHandler,
+		},
+		{
+			name:     "removeAutomationRule",
+			method:   "DELETE",
+			path:     "/automation/rules/{rule_name}",
+			summary:  "Remove an automation rule",
+			params:   []routeParam{ruleNameParam},
+			mutating: true,
+			scope:    ScopeAdmin,
+			handler:  RemoveAutomationRuleHandler,
+		},
+		{
+			name:    "debugVars",
+			method:  "GET",
+			path:    "/debug/vars",
+			summary: "expvar counters, like goroutines and per-service log sizes and websocket clients, dropped lines and broadcast times",
+			scope:   ScopeAdmin,
+			debug:   true,
+			handler: ExpvarHandler,
+		},
+		{
+			name:    "pprofIndex",
+			method:  "GET",
+			path:    "/debug/pprof/",
+			summary: "Index of the available pprof profiles",
+			scope:   ScopeAdmin,
+			debug:   true,
+			handler: PprofHandler,
+		},
+		{
+			name:    "pprofProfile",
+			path:    "/debug/pprof/{profile}",
+			summary: "A pprof profile",
+			params: []routeParam{
+				{name: "profile", in: "path", kind: "string", description: "Name of the profile, like heap or goroutine", required: true},
+			},
+			scope:   ScopeAdmin,
+			debug:   true,
+			handler: PprofHandler,
+		},
+	}
+}
+
+// NewRouter returns a router with every guardian endpoint registered under
+// the versioned prefix, plus the original unversioned paths for existing
+// clients
+func NewRouter(gg *GladiusGuardian) *mux.Router {
+	r := mux.NewRouter()
+	v1 := r.PathPrefix(APIPrefix).Subrouter()
+	limiter := newRateLimiter(viper.GetInt("ControlRateLimit"), viper.GetInt("ControlRateBurst"))
+	auth := newJWTAuth(viper.GetString("JWTSecret"))
+	readOnly := viper.GetBool("ReadOnly")
+	debug := viper.GetBool("EnableDebugEndpoints")
+	for _, rt := range routes() {
+		if rt.debug && !debug {
+			continue
+		}
+
+		h := rt.handler(gg)
+		if rt.control {
+			h = limiter.limit(h)
+		}
+		if rt.mutating && readOnly {
+			h = readOnlyHandler
+		}
+		h = auth.require(rt.scope, h) // Outside the limiter so it can key on the verified token
+		h = tracing.Handler(rt.name, h)
+		registerRoute(v1, rt, rt.name, withAPIVersion(APIVersion, h))
+		registerRoute(r, rt, "legacy_"+rt.name, withAPIVersion(legacyAPIVersion, h))
+	}
+
+	// Unknown versioned paths get the usual envelope too
+	v1.NotFoundHandler = withAPIVersion(APIVersion, func(w http.ResponseWriter, r *http.Request) {
+		ErrorHandler(w, r, "No such endpoint", errors.New("no endpoint at "+r.URL.Path), http.StatusNotFound)
+	})
+	return r
+}
+
+// ErrReadOnly is returned for mutating requests when the guardian is read-only
+var ErrReadOnly = errors.New("mutating operations are disabled")
+
+// readOnlyHandler replaces every mutating route when the guardian is read-only
+func readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	ErrorHandler(w, r, "The guardian is in read-only mode", ErrReadOnly, http.StatusForbidden)
+}
+
+func registerRoute(r *mux.Router, rt route, name string, h http.HandlerFunc) {
+	mr := r.HandleFunc(rt.path, h).Name(name)
+	if rt.method != "" {
+		mr.Methods(rt.method)
+	}
+}
@@ -0,0 +1,216 @@
+package guardian
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SandboxCommand is the hidden subcommand the guardian runs itself with to
+// set up a service's sandbox before exec'ing the service, see RunSandbox
+const SandboxCommand = "__sandbox"
+
+// Environment variable the sandbox settings are passed to that subcommand in
+const sandboxEnv = "GLADIUS_GUARDIAN_SANDBOX"
+
+// Namespaces a service can be put in, see ServiceOptions.Namespaces
+const (
+	NamespaceMount   = "mount"
+	NamespacePID     = "pid"
+	NamespaceNetwork = "network"
+	NamespaceIPC     = "ipc"
+	NamespaceUTS     = "uts"
+)
+
+// sandboxConfig is what the sandbox subcommand sets up before running the
+// service
+type sandboxConfig struct {
+	Mount           bool     `json:"mount"`
+	PID             bool     `json:"pid"`
+	Network         bool     `json:"network"`
+	NoNewPrivileges bool     `json:"no_new_privileges"`
+	ReadOnlyRoot    bool     `json:"read_only_root"`
+	WritablePaths   []string `json:"writable_paths"`
+	SeccompFilter   []byte   `json:"seccomp_filter"`
+	AppArmorProfile string   `json:"apparmor_profile"`
+	Capabilities    []int    `json:"capabilities"`
+	Chroot          string   `json:"chroot"`
+	Dir             string   `json:"dir"`
+}
+
+// Linux capabilities by number
+var capabilityNames = []string{
+	"CAP_CHOWN", "CAP_DAC_OVERRIDE", "CAP_DAC_READ_SEARCH", "CAP_FOWNER",
+	"CAP_FSETID", "CAP_KILL", "CAP_SETGID", "CAP_SETUID", "CAP_SETPCAP",
+	"CAP_LINUX_IMMUTABLE", "CAP_NET_BIND_SERVICE", "CAP_NET_BROADCAST",
+	"CAP_NET_ADMIN", "CAP_NET_RAW", "CAP_IPC_LOCK", "CAP_IPC_OWNER",
+	"CAP_SYS_MODULE", "CAP_SYS_RAWIO", "CAP_SYS_CHROOT", "CAP_SYS_PTRACE",
+	"CAP_SYS_PACCT", "CAP_SYS_ADMIN", "CAP_SYS_BOOT", "CAP_SYS_NICE",
+	"CAP_SYS_RESOURCE", "CAP_SYS_TIME", "CAP_SYS_TTY_CONFIG", "CAP_MKNOD",
+	"CAP_LEASE", "CAP_AUDIT_WRITE", "CAP_AUDIT_CONTROL", "CAP_SETFCAP",
+	"CAP_MAC_OVERRIDE", "CAP_MAC_ADMIN", "CAP_SYSLOG", "CAP_WAKE_ALARM",
+	"CAP_BLOCK_SUSPEND", "CAP_AUDIT_READ", "CAP_PERFMON", "CAP_BPF",
+	"CAP_CHECKPOINT_RESTORE",
+}
+
+// parseCapabilities returns the numbers of capabilities named like
+// "CAP_NET_RAW" or "net_raw"
+func parseCapabilities(names []string) ([]int, error) {
+	caps := make([]int, 0, len(names))
+	for _, name := range names {
+		name = canonicalCapability(name)
+		found := false
+		for i, c := range capabilityNames {
+			if c == name {
+				caps = append(caps, i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown capability %q", name)
+		}
+	}
+	return caps, nil
+}
+
+// canonicalCapability returns the name of a capability the way it's usually
+// written, like CAP_NET_RAW
+func canonicalCapability(name string) string {
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	return name
+}
+
+// dropsCapabilities returns whether the service is started with fewer
+// capabilities, only root has any to drop
+func dropsCapabilities(opts ServiceOptions) bool {
+	return len(opts.Capabilities) > 0 && os.Geteuid() == 0
+}
+
+// Size of an instruction of a compiled seccomp filter, a struct sock_filter,
+// and the most instructions the kernel takes
+const (
+	bpfInstructionSize = 8
+	bpfMaxInstructions = 4096
+)
+
+func hasSandbox(opts ServiceOptions) bool {
+	return len(opts.Namespaces) > 0 || opts.NoNewPrivileges || opts.ReadOnlyRoot ||
+		opts.SeccompProfile != "" || opts.AppArmorProfile != "" || dropsCapabilities(opts) ||
+		opts.ConfineToDataDir || opts.Chroot
+}
+
+// checkSandbox returns an error if the sandbox options don't make sense
+func checkSandbox(opts ServiceOptions) error {
+	for _, ns := range opts.Namespaces {
+		switch ns {
+		case NamespaceMount, NamespacePID, NamespaceNetwork, NamespaceIPC, NamespaceUTS:
+		default:
+			return fmt.Errorf("unknown namespace %q", ns)
+		}
+	}
+	for _, path := range opts.WritablePaths {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("writable path %q isn't absolute", path)
+		}
+	}
+	if err := checkDataDir(opts); err != nil {
+		return err
+	}
+	if len(opts.WritablePaths) > 0 && !opts.ReadOnlyRoot && !opts.ConfineToDataDir {
+		return errors.New("writable paths only make sense with a read-only root")
+	}
+	if _, err := parseCapabilities(opts.Capabilities); err != nil {
+		return err
+	}
+	if opts.SeccompProfile != "" && backendName(opts) == BackendExec {
+		if _, err := readSeccompFilter(opts.SeccompProfile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSeccompFilter reads a compiled seccomp filter and makes sure it's made
+// of whole instructions
+func readSeccompFilter(path string) ([]byte, error) {
+	filter, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't read seccomp filter: %s", err)
+	}
+	n := len(filter) / bpfInstructionSize
+	if len(filter) == 0 || len(filter)%bpfInstructionSize != 0 || n > bpfMaxInstructions {
+		return nil, fmt.Errorf("%s isn't a compiled seccomp filter", path)
+	}
+	return filter, nil
+}
+
+func newSandboxConfig(opts ServiceOptions) (sandboxConfig, error) {
+	cfg := sandboxConfig{
+		NoNewPrivileges: opts.NoNewPrivileges || opts.SeccompProfile != "",
+		ReadOnlyRoot:    opts.ReadOnlyRoot || opts.ConfineToDataDir,
+		WritablePaths:   opts.WritablePaths,
+		AppArmorProfile: opts.AppArmorProfile,
+	}
+	if opts.ConfineToDataDir {
+		cfg.WritablePaths = append(append([]string{}, opts.WritablePaths...), opts.DataDir)
+	}
+	if opts.Chroot {
+		cfg.Chroot, cfg.Dir = opts.DataDir, opts.WorkingDir
+	}
+	if opts.SeccompProfile != "" {
+		filter, err := readSeccompFilter(opts.SeccompProfile)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.SeccompFilter = filter
+	}
+	if dropsCapabilities(opts) {
+		caps, err := parseCapabilities(opts.Capabilities)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Capabilities = caps
+	}
+	for _, ns := range opts.Namespaces {
+		switch ns {
+		case NamespaceMount:
+			cfg.Mount = true
+		case NamespacePID:
+			cfg.PID = true
+		case NamespaceNetwork:
+			cfg.Network = true
+		}
+	}
+
+	// /proc is mounted again for a new PID namespace, and the root can only be
+	// made read-only for the service in a mount namespace of its own. Without
+	// root the namespace comes with a user namespace to chroot in.
+	cfg.Mount = cfg.Mount || cfg.PID || cfg.ReadOnlyRoot || cfg.Chroot != ""
+	return cfg, nil
+}
+
+// sandbox makes the command run the service in its sandbox, if it has one.
+// Where sandboxes aren't supported the service runs without it.
+func sandbox(name string, p *exec.Cmd, opts ServiceOptions) error {
+	if !hasSandbox(opts) {
+		return nil
+	}
+	err := setupSandbox(p, opts)
+	if errors.Is(err, ErrUnsupportedPlatform) {
+		log.WithFields(log.Fields{
+			"service_name": name,
+		}).Warn("Sandboxes aren't supported on this platform, running service without one")
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,386 @@
+package guardian
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// setupSandbox runs the command through the sandbox subcommand, in new
+// namespaces. When the guardian isn't root a user namespace mapping our own
+// user is added, so the other namespaces can be created without privileges.
+func setupSandbox(p *exec.Cmd, opts ServiceOptions) error {
+	executable, err := startExecutable, startExecutableErr
+	if err != nil {
+		return err
+	}
+	cfg, err := newSandboxConfig(opts)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	var flags uintptr
+	if cfg.Mount {
+		flags |= unix.CLONE_NEWNS
+	}
+	for _, ns := range opts.Namespaces {
+		switch ns {
+		case NamespacePID:
+			flags |= unix.CLONE_NEWPID
+		case NamespaceNetwork:
+			flags |= unix.CLONE_NEWNET
+		case NamespaceIPC:
+			flags |= unix.CLONE_NEWIPC
+		case NamespaceUTS:
+			flags |= unix.CLONE_NEWUTS
+		}
+	}
+
+	if p.SysProcAttr == nil {
+		p.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if flags != 0 && os.Geteuid() != 0 {
+		flags |= unix.CLONE_NEWUSER
+		p.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Geteuid(), HostID: os.Geteuid(), Size: 1}}
+		p.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getegid(), HostID: os.Getegid(), Size: 1}}
+	}
+	p.SysProcAttr.Cloneflags |= flags
+
+	// The subcommand gets the resolved path to exec followed by the original
+	// arguments, starting with the name it was run as. In a chroot the path
+	// is inside it, and it changes to the working directory itself.
+	path := p.Path
+	if cfg.Chroot != "" {
+		rel, err := filepath.Rel(cfg.Chroot, p.Path)
+		if err != nil {
+			return err
+		}
+		path, p.Dir = "/"+rel, ""
+	}
+	p.Args = append([]string{executable, SandboxCommand, path}, p.Args...)
+	p.Path = executable
+	p.Env = append(append([]string{}, p.Env...), sandboxEnv+"="+string(b))
+	return nil
+}
+
+// RunSandbox is the sandbox subcommand: it finishes setting up the sandbox
+// from inside the new namespaces, then execs the service in its place. The
+// arguments are the path of the service's executable and its arguments.
+func RunSandbox(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: gladius-guardian "+SandboxCommand+" <path> <argv0> [args...]")
+		return 2
+	}
+
+	var cfg sandboxConfig
+	if err := json.Unmarshal([]byte(os.Getenv(sandboxEnv)), &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "gladius-guardian: invalid sandbox settings: %s\n", err)
+		return 2
+	}
+	os.Unsetenv(sandboxEnv)
+
+	// Some of what's set up is per thread, so it has to be the one that execs
+	runtime.LockOSThread()
+	if err := enterSandbox(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "gladius-guardian: couldn't set up sandbox: %s\n", err)
+		return 1
+	}
+	err := syscall.Exec(args[0], args[1:], os.Environ())
+	fmt.Fprintf(os.Stderr, "gladius-guardian: couldn't run %s: %s\n", args[0], err)
+	return 1
+}
+
+func enterSandbox(cfg sandboxConfig) error {
+	if cfg.Mount {
+		// Keep our mounts from propagating back to the host
+		if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("making mounts private: %s", err)
+		}
+	}
+	if cfg.PID {
+		if err := unix.Mount("proc", "/proc", "proc", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+			return fmt.Errorf("mounting /proc: %s", err)
+		}
+	}
+	if cfg.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up loopback: %s", err)
+		}
+	}
+	if cfg.ReadOnlyRoot {
+		if err := readOnlyRoot(cfg.WritablePaths); err != nil {
+			return err
+		}
+	}
+	// After everything that needs the host's /proc
+	if cfg.AppArmorProfile != "" {
+		if err := appArmorOnExec(cfg.AppArmorProfile); err != nil {
+			return fmt.Errorf("setting AppArmor profile: %s", err)
+		}
+	}
+	if cfg.Chroot != "" {
+		if err := unix.Chroot(cfg.Chroot); err != nil {
+			return fmt.Errorf("changing root: %s", err)
+		}
+		dir := cfg.Dir
+		if dir == "" {
+			dir = "/"
+		}
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Capabilities) > 0 {
+		if err := keepCapabilities(cfg.Capabilities); err != nil {
+			return fmt.Errorf("dropping capabilities: %s", err)
+		}
+	}
+	if cfg.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("setting no_new_privs: %s", err)
+		}
+	}
+	// Last, the filter could forbid anything done before
+	if len(cfg.SeccompFilter) > 0 {
+		if err := seccompFilter(cfg.SeccompFilter); err != nil {
+			return fmt.Errorf("loading seccomp filter: %s", err)
+		}
+	}
+	return nil
+}
+
+// keepCapabilities drops every capability but the ones given from the
+// bounding set, which is what root gets when it execs the service, and from
+// our own sets. The kept ones are made ambient too so they survive the exec
+// if the service isn't run as root.
+func keepCapabilities(keep []int) error {
+	kept := make(map[int]bool, len(keep))
+	var mask uint64
+	for _, c := range keep {
+		kept[c] = true
+		mask |= 1 << uint(c)
+	}
+	for c := 0; c < 64; c++ {
+		if kept[c] {
+			continue
+		}
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(c), 0, 0, 0)
+		if err == unix.EINVAL {
+			// Past the last capability the kernel has
+			break
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", capabilityName(c), err)
+		}
+	}
+
+	// struct __user_cap_header_struct and two __user_cap_data_structs, for the
+	// low and high 32 capabilities
+	header := struct {
+		version uint32
+		pid     int32
+	}{linuxCapabilityVersion3, 0}
+	var data [2]struct {
+		effective, permitted, inheritable uint32
+	}
+	for i := range data {
+		bits := uint32(mask >> (32 * uint(i)))
+		data[i].effective, data[i].permitted, data[i].inheritable = bits, bits, bits
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+
+	for _, c := range keep {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(c), 0, 0); err != nil {
+			return fmt.Errorf("making %s ambient: %s", capabilityName(c), err)
+		}
+	}
+	return nil
+}
+
+// _LINUX_CAPABILITY_VERSION_3, for 64 bit capability sets
+const linuxCapabilityVersion3 = 0x20080522
+
+func capabilityName(c int) string {
+	if c < len(capabilityNames) {
+		return capabilityNames[c]
+	}
+	return strconv.Itoa(c)
+}
+
+// appArmorOnExec has the profile applied when this thread execs the service.
+// Newer kernels have a directory for each security module, older ones only
+// the shared file.
+func appArmorOnExec(profile string) error {
+	// Without AppArmor the write can go to another module, or nowhere
+	enabled, err := ioutil.ReadFile("/sys/module/apparmor/parameters/enabled")
+	if err != nil || !strings.HasPrefix(string(enabled), "Y") {
+		return errors.New("AppArmor isn't enabled")
+	}
+
+	attr := "/proc/thread-self/attr/apparmor/exec"
+	if _, err := os.Stat(attr); err != nil {
+		attr = "/proc/thread-self/attr/exec"
+	}
+	f, err := os.OpenFile(attr, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString("exec " + profile)
+	return err
+}
+
+// seccompFilter loads a compiled filter for this thread, it's kept across
+// the exec
+func seccompFilter(filter []byte) error {
+	// struct sock_fprog: the number of instructions and a pointer to them
+	prog := struct {
+		len    uint16
+		filter uintptr
+	}{uint16(len(filter) / bpfInstructionSize), uintptr(unsafe.Pointer(&filter[0]))}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return err
+	}
+	runtime.KeepAlive(filter)
+	return nil
+}
+
+// Pseudo filesystems left writable with a read-only root
+var pseudoFilesystems = []string{"/proc", "/sys", "/dev"}
+
+// readOnlyRoot makes every mount read-only except the writable paths, which
+// are bind mounted onto themselves first so they're mounts of their own
+func readOnlyRoot(writable []string) error {
+	for _, path := range writable {
+		if err := unix.Mount(path, path, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return fmt.Errorf("binding writable path %s: %s", path, err)
+		}
+	}
+
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if underAny(m.path, pseudoFilesystems) || underAny(m.path, writable) {
+			continue
+		}
+		// Flags locked by a user namespace have to be kept when remounting
+		flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY)
+		flags |= m.flags
+		if err := unix.Mount("", m.path, "", flags, ""); err != nil {
+			return fmt.Errorf("making %s read-only: %s", m.path, err)
+		}
+	}
+	return nil
+}
+
+type mountPoint struct {
+	path  string
+	flags uintptr
+}
+
+var mountFlags = map[string]uintptr{
+	"nosuid":     unix.MS_NOSUID,
+	"nodev":      unix.MS_NODEV,
+	"noexec":     unix.MS_NOEXEC,
+	"noatime":    unix.MS_NOATIME,
+	"nodiratime": unix.MS_NODIRATIME,
+	"relatime":   unix.MS_RELATIME,
+}
+
+// mountPoints lists our mounts with their per-mount flags
+func mountPoints() ([]mountPoint, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := make([]mountPoint, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// ID, parent ID, major:minor, root, mount point, mount options, ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		m := mountPoint{path: unescapeMountPath(fields[4])}
+		for _, opt := range strings.Split(fields[5], ",") {
+			m.flags |= mountFlags[opt]
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes mountinfo uses for spaces and
+// other special characters
+func unescapeMountPath(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// underAny returns whether path is one of the directories or inside one
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// loopbackUp brings up the loopback interface of a new network namespace, it
+// starts out down
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	// struct ifreq: the interface name followed by its flags
+	var ifr [40]byte
+	copy(ifr[:], "lo")
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errno
+	}
+	flags := (*uint16)(unsafe.Pointer(&ifr[unix.IFNAMSIZ]))
+	*flags |= unix.IFF_UP
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
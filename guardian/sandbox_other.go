@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package guardian
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func setupSandbox(p *exec.Cmd, opts ServiceOptions) error {
+	return ErrUnsupportedPlatform
+}
+
+// RunSandbox is the sandbox subcommand, services are never started with it
+// here
+func RunSandbox(args []string) int {
+	fmt.Fprintln(os.Stderr, "gladius-guardian: sandboxes aren't supported on this platform")
+	return 1
+}
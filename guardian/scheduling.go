@@ -0,0 +1,97 @@
+package guardian
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// I/O scheduling classes for IOClass, like with ionice
+const (
+	IOClassRealtime   = "realtime"
+	IOClassBestEffort = "best-effort"
+	IOClassIdle       = "idle"
+)
+
+// hasScheduling returns whether any of the scheduling options are set
+func hasScheduling(opts ServiceOptions) bool {
+	return opts.Nice != 0 || opts.IOClass != "" || opts.OOMScoreAdjust != 0 || opts.CPUAffinity != ""
+}
+
+// checkScheduling returns an error if a scheduling option is out of range
+func checkScheduling(opts ServiceOptions) error {
+	if opts.Nice < -20 || opts.Nice > 19 {
+		return fmt.Errorf("nice level %d isn't between -20 and 19", opts.Nice)
+	}
+	switch opts.IOClass {
+	case "", IOClassRealtime, IOClassBestEffort, IOClassIdle:
+	default:
+		return fmt.Errorf("unknown I/O class %q", opts.IOClass)
+	}
+	if opts.IOPriority < 0 || opts.IOPriority > 7 {
+		return fmt.Errorf("I/O priority %d isn't between 0 and 7", opts.IOPriority)
+	}
+	if opts.OOMScoreAdjust < -1000 || opts.OOMScoreAdjust > 1000 {
+		return fmt.Errorf("OOM score adjustment %d isn't between -1000 and 1000", opts.OOMScoreAdjust)
+	}
+	cpus, err := parseCPUList(opts.CPUAffinity)
+	if err != nil {
+		return err
+	}
+	for _, cpu := range cpus {
+		if cpu >= runtime.NumCPU() {
+			return fmt.Errorf("can't pin to CPU %d, there are only %d", cpu, runtime.NumCPU())
+		}
+	}
+	return nil
+}
+
+// parseCPUList parses a list of CPUs like "0-3,6", the format of cpusets
+func parseCPUList(s string) ([]int, error) {
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(first)
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(last)
+		}
+		if err != nil || from < 0 || to < from {
+			return nil, fmt.Errorf("bad CPU list %q", s)
+		}
+		for cpu := from; cpu <= to; cpu++ {
+			seen[cpu] = true
+		}
+	}
+
+	cpus := make([]int, 0, len(seen))
+	for cpu := range seen {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+	return cpus, nil
+}
+
+// applyScheduling sets the priorities of a process that was just started.
+// Failing to isn't fatal, the service runs with the defaults and a warning
+// is logged.
+func applyScheduling(name string, pid int, opts ServiceOptions) {
+	if !hasScheduling(opts) {
+		return
+	}
+	if err := setScheduling(pid, opts); err != nil {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"pid":          pid,
+			"err":          err,
+		}).Warn("Couldn't set the scheduling priorities of service")
+	}
+}
@@ -0,0 +1,85 @@
+package guardian
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"golang.org/x/sys/unix"
+)
+
+// ioprio_set(2) arguments
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+)
+
+var ioClasses = map[string]int{
+	IOClassRealtime:   1,
+	IOClassBestEffort: 2,
+	IOClassIdle:       3,
+}
+
+// setScheduling sets the priorities and affinity of every thread of the
+// process, Linux keeps them per thread and the service might have started
+// some already
+func setScheduling(pid int, opts ServiceOptions) error {
+	var cpus *unix.CPUSet
+	if opts.CPUAffinity != "" {
+		list, err := parseCPUList(opts.CPUAffinity)
+		if err != nil {
+			return err
+		}
+		cpus = &unix.CPUSet{}
+		for _, cpu := range list {
+			cpus.Set(cpu)
+		}
+	}
+
+	var result *multierror.Error
+	for _, tid := range threads(pid) {
+		if opts.Nice != 0 {
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, opts.Nice); err != nil {
+				result = multierror.Append(result, fmt.Errorf("nice: %s", err))
+			}
+		}
+		if class, ok := ioClasses[opts.IOClass]; ok {
+			prio := class<<ioprioClassShift | opts.IOPriority
+			if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+				result = multierror.Append(result, fmt.Errorf("ionice: %s", errno))
+			}
+		}
+		if cpus != nil {
+			if err := unix.SchedSetaffinity(tid, cpus); err != nil {
+				result = multierror.Append(result, fmt.Errorf("CPU affinity: %s", err))
+			}
+		}
+	}
+	if opts.OOMScoreAdjust != 0 {
+		path := "/proc/" + strconv.Itoa(pid) + "/oom_score_adj"
+		if err := ioutil.WriteFile(path, []byte(strconv.Itoa(opts.OOMScoreAdjust)), 0644); err != nil {
+			result = multierror.Append(result, fmt.Errorf("oom_score_adj: %s", err))
+		}
+	}
+	return result.ErrorOrNil()
+}
+
+// threads returns the IDs of the process's threads, or just its own ID if
+// they can't be listed
+func threads(pid int) []int {
+	entries, err := ioutil.ReadDir("/proc/" + strconv.Itoa(pid) + "/task")
+	if err != nil {
+		return []int{pid}
+	}
+	tids := make([]int, 0, len(entries))
+	for _, e := range entries {
+		if tid, err := strconv.Atoi(e.Name()); err == nil {
+			tids = append(tids, tid)
+		}
+	}
+	if len(tids) == 0 {
+		return []int{pid}
+	}
+	return tids
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package guardian
+
+func setScheduling(pid int, opts ServiceOptions) error {
+	return ErrUnsupportedPlatform
+}
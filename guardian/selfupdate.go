@@ -0,0 +1,110 @@
+package guardian
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Largest guardian release that will be downloaded
+const maxUpdateSize = 256 << 20
+
+// ErrBadSignature is returned when a downloaded release isn't signed by the
+// update key
+var ErrBadSignature = errors.New("release signature doesn't match the update key")
+
+// ParseUpdateKey decodes a base64 ed25519 public key
+func ParseUpdateKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid update key: %s", err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid update key: must be %d bytes", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// DownloadUpdate downloads the release at url along with its base64 ed25519
+// signature at url + ".sig", and once it's verified against key replaces the
+// guardian executable with it. The old executable is kept with a .old suffix.
+// Call Reexec to switch to the new version.
+func DownloadUpdate(ctx context.Context, url string, key ed25519.PublicKey) error {
+	release, err := download(ctx, url, maxUpdateSize)
+	if err != nil {
+		return err
+	}
+	sigText, err := download(ctx, url+".sig", 1024)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	if !ed25519.Verify(key, release, sig) {
+		return ErrBadSignature
+	}
+
+	executable, err := startExecutable, startExecutableErr
+	if err != nil {
+		return err
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		return err
+	}
+
+	// Write next to the executable so the rename can't cross filesystems
+	tmp := executable + ".new"
+	if err := ioutil.WriteFile(tmp, release, 0755); err != nil {
+		return fmt.Errorf("error writing release: %s", err)
+	}
+	if err := os.Rename(executable, executable+".old"); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error moving old executable: %s", err)
+	}
+	if err := os.Rename(tmp, executable); err != nil {
+		os.Rename(executable+".old", executable)
+		return fmt.Errorf("error replacing executable: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"url":        url,
+		"executable": executable,
+	}).Info("Installed verified guardian release")
+	return nil
+}
+
+func download(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading %s: %s", url, resp.Status)
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("error downloading %s: %s", url, err)
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", url, limit)
+	}
+	return b, nil
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package guardian
+
+import "syscall"
+
+// Signals a service can be told to reload with, by name without the SIG
+var signalsByName = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
@@ -0,0 +1,12 @@
+package guardian
+
+import "syscall"
+
+// Windows processes can only be killed, these are accepted so configs stay
+// portable but sending them fails
+var signalsByName = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+}
@@ -0,0 +1,128 @@
+package guardian
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Version of the snapshot format, snapshots of other versions are refused
+const snapshotVersion = 1
+
+// Snapshot is how every service is registered and whether it's running, to
+// set up another node the same way
+type Snapshot struct {
+	Version  int               `json:"version" yaml:"version"`
+	Services []SnapshotService `json:"services" yaml:"services"`
+}
+
+// SnapshotService is a service in a snapshot. Unlike ListServices the
+// environment isn't redacted so it can be registered again as it was.
+type SnapshotService struct {
+	Name        string         `json:"name" yaml:"name"`
+	Executable  string         `json:"executable,omitempty" yaml:"executable,omitempty"`
+	Environment []string       `json:"environment_vars" yaml:"environment_vars"`
+	Enabled     bool           `json:"enabled" yaml:"enabled"`
+	Running     bool           `json:"running" yaml:"running"`
+	Options     ServiceOptions `json:"options" yaml:"options"`
+}
+
+// ExportSnapshot returns the registration and state of every service
+func (gg *GladiusGuardian) ExportSnapshot() Snapshot {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	snapshot := Snapshot{Version: snapshotVersion, Services: make([]SnapshotService, 0, len(gg.registeredServices))}
+	for name, settings := range gg.registeredServices {
+		snapshot.Services = append(snapshot.Services, SnapshotService{
+			Name:        name,
+			Executable:  settings.execName,
+			Environment: settings.env,
+			Enabled:     !settings.disabled,
+			Running:     gg.services[name] != nil,
+			Options:     settings.opts,
+		})
+	}
+	sort.Slice(snapshot.Services, func(i, j int) bool { return snapshot.Services[i].Name < snapshot.Services[j].Name })
+	return snapshot
+}
+
+// ImportSnapshot registers every service in the snapshot, replacing ones that
+// are already registered, then starts or stops each of them to match it.
+// Services that aren't in the snapshot are left alone. A service that can't be
+// registered is skipped, the results say which ones failed.
+func (gg *GladiusGuardian) ImportSnapshot(ctx context.Context, snapshot Snapshot) ([]*ServiceResult, error) {
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	results := make([]*ServiceResult, 0, len(snapshot.Services))
+	registered := make([]SnapshotService, 0, len(snapshot.Services))
+	for _, svc := range snapshot.Services {
+		err := gg.ReplaceService(svc.Name, svc.Executable, svc.Environment, svc.Options)
+		if err == nil {
+			err = gg.SetEnabled(svc.Name, svc.Enabled)
+		}
+		if err != nil {
+			results = append(results, newServiceResult(svc.Name, err))
+			continue
+		}
+		registered = append(registered, svc)
+	}
+
+	// Everything is registered first so dependencies can be started
+	for _, svc := range registered {
+		results = append(results, gg.applyAction(ctx, runningAction(svc.Running), svc.Name, nil, true))
+	}
+
+	log.WithFields(log.Fields{
+		"services": len(snapshot.Services),
+		"failed":   len(snapshot.Services) - countSucceeded(results),
+	}).Info("Imported snapshot")
+	return results, nil
+}
+
+func countSucceeded(results []*ServiceResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Success {
+			n++
+		}
+	}
+	return n
+}
+
+// encodeSnapshot encodes a snapshot as "json" or "yaml"
+func encodeSnapshot(snapshot Snapshot, format string) ([]byte, error) {
+	switch format {
+	case "", "json":
+		return json.MarshalIndent(snapshot, "", "  ")
+	case "yaml", "yml":
+		return yaml.Marshal(snapshot)
+	}
+	return nil, fmt.Errorf("unknown snapshot format %q, must be json or yaml", format)
+}
+
+// decodeSnapshot decodes a JSON or YAML snapshot, whichever it looks like
+func decodeSnapshot(b []byte) (Snapshot, error) {
+	snapshot := Snapshot{}
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "{") {
+		err = json.Unmarshal(b, &snapshot)
+	} else {
+		err = yaml.UnmarshalStrict(b, &snapshot)
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	if len(snapshot.Services) == 0 && snapshot.Version == 0 {
+		return snapshot, errors.New("empty snapshot")
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,76 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrSpawnRateLimited is returned when starting a service would spawn
+// processes faster than the spawn rate limit allows
+var ErrSpawnRateLimited = errors.New("services are being spawned too quickly")
+
+// spawnLimits caps how many services can be starting at once and how quickly
+// they can be spawned, so a runaway client can't fork-bomb the host through us
+type spawnLimits struct {
+	mux   sync.Mutex
+	slots chan struct{} // Nil when there's no limit
+	rate  *rateLimiter  // Nil when there's no limit
+}
+
+// SetSpawnLimits sets how many services can be starting at the same time, and
+// how many can be spawned per minute with bursts of up to burst. 0 disables
+// either limit. Starts over the concurrency limit wait for a slot, starts
+// over the rate limit fail with ErrSpawnRateLimited.
+func (gg *GladiusGuardian) SetSpawnLimits(maxStarting, perMinute, burst int) {
+	gg.spawns.mux.Lock()
+	defer gg.spawns.mux.Unlock()
+
+	gg.spawns.slots = nil
+	if maxStarting > 0 {
+		gg.spawns.slots = make(chan struct{}, maxStarting)
+	}
+	gg.spawns.rate = newRateLimiter(perMinute, burst)
+}
+
+// acquire waits for one of the starting slots and takes a spawn from the rate
+// limit, the returned function gives the slot back once the service started
+func (sl *spawnLimits) acquire(ctx context.Context, name string) (func(), error) {
+	sl.mux.Lock()
+	slots, rate := sl.slots, sl.rate
+	sl.mux.Unlock()
+
+	release := func() {}
+	if slots != nil {
+		select {
+		case slots <- struct{}{}:
+			release = func() { <-slots }
+		default:
+			log.WithFields(log.Fields{
+				"service_name": name,
+			}).Info("Too many services starting, waiting for one to finish")
+			select {
+			case slots <- struct{}{}:
+				release = func() { <-slots }
+			case <-ctx.Done():
+				return nil, fmt.Errorf("can't start %s: %s", name, ctx.Err())
+			}
+		}
+	}
+
+	if rate != nil {
+		if ok, wait := rate.allow("spawn"); !ok {
+			release()
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"retry_in":     wait,
+			}).Warn("Spawn rate limit hit, not starting service")
+			return nil, fmt.Errorf("can't start %s, try again in %.0fs: %w", name, math.Ceil(wait.Seconds()), ErrSpawnRateLimited)
+		}
+	}
+	return release, nil
+}
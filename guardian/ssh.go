@@ -0,0 +1,382 @@
+package guardian
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gladiusio/gladius-guardian/tracing"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshBackend starts services on remote hosts over SSH. The connection is kept
+// alive with keepalive requests, if too many go unanswered it's dropped and
+// the service is treated as exited, even though it may still be running on
+// a host that's only unreachable. Its output is streamed back into the log.
+type sshBackend struct{}
+
+func (sshBackend) validate(name, execLocation string, opts ServiceOptions) error {
+	if opts.SSHHost == "" {
+		return fmt.Errorf("service %s runs with the %s backend but has no SSHHost", name, BackendSSH)
+	}
+	if _, _, err := splitSSHHost(opts.SSHHost); err != nil {
+		return fmt.Errorf("service %s: %s", name, err)
+	}
+	if opts.Image != "" {
+		return fmt.Errorf("service %s has an image but runs with the %s backend", name, BackendSSH)
+	}
+	if execLocation == "" {
+		return fmt.Errorf("service %s has no executable to run on %s", name, opts.SSHHost)
+	}
+	return nil
+}
+
+func (sshBackend) spawn(ctx context.Context, gg *GladiusGuardian, name string, settings *serviceSettings, env []string, timeout *time.Duration) (instance, error) {
+	return gg.spawnRemote(ctx, name, settings.execName, settings.opts, env, timeout)
+}
+
+// splitSSHHost splits user@host[:port] into the user and the address to dial,
+// without a user the guardian's own is used
+func splitSSHHost(host string) (string, string, error) {
+	user, addr := "", host
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, addr = host[:i], host[i+1:]
+	}
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	if addr == "" {
+		return "", "", fmt.Errorf("invalid SSH host %q, it has to be [user@]host[:port]", host)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	return user, addr, nil
+}
+
+// sshClientConfig authenticates with the SSH agent if there's one running and
+// the key in SSHKeyFile, host keys are checked against SSHKnownHostsFile
+func sshClientConfig(user string) (*ssh.ClientConfig, error) {
+	home, _ := os.UserHomeDir()
+
+	signers := make([]ssh.Signer, 0)
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+	keyFile := viper.GetString("SSHKeyFile")
+	if keyFile == "" {
+		keyFile = filepath.Join(home, ".ssh", "id_rsa")
+	}
+	if key, err := ioutil.ReadFile(keyFile); err == nil {
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("can't use SSH key %s: %s", keyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no SSH keys, set SSHKeyFile or run an SSH agent")
+	}
+
+	knownHosts := viper.GetString("SSHKnownHostsFile")
+	if knownHosts == "" {
+		knownHosts = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("can't read known hosts: %s", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeys,
+		Timeout:         viper.GetDuration("SSHConnectTimeout"),
+	}, nil
+}
+
+// remoteCommand is the shell command that reports its PID on the first line
+// of output then runs the service in its place
+func remoteCommand(location string, opts ServiceOptions, env []string) string {
+	var b strings.Builder
+	b.WriteString("echo $$; ")
+	if opts.WorkingDir != "" {
+		b.WriteString("cd " + shellQuote(opts.WorkingDir) + " && ")
+	}
+	b.WriteString("exec env")
+	for _, e := range env {
+		b.WriteString(" " + shellQuote(e))
+	}
+	b.WriteString(" " + shellQuote(location))
+	for _, a := range opts.Args {
+		b.WriteString(" " + shellQuote(a))
+	}
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// remoteInstance is a service running on another host, started over SSH
+type remoteInstance struct {
+	client    *ssh.Client
+	session   *ssh.Session
+	host      string
+	execPath  string
+	envVars   []string
+	remotePID int
+
+	stderrTail *lineTail
+
+	mux  sync.Mutex
+	lost error // Why the connection was dropped, if it was
+}
+
+// There's no local process, the PID on the remote host is in the location
+func (ri *remoteInstance) pid() int      { return 0 }
+func (ri *remoteInstance) env() []string { return ri.envVars }
+
+func (ri *remoteInstance) location() string {
+	return fmt.Sprintf("ssh://%s%s (pid %d)", ri.host, ri.execPath, ri.remotePID)
+}
+
+func (ri *remoteInstance) kill() error {
+	return ri.signal(syscall.SIGKILL)
+}
+
+// signal runs kill on the remote host, most SSH servers ignore the signals
+// sent through a session
+func (ri *remoteInstance) signal(sig os.Signal) error {
+	arg := ""
+	if s, ok := sig.(syscall.Signal); ok {
+		arg = "-" + strconv.Itoa(int(s))
+		for name, known := range signalsByName {
+			if known == s {
+				arg = "-" + name
+			}
+		}
+		if s == syscall.SIGKILL {
+			arg = "-KILL"
+		}
+	}
+	if arg == "" {
+		return fmt.Errorf("can't send %s to a remote service", sig)
+	}
+
+	session, err := ri.client.NewSession()
+	if err != nil {
+		return fmt.Errorf("can't reach %s: %s", ri.host, err)
+	}
+	defer session.Close()
+	if out, err := session.CombinedOutput("kill " + arg + " " + strconv.Itoa(ri.remotePID)); err != nil {
+		return fmt.Errorf("kill on %s failed: %s %s", ri.host, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// keepAlive drops the connection once max keepalives in a row go unanswered,
+// which ends the session as if the service exited
+func (ri *remoteInstance) keepAlive(interval time.Duration, max int, done <-chan struct{}) {
+	if interval <= 0 || max <= 0 {
+		return
+	}
+	missed := 0
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := ri.client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+		select {
+		case err := <-reply:
+			if err == nil {
+				missed = 0
+				continue
+			}
+		case <-time.After(interval):
+		}
+
+		missed++
+		if missed >= max {
+			ri.mux.Lock()
+			ri.lost = fmt.Errorf("lost connection to %s, %d keepalives went unanswered", ri.host, missed)
+			ri.mux.Unlock()
+			ri.client.Close()
+			return
+		}
+	}
+}
+
+// wait blocks until the remote service exits or the connection is lost
+func (ri *remoteInstance) wait() error {
+	err := ri.session.Wait()
+	ri.client.Close()
+
+	ri.mux.Lock()
+	lost := ri.lost
+	ri.mux.Unlock()
+	if lost != nil {
+		return lost
+	}
+
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	switch {
+	case errors.As(err, &exitErr):
+		if sig := exitErr.Signal(); sig != "" {
+			s, ok := signalsByName[sig]
+			if sig == "KILL" {
+				s, ok = syscall.SIGKILL, true
+			}
+			if ok {
+				sig = s.String()
+			}
+			return &exitCodeError{code: -1, signal: sig}
+		}
+		return &exitCodeError{code: exitErr.ExitStatus()}
+	case errors.As(err, &missingErr), errors.Is(err, io.EOF):
+		return fmt.Errorf("lost connection to %s", ri.host)
+	}
+	return err
+}
+
+// spawnRemote connects to the service's host and runs it there, streaming its
+// output into the log and watching the connection for it to exit
+func (gg *GladiusGuardian) spawnRemote(ctx context.Context, name, location string, opts ServiceOptions, env []string, timeout *time.Duration) (_ instance, err error) {
+	ctx, span := tracing.Start(ctx, "guardian.spawnRemote")
+	span.SetAttribute("service.name", name)
+	span.SetAttribute("ssh.host", opts.SSHHost)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	release, err := gg.spawns.acquire(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	user, addr, err := splitSSHHost(opts.SSHHost)
+	if err != nil {
+		return nil, err
+	}
+	config, err := sshClientConfig(user)
+	if err != nil {
+		return nil, err
+	}
+	outSink, errSink, err := openOutput(name, opts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		outSink.close()
+		errSink.close()
+		return nil, fmt.Errorf("Error connecting to %s: %s", opts.SSHHost, err)
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		outSink.close()
+		errSink.close()
+		return nil, fmt.Errorf("Error opening SSH session: %s", err)
+	}
+
+	if traceParent := tracing.TraceParent(ctx); traceParent != "" {
+		env = append(append([]string{}, env...), "TRACEPARENT="+traceParent)
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		client.Close()
+		outSink.close()
+		errSink.close()
+		return nil, fmt.Errorf("Error opening SSH session: %s", err)
+	}
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		client.Close()
+		outSink.close()
+		errSink.close()
+		return nil, fmt.Errorf("Error opening SSH session: %s", err)
+	}
+
+	ri := &remoteInstance{client: client, session: session, host: opts.SSHHost, execPath: location, envVars: env, stderrTail: newLineTail()}
+	go gg.readLog(name, ioutil.NopCloser(stderr), errSink, ri.stderrTail)
+	return gg.runRemote(name, ri, bufio.NewReader(stdout), outSink, remoteCommand(location, opts, env), timeout)
+}
+
+// runRemote starts the command in the instance's session and waits for the
+// service to come up, its stdout going to outSink
+func (gg *GladiusGuardian) runRemote(name string, ri *remoteInstance, stdout *bufio.Reader, outSink *outputSink, command string, timeout *time.Duration) (instance, error) {
+	if err := ri.session.Start(command); err != nil {
+		ri.client.Close()
+		outSink.close()
+		log.WithFields(log.Fields{
+			"ssh_host":      ri.host,
+			"exec_location": ri.execPath,
+			"err":           err,
+		}).Warn("Couldn't start remote service")
+		return nil, fmt.Errorf("Error starting remote service: %s", err)
+	}
+
+	// The shell reports its PID before it's replaced by the service
+	line, err := stdout.ReadString('\n')
+	if err == nil {
+		ri.remotePID, err = strconv.Atoi(strings.TrimSpace(line))
+	}
+	if err != nil {
+		ri.client.Close()
+		outSink.close()
+		return nil, fmt.Errorf("Error starting remote service, it didn't report its PID: %s", err)
+	}
+	go gg.readLog(name, ioutil.NopCloser(stdout), outSink, nil)
+
+	done := make(chan struct{})
+	go ri.keepAlive(viper.GetDuration("SSHKeepAliveInterval"), viper.GetInt("SSHKeepAliveMax"), done)
+
+	exited := make(chan struct{})
+	var waitErr error
+	go gg.watchExit(name, ri, func() error {
+		defer close(exited)
+		defer close(done)
+		waitErr = ri.wait()
+		return waitErr
+	})
+
+	select {
+	case <-time.After(*timeout):
+		return ri, nil
+	case <-exited:
+		return nil, newStartupError(name, waitErr, ri.stderrTail)
+	}
+}
@@ -0,0 +1,86 @@
+package guardian
+
+import (
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Log lines matching this count towards a service's log error rate
+var errorLinePattern = regexp.MustCompile(`(?i)\b(error|panic|fatal)\b`)
+
+// serviceStats are counters kept for each service over the guardian's life
+type serviceStats struct {
+	Starts    int64      `json:"starts"`
+	Restarts  int64      `json:"restarts"` // Starts after the first one
+	LogErrors int64      `json:"log_errors"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+}
+
+type statsStore struct {
+	mux   sync.Mutex
+	stats map[string]*serviceStats
+}
+
+func newStatsStore() *statsStore {
+	return &statsStore{stats: make(map[string]*serviceStats)}
+}
+
+func (ss *statsStore) get(name string) *serviceStats {
+	s, ok := ss.stats[name]
+	if !ok {
+		s = &serviceStats{}
+		ss.stats[name] = s
+	}
+	return s
+}
+
+func (ss *statsStore) started(name string) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	s := ss.get(name)
+	if s.Starts > 0 {
+		s.Restarts++
+	}
+	s.Starts++
+	now := time.Now()
+	s.StartedAt = &now
+}
+
+func (ss *statsStore) stopped(name string) {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	ss.get(name).StartedAt = nil
+}
+
+func (ss *statsStore) logLine(name, line string) {
+	if !errorLinePattern.MatchString(line) {
+		return
+	}
+
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+	ss.get(name).LogErrors++
+}
+
+// snapshot returns a copy of every service's stats
+func (ss *statsStore) snapshot() map[string]serviceStats {
+	ss.mux.Lock()
+	defer ss.mux.Unlock()
+
+	snapshot := make(map[string]serviceStats, len(ss.stats))
+	for name, s := range ss.stats {
+		snapshot[name] = *s
+	}
+	return snapshot
+}
+
+// Uptime returns how long the service has been running, or 0 if it isn't
+func (s serviceStats) Uptime() time.Duration {
+	if s.StartedAt == nil {
+		return 0
+	}
+	return time.Since(*s.StartedAt)
+}
@@ -0,0 +1,107 @@
+package guardian
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Max size of a single StatsD packet, small enough to not be fragmented
+const maxStatsDPacket = 1400
+
+// StartStatsD pushes per-service metrics to the StatsD server at address every
+// interval: restart and log error counts since the last push, uptime, the
+// size of the data directory and how its log is sent to websocket clients. With labelTags the labels of each service are
+// added to its metrics as DogStatsD style tags.
+func (gg *GladiusGuardian) StartStatsD(address, prefix string, interval time.Duration, labelTags bool) error {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return fmt.Errorf("error connecting to StatsD: %s", err)
+	}
+
+	prefix = strings.TrimSuffix(prefix, ".")
+	go func() {
+		last := make(map[string]serviceStats)
+		lastWS := make(map[string]websocketMetrics)
+		for range time.Tick(interval) {
+			current := gg.stats.snapshot()
+			tags := make(map[string]string)
+			if labelTags {
+				for name, labels := range gg.labelsOf() {
+					tags[name] = statsDTags(labels)
+				}
+			}
+			metrics := make([]string, 0)
+			for name, s := range current {
+				p := prefix + "." + name
+				prev := last[name]
+				metrics = append(metrics,
+					fmt.Sprintf("%s.restarts:%d|c%s", p, s.Restarts-prev.Restarts, tags[name]),
+					fmt.Sprintf("%s.log_errors:%d|c%s", p, s.LogErrors-prev.LogErrors, tags[name]),
+					fmt.Sprintf("%s.uptime_seconds:%d|g%s", p, int64(s.Uptime().Seconds()), tags[name]),
+				)
+
+				ws := gg.logClients.metrics(name)
+				metrics = append(metrics,
+					fmt.Sprintf("%s.websocket_clients:%d|g%s", p, ws.Clients, tags[name]),
+					fmt.Sprintf("%s.websocket_dropped_lines:%d|c%s", p, ws.DroppedLines-lastWS[name].DroppedLines, tags[name]),
+					fmt.Sprintf("%s.websocket_avg_broadcast_ms:%g|g%s", p, ws.AvgBroadcastTime, tags[name]),
+				)
+				lastWS[name] = ws
+			}
+			last = current
+			for name, u := range gg.diskUsage.snapshot() {
+				metrics = append(metrics, fmt.Sprintf("%s.%s.data_dir_bytes:%d|g%s", prefix, name, u.Bytes, tags[name]))
+			}
+
+			if err := sendStatsD(conn, metrics); err != nil {
+				log.WithFields(log.Fields{
+					"address": address,
+					"err":     err,
+				}).Debug("Couldn't send StatsD metrics")
+			}
+		}
+	}()
+	return nil
+}
+
+// statsDTags returns the labels as the tag suffix of a metric, sorted so the
+// same labels always give the same tags
+func statsDTags(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	tags := make([]string, 0, len(labels))
+	for k, v := range labels {
+		tags = append(tags, k+":"+v)
+	}
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
+
+// sendStatsD writes the metrics packing as many into each packet as fit
+func sendStatsD(conn net.Conn, metrics []string) error {
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		if buf.Len() > 0 && buf.Len()+len(m)+1 > maxStatsDPacket {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(m)
+	}
+	if buf.Len() > 0 {
+		_, err := conn.Write(buf.Bytes())
+		return err
+	}
+	return nil
+}
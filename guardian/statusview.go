@@ -0,0 +1,153 @@
+package guardian
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States a service can be in, see serviceStatus
+const (
+	StateStopped  = "stopped"
+	StateStarting = "starting" // Being spawned, until its spawn timeout passes
+	StateRunning  = "running"
+)
+
+// serviceView is what status needs to know about a service
+type serviceView struct {
+	inst      instance
+	starting  bool
+	disabled  bool
+	labels    map[string]string
+	overrides []string
+}
+
+// statusViews is a snapshot of every service's view, swapped for a new one
+// whenever one changes so status can be read without the guardian's lock and
+// isn't held up by whatever holds it
+type statusViews struct {
+	current  atomic.Value    // map[string]serviceView, never changed once stored
+	starting map[string]bool // Services being started, guarded by the guardian's lock
+
+	// Redacted variables the running instances were started with on top of
+	// their service's environment, guarded by the guardian's lock
+	overrides map[string][]string
+}
+
+// publishViewsLocked swaps in a new snapshot built from the registered
+// services, the guardian's lock has to be held
+func (gg *GladiusGuardian) publishViewsLocked() {
+	views := make(map[string]serviceView, len(gg.services))
+	for name, inst := range gg.services {
+		view := serviceView{inst: inst, starting: gg.views.starting[name], overrides: gg.views.overrides[name]}
+		if settings, ok := gg.registeredServices[name]; ok {
+			view.disabled = settings.disabled
+			view.labels = settings.opts.Labels
+		}
+		views[name] = view
+	}
+	gg.views.current.Store(views)
+}
+
+// serviceViews returns the latest snapshot, it mustn't be changed
+func (gg *GladiusGuardian) serviceViews() map[string]serviceView {
+	views, _ := gg.views.current.Load().(map[string]serviceView)
+	return views
+}
+
+// setStarting marks the service as being started, or not anymore
+func (sv *supervisor) setStarting(starting bool) {
+	sv.gg.mux.Lock()
+	if starting {
+		sv.gg.views.starting[sv.name] = true
+	} else {
+		delete(sv.gg.views.starting, sv.name)
+	}
+	sv.gg.publishViewsLocked()
+	sv.gg.mux.Unlock()
+	sv.gg.revision.bump()
+}
+
+// How long a status snapshot is used for while the status revision stays the
+// same, which is how stale what the revision doesn't track can get, like the
+// ports a service listens on
+const statusSnapshotMaxAge = time.Second
+
+type statusSnapshot struct {
+	revision    uint64
+	invalidated uint64 // statusCache.invalidated when it was built
+	built       time.Time
+	statuses    map[string]*serviceStatus
+}
+
+// statusCache keeps the status of every service so the UI polling it doesn't
+// rebuild it each time. Snapshots are never changed once they're stored, a
+// new one replaces them after a change.
+type statusCache struct {
+	invalidated uint64       // Bumped by invalidateStatus, accessed atomically
+	current     atomic.Value // *statusSnapshot
+	building    sync.Mutex   // So polls that find it stale build it only once
+}
+
+// statusSnapshot returns the status of every service, building a new
+// snapshot if the current one is out of date
+func (gg *GladiusGuardian) statusSnapshot() map[string]*serviceStatus {
+	if s := gg.freshStatusSnapshot(); s != nil {
+		return s.statuses
+	}
+
+	gg.statusCache.building.Lock()
+	defer gg.statusCache.building.Unlock()
+	if s := gg.freshStatusSnapshot(); s != nil {
+		return s.statuses
+	}
+
+	s := &statusSnapshot{
+		revision:    gg.revision.current(),
+		invalidated: atomic.LoadUint64(&gg.statusCache.invalidated),
+		built:       time.Now(),
+	}
+	s.statuses = gg.buildStatuses()
+	gg.statusCache.current.Store(s)
+	return s.statuses
+}
+
+func (gg *GladiusGuardian) freshStatusSnapshot() *statusSnapshot {
+	s, _ := gg.statusCache.current.Load().(*statusSnapshot)
+	if s == nil || s.revision != gg.revision.current() || s.invalidated != atomic.LoadUint64(&gg.statusCache.invalidated) || time.Since(s.built) > statusSnapshotMaxAge {
+		return nil
+	}
+	return s
+}
+
+// invalidateStatus has the next status read build a new snapshot, for changes
+// the status revision doesn't cover
+func (gg *GladiusGuardian) invalidateStatus() {
+	atomic.AddUint64(&gg.statusCache.invalidated, 1)
+}
+
+// buildStatuses returns the status of every service from the latest views
+func (gg *GladiusGuardian) buildStatuses() map[string]*serviceStatus {
+	views := gg.serviceViews()
+	statuses := make(map[string]*serviceStatus, len(views))
+	for name, view := range views {
+		status := newServiceStatus(view.inst)
+		if view.inst == nil && view.starting {
+			status.State = StateStarting
+		}
+		if ports := gg.AllocatedPorts(name); len(ports) > 0 {
+			status.AllocatedPorts = ports
+		}
+		status.Orphans, status.Zombies = gg.strays.get(name)
+		status.DataDir = gg.diskUsage.get(name)
+		status.Maintenance = gg.InMaintenance(name)
+		status.Disabled = view.disabled
+		status.Labels = copyLabels(view.labels)
+		status.Template = gg.templateOf(name)
+		status.LastExit = gg.exits.last(name)
+		status.Restart = gg.restartStatus(name)
+		status.Overrides = view.overrides
+		statuses[name] = status
+	}
+	return statuses
+}
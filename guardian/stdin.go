@@ -0,0 +1,43 @@
+package guardian
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// inputInstance is an instance whose standard input can be written to
+type inputInstance interface {
+	input() *os.File
+}
+
+// How long writing to a service's input can block, like when it isn't reading
+const stdinWriteTimeout = 5 * time.Second
+
+// WriteStdin writes to the standard input of the running service, a newline
+// is added if the line doesn't end with one
+func (gg *GladiusGuardian) WriteStdin(name, line string) error {
+	gg.mux.Lock()
+	_, registered := gg.registeredServices[name]
+	inst := gg.services[name]
+	gg.mux.Unlock()
+	if !registered {
+		return ErrNotRegistered
+	}
+	if inst == nil {
+		return fmt.Errorf("can't write to %s: %w", name, ErrNotRunning)
+	}
+	ii, ok := inst.(inputInstance)
+	if !ok || ii.input() == nil {
+		return fmt.Errorf("%s doesn't accept input", name)
+	}
+
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	f := ii.input()
+	f.SetWriteDeadline(time.Now().Add(stdinWriteTimeout))
+	_, err := f.Write([]byte(line))
+	return err
+}
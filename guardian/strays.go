@@ -0,0 +1,189 @@
+package guardian
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// StrayOptions controls what is done about stray processes when they're found
+type StrayOptions struct {
+	ReapZombies bool // Reap zombies adopted by the guardian that nothing waits on
+	KillOrphans bool // Send SIGTERM to untracked processes of a registered service
+}
+
+// strayProcesses holds what the last scan found for each service
+type strayProcesses struct {
+	mux     sync.Mutex
+	orphans map[string][]*ProcessInfo
+	zombies map[string][]*ProcessInfo
+}
+
+func (sp *strayProcesses) get(service string) ([]*ProcessInfo, []*ProcessInfo) {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	return sp.orphans[service], sp.zombies[service]
+}
+
+func (sp *strayProcesses) set(orphans, zombies map[string][]*ProcessInfo) {
+	sp.mux.Lock()
+	defer sp.mux.Unlock()
+	sp.orphans = orphans
+	sp.zombies = zombies
+}
+
+// StartStrayScan looks for stray processes every interval and reports them in
+// the status of the service they belong to. Orphans are processes running a
+// registered service's executable that the guardian isn't tracking, like ones
+// left over from an unclean shutdown. Zombies are exited processes in a
+// service's process tree that haven't been waited on.
+func (gg *GladiusGuardian) StartStrayScan(interval time.Duration, opts StrayOptions) error {
+	if _, err := listProcesses(); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			gg.scanStrays(opts)
+		}
+	}()
+	return nil
+}
+
+func (gg *GladiusGuardian) scanStrays(opts StrayOptions) {
+	procs, err := listProcesses()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't list processes")
+		return
+	}
+	byPID, children := indexProcesses(procs)
+
+	// Every process under a tracked service belongs to it
+	owner := make(map[int]string)
+	pids := gg.runningPIDs("all")
+	for name, pid := range pids {
+		if root, ok := byPID[pid]; ok {
+			walkTree(buildTree(root, children, make(map[int]bool)), func(p *ProcessInfo) {
+				owner[p.PID] = name
+			})
+		}
+	}
+
+	for name, followed := range gg.followedPIDs() {
+		for _, pid := range followed {
+			if root, ok := byPID[pid]; ok {
+				walkTree(buildTree(root, children, make(map[int]bool)), func(p *ProcessInfo) {
+					owner[p.PID] = name
+				})
+			}
+		}
+	}
+
+	self := os.Getpid()
+	paths := gg.execPaths()
+	orphans := make(map[string][]*ProcessInfo)
+	zombies := make(map[string][]*ProcessInfo)
+	for _, p := range procs {
+		if p.State == "Z" {
+			if name, ok := owner[p.PPID]; ok {
+				zombies[name] = append(zombies[name], p)
+			} else if p.PPID == self && opts.ReapZombies {
+				gg.reapStray(p)
+			}
+			continue
+		}
+
+		if _, tracked := owner[p.PID]; tracked || p.PID == self {
+			continue
+		}
+		// Only report the top of an orphaned tree, its children go with it
+		if _, ok := byPID[p.PPID]; ok && matchesExec(byPID[p.PPID], paths) != "" {
+			continue
+		}
+		if name := matchesExec(p, paths); name != "" {
+			orphans[name] = append(orphans[name], p)
+			if opts.KillOrphans {
+				gg.killStray(name, p)
+			}
+		}
+	}
+
+	gg.strays.set(orphans, zombies)
+}
+
+// reapStray reaps a zombie child of the guardian, unless it's one of the
+// processes the guardian started or follows and waits on itself
+func (gg *GladiusGuardian) reapStray(p *ProcessInfo) {
+	reaped, err := waited.reap(p.PID)
+	if !reaped {
+		return
+	}
+	log.WithFields(log.Fields{
+		"pid": p.PID,
+		"err": err,
+	}).Info("Reaped zombie process")
+}
+
+func (gg *GladiusGuardian) killStray(name string, p *ProcessInfo) {
+	err := terminateProcess(p.PID)
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"pid":          p.PID,
+		"command":      p.Command,
+		"err":          err,
+	}).Warn("Killed orphaned service process")
+}
+
+// execPaths returns the resolved executable of each registered service
+func (gg *GladiusGuardian) execPaths() map[string]string {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	paths := make(map[string]string)
+	for name, settings := range gg.registeredServices {
+		if path, err := exec.LookPath(settings.execName); err == nil {
+			if abs, err := filepath.Abs(path); err == nil {
+				paths[abs] = name
+			}
+			// /proc reports the target of symlinks
+			if resolved, err := filepath.EvalSymlinks(path); err == nil {
+				paths[resolved] = name
+			}
+		}
+	}
+	return paths
+}
+
+// matchesExec returns the service whose executable the process is running, a
+// script shows up as its interpreter so the first argument is checked too
+func matchesExec(p *ProcessInfo, paths map[string]string) string {
+	candidates := []string{p.exe}
+	if len(p.args) > 0 {
+		candidates = append(candidates, p.args[0])
+	}
+	if len(p.args) > 1 {
+		candidates = append(candidates, p.args[1])
+	}
+	for _, c := range candidates {
+		if c == "" {
+			continue
+		}
+		if name, ok := paths[c]; ok {
+			return name
+		}
+	}
+	return ""
+}
+
+func walkTree(p *ProcessInfo, fn func(p *ProcessInfo)) {
+	fn(p)
+	for _, c := range p.Children {
+		walkTree(c, fn)
+	}
+}
@@ -0,0 +1,111 @@
+package guardian
+
+import (
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variable set on services started while the guardian is a
+// subreaper, so processes re-parented to us can be traced back to the service
+// they came from
+const serviceMarkerEnv = "GLADIUS_GUARDIAN_SERVICE"
+
+// EnableSubreaper makes the guardian adopt the orphaned descendants of its
+// services instead of init. A service whose main process forks a daemon and
+// exits keeps running for as long as the daemon does, and stopping the service
+// kills the daemon. Only services started afterwards are followed this way.
+func (gg *GladiusGuardian) EnableSubreaper() error {
+	if err := setSubreaper(); err != nil {
+		return err
+	}
+	gg.mux.Lock()
+	gg.subreaper = true
+	gg.mux.Unlock()
+	return nil
+}
+
+// reparented returns the processes of a service that were re-parented to the
+// guardian, leaving out its main process. Each one has to be waited on with
+// waited.wait.
+func reparented(service string, mainPID int) []*os.Process {
+	found := make([]*os.Process, 0)
+	waited.add(func() ([]int, error) {
+		procs, err := listProcesses()
+		if err != nil {
+			return nil, err
+		}
+
+		self := os.Getpid()
+		var pids []int
+		for _, p := range procs {
+			if p.PPID != self || p.PID == mainPID || p.State == "Z" {
+				continue
+			}
+			if serviceMarker(p.PID) != service {
+				continue
+			}
+			if proc, err := os.FindProcess(p.PID); err == nil {
+				found = append(found, proc)
+				pids = append(pids, p.PID)
+			}
+		}
+		return pids, nil
+	})
+	return found
+}
+
+// follow waits for the daemons left behind by the main process, and for any
+// they leave behind in turn. The service is stopped once they're all gone.
+func (pi *processInstance) follow(daemons []*os.Process) (err error) {
+	for len(daemons) > 0 {
+		pi.mux.Lock()
+		pi.daemons = daemons
+		pi.mux.Unlock()
+		log.WithFields(log.Fields{
+			"service_name": pi.service,
+			"pid":          daemons[0].Pid,
+			"daemons":      len(daemons),
+		}).Info("Service daemonized, following its daemons")
+
+		for _, d := range daemons {
+			state, waitErr := waited.wait(d)
+			switch {
+			case waitErr != nil:
+				err = waitErr
+			case !state.Success():
+				err = &exec.ExitError{ProcessState: state}
+			}
+		}
+
+		pi.mux.Lock()
+		stopping := pi.stopping
+		pi.mux.Unlock()
+		if stopping {
+			return err
+		}
+		daemons = reparented(pi.service, 0)
+	}
+	return err
+}
+
+// followedPIDs returns the daemons followed for each service
+func (gg *GladiusGuardian) followedPIDs() map[string][]int {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+
+	pids := make(map[string][]int)
+	for name, inst := range gg.services {
+		pi, ok := inst.(*processInstance)
+		if !ok || pi == nil {
+			continue
+		}
+		pi.mux.Lock()
+		for _, d := range pi.daemons {
+			pids[name] = append(pids[name], d.Pid)
+		}
+		pi.mux.Unlock()
+	}
+	return pids
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package guardian
+
+func setSubreaper() error {
+	return ErrUnsupportedPlatform
+}
+
+func serviceMarker(pid int) string {
+	return ""
+}
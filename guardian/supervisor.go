@@ -0,0 +1,294 @@
+package guardian
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Commands a supervisor takes
+const (
+	commandStart = iota
+	commandStop
+	commandSignal
+	commandExited
+	commandReplace
+	commandAdopt
+	commandHandle
+)
+
+type supervisorCommand struct {
+	kind int
+	ctx  context.Context
+	env  []string
+	sig  os.Signal
+	inst instance // The exited, adopted or new instance
+	old  instance // The instance being replaced
+	err  error    // How the exited instance ended
+
+	reply chan commandResult // Nil for commands nobody waits on
+}
+
+type commandResult struct {
+	err    error
+	handle *ServiceHandle // Run of the started service
+}
+
+// supervisor owns the running instance of a service. Starting, stopping,
+// signalling and exits are handled by its goroutine one at a time, so the
+// service's state only changes there, and a start waits out the spawn timeout
+// without holding up any other service. The instance is published to the
+// guardian's services map for everything that only reads it, like status.
+type supervisor struct {
+	gg       *GladiusGuardian
+	name     string
+	commands chan supervisorCommand
+
+	// Only used by the supervisor's goroutine
+	inst     instance
+	stopping instance // Being stopped by the guardian
+	handles  map[instance]*ServiceHandle
+}
+
+func newSupervisor(gg *GladiusGuardian, name string) *supervisor {
+	sv := &supervisor{gg: gg, name: name, commands: make(chan supervisorCommand), handles: make(map[instance]*ServiceHandle)}
+	go sv.run()
+	return sv
+}
+
+// supervisor returns the supervisor of a registered service, nil if it isn't
+func (gg *GladiusGuardian) supervisor(name string) *supervisor {
+	gg.mux.Lock()
+	defer gg.mux.Unlock()
+	return gg.supervisors[name]
+}
+
+func (sv *supervisor) run() {
+	for cmd := range sv.commands {
+		var err error
+		switch cmd.kind {
+		case commandStart:
+			err = sv.start(cmd.ctx, cmd.env)
+		case commandStop:
+			err = sv.stop()
+		case commandSignal:
+			err = sv.signal(cmd.sig)
+		case commandHandle:
+			// Only wants the handle of the running instance
+		case commandExited:
+			sv.exited(cmd.inst, cmd.err)
+		case commandReplace:
+			err = sv.replace(cmd.old, cmd.inst)
+		case commandAdopt:
+			sv.setInstance(cmd.inst, nil)
+		}
+		if cmd.reply != nil {
+			cmd.reply <- commandResult{err: err, handle: sv.handles[sv.inst]}
+		}
+	}
+}
+
+// do has the supervisor run a command and waits for it to be done. The
+// guardian's lock can't be held, the supervisor takes it to publish changes.
+func (sv *supervisor) do(cmd supervisorCommand) error {
+	return sv.call(cmd).err
+}
+
+// call is do, also returning the handle of the running instance
+func (sv *supervisor) call(cmd supervisorCommand) commandResult {
+	cmd.reply = make(chan commandResult, 1)
+	sv.commands <- cmd
+	return <-cmd.reply
+}
+
+// setInstance makes inst the running instance, overrides are the variables
+// its start was given on top of the service's environment
+func (sv *supervisor) setInstance(inst instance, overrides []string) {
+	sv.inst = inst
+	if inst != nil && sv.handles[inst] == nil {
+		sv.handles[inst] = newServiceHandle(sv.name, inst)
+		sv.handles[inst].overrides = overrides
+	}
+	sv.gg.mux.Lock()
+	sv.gg.services[sv.name] = inst
+	if inst != nil && len(overrides) > 0 {
+		sv.gg.views.overrides[sv.name] = overrides
+	} else {
+		delete(sv.gg.views.overrides, sv.name)
+	}
+	sv.gg.publishViewsLocked()
+	sv.gg.mux.Unlock()
+	sv.gg.revision.bump()
+}
+
+func (sv *supervisor) start(ctx context.Context, env []string) error {
+	gg, name := sv.gg, sv.name
+	if sv.inst != nil {
+		return fmt.Errorf("can't start %s: %w", name, ErrAlreadyRunning)
+	}
+	if err := gg.checkLeader(); err != nil {
+		return fmt.Errorf("can't start %s: %w", name, err)
+	}
+	if err := gg.allowed(PluginRequest{Hook: HookAllowStart, Service: name}); err != nil {
+		return fmt.Errorf("can't start %s: %w", name, err)
+	}
+
+	gg.mux.Lock()
+	serviceSettings := gg.registeredServices[name]
+	timeout := gg.startTimeout()
+	gg.mux.Unlock()
+
+	// Fill in allocated ports and make sure none of the ports are taken
+	spawnEnv, err := gg.ports.expandEnv(name, gg.startEnv(serviceSettings, env))
+	if err != nil {
+		return err
+	}
+	if err := checkPorts(serviceSettings.opts.Ports); err != nil {
+		return fmt.Errorf("can't start %s: %w", name, err)
+	}
+	if err := checkScheduling(serviceSettings.opts); err != nil {
+		return fmt.Errorf("can't start %s: %s", name, err)
+	}
+	if err := checkSandbox(serviceSettings.opts); err != nil {
+		return fmt.Errorf("can't start %s: %s", name, err)
+	}
+	if missing := missingEnv(spawnEnv, serviceSettings.opts.RequiredEnv); len(missing) > 0 {
+		return fmt.Errorf("can't start %s, missing environment variables: %s", name, strings.Join(missing, ", "))
+	}
+
+	b, err := lookupBackend(serviceSettings.opts)
+	if err != nil {
+		return fmt.Errorf("can't start %s: %s", name, err)
+	}
+	sv.setStarting(true)
+	defer sv.setStarting(false)
+	gg.emit(Event{Type: EventStarting, Service: name})
+	p, err := b.spawn(ctx, gg, name, serviceSettings, spawnEnv, timeout)
+	if err != nil {
+		return err
+	}
+	if *timeout == 0 && hasReadinessProbe(gg, name, serviceSettings.opts) {
+		if err := gg.waitUntilReady(name, serviceSettings.opts, readyTimeout(serviceSettings.opts)); err != nil {
+			sv.stopping = p
+			p.kill()
+			return fmt.Errorf("can't start %s: %s", name, err)
+		}
+	}
+	sv.setInstance(p, redactEnv(env))
+	gg.stats.started(name)
+	gg.emit(Event{Type: EventStarted, Service: name, PID: p.pid()})
+	log.WithFields(log.Fields{
+		"service_name":     name,
+		"exec_location":    p.location(),
+		"environment_vars": strings.Join(env, ", "),
+	}).Debug("Started service")
+	return nil
+}
+
+func (sv *supervisor) stop() error {
+	if sv.inst == nil {
+		return fmt.Errorf("can't stop %s: %w", sv.name, ErrNotRunning)
+	}
+
+	sv.stopping = sv.inst
+	if err := sv.inst.kill(); err != nil {
+		sv.stopping = nil
+		log.WithFields(log.Fields{
+			"service_name":     sv.name,
+			"exec_location":    sv.inst.location(),
+			"environment_vars": strings.Join(sv.inst.env(), ", "),
+			"err":              err,
+		}).Warn("Couldn't kill service")
+		return errors.New("couldn't kill service, error was: " + err.Error())
+	}
+	return nil
+}
+
+func (sv *supervisor) signal(sig os.Signal) error {
+	if sv.inst == nil {
+		return fmt.Errorf("can't signal %s: %w", sv.name, ErrNotRunning)
+	}
+	return sv.inst.signal(sig)
+}
+
+// exited marks the service as stopped and reports how it exited, unless
+// another instance took over in the meantime, like after a blue/green restart
+func (sv *supervisor) exited(inst instance, err error) {
+	gg, name := sv.gg, sv.name
+	replaced := sv.inst != nil && sv.inst != inst
+	if !replaced {
+		sv.setInstance(nil, nil)
+	}
+	stopRequested := sv.stopping == inst
+	if stopRequested {
+		sv.stopping = nil
+	}
+
+	status := classifyExit(err, stopRequested)
+	record := ExitRecord{ExitStatus: status, PID: inst.pid(), Time: time.Now(), Env: redactEnv(inst.env())}
+	if h := sv.handles[inst]; h != nil {
+		delete(sv.handles, inst)
+		record.RunID = h.RunID
+		record.Overrides = h.overrides
+		h.finish(record)
+	}
+	if !replaced {
+		gg.stats.stopped(name)
+		gg.exits.add(name, record)
+		gg.invalidateStatus() // It was snapshotted stopped before its exit was recorded
+
+		ev := Event{Type: EventExited, Service: name, PID: inst.pid(), Exit: &status}
+		switch status.Class {
+		case ExitStopped:
+			ev.Type = EventStopped
+		case ExitSignaled, ExitFailed:
+			ev.Type = EventCrashed
+			go gg.restartAfterCrash(name)
+		}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		gg.emit(ev)
+	}
+
+	// Only log errors if we didn't stop it
+	if err != nil && !stopRequested {
+		log.WithFields(log.Fields{
+			"exec_location":    inst.location(),
+			"environment_vars": strings.Join(inst.env(), ", "),
+			"err":              err,
+		}).Error("Service errored out")
+		gg.AppendToLog(name, "Exiting... "+err.Error())
+	}
+}
+
+// replace makes the new instance the service's running one, which
+// re-advertises it on its new ports, then stops the old one
+func (sv *supervisor) replace(old, inst instance) error {
+	if sv.inst != old {
+		inst.kill()
+		return errors.New("the old instance stopped in the meantime")
+	}
+	sv.setInstance(inst, nil)
+	sv.gg.stats.started(sv.name)
+	sv.gg.emit(Event{Type: EventStarted, Service: sv.name, PID: inst.pid()})
+
+	if err := old.kill(); err != nil {
+		log.WithFields(log.Fields{
+			"service_name": sv.name,
+			"pid":          old.pid(),
+			"err":          err,
+		}).Warn("Couldn't stop old instance after blue/green restart")
+	}
+	log.WithFields(log.Fields{
+		"service_name": sv.name,
+		"old_pid":      old.pid(),
+		"pid":          inst.pid(),
+	}).Info("Switched service over to its new instance")
+	return nil
+}
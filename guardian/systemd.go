@@ -0,0 +1,212 @@
+package guardian
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ExportSystemdUnits writes a gladius-<name>.service unit to dir for each
+// registered service, running it the same way the guardian would. Allocated
+// ports are filled in, so the units keep using the ports the guardian picked.
+func (gg *GladiusGuardian) ExportSystemdUnits(dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	written := make([]string, 0)
+	for _, name := range gg.serviceNames("all") {
+		gg.mux.Lock()
+		settings := gg.registeredServices[name]
+		gg.mux.Unlock()
+
+		unit, err := gg.systemdUnit(name, settings)
+		if err != nil {
+			return written, fmt.Errorf("error generating unit for %s: %s", name, err)
+		}
+		path := filepath.Join(dir, systemdUnitName(name))
+		if err := ioutil.WriteFile(path, unit, 0644); err != nil {
+			return written, err
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
+
+func systemdUnitName(service string) string {
+	return "gladius-" + service + ".service"
+}
+
+func (gg *GladiusGuardian) systemdUnit(name string, settings *serviceSettings) ([]byte, error) {
+	env, err := gg.ports.expandEnv(name, gg.configuredEnv(settings))
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# Generated by gladius-guardian")
+	fmt.Fprintln(&b, "[Unit]")
+	fmt.Fprintf(&b, "Description=Gladius %s\n", name)
+	if len(settings.opts.DependsOn) > 0 {
+		deps := make([]string, 0, len(settings.opts.DependsOn))
+		for _, dep := range settings.opts.DependsOn {
+			deps = append(deps, systemdUnitName(dep))
+		}
+		fmt.Fprintf(&b, "Requires=%s\n", strings.Join(deps, " "))
+		fmt.Fprintf(&b, "After=%s\n", strings.Join(deps, " "))
+	}
+
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Service]")
+	if backendName(settings.opts) == BackendDocker {
+		// Environment, ports and volumes are passed to docker directly
+		containerName := "gladius-" + name
+		command := []string{"/usr/bin/docker", "run", "--rm", "--name", containerName}
+		for _, e := range env {
+			command = append(command, "-e", e)
+		}
+		for _, v := range settings.opts.Volumes {
+			command = append(command, "-v", v)
+		}
+		for _, p := range settings.opts.PublishPorts {
+			command = append(command, "-p", p)
+		}
+		if settings.opts.WorkingDir != "" {
+			command = append(command, "-w", settings.opts.WorkingDir)
+		}
+		if settings.opts.OOMScoreAdjust != 0 {
+			command = append(command, "--oom-score-adj", strconv.Itoa(settings.opts.OOMScoreAdjust))
+		}
+		if settings.opts.CPUAffinity != "" {
+			command = append(command, "--cpuset-cpus", settings.opts.CPUAffinity)
+		}
+		if settings.opts.ReadOnlyRoot {
+			command = append(command, "--read-only")
+		}
+		if settings.opts.NoNewPrivileges {
+			command = append(command, "--security-opt", "no-new-privileges")
+		}
+		if settings.opts.SeccompProfile != "" {
+			command = append(command, "--security-opt", "seccomp="+settings.opts.SeccompProfile)
+		}
+		if settings.opts.AppArmorProfile != "" {
+			command = append(command, "--security-opt", "apparmor="+settings.opts.AppArmorProfile)
+		}
+		if len(settings.opts.Capabilities) > 0 {
+			command = append(command, "--cap-drop", "ALL")
+			for _, c := range settings.opts.Capabilities {
+				command = append(command, "--cap-add", canonicalCapability(c))
+			}
+		}
+		command = append(command, settings.opts.Image)
+		command = append(command, settings.opts.Args...)
+
+		fmt.Fprintf(&b, "ExecStartPre=-/usr/bin/docker rm -f %s\n", containerName)
+		fmt.Fprintf(&b, "ExecStart=%s\n", systemdCommand(command))
+		fmt.Fprintf(&b, "ExecStop=/usr/bin/docker stop %s\n", containerName)
+	} else {
+		for _, e := range env {
+			fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(e))
+		}
+		exec, err := filepath.Abs(settings.execName)
+		if err != nil {
+			return nil, err
+		}
+		if settings.opts.WorkingDir != "" {
+			fmt.Fprintf(&b, "WorkingDirectory=%s\n", strings.Replace(settings.opts.WorkingDir, "%", "%%", -1))
+		}
+		fmt.Fprintf(&b, "ExecStart=%s\n", systemdCommand(append([]string{exec}, settings.opts.Args...)))
+		if settings.opts.Nice != 0 {
+			fmt.Fprintf(&b, "Nice=%d\n", settings.opts.Nice)
+		}
+		if settings.opts.IOClass != "" {
+			fmt.Fprintf(&b, "IOSchedulingClass=%s\n", settings.opts.IOClass)
+			fmt.Fprintf(&b, "IOSchedulingPriority=%d\n", settings.opts.IOPriority)
+		}
+		if settings.opts.OOMScoreAdjust != 0 {
+			fmt.Fprintf(&b, "OOMScoreAdjust=%d\n", settings.opts.OOMScoreAdjust)
+		}
+		if settings.opts.CPUAffinity != "" {
+			fmt.Fprintf(&b, "CPUAffinity=%s\n", strings.Replace(settings.opts.CPUAffinity, ",", " ", -1))
+		}
+		writeSystemdSandbox(&b, settings.opts)
+	}
+	// The guardian kills services to stop them and doesn't restart them
+	fmt.Fprintln(&b, "KillSignal=SIGKILL")
+	fmt.Fprintln(&b, "Restart=no")
+
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Install]")
+	fmt.Fprintln(&b, "WantedBy=multi-user.target")
+	return b.Bytes(), nil
+}
+
+// writeSystemdSandbox adds the systemd equivalents of the sandbox options,
+// systemd sets up PID namespaces on its own terms so that one is left out.
+// Units can't load a compiled seccomp filter either, SystemCallFilter= takes
+// syscall names.
+func writeSystemdSandbox(b *bytes.Buffer, opts ServiceOptions) {
+	directives := map[string]string{
+		NamespaceMount:   "PrivateMounts=yes",
+		NamespaceNetwork: "PrivateNetwork=yes",
+		NamespaceIPC:     "PrivateIPC=yes",
+		NamespaceUTS:     "ProtectHostname=yes",
+	}
+	for _, ns := range opts.Namespaces {
+		if d, ok := directives[ns]; ok {
+			fmt.Fprintln(b, d)
+		}
+	}
+	if opts.NoNewPrivileges {
+		fmt.Fprintln(b, "NoNewPrivileges=yes")
+	}
+	if opts.AppArmorProfile != "" {
+		fmt.Fprintf(b, "AppArmorProfile=%s\n", opts.AppArmorProfile)
+	}
+	if len(opts.Capabilities) > 0 {
+		caps := make([]string, 0, len(opts.Capabilities))
+		for _, c := range opts.Capabilities {
+			caps = append(caps, canonicalCapability(c))
+		}
+		fmt.Fprintf(b, "CapabilityBoundingSet=%s\n", strings.Join(caps, " "))
+		fmt.Fprintf(b, "AmbientCapabilities=%s\n", strings.Join(caps, " "))
+	}
+	if opts.ReadOnlyRoot || opts.ConfineToDataDir {
+		fmt.Fprintln(b, "ProtectSystem=strict")
+		for _, path := range opts.WritablePaths {
+			fmt.Fprintf(b, "ReadWritePaths=%s\n", strings.Replace(path, "%", "%%", -1))
+		}
+		if opts.ConfineToDataDir {
+			fmt.Fprintf(b, "ReadWritePaths=%s\n", strings.Replace(opts.DataDir, "%", "%%", -1))
+		}
+	}
+	if opts.Chroot {
+		fmt.Fprintf(b, "RootDirectory=%s\n", strings.Replace(opts.DataDir, "%", "%%", -1))
+	}
+}
+
+// systemdCommand quotes a command line, systemd expands variables in them
+// so dollar signs are escaped too
+func systemdCommand(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, a := range args {
+		quoted = append(quoted, systemdQuote(strings.Replace(a, "$", "$$", -1)))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// systemdQuote quotes a word for a unit file if it needs it, and escapes
+// specifiers systemd would otherwise expand
+func systemdQuote(s string) string {
+	s = strings.Replace(s, "%", "%%", -1)
+	if s != "" && !strings.ContainsAny(s, " \t\"'\\;") {
+		return s
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
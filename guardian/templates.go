@@ -0,0 +1,207 @@
+package guardian
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoTemplate is returned for a service template that isn't registered
+var ErrNoTemplate = errors.New("no service template with that name")
+
+// ServiceTemplate describes services that only differ in a few parameters,
+// like edge workers each with their own directory. Text fields can use
+// {{.param}} for a parameter given when it's instantiated and {{.name}} for
+// the name of the new service, {{port "name"}} in the environment still
+// allocates a port for each instance. In the config file templates are
+// [Templates.<name>] tables.
+type ServiceTemplate struct {
+	Name        string `mapstructure:"-"`
+	Executable  string
+	Environment []string
+
+	// Parameters that have to be given, with an optional default after an
+	// "=", like "dir" or "loglevel=info"
+	Params []string
+
+	ServiceOptions `mapstructure:",squash"`
+}
+
+// templateInstance is a service registered from a template, kept so it can be
+// registered again after the guardian re-execs
+type templateInstance struct {
+	Template string            `json:"template"`
+	Name     string            `json:"name"`
+	Params   map[string]string `json:"params"`
+	Env      []string          `json:"default_env"`
+}
+
+type serviceTemplates struct {
+	mux       sync.Mutex
+	templates map[string]ServiceTemplate
+	instances map[string]templateInstance
+}
+
+// RegisterTemplate adds a template services can be instantiated from,
+// replacing one with the same name
+func (gg *GladiusGuardian) RegisterTemplate(t ServiceTemplate) {
+	gg.templates.mux.Lock()
+	defer gg.templates.mux.Unlock()
+	gg.templates.templates[t.Name] = t
+	log.WithFields(log.Fields{
+		"template": t.Name,
+	}).Debug("Registered service template")
+}
+
+// Templates returns the registered templates by name
+func (gg *GladiusGuardian) Templates() map[string]ServiceTemplate {
+	gg.templates.mux.Lock()
+	defer gg.templates.mux.Unlock()
+	templates := make(map[string]ServiceTemplate, len(gg.templates.templates))
+	for name, t := range gg.templates.templates {
+		templates[name] = t
+	}
+	return templates
+}
+
+// InstantiateTemplate registers a service named name from a template, with
+// its parameters filled in. The default environment is added in front of the
+// template's own like with RegisterDefinition.
+func (gg *GladiusGuardian) InstantiateTemplate(templateName, name string, params map[string]string, defaultEnv []string) error {
+	gg.templates.mux.Lock()
+	t, ok := gg.templates.templates[templateName]
+	gg.templates.mux.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoTemplate, templateName)
+	}
+	if name == "" || name == "all" {
+		return fmt.Errorf("can't name a service %q", name)
+	}
+	if gg.isRegistered(name) {
+		return fmt.Errorf("can't register %s: %w", name, ErrAlreadyRegistered)
+	}
+
+	def, err := t.instantiate(name, params)
+	if err != nil {
+		return fmt.Errorf("can't instantiate %s: %s", templateName, err)
+	}
+	if err := gg.RegisterDefinition(def, defaultEnv); err != nil {
+		return err
+	}
+
+	gg.templates.mux.Lock()
+	gg.templates.instances[name] = templateInstance{Template: templateName, Name: name, Params: params, Env: defaultEnv}
+	gg.templates.mux.Unlock()
+
+	log.WithFields(log.Fields{
+		"template":     templateName,
+		"service_name": name,
+	}).Info("Registered service from template")
+	return nil
+}
+
+// templateOf returns the template a service was instantiated from, if any
+func (gg *GladiusGuardian) templateOf(name string) string {
+	gg.templates.mux.Lock()
+	defer gg.templates.mux.Unlock()
+	return gg.templates.instances[name].Template
+}
+
+// templateInstances returns the services registered from templates, sorted by
+// name
+func (gg *GladiusGuardian) templateInstances() []templateInstance {
+	gg.templates.mux.Lock()
+	defer gg.templates.mux.Unlock()
+	instances := make([]templateInstance, 0, len(gg.templates.instances))
+	for _, inst := range gg.templates.instances {
+		instances = append(instances, inst)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances
+}
+
+// instantiate returns the definition of a service made from the template
+func (t ServiceTemplate) instantiate(name string, params map[string]string) (ServiceDefinition, error) {
+	data := map[string]string{}
+	for _, p := range t.Params {
+		key, value, hasDefault := strings.Cut(p, "=")
+		if v, ok := params[key]; ok {
+			value = v
+		} else if !hasDefault {
+			return ServiceDefinition{}, fmt.Errorf("missing parameter %s", key)
+		}
+		data[key] = value
+	}
+	for key := range params {
+		if _, ok := data[key]; !ok {
+			return ServiceDefinition{}, fmt.Errorf("unknown parameter %s", key)
+		}
+	}
+	data["name"] = name
+
+	var err error
+	fill := func(s string) string {
+		if err != nil {
+			return s
+		}
+		var filled string
+		filled, err = fillTemplate(s, data)
+		return filled
+	}
+	fillAll := func(ss []string) []string {
+		if ss == nil {
+			return nil
+		}
+		filled := make([]string, 0, len(ss))
+		for _, s := range ss {
+			filled = append(filled, fill(s))
+		}
+		return filled
+	}
+
+	def := ServiceDefinition{Name: name, ServiceOptions: t.ServiceOptions}
+	def.Executable = fill(t.Executable)
+	def.Environment = fillAll(t.Environment)
+	def.Args = fillAll(t.Args)
+	def.WorkingDir = fill(t.WorkingDir)
+	def.Image = fill(t.Image)
+	def.Volumes = fillAll(t.Volumes)
+	def.PublishPorts = fillAll(t.PublishPorts)
+	def.ConfigFiles = fillAll(t.ConfigFiles)
+	def.WaitForFiles = fillAll(t.WaitForFiles)
+	def.WaitForAddresses = fillAll(t.WaitForAddresses)
+	def.WritablePaths = fillAll(t.WritablePaths)
+	def.ProxyURL = fill(t.ProxyURL)
+	def.DependsOn = append([]string{}, t.DependsOn...)
+	if t.Labels != nil {
+		def.Labels = make(map[string]string, len(t.Labels))
+		for k, v := range t.Labels {
+			def.Labels[k] = fill(v)
+		}
+	}
+	return def, err
+}
+
+// fillTemplate fills in the parameters, port calls are left alone so they're
+// expanded when the service starts
+func fillTemplate(s string, data map[string]string) (string, error) {
+	funcs := template.FuncMap{
+		"port": func(name string) string { return "{{port " + strconv.Quote(name) + "}}" },
+	}
+	t, err := template.New("").Funcs(funcs).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("bad template %q: %s", s, err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error filling in %q: %s", s, err)
+	}
+	return buf.String(), nil
+}
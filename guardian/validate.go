@@ -0,0 +1,139 @@
+package guardian
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidateConfig checks every registered service without starting anything:
+// how each of them is set up, that what they depend on is registered and
+// doesn't depend on them in turn or come up in a later phase, and that no two
+// of them want the same fixed port. Unlike a dry run it doesn't matter what's
+// running. It returns every problem found by service name, empty if there are
+// none.
+func (gg *GladiusGuardian) ValidateConfig() map[string][]string {
+	gg.mux.Lock()
+	registered := make(map[string]*serviceSettings, len(gg.registeredServices))
+	for name, settings := range gg.registeredServices {
+		registered[name] = settings
+	}
+	gg.mux.Unlock()
+
+	problems := make(map[string][]string)
+	add := func(name, format string, args ...interface{}) {
+		problems[name] = append(problems[name], fmt.Sprintf(format, args...))
+	}
+
+	names := make([]string, 0, len(registered))
+	for name := range registered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gg.phases.mux.Lock()
+	phaseIndex := make(map[string]int, len(gg.phases.order))
+	for i, phase := range gg.phases.order {
+		phaseIndex[phase] = i
+	}
+	gg.phases.mux.Unlock()
+
+	ports := make(map[int][]string)
+	for _, name := range names {
+		settings := registered[name]
+		for _, p := range gg.settingsProblems(name, settings) {
+			add(name, "%s", p)
+		}
+		phase, inPhase := phaseIndex[settings.opts.Phase]
+		if settings.opts.Phase != "" && !inPhase {
+			add(name, "phase %s isn't one of the phases", settings.opts.Phase)
+		}
+		for _, dep := range settings.opts.DependsOn {
+			if registered[dep] == nil {
+				add(name, "depends on %s, which isn't registered", dep)
+				continue
+			}
+			if depPhase, ok := phaseIndex[registered[dep].opts.Phase]; ok && inPhase && depPhase > phase {
+				add(name, "depends on %s, which comes up in the later phase %s", dep, registered[dep].opts.Phase)
+			}
+		}
+		for _, port := range settings.opts.Ports {
+			ports[port] = append(ports[port], name)
+		}
+	}
+
+	for _, cycle := range dependencyCycles(names, func(name string) []string {
+		return registered[name].opts.DependsOn
+	}) {
+		add(cycle[0], "dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	for port, users := range ports {
+		if len(users) < 2 {
+			continue
+		}
+		for _, name := range users {
+			others := make([]string, 0, len(users)-1)
+			for _, other := range users {
+				if other != name {
+					others = append(others, other)
+				}
+			}
+			add(name, "port %d is also used by %s", port, strings.Join(others, ", "))
+		}
+	}
+	for _, p := range problems {
+		sort.Strings(p)
+	}
+	return problems
+}
+
+// dependencyCycles returns every cycle between the services, each one as the
+// services in it starting and ending with the same one. Dependencies that
+// aren't in names are left out.
+func dependencyCycles(names []string, dependsOn func(name string) []string) [][]string {
+	known := make(map[string]bool, len(names))
+	for _, name := range names {
+		known[name] = true
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int, len(names))
+	path := make([]string, 0)
+	cycles := make([][]string, 0)
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range dependsOn(name) {
+			if !known[dep] {
+				continue
+			}
+			switch state[dep] {
+			case unvisited:
+				visit(dep)
+			case visiting:
+				// Back to a service further up the path, from there to here is a cycle
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == dep {
+						cycle := append(append([]string{}, path[i:]...), dep)
+						cycles = append(cycles, cycle)
+						break
+					}
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = done
+	}
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+	return cycles
+}
@@ -0,0 +1,69 @@
+package guardian
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	// APIVersion is the current version of the guardian HTTP API
+	APIVersion = "v1"
+	// APIPrefix is the path prefix every versioned route is served under
+	APIPrefix = "/api/" + APIVersion
+
+	// legacyAPIVersion marks requests to the original unversioned paths
+	legacyAPIVersion = "legacy"
+)
+
+type contextKey int
+
+const (
+	apiVersionKey contextKey = iota
+	principalKey             // Who a verified token was issued to, see jwtAuth.require
+)
+
+func withAPIVersion(version string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey, version)))
+	}
+}
+
+// apiVersion returns the API version the request was made against
+func apiVersion(r *http.Request) string {
+	if v, ok := r.Context().Value(apiVersionKey).(string); ok {
+		return v
+	}
+	return legacyAPIVersion
+}
+
+// legacyServiceStatus is the service status shape the unversioned routes have
+// always returned, the gladius UI depends on it so it must not change
+type legacyServiceStatus struct {
+	Running  bool     `json:"running"`
+	PID      int      `json:"pid"`
+	Env      []string `json:"environment_vars"`
+	Location string   `json:"executable_location"`
+}
+
+// toLegacyStatuses converts service statuses to the legacy shape
+func toLegacyStatuses(statuses map[string]*serviceStatus) map[string]*legacyServiceStatus {
+	legacy := make(map[string]*legacyServiceStatus)
+	for name, s := range statuses {
+		legacy[name] = &legacyServiceStatus{
+			Running:  s.Running,
+			PID:      s.PID,
+			Env:      s.Env,
+			Location: s.Location,
+		}
+	}
+	return legacy
+}
+
+// statusResponse returns the statuses in the shape expected by the version of
+// the API the request was made against
+func statusResponse(r *http.Request, statuses map[string]*serviceStatus) interface{} {
+	if apiVersion(r) == legacyAPIVersion {
+		return toLegacyStatuses(statuses)
+	}
+	return statuses
+}
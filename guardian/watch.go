@@ -0,0 +1,230 @@
+package guardian
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// fileWatcher calls back when watched files are written or replaced, once
+// they've been left alone for the debounce so a file copied in over several
+// writes only triggers once
+type fileWatcher struct {
+	watcher  *fsnotify.Watcher
+	debounce time.Duration
+
+	mux    sync.Mutex
+	files  map[string][]func()
+	dirs   map[string]bool
+	timers map[string]*time.Timer
+}
+
+func newFileWatcher(debounce time.Duration) (*fileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	fw := &fileWatcher{
+		watcher:  w,
+		debounce: debounce,
+		files:    make(map[string][]func()),
+		dirs:     make(map[string]bool),
+		timers:   make(map[string]*time.Timer),
+	}
+	go fw.run()
+	return fw, nil
+}
+
+// watch calls fn when the file at path changes. The directory is watched
+// rather than the file, so replacing the file by renaming over it is noticed.
+func (fw *fileWatcher) watch(path string, fn func()) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	dir := filepath.Dir(path)
+	if !fw.dirs[dir] {
+		if err := fw.watcher.Add(dir); err != nil {
+			return err
+		}
+		fw.dirs[dir] = true
+	}
+	fw.files[path] = append(fw.files[path], fn)
+	return nil
+}
+
+func (fw *fileWatcher) run() {
+	for {
+		select {
+		case ev, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				fw.changed(filepath.Clean(ev.Name))
+			}
+		case err, ok := <-fw.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Error watching files")
+		}
+	}
+}
+
+func (fw *fileWatcher) changed(path string) {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	fns, ok := fw.files[path]
+	if !ok {
+		return
+	}
+	if t, ok := fw.timers[path]; ok {
+		t.Reset(fw.debounce)
+		return
+	}
+	fw.timers[path] = time.AfterFunc(fw.debounce, func() {
+		fw.mux.Lock()
+		delete(fw.timers, path)
+		fw.mux.Unlock()
+		for _, fn := range fns {
+			fn()
+		}
+	})
+}
+
+// WatchServiceFiles watches the executables of services with RestartOnChange
+// set and the ConfigFiles of every service. Running services are restarted or
+// reloaded debounce after the last change to one of their files.
+func (gg *GladiusGuardian) WatchServiceFiles(debounce time.Duration) error {
+	type watchedFile struct {
+		service, path string
+		executable    bool
+	}
+
+	gg.mux.Lock()
+	files := make([]watchedFile, 0)
+	for name, settings := range gg.registeredServices {
+		for _, path := range settings.opts.ConfigFiles {
+			files = append(files, watchedFile{service: name, path: path})
+		}
+		if !settings.opts.RestartOnChange || backendName(settings.opts) != BackendExec {
+			continue
+		}
+		path, err := exec.LookPath(settings.execName)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"err":          err,
+			}).Warn("Can't watch executable of service")
+			continue
+		}
+		files = append(files, watchedFile{service: name, path: path, executable: true})
+	}
+	gg.mux.Unlock()
+	if len(files) == 0 {
+		return nil
+	}
+
+	fw, err := newFileWatcher(debounce)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		f := f
+		err := fw.watch(f.path, func() {
+			if f.executable {
+				gg.restartChanged(f.service, "executable")
+			} else {
+				gg.reloadChanged(f.service, f.path)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("can't watch %s for %s: %s", f.path, f.service, err)
+		}
+	}
+	return nil
+}
+
+// reloadChanged applies a change to one of a service's config files the way
+// its ReloadStrategy says to
+func (gg *GladiusGuardian) reloadChanged(name, path string) {
+	gg.mux.Lock()
+	inst := gg.services[name]
+	strategy := gg.registeredServices[name].opts.ReloadStrategy
+	gg.mux.Unlock()
+	if inst == nil {
+		return
+	}
+
+	if strategy != ReloadSignal {
+		gg.restartChanged(name, path)
+		return
+	}
+	if gg.InMaintenance(name) {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"changed":      path,
+		}).Info("Not reloading service in maintenance mode after a change")
+		return
+	}
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"changed":      path,
+	}).Info("Reloading service after a change")
+	if err := gg.ReloadService(name); err != nil {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"err":          err,
+		}).Warn("Couldn't reload service")
+	}
+}
+
+// restartChanged restarts a service after a file it uses changed, if it's
+// running
+func (gg *GladiusGuardian) restartChanged(name, what string) {
+	gg.mux.Lock()
+	running := gg.services[name] != nil
+	gg.mux.Unlock()
+	if !running {
+		return
+	}
+	if gg.InMaintenance(name) {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"changed":      what,
+		}).Info("Not restarting service in maintenance mode after a change")
+		return
+	}
+	if err := gg.allowed(PluginRequest{Hook: HookShouldRestart, Service: name, Reason: what + " changed"}); err != nil {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"changed":      what,
+			"err":          err,
+		}).Info("Not restarting service after a change")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"service_name": name,
+		"changed":      what,
+	}).Info("Restarting service after a change")
+	result := gg.applyAction(context.Background(), ActionRestart, name, nil, false)
+	if !result.Success {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"err":          result.Error,
+		}).Warn("Couldn't restart service")
+	}
+}
@@ -2,9 +2,17 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	gconfig "github.com/gladiusio/gladius-utils/config"
@@ -14,78 +22,747 @@ import (
 	"github.com/gladiusio/gladius-guardian/config"
 	"github.com/gladiusio/gladius-guardian/guardian"
 	"github.com/gladiusio/gladius-guardian/service"
-	"github.com/gorilla/mux"
+	"github.com/gladiusio/gladius-guardian/tracing"
 	"github.com/spf13/viper"
 )
 
+// Port the API is served on
+const apiPort = 7791
+
 func main() {
+	// Subcommands that don't run the guardian
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		case "export-systemd":
+			os.Exit(runExportSystemd(os.Args[2:]))
+		case "check-config", "--check-config":
+			os.Exit(runCheckConfig(os.Args[2:]))
+		case guardian.SandboxCommand:
+			// Run by the guardian itself to start a sandboxed service
+			os.Exit(guardian.RunSandbox(os.Args[2:]))
+		}
+	}
+
 	service.SetupService(run)
 }
 
-func run() {
-	base, err := gconfig.GetGladiusBase()
+// runImport prints the services of a docker-compose file or Procfile as config
+// file tables, so they can be appended to the guardian's config
+func runImport(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: gladius-guardian import <docker-compose.yml|Procfile>")
+		return 2
+	}
+
+	defs, err := guardian.ImportFile(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't import %s: %s\n", args[0], err)
+		return 1
+	}
+	if err := guardian.WriteServicesTOML(os.Stdout, defs); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't write services: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runExportSystemd writes a systemd unit for each configured service
+func runExportSystemd(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintln(os.Stderr, "usage: gladius-guardian export-systemd <directory> [gladius base]")
+		return 2
+	}
+
+	// The Gladius base is read from the first argument
+	os.Args = append(os.Args[:1], args[1:]...)
+	loadConfig()
+	gg := guardian.New()
+	gg.SetEventLogSize(viper.GetInt("EventLogSize"))
+	registerServices(gg, false)
+
+	written, err := gg.ExportSystemdUnits(args[0])
+	for _, path := range written {
+		fmt.Println(path)
+	}
 	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't export units: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runCheckConfig reads the config and checks every service in it without
+// starting anything, printing each problem found
+func runCheckConfig(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "usage: gladius-guardian check-config [gladius base]")
+		return 2
+	}
+
+	os.Args = append(os.Args[:1], args...)
+	loadConfig()
+
+	// Services that couldn't be parsed or registered are logged as warnings
+	warnings := &warningCounter{}
+	log.AddHook(warnings)
+	gg := guardian.New()
+	registerServices(gg, false)
+
+	failed := warnings.count > 0
+	if err := config.ReadError(); err != nil {
+		fmt.Printf("config: %s\n", err)
+		failed = true
+	}
+	problems := gg.ValidateConfig()
+	names := make([]string, 0, len(problems))
+	for name := range problems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, problem := range problems[name] {
+			fmt.Printf("%s: %s\n", name, problem)
+		}
+		failed = true
+	}
+
+	if failed {
+		return 1
+	}
+	fmt.Println("Config is valid")
+	return 0
+}
+
+// warningCounter counts the warnings and errors logged
+type warningCounter struct {
+	count int
+}
+
+func (wc *warningCounter) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel}
+}
+
+func (wc *warningCounter) Fire(*log.Entry) error {
+	wc.count++
+	return nil
+}
+
+// run runs the guardian until it's interrupted or stop is closed, like when the
+// service manager stops it, then stops the services
+func run(stop <-chan struct{}) {
+	loadConfig()
+	build := guardian.BuildInfo()
+	log.WithFields(log.Fields{
+		"version":    build.Version,
+		"git_commit": build.GitCommit,
+		"build_date": build.BuildDate,
+		"go_version": build.GoVersion,
+		"platform":   build.Platform,
+	}).Info("Starting gladius-guardian")
+	tracing.Setup(viper.GetString("TracingEndpoint"), viper.GetString("TracingServiceName"))
+
+	gg := guardian.New()
+	setupEventPublisher(gg) // Before anything happens that would emit events
+	setupDiscovery(gg)
+	registerServices(gg, false)
+
+	// Services changed in the remote config are registered again, running
+	// ones pick up the changes when they're restarted
+	reloaded := func() {
+		gg.ConfigReloaded("remote config changed")
+		registerServices(gg, true)
+	}
+	if err := config.WatchRemoteConfig(context.Background(), reloaded); err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
-		}).Fatal("Couldn't get Gladius base")
+		}).Warn("Couldn't watch remote config")
 	}
-	config.SetupConfig(base)
 
-	r := mux.NewRouter()
-	gg := guardian.New()
+	setupLeaderElection(gg)
 
-	// Register our two daemons
-	gg.RegisterService(
-		"networkd",
-		viper.GetString("NetworkdExecutable"),
-		viper.GetStringSlice("DefaultEnvironment"),
-	)
-	gg.RegisterService(
-		"controld",
-		viper.GetString("ControldExecutable"),
-		viper.GetStringSlice("DefaultEnvironment"),
-	)
+	if viper.GetBool("Subreaper") {
+		if err := gg.EnableSubreaper(); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't become a subreaper, daemonizing services won't be followed")
+		}
+	}
 
-	// Handle the index
-	r.HandleFunc("/", guardian.IndexHandler)
+	// Take over the services of the guardian we were exec'd from, if any
+	if adopted, err := gg.AdoptServices(); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't take over all services")
+	} else if adopted > 0 {
+		log.WithFields(log.Fields{
+			"services": adopted,
+		}).Info("Took over running services")
+	}
 
-	// Guardian related endpoints
-	r.HandleFunc("/service/stats/{service_name}", guardian.GetServicesHandler(gg)).Methods("GET")
-	r.HandleFunc("/service/set_state/{service_name}", guardian.ServiceStateHandler(gg)).Methods("PUT")
-	r.HandleFunc("/service/set_timeout", guardian.SetStartTimeoutHandler(gg)).Methods("POST")
-	r.HandleFunc("/service/logs", guardian.GetOldLogsHandler(gg)).Methods("GET")
-	r.HandleFunc("/service/ws/logs/{service_name}", guardian.GetNewLogsWebSocketHandler(gg))
+	if base, err := gconfig.GetGladiusBase(); err == nil {
+		gg.SetupDiagnostics(base, uint64(viper.GetInt("DiagnosticsMinFreeMB"))<<20)
+	}
+
+	backupDir := viper.GetString("BackupDir")
+	if base, err := gconfig.GetGladiusBase(); err == nil && backupDir == "" {
+		backupDir = filepath.Join(base, "backups")
+	}
+	gg.SetupBackups(backupDir, viper.GetInt("BackupKeep"))
+
+	if viper.GetBool("Maintenance") {
+		gg.SetMaintenance("all", true)
+	}
+
+	removePIDFiles := func() {}
+	if dir := viper.GetString("PIDFileDir"); dir != "" {
+		remove, err := gg.SetupPIDFiles(dir)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't write PID files")
+		} else {
+			removePIDFiles = remove
+		}
+	}
+
+	if err := gg.WatchServiceFiles(viper.GetDuration("FileChangeDebounce")); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't watch service files")
+	}
+
+	if addr := viper.GetString("StatsDAddress"); addr != "" {
+		err := gg.StartStatsD(addr, viper.GetString("StatsDPrefix"), viper.GetDuration("StatsDInterval"), viper.GetBool("StatsDLabelTags"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't start StatsD metrics")
+		}
+	}
+
+	if addr := viper.GetString("GELFAddress"); addr != "" {
+		err := gg.StartGELF(viper.GetString("GELFProtocol"), addr, viper.GetStringMapString("GELFFields"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't start shipping logs to Graylog")
+		}
+	}
+
+	if peers := viper.GetStringMapString("FleetPeers"); len(peers) > 0 {
+		name := viper.GetString("FleetNodeName")
+		if name == "" {
+			name, _ = os.Hostname()
+		}
+		if err := gg.SetFleetPeers(name, peers, viper.GetString("FleetToken"), viper.GetDuration("FleetTimeout")); err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't set up fleet peers")
+		}
+	}
+
+	if interval := viper.GetDuration("StrayScanInterval"); interval > 0 {
+		err := gg.StartStrayScan(interval, guardian.StrayOptions{
+			ReapZombies: viper.GetBool("ReapZombies"),
+			KillOrphans: viper.GetBool("KillOrphans"),
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't start scanning for stray processes")
+		}
+	}
+
+	if interval := viper.GetDuration("DiskUsageInterval"); interval > 0 {
+		gg.StartDiskUsageScan(interval)
+	}
+	if interval := viper.GetDuration("LogHeartbeatInterval"); interval > 0 {
+		gg.StartLogHeartbeats(interval)
+	}
+
+	setupAlerts(gg)
+	setupHousekeeping(gg)
+	setupPlugins(gg)
+	setupAutomation(gg)
+
+	gg.AddReadinessCheck("config", func() error {
+		if !config.Loaded() {
+			return errors.New("config not loaded")
+		}
+		return nil
+	})
+
+	// Every endpoint is described in the guardian route table, see
+	// guardian/routes.go
+	r := guardian.NewRouter(gg)
+	handler := guardian.CORSHandler(
+		r,
+		viper.GetStringSlice("CORSAllowedOrigins"),
+		viper.GetStringSlice("CORSAllowedMethods"),
+		viper.GetStringSlice("CORSAllowedHeaders"),
+	)
 
 	// Setup a custom server so we can gracefully stop later
 	srv := &http.Server{
-		Addr:         "0.0.0.0:7791",
+		Addr:         fmt.Sprintf("0.0.0.0:%d", apiPort),
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
-		Handler:      r,
+		Handler:      handler,
+	}
+
+	useTLS, err := setupTLS(srv)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Couldn't setup TLS")
+	}
+
+	// The listener is kept open across restarts, see Reexec
+	l, err := gg.Listen("api", srv.Addr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Couldn't listen for API requests")
 	}
+	gg.BeforeReexec(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		gg.CloseLogClients()
+		srv.Shutdown(ctx)
+	})
 
 	// Run our server in a goroutine so that it doesn't block.
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		var err error
+		if useTLS {
+			// The certificate is already loaded in the TLS config
+			err = srv.ServeTLS(l, "", "")
+		} else {
+			err = srv.Serve(l)
+		}
+		if err != nil {
 			log.Println(err)
 		}
 	}()
 
+	// Bring up the services flagged to start with the guardian once the API is
+	// there to follow them
+	go func() {
+		for _, result := range gg.Autostart(context.Background()) {
+			if !result.Success {
+				log.WithFields(log.Fields{
+					"service_name": result.Service,
+					"err":          result.Error,
+				}).Warn("Couldn't autostart service")
+			}
+		}
+	}()
+
+	var mdns *guardian.MDNSResponder
+	if viper.GetBool("MDNSEnabled") {
+		mdns, err = gg.StartMDNS(apiPort, viper.GetString("MDNSInstanceName"), viper.GetBool("MDNSAnnounceServices"))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("Couldn't start mDNS announcements")
+		}
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 
-	<-c // Block until we receive our signal.
+	// Block until we receive our signal, or the service manager stops us
+	select {
+	case <-c:
+	case <-stop:
+	}
 
-	gg.StopService("all")
+	if mdns != nil {
+		mdns.Shutdown()
+	}
+	gg.StopAllServices()
+	gg.CloseLogClients() // After services logged their last lines
+	removePIDFiles()
+	tracing.Shutdown()
 	stopHTTPServer(srv)
 }
 
+// serviceOptions reads the options for a service from its [Services.<name>]
+// table in the config
+func serviceOptions(name string) guardian.ServiceOptions {
+	opts := guardian.ServiceOptions{}
+	if err := viper.UnmarshalKey("Services."+name, &opts); err != nil {
+		log.WithFields(log.Fields{
+			"service_name": name,
+			"err":          err,
+		}).Warn("Couldn't parse service options, using defaults")
+	}
+	return opts
+}
+
+// loadConfig finds the Gladius base and loads the config file in it
+func loadConfig() {
+	base, err := gconfig.GetGladiusBase()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Fatal("Couldn't get Gladius base")
+	}
+	config.SetupConfig(base)
+}
+
+// registerServices registers networkd, controld and the services defined in
+// the config, replacing their registrations when the config is reloaded
+func registerServices(gg *guardian.GladiusGuardian, replace bool) {
+	gg.SetPortRange(viper.GetInt("PortRangeStart"), viper.GetInt("PortRangeEnd"))
+	gg.SetLogBudget(viper.GetInt("LogBufferBytes"), viper.GetInt("MaxServiceLogBytes"))
+	if viper.IsSet("MaxLogLines") {
+		log.WithFields(log.Fields{
+			"max_log_lines": viper.GetInt("MaxLogLines"),
+		}).Warn("MaxLogLines is deprecated, use LogBufferBytes and MaxServiceLogBytes instead")
+	}
+	gg.SetMaxLogLines(viper.GetInt("MaxLogLines"))
+	gg.SetDefaultTimeout(viper.GetDuration("DefaultSpawnTimeout"))
+	gg.SetDefaultEnvironment(viper.GetStringSlice("DefaultEnvironment"))
+	if err := gg.SetPhases(viper.GetStringSlice("Phases")); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't set up phases")
+	}
+	gg.SetSpawnLimits(viper.GetInt("MaxConcurrentStarts"), viper.GetInt("SpawnRateLimit"), viper.GetInt("SpawnRateBurst"))
+	if err := gg.SetEnvSets(viper.GetStringMapStringSlice("EnvSets"), viper.GetString("ActiveEnvSet")); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't set up environment sets")
+	}
+
+	// Register our two daemons
+	daemons := []struct{ name, executableKey string }{
+		{"networkd", "NetworkdExecutable"},
+		{"controld", "ControldExecutable"},
+	}
+	register := gg.RegisterServiceWithOptions
+	if replace {
+		register = gg.ReplaceService
+	}
+	for _, d := range daemons {
+		err := register(
+			d.name,
+			viper.GetString(d.executableKey),
+			nil,
+			serviceOptions(d.name),
+		)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"service_name": d.name,
+				"err":          err,
+			}).Warn("Couldn't register service")
+		}
+	}
+	registerConfiguredServices(gg, replace)
+	registerTemplates(gg)
+}
+
+// registerTemplates registers the service templates defined in the config,
+// services are instantiated from them through the API
+func registerTemplates(gg *guardian.GladiusGuardian) {
+	for name := range viper.GetStringMap("Templates") {
+		t := guardian.ServiceTemplate{}
+		if err := viper.UnmarshalKey("Templates."+name, &t); err != nil {
+			log.WithFields(log.Fields{
+				"template": name,
+				"err":      err,
+			}).Warn("Couldn't parse service template")
+			continue
+		}
+		if t.Executable == "" && t.Image == "" {
+			log.WithFields(log.Fields{
+				"template": name,
+			}).Warn("Template has neither an Executable nor an Image, not registering it")
+			continue
+		}
+		t.Name = name
+		gg.RegisterTemplate(t)
+	}
+}
+
+// registerConfiguredServices registers every other service with a table in
+// the config, like the ones written by "gladius-guardian import"
+func registerConfiguredServices(gg *guardian.GladiusGuardian, replace bool) {
+	register := gg.RegisterDefinition
+	if replace {
+		register = gg.ReplaceDefinition
+	}
+
+	names := make([]string, 0)
+	for name := range viper.GetStringMap("Services") {
+		if name != "networkd" && name != "controld" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		def := guardian.ServiceDefinition{}
+		if err := viper.UnmarshalKey("Services."+name, &def); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"err":          err,
+			}).Warn("Couldn't parse service definition")
+			continue
+		}
+		if def.Executable == "" && def.Image == "" {
+			log.WithFields(log.Fields{
+				"service_name": name,
+			}).Warn("Service has neither an Executable nor an Image, not registering it")
+			continue
+		}
+		def.Name = name
+		if err := register(def, nil); err != nil {
+			log.WithFields(log.Fields{
+				"service_name": name,
+				"err":          err,
+			}).Warn("Couldn't register service")
+		}
+	}
+}
+
+// setupEventPublisher adds the configured event publisher to the guardian
+func setupEventPublisher(gg *guardian.GladiusGuardian) {
+	switch publisher := viper.GetString("EventPublisher"); publisher {
+	case "":
+	case "nats":
+		gg.AddEventPublisher(guardian.NewNATSPublisher(
+			viper.GetString("EventPublisherAddress"),
+			viper.GetString("EventPublisherPrefix"),
+		))
+	case "mqtt":
+		// MQTT topics are separated by slashes rather than dots
+		gg.AddEventPublisher(guardian.NewMQTTPublisher(
+			viper.GetString("EventPublisherAddress"),
+			strings.Replace(viper.GetString("EventPublisherPrefix"), ".", "/", -1),
+			viper.GetString("EventPublisherClientID"),
+			viper.GetString("EventPublisherUsername"),
+			viper.GetString("EventPublisherPassword"),
+		))
+	default:
+		log.WithFields(log.Fields{
+			"publisher": publisher,
+		}).Warn("Unknown event publisher, must be nats or mqtt")
+	}
+}
+
+// setupDiscovery registers running services with the configured service
+// discovery backend
+func setupDiscovery(gg *guardian.GladiusGuardian) {
+	var registry guardian.ServiceRegistry
+	switch backend := viper.GetString("Discovery"); backend {
+	case "":
+		return
+	case "consul":
+		registry = guardian.NewConsulRegistry(viper.GetString("DiscoveryAddress"), viper.GetString("DiscoveryToken"))
+	case "etcd":
+		registry = guardian.NewEtcdRegistry(viper.GetString("DiscoveryAddress"), viper.GetString("DiscoveryPrefix"))
+	default:
+		log.WithFields(log.Fields{
+			"backend": backend,
+		}).Warn("Unknown service discovery backend, must be consul or etcd")
+		return
+	}
+
+	gg.SetupDiscovery(
+		registry,
+		viper.GetString("DiscoveryAdvertiseAddress"),
+		viper.GetStringSlice("DiscoveryTags"),
+		viper.GetDuration("DiscoveryTTL"),
+	)
+}
+
+// setupLeaderElection makes the guardian stand by for the leader lock, if
+// there's one configured
+func setupLeaderElection(gg *guardian.GladiusGuardian) {
+	var lock guardian.LeaderLock
+	switch kind := viper.GetString("LeaderLock"); kind {
+	case "":
+		return
+	case "file":
+		path := viper.GetString("LeaderLockPath")
+		if path == "" {
+			base, err := gconfig.GetGladiusBase()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err": err,
+				}).Warn("Couldn't get Gladius base for the leader lock")
+				return
+			}
+			path = filepath.Join(base, "guardian.lock")
+		}
+		lock = guardian.NewFileLock(path)
+	case "consul":
+		lock = guardian.NewConsulLock(
+			viper.GetString("LeaderLockAddress"),
+			viper.GetString("LeaderLockToken"),
+			viper.GetString("LeaderLockKey"),
+			viper.GetDuration("LeaderLockTTL"),
+		)
+	default:
+		log.WithFields(log.Fields{
+			"lock": kind,
+		}).Warn("Unknown leader lock, must be file or consul")
+		return
+	}
+	gg.RunLeaderElection(context.Background(), lock)
+}
+
+// setupAlerts starts evaluating the configured alert rules
+func setupAlerts(gg *guardian.GladiusGuardian) {
+	var rules []*guardian.AlertRule
+	if err := viper.UnmarshalKey("AlertRules", &rules); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't parse alert rules")
+		return
+	}
+	if len(rules) == 0 {
+		return
+	}
+
+	notifiers := make([]guardian.AlertNotifier, 0)
+	for _, url := range viper.GetStringSlice("AlertWebhooks") {
+		notifiers = append(notifiers, guardian.NewWebhookNotifier(url))
+	}
+	if server := viper.GetString("AlertSMTPServer"); server != "" {
+		notifiers = append(notifiers, &guardian.EmailNotifier{
+			Server:   server,
+			From:     viper.GetString("AlertEmailFrom"),
+			To:       viper.GetStringSlice("AlertEmailTo"),
+			Username: viper.GetString("AlertSMTPUsername"),
+			Password: viper.GetString("AlertSMTPPassword"),
+		})
+	}
+
+	if err := gg.SetupAlerts(rules, notifiers); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't setup alerts")
+	}
+}
+
+// setupHousekeeping starts pruning with the configured rules
+func setupHousekeeping(gg *guardian.GladiusGuardian) {
+	interval := viper.GetDuration("HousekeepingInterval")
+	if interval <= 0 {
+		return
+	}
+	var rules []guardian.PruneRule
+	if err := viper.UnmarshalKey("PruneRules", &rules); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't parse prune rules")
+		return
+	}
+	historyAge := viper.GetDuration("PruneRunHistoryAge")
+	if len(rules) == 0 && historyAge <= 0 {
+		return
+	}
+
+	if err := gg.StartHousekeeping(interval, rules, historyAge); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't start housekeeping")
+	}
+}
+
+// setupPlugins loads the configured plugins
+func setupPlugins(gg *guardian.GladiusGuardian) {
+	var plugins []guardian.Plugin
+	if err := viper.UnmarshalKey("Plugins", &plugins); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't parse plugins")
+		return
+	}
+	if len(plugins) == 0 {
+		return
+	}
+	if err := gg.SetPlugins(plugins); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't setup plugins")
+	}
+}
+
+// setupAutomation loads the configured automation rules
+func setupAutomation(gg *guardian.GladiusGuardian) {
+	var rules []guardian.AutomationRule
+	if err := viper.UnmarshalKey("AutomationRules", &rules); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Couldn't parse automation rules")
+		return
+	}
+	for _, rule := range rules {
+		if err := gg.SetAutomationRule(rule); err != nil {
+			log.WithFields(log.Fields{
+				"rule": rule.Name,
+				"err":  err,
+			}).Warn("Couldn't setup automation rule")
+		}
+	}
+}
+
+// setupTLS configures the server to use TLS if a certificate is configured, and
+// to require client certificates signed by the configured CA if there is one.
+// It returns whether the server should be started with TLS.
+func setupTLS(srv *http.Server) (bool, error) {
+	certFile := viper.GetString("TLSCertFile")
+	keyFile := viper.GetString("TLSKeyFile")
+	caFile := viper.GetString("TLSClientCAFile")
+
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return false, errors.New("TLSClientCAFile requires TLSCertFile and TLSKeyFile to be set")
+		}
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return false, fmt.Errorf("error loading certificate: %s", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return false, fmt.Errorf("error reading client CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return false, errors.New("no certificates found in client CA file")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	srv.TLSConfig = tlsConfig
+	log.WithFields(log.Fields{
+		"cert_file":      certFile,
+		"client_ca_file": caFile,
+	}).Info("Serving API over TLS")
+	return true, nil
+}
+
 func stopHTTPServer(srv *http.Server) {
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
 	srv.Shutdown(ctx)
-	os.Exit(0)
 }
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package service
+
+import "github.com/kardianos/service"
+
+// logToSystem does nothing, other service managers capture the guardian's
+// output themselves
+func logToSystem(s service.Service) error {
+	return nil
+}
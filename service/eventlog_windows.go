@@ -0,0 +1,47 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/kardianos/service"
+	"github.com/sirupsen/logrus"
+)
+
+// eventLogHook copies the guardian's log to the Windows event log, the only
+// place it can be read when running as a service
+type eventLogHook struct {
+	logger service.Logger
+}
+
+func (h eventLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+func (h eventLogHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case logrus.InfoLevel:
+		return h.logger.Info(line)
+	case logrus.WarnLevel:
+		return h.logger.Warning(line)
+	default:
+		return h.logger.Error(line)
+	}
+}
+
+// logToSystem sends the guardian's log to the event log when it runs as a
+// service, the source is registered when it's installed
+func logToSystem(s service.Service) error {
+	if service.Interactive() {
+		return nil
+	}
+	logger, err := s.SystemLogger(nil)
+	if err != nil {
+		return fmt.Errorf("can't open the event log: %s", err)
+	}
+	logrus.AddHook(eventLogHook{logger: logger})
+	return nil
+}
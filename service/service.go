@@ -1,14 +1,88 @@
 package service
 
-import "github.com/gladiusio/gladius-utils/init/manager"
+import (
+	"log"
+	"os"
+	"time"
 
-func SetupService(run func()) {
-	// Define some variables
-	name, displayName, description :=
-		"GladiusGuardian",
-		"Gladius Guardian",
-		"Gladius Guardian"
+	"github.com/gladiusio/gladius-utils/config"
+	"github.com/kardianos/service"
+)
 
-	// Run the function "run" in guardian as a service
-	manager.RunService(name, displayName, description, run)
+// How long the service manager waits for run to stop the services and return
+// once it's told to stop
+const stopTimeout = 30 * time.Second
+
+// program runs the guardian under the service manager: systemd, launchd or
+// the Windows service control manager
+type program struct {
+	run  func(stop <-chan struct{})
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (p *program) Start(s service.Service) error {
+	// Start should not block. Do the actual work async.
+	go func() {
+		defer close(p.done)
+		p.run(p.stop)
+	}()
+	return nil
+}
+
+// Stop has run shut down and waits for it, so the services are stopped before
+// the service manager considers the guardian stopped
+func (p *program) Stop(s service.Service) error {
+	close(p.stop)
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+	}
+	return nil
+}
+
+// SetupService runs run as a service, or with "install", "uninstall",
+// "start", "stop" or "restart" controls the installed one. run is given a
+// channel that's closed when the service manager stops the guardian, like on
+// shutdown, and has to return once it stopped everything. On Windows the
+// guardian's log goes to the event log when it runs as a service.
+func SetupService(run func(stop <-chan struct{})) {
+	base, err := config.GetGladiusBase()
+	if err != nil {
+		log.Fatal(err)
+	}
+	svcConfig := &service.Config{
+		Name:        "GladiusGuardian",
+		DisplayName: "Gladius Guardian",
+		Description: "Gladius Guardian",
+		Arguments:   []string{base},
+	}
+
+	p := &program{run: run, stop: make(chan struct{}), done: make(chan struct{})}
+	s, err := service.New(p, svcConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		for _, action := range service.ControlAction {
+			if os.Args[1] == action {
+				if err := service.Control(s, action); err != nil {
+					log.Fatal(err)
+				}
+				return // Don't execute the rest of the code
+			}
+		}
+	}
+
+	if err := logToSystem(s); err != nil {
+		log.Println(err)
+	}
+	logger, err := s.Logger(nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := s.Run(); err != nil {
+		logger.Error(err)
+	}
 }
@@ -0,0 +1,151 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxBatchSize  = 512
+	flushInterval = 5 * time.Second
+)
+
+// otlpExporter batches finished spans and posts them as OTLP/HTTP JSON
+type otlpExporter struct {
+	mux         sync.Mutex
+	url         string
+	serviceName string
+	spans       []*Span
+	client      *http.Client
+}
+
+func newOTLPExporter(url, serviceName string) *otlpExporter {
+	e := &otlpExporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+	go func() {
+		for range time.Tick(flushInterval) {
+			e.flush()
+		}
+	}()
+	return e
+}
+
+func (e *otlpExporter) add(s *Span) {
+	e.mux.Lock()
+	e.spans = append(e.spans, s)
+	full := len(e.spans) >= maxBatchSize
+	e.mux.Unlock()
+
+	if full {
+		go e.flush()
+	}
+}
+
+func (e *otlpExporter) flush() {
+	e.mux.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mux.Unlock()
+
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.payload(spans))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("Couldn't encode trace spans")
+		return
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "url": e.url}).Warn("Couldn't export trace spans")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.WithFields(log.Fields{"status": resp.Status, "url": e.url}).Warn("Trace collector rejected spans")
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 1 is OK, 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       otlpStatus      `json:"status"`
+}
+
+func (e *otlpExporter) payload(spans []*Span) map[string]interface{} {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mux.Lock()
+		span := otlpSpan{
+			TraceID:    hex.EncodeToString(s.traceID[:]),
+			SpanID:     hex.EncodeToString(s.spanID[:]),
+			Name:       s.name,
+			Kind:       s.kind,
+			Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+			End:        strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes: make([]otlpAttribute, 0, len(s.attrs)),
+			Status:     otlpStatus{Code: 1},
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attrs {
+			span.Attributes = append(span.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: v}})
+		}
+		if s.err != nil {
+			span.Status = otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		s.mux.Unlock()
+		encoded = append(encoded, span)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{
+						{Key: "service.name", Value: otlpValue{StringValue: e.serviceName}},
+					},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/gladiusio/gladius-guardian/tracing"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
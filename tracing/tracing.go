@@ -0,0 +1,249 @@
+/*
+Package tracing - Minimal OpenTelemetry compatible tracing, spans are exported
+to an OTLP/HTTP collector and context is propagated with W3C traceparent
+headers
+*/
+package tracing
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type spanKey struct{}
+
+// Span is a single timed operation within a trace, a nil Span is valid and
+// does nothing so callers don't have to check whether tracing is enabled
+type Span struct {
+	mux      sync.Mutex
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]string
+	err      error
+	ended    bool
+}
+
+// Span kinds, matching the OTLP enum
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+var (
+	exporterMux sync.RWMutex
+	exporter    *otlpExporter
+)
+
+// Setup enables tracing, exporting spans to the OTLP/HTTP collector at
+// endpoint (like http://localhost:4318). An empty endpoint leaves tracing off.
+func Setup(endpoint, serviceName string) {
+	if endpoint == "" {
+		return
+	}
+
+	exporterMux.Lock()
+	defer exporterMux.Unlock()
+	exporter = newOTLPExporter(strings.TrimSuffix(endpoint, "/")+"/v1/traces", serviceName)
+}
+
+// Shutdown flushes any spans that haven't been exported yet
+func Shutdown() {
+	exporterMux.RLock()
+	defer exporterMux.RUnlock()
+	if exporter != nil {
+		exporter.flush()
+	}
+}
+
+func enabled() bool {
+	exporterMux.RLock()
+	defer exporterMux.RUnlock()
+	return exporter != nil
+}
+
+// Start starts a span as a child of the span in ctx, if there is one
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, KindInternal)
+}
+
+func start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if !enabled() {
+		return ctx, nil
+	}
+
+	s := &Span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]string)}
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(remoteParent); ok {
+		s.traceID = remote.traceID
+		s.parentID = remote.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Detach returns a background context carrying the span in ctx, for work that
+// continues after the request that started it is done
+func Detach(ctx context.Context) context.Context {
+	if s := FromContext(ctx); s != nil {
+		return context.WithValue(context.Background(), spanKey{}, s)
+	}
+	return context.Background()
+}
+
+// FromContext returns the span in the context, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// SetAttribute records a key/value pair on the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed, a nil error is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.err = err
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	if s.ended {
+		s.mux.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mux.Unlock()
+
+	exporterMux.RLock()
+	defer exporterMux.RUnlock()
+	if exporter != nil {
+		exporter.add(s)
+	}
+}
+
+// TraceParent returns the W3C traceparent value for the span in ctx, or an
+// empty string if there isn't one
+func TraceParent(ctx context.Context) string {
+	s := FromContext(ctx)
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+type remoteKey struct{}
+
+type remoteParent struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+// withRemoteParent returns a context carrying the parent described by a W3C
+// traceparent value, invalid values are ignored
+func withRemoteParent(ctx context.Context, traceParent string) context.Context {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return ctx
+	}
+
+	var p remoteParent
+	if _, err := hex.Decode(p.traceID[:], []byte(parts[1])); err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(p.spanID[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, p)
+}
+
+// Handler wraps h in a server span named name, continuing the trace from the
+// request's traceparent header if it has one
+func Handler(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !enabled() {
+			h(w, r)
+			return
+		}
+
+		ctx := withRemoteParent(r.Context(), r.Header.Get("traceparent"))
+		ctx, span := start(ctx, name, KindServer)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", fmt.Sprint(sw.status))
+		if sw.status >= 500 {
+			span.SetError(fmt.Errorf("HTTP %d", sw.status))
+		}
+		span.End()
+	}
+}
+
+// statusWriter records the status code written by a handler
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Hijack lets websocket upgrades through
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	return hj.Hijack()
+}
+
+// Flush lets streaming responses through
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}